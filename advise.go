@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"github.com/dcepelik/snap/humanize"
+)
+
+// adviceIntervals are intervals of buckets --advise proposes above the RPO.
+var adviceIntervals = []time.Duration{time.Hour, day, week, month, year}
+
+// maxAdvisedYears limits the size of the yearly bucket, which would
+// otherwise grow without bounds with a generous budget.
+const maxAdvisedYears = 10
+
+// formatInterval formats d in the largest unit accepted in the configuration
+// which divides it.
+func formatInterval(d time.Duration) string {
+	units := []struct {
+		d    time.Duration
+		unit string
+	}{
+		{year, "y"}, {month, "M"}, {week, "w"}, {day, "d"},
+		{time.Hour, "h"}, {time.Minute, "m"}, {time.Second, "s"},
+	}
+	for _, u := range units {
+		if d >= u.d && d%u.d == 0 {
+			return fmt.Sprintf("%d%s", d/u.d, u.unit)
+		}
+	}
+	return fmt.Sprintf("%ds", d/time.Second)
+}
+
+// churnRate measures how many bytes per hour change between snapshots of
+// p, on average.
+func (a *app) churnRate(p *profileJSON) (float64, int, error) {
+	snaps, err := profileSnaps(p)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(snaps) < 2 {
+		return 0, 0, fmt.Errorf("at least two snapshots are needed to " +
+			"measure churn")
+	}
+	var changed uint64
+	var span time.Duration
+	for i := 1; i < len(snaps); i++ {
+		prev, s := snaps[i-1], snaps[i]
+		c, err := a.sendChanges(prev.subvolPath(), s.subvolPath())
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s: %w", s.path, err)
+		}
+		changed += c
+		span += s.created.Sub(prev.created)
+	}
+	if span <= 0 {
+		return 0, 0, fmt.Errorf("snapshots were all taken at once")
+	}
+	return float64(changed) / span.Hours(), len(snaps) - 1, nil
+}
+
+// advise proposes buckets of p which keep snapshots at most rpo apart, and
+// as far into the past as budget of space allows. Each snapshot is assumed
+// to hold data changed over its bucket's interval, which overestimates use
+// of space when the same data changes repeatedly.
+func (a *app) advise(p *profileJSON, budget, rpo string) error {
+	if budget == "" {
+		return fmt.Errorf("--budget is needed")
+	}
+	limit, err := parseSize(budget)
+	if err != nil {
+		return err
+	}
+	first := minInterval(p)
+	if rpo != "" {
+		var d BucketInterval
+		if err := d.UnmarshalText([]byte(rpo)); err != nil {
+			return err
+		}
+		first = time.Duration(d)
+	}
+	if first <= 0 {
+		first = time.Hour
+	}
+	rate, pairs, err := a.churnRate(p)
+	if err != nil {
+		return err
+	}
+	intervals := []time.Duration{first}
+	for _, d := range adviceIntervals {
+		if d > first {
+			intervals = append(intervals, d)
+		}
+	}
+	cost := func(d time.Duration, n int) float64 {
+		return rate * d.Hours() * float64(n)
+	}
+	// Each bucket covers the interval of the next one, the last one gets
+	// what's left of the budget.
+	left := float64(limit)
+	var sizes []int
+	for i, d := range intervals {
+		if cost(d, 1) > left {
+			break
+		}
+		n := maxAdvisedYears
+		if i+1 < len(intervals) {
+			n = int(math.Ceil(float64(intervals[i+1]) / float64(d)))
+		}
+		if rate > 0 {
+			n = min(n, int(left/cost(d, 1)))
+		}
+		sizes = append(sizes, n)
+		left -= cost(d, n)
+	}
+	if len(sizes) == 0 {
+		return fmt.Errorf("%s changes every %s, which is more than "+
+			"the budget", formatBytes(uint64(cost(first, 1))),
+			humanize.Duration(first, 2))
+	}
+
+	var buckets []bucketTemplate
+	t := newTable("INTERVAL", "SIZE", "COVERS", "ESTIMATE")
+	t.alignRight(1, 2, 3)
+	var total float64
+	for i, n := range sizes {
+		d := intervals[i]
+		total += cost(d, n)
+		buckets = append(buckets, bucketTemplate{formatInterval(d), n})
+		t.add(plainCell("%s", formatInterval(d)),
+			plainCell("%d", n),
+			plainCell("%s", humanize.Duration(d*time.Duration(n), 2)),
+			plainCell("%s", formatBytes(uint64(cost(d, n)))))
+	}
+	if !a.opts.plain {
+		if err := a.printTable(t); err != nil {
+			return err
+		}
+		fmt.Printf("\n%s/h changed on average between %d pairs of "+
+			"snapshots, about %s of %s would be used\n\n",
+			formatBytes(uint64(rate)), pairs,
+			formatBytes(uint64(total)), formatBytes(uint64(limit)))
+	}
+	out, err := json.MarshalIndent(map[string]interface{}{
+		"Buckets": buckets,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(os.Stdout, string(out))
+	return err
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"sync/atomic"
+	"time"
+)
+
+// Formats of archives made by --archive.
+const (
+	formatTarZstd        = "tar.zst"
+	formatSquashFS       = "squashfs"
+	defaultArchiveFormat = formatTarZstd
+)
+
+// archive packages the snapshot of p created at the given time into an
+// archive of the given format at output, for those who don't use Btrfs.
+func (a *app) archive(p *profileJSON, timestamp, format, output string) error {
+	snaps, err := profileSnaps(p)
+	if err != nil {
+		return err
+	}
+	var s *snap
+	for _, t := range snaps {
+		if path.Base(t.path) == timestamp {
+			s = t
+		}
+	}
+	if s == nil {
+		return fmt.Errorf("no snapshot %s", timestamp)
+	}
+	if _, err := os.Stat(output); err == nil {
+		return fmt.Errorf("%s already exists", output)
+	}
+	dir := s.subvolPath()
+	var run func() error
+	switch format {
+	case formatTarZstd:
+		var count int64
+		stages := []stage{
+			{argv: []string{"tar", "--numeric-owner", "--acls",
+				"--xattrs", "-C", dir, "-cf", "-", "."}},
+			{count: &count},
+			{argv: []string{"zstd", "-q", "-T0", "-o", output}},
+		}
+		if a.opts.dryRun || a.opts.verbose {
+			fmt.Fprintln(os.Stderr, a.pipelineString(stages))
+		}
+		run = func() error {
+			a.loadUsage(p, []*snap{s})
+			stop := a.showProgress(&count, s.usage)
+			defer stop()
+			return a.runPipeline(stages)
+		}
+	case formatSquashFS:
+		// mksquashfs shows progress on its own.
+		argv := []string{"mksquashfs", dir, output, "-comp", "zstd"}
+		if !useProgress() {
+			argv = append(argv, "-no-progress")
+		}
+		if a.opts.dryRun || a.opts.verbose {
+			printArgv(argv)
+		}
+		run = func() error {
+			cmd := exec.Command(argv[0], argv[1:]...)
+			cmd.Env = a.env
+			cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+			if err := cmd.Run(); err != nil {
+				return fmt.Errorf("%s: %w", argv[0], err)
+			}
+			return nil
+		}
+	}
+	if a.opts.dryRun {
+		return nil
+	}
+	if err := run(); err != nil {
+		os.Remove(output)
+		return err
+	}
+	return nil
+}
+
+// useProgress tells whether progress should be shown, which is only if
+// someone watches stderr.
+func useProgress() bool {
+	fi, err := os.Stderr.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// showProgress keeps reporting how many bytes have been counted so far, out
+// of those referenced by the snapshot, if usage is known. The returned
+// function stops it.
+func (a *app) showProgress(count *int64, usage *qgroupUsage) func() {
+	if !useProgress() {
+		return func() {}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		for {
+			n := uint64(atomic.LoadInt64(count))
+			line := formatBytes(n)
+			if usage != nil && usage.referenced > 0 {
+				line += fmt.Sprintf(" of ~%s (%d%%)",
+					formatBytes(usage.referenced),
+					n*100/usage.referenced)
+			}
+			fmt.Fprintf(os.Stderr, "\r\033[K%s", line)
+			select {
+			case <-t.C:
+			case <-done:
+				fmt.Fprintln(os.Stderr)
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// validArchiveFormat tells whether format is a valid --format value.
+func validArchiveFormat(format string) bool {
+	return format == formatTarZstd || format == formatSquashFS
+}
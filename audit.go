@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+	"time"
+)
+
+// auditLog is where actions which destroy or overwrite data are recorded,
+// relative to the storage directory. The log is only ever appended to, one
+// JSON object per line.
+const auditLog = ".audit.log"
+
+// Actions recorded in the audit log.
+const (
+	auditDelete   = "delete"
+	auditTrash    = "trash"
+	auditUndelete = "undelete"
+	auditRestore  = "restore"
+)
+
+// auditEntry records an action. SudoUser is who ran snap through sudo or
+// pkexec, or asked for the action over D-Bus, if anyone.
+type auditEntry struct {
+	Time     time.Time
+	User     string
+	SudoUser string `json:",omitempty"`
+	Action   string
+	Snapshot string
+	Target   string `json:",omitempty"`
+	Args     []string
+}
+
+// audit records in the audit log of storage that action was performed on the
+// snapshot s. Target is where the snapshot went, if anywhere.
+func (a *app) audit(storage, action string, s *snap, target string) error {
+	if a.opts.dryRun {
+		return nil
+	}
+	e := &auditEntry{
+		Time:     time.Now(),
+		User:     fmt.Sprint(os.Getuid()),
+		SudoUser: os.Getenv("SUDO_USER"),
+		Action:   action,
+		Snapshot: path.Base(s.path),
+		Target:   target,
+		Args:     os.Args,
+	}
+	if u, err := user.Current(); err == nil {
+		e.User = u.Username
+	}
+	if u := userName(a.invoker); u != "" {
+		e.SudoUser = u
+	}
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path.Join(storage, auditLog),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("cannot write audit log: %w", err)
+	}
+	// A single write, so that concurrent ones don't interleave.
+	if _, err := f.Write(append(buf, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("cannot write audit log: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("cannot write audit log: %w", err)
+	}
+	return f.Close()
+}
+
+// auditEntries reads the audit log of storage.
+func auditEntries(storage string) ([]*auditEntry, error) {
+	f, err := os.Open(path.Join(storage, auditLog))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []*auditEntry
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for n := 1; sc.Scan(); n++ {
+		var e auditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", auditLog, n, err)
+		}
+		entries = append(entries, &e)
+	}
+	return entries, sc.Err()
+}
+
+// showAuditLog prints the audit log of p.
+func (a *app) showAuditLog(p *profileJSON) error {
+	dir, err := storageDir(p)
+	if err != nil {
+		return err
+	}
+	entries, err := auditEntries(dir)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	t := newTable("TIME", "USER", "ACTION", "SNAPSHOT", "TARGET",
+		"COMMAND")
+	for _, e := range entries {
+		user := e.User
+		if e.SudoUser != "" {
+			user += " (" + e.SudoUser + ")"
+		}
+		t.add(plainCell("%s", a.formatTime(e.Time, now)),
+			plainCell("%s", user),
+			plainCell("%s", e.Action),
+			plainCell("%s", e.Snapshot),
+			plainCell("%s", e.Target),
+			plainCell("%s", strings.Join(e.Args, " ")))
+	}
+	return a.printTable(t)
+}
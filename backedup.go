@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// backedUp records which backup profiles have a copy of a snapshot, and
+// since when, so that profiles with KeepUntilBackedUp don't prune snapshots
+// whose only copy they have. Backups record snapshots they find already
+// copied too, so a lost record is made up for by the next backup.
+type backedUp struct {
+	To map[ProfileName]time.Time
+}
+
+// destinations returns the backup profiles which back up snapshots of p on
+// this machine, sorted by name.
+func (c *configJSON) destinations(p *profileJSON) []*profileJSON {
+	var dsts []*profileJSON
+	for _, q := range c.Profiles {
+		if q.Source != nil && *q.Source == p.name {
+			dsts = append(dsts, q)
+		}
+	}
+	sort.Slice(dsts, func(i, j int) bool {
+		return dsts[i].name < dsts[j].name
+	})
+	return dsts
+}
+
+// recordBackedUp records that the backup profile p has a copy of s.
+func (a *app) recordBackedUp(p *profileJSON, s *snap) error {
+	if a.opts.dryRun {
+		return nil
+	}
+	key := snapKey("backedup", s)
+	var b backedUp
+	if _, err := a.db.get(key, &b); err != nil {
+		return err
+	}
+	if _, ok := b.To[p.name]; ok {
+		return nil
+	}
+	if b.To == nil {
+		b.To = make(map[ProfileName]time.Time)
+	}
+	b.To[p.name] = time.Now()
+	if err := a.db.put(key, &b); err != nil {
+		return fmt.Errorf("cannot record backup of %s: %w", s.path, err)
+	}
+	return nil
+}
+
+// splitBackedUp splits snaps of p into those which all its destinations have
+// copies of and those pending a backup, in order. Unless p has
+// KeepUntilBackedUp, all of snaps count as backed up.
+func (a *app) splitBackedUp(p *profileJSON, snaps []*snap) (done, pending []*snap, err error) {
+	dsts := a.cfg.destinations(p)
+	if !p.KeepUntilBackedUp || len(dsts) == 0 {
+		return snaps, nil, nil
+	}
+	for _, s := range snaps {
+		var b backedUp
+		if _, err := a.db.get(snapKey("backedup", s), &b); err != nil {
+			return nil, nil, err
+		}
+		all := true
+		for _, d := range dsts {
+			if _, ok := b.To[d.name]; !ok {
+				all = false
+			}
+		}
+		if all {
+			done = append(done, s)
+		} else {
+			pending = append(pending, s)
+		}
+	}
+	return done, pending, nil
+}
+
+// keepPending reports snapshots which pruning keeps since they're pending a
+// backup.
+func (a *app) keepPending(pending []*snap) {
+	if !a.opts.dryRun && !a.opts.verbose {
+		return
+	}
+	for _, s := range pending {
+		fmt.Fprintf(os.Stderr, "keeping %s until it's backed up\n", s.path)
+	}
+}
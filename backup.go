@@ -0,0 +1,464 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sourceProfile returns the profile whose snapshots are backed up by the
+// backup profile p.
+func (a *app) sourceProfile(p *profileJSON) (*profileJSON, error) {
+	if p.Source == nil {
+		return nil, fmt.Errorf("not a backup profile")
+	}
+	// Validated by loadConfig.
+	return a.cfg.Profiles[*p.Source], nil
+}
+
+// sourceDir returns the host and the directory which hold the snapshots
+// backed up by the backup profile p. The host is empty unless p pulls
+// snapshots from another machine.
+func (a *app) sourceDir(p *profileJSON) (host, dir string, err error) {
+	if p.Pull != nil {
+		return *p.Pull.Host, *p.Pull.Storage, nil
+	}
+	src, err := a.sourceProfile(p)
+	if err != nil {
+		return "", "", err
+	}
+	dir, err = storageDir(src)
+	return "", dir, err
+}
+
+// defaultClockSkew allows for creation times truncated to whole seconds on
+// one side but rounded on the other.
+const defaultClockSkew = time.Second
+
+// clockSkew returns how far apart the creation times of the same snapshot
+// may be on the two sides of the backup profile p.
+func clockSkew(p *profileJSON) time.Duration {
+	if p.ClockSkew == nil {
+		return defaultClockSkew
+	}
+	d, _ := time.ParseDuration(*p.ClockSkew)
+	return d
+}
+
+// matchSnaps pairs snapshots in x with their copies in y. Snapshots whose
+// UUIDs are known are matched by them, regardless of their names. Others are
+// matched by creation time, which may differ by up to skew. Both x and y
+// must be sorted by creation time. It returns the counterparts of snapshots
+// in x which have one.
+func matchSnaps(x, y []*snap, skew time.Duration) map[*snap]*snap {
+	m := make(map[*snap]*snap)
+	matched := make(map[*snap]bool)
+	for _, s := range x {
+		if s.ids == nil {
+			continue
+		}
+		for _, t := range y {
+			if t.ids != nil && !matched[t] && s.ids.same(t.ids) {
+				m[s] = t
+				matched[t] = true
+				break
+			}
+		}
+	}
+	j := 0
+	for _, s := range x {
+		if m[s] != nil {
+			continue
+		}
+		for j < len(y) && (matched[y[j]] ||
+			y[j].created.Before(s.created.Add(-skew))) {
+			j++
+		}
+		if j < len(y) && !y[j].created.After(s.created.Add(skew)) &&
+			(s.ids == nil || y[j].ids == nil) {
+			m[s] = y[j]
+			j++
+		}
+	}
+	return m
+}
+
+// sourceSnaps returns snapshots backed up by the backup profile p, which are
+// kept in dir on host.
+func (a *app) sourceSnaps(p *profileJSON, host, dir string) ([]*snap, error) {
+	if host != "" {
+		return a.hostSnaps(host, dir)
+	}
+	src, err := a.sourceProfile(p)
+	if err != nil {
+		return nil, err
+	}
+	return profileSnaps(src)
+}
+
+// backup transfers all snapshots of the source profile which are missing in
+// the backup profile's storage. Snapshots are matched by their UUIDs or, if
+// those aren't available, by their creation time, tolerating clock skew
+// between the machines. Each one is sent relative to the newest older
+// snapshot present on both sides, if any, unless --full is given. Profiles
+// with Rsync copy files instead, hard-linking those unchanged since that
+// snapshot was copied.
+// Snapshots which fail to transfer time and again are quarantined and
+// skipped, see transferFailures.
+func (a *app) backup(p *profileJSON) error {
+	host, srcDir, err := a.sourceDir(p)
+	if err != nil {
+		return err
+	}
+	srcSnaps, err := a.sourceSnaps(p, host, srcDir)
+	if err != nil {
+		return err
+	}
+	dst, err := storageDir(p)
+	if err != nil {
+		return err
+	}
+	dstSnaps, err := profileSnaps(p)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		if err := loadNotes(srcSnaps); err != nil {
+			return err
+		}
+	}
+	a.loadIDs(host, srcSnaps)
+	if p.Rsync == nil {
+		a.loadIDs("", dstSnaps)
+	}
+	have := matchSnaps(srcSnaps, dstSnaps, clockSkew(p))
+	if host == "" {
+		for s := range have {
+			if err := a.recordBackedUp(p, s); err != nil {
+				return err
+			}
+		}
+	}
+	// Snapshots of others in a shared directory may have the same names.
+	allSnaps, err := findSnaps(dst)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for _, s := range allSnaps {
+		names[path.Base(s.path)] = true
+	}
+	var missing, parents []*snap
+	var parent *snap
+	for _, s := range srcSnaps {
+		if have[s] == nil {
+			if name := path.Base(s.path); names[name] {
+				return fmt.Errorf("%s exists in %s, but is not "+
+					"a copy of %s", name, dst, s.path)
+			}
+			missing = append(missing, s)
+			parents = append(parents, parent)
+		}
+		parent = s
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	var size uint64
+	var known bool
+	if host == "" {
+		src, err := a.sourceProfile(p)
+		if err != nil {
+			return err
+		}
+		a.loadUsage(src, missing)
+		size, known = transferSize(missing, parents[0] == nil)
+		if a.opts.full {
+			size, known = fullSize(missing)
+		}
+	}
+	var proto int
+	if !a.opts.dryRun && p.Rsync == nil {
+		proto, err = a.checkTransfer(host, "", dst, size, known)
+		if err != nil {
+			return err
+		}
+	}
+	copies := make(map[*snap]string)
+	for s, t := range have {
+		copies[s] = t.path
+	}
+	// Snapshots after quarantined ones are sent relative to the parents
+	// the quarantined ones would have been.
+	replaced := make(map[*snap]*snap)
+	for i, s := range missing {
+		parent := parents[i]
+		if r, ok := replaced[parent]; ok {
+			parent = r
+		}
+		if a.opts.full {
+			parent = nil
+		}
+		skip, err := a.quarantined(p, s)
+		if err != nil {
+			return err
+		}
+		if skip {
+			fmt.Fprintf(os.Stderr, "warning: skipping quarantined "+
+				"%s\n", s.path)
+			replaced[s] = parent
+			continue
+		}
+		if p.Rsync != nil {
+			err = a.rsync(host, s, copies[parent], dst, p.Rsync)
+		} else {
+			err = a.sendReceive(host, "", s, parent, dst, p.Buffer,
+				proto)
+			if errors.Is(err, ErrDestinationMissingParent) &&
+				a.opts.repairChain {
+				fmt.Fprintf(os.Stderr, "parent of %s missing "+
+					"at the destination, sending it in full\n",
+					s.path)
+				err = a.sendReceive(host, "", s, nil, dst,
+					p.Buffer, proto)
+			}
+		}
+		if err != nil {
+			skip, qerr := a.transferFailed(p, s, err)
+			if qerr != nil {
+				fmt.Fprintf(os.Stderr, "cannot record failed "+
+					"transfer: %v\n", qerr)
+			}
+			if !skip {
+				return fmt.Errorf("%s: %w", s.path, err)
+			}
+			if ps := a.current(); ps != nil {
+				ps.Quarantined = append(ps.Quarantined, s.path)
+			}
+			replaced[s] = parent
+			continue
+		}
+		if err := a.transferred(p, s); err != nil {
+			return err
+		}
+		if host == "" {
+			if err := a.recordBackedUp(p, s); err != nil {
+				return err
+			}
+		}
+		copies[s] = path.Join(dst, path.Base(s.path))
+		recv := &snap{path: path.Join(dst, path.Base(s.path))}
+		if err := a.setOwner(recv, p.name); err != nil {
+			return err
+		}
+		recv.description, recv.reason = s.description, s.reason
+		if err := a.saveNote(recv); err != nil {
+			return err
+		}
+		if err := a.copyMeta(host, s, recv); err != nil {
+			return err
+		}
+		source := s.path
+		if host != "" {
+			source = host + ":" + s.path
+		}
+		a.emit(eventBackedUp, p, recv, source, nil)
+	}
+	return nil
+}
+
+// restore transfers the snapshot created at the given time from the backup
+// profile p back to where it was backed up from.
+func (a *app) restore(p *profileJSON, timestamp string) error {
+	if p.Rsync != nil {
+		return fmt.Errorf("copies made by rsync aren't snapshots, " +
+			"copy the files back instead")
+	}
+	host, srcDir, err := a.sourceDir(p)
+	if err != nil {
+		return err
+	}
+	if host == "" && !a.opts.dryRun {
+		unlock, err := lockStorage(srcDir)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	snaps, err := profileSnaps(p)
+	if err != nil {
+		return err
+	}
+	srcSnaps, err := a.sourceSnaps(p, host, srcDir)
+	if err != nil {
+		return err
+	}
+	a.loadIDs("", snaps)
+	a.loadIDs(host, srcSnaps)
+	have := matchSnaps(snaps, srcSnaps, clockSkew(p))
+	var parent *snap
+	for _, s := range snaps {
+		if path.Base(s.path) != timestamp {
+			if have[s] != nil && !a.opts.full {
+				parent = s
+			}
+			continue
+		}
+		if have[s] != nil {
+			return fmt.Errorf("snapshot %s already present in %s",
+				timestamp, srcDir)
+		}
+		var proto int
+		if !a.opts.dryRun {
+			a.loadUsage(p, []*snap{s})
+			size, known := transferSize([]*snap{s}, parent == nil)
+			proto, err = a.checkTransfer("", host, srcDir, size, known)
+			if err != nil {
+				return err
+			}
+		}
+		err := a.sendReceive("", host, s, parent, srcDir, p.Buffer, proto)
+		if err != nil {
+			return err
+		}
+		dir, err := storageDir(p)
+		if err != nil {
+			return err
+		}
+		target := srcDir
+		if host != "" {
+			target = host + ":" + srcDir
+		}
+		if err := a.audit(dir, auditRestore, s, target); err != nil {
+			return err
+		}
+		if host != "" {
+			return nil
+		}
+		recv := &snap{path: path.Join(srcDir, path.Base(s.path))}
+		return a.setOwner(recv, *p.Source)
+	}
+	return fmt.Errorf("no snapshot %s of this host", timestamp)
+}
+
+// sendReceive pipes btrfs send of s on host from into btrfs receive in
+// storage on host to, where empty host names mean the local machine. If
+// parent is not nil, an incremental stream is sent; parent must be present in
+// storage already. If buf is not nil, the stream passes through a buffer. If
+// proto is not 0, send stream protocol of that version is requested.
+func (a *app) sendReceive(from, to string, s, parent *snap, storage string, buf *bufferJSON, proto int) error {
+	dir := path.Join(storage, path.Base(s.path))
+	recvDir := dir
+	if s.flat {
+		// The received subvolume is named after the one sent, which
+		// is the snapshot directory itself in the flat layout.
+		recvDir = storage
+	}
+	sendArgv := []string{a.btrfs(from, "send"), "send", "-q"}
+	if proto != 0 {
+		sendArgv = append(sendArgv, "--proto", strconv.Itoa(proto))
+	}
+	if parent != nil {
+		sendArgv = append(sendArgv, "-p", parent.subvolPath())
+	}
+	sendArgv = append(sendArgv, s.subvolPath())
+	stages := []stage{{host: from, argv: sendArgv}}
+	var count int64
+	if buf != nil {
+		if len(buf.Command) > 0 {
+			stages = append(stages, stage{argv: buf.Command})
+		} else {
+			size, _ := parseSize(*buf.Size)
+			stages = append(stages, stage{buffer: size, count: &count})
+		}
+	}
+	if a.countsTransfers() && (buf == nil || len(buf.Command) > 0) {
+		// Counting needs the stream to pass through snap itself.
+		stages = append(stages, stage{count: &count})
+	}
+	recvArgv := []string{a.btrfs(to, "receive"), "receive", recvDir}
+	stages = append(stages, stage{host: to, argv: recvArgv})
+	if a.opts.dryRun || a.opts.verbose {
+		fmt.Fprintln(os.Stderr, a.pipelineString(stages))
+	}
+	if a.opts.dryRun {
+		return nil
+	}
+
+	if err := a.mkdirAll(to, recvDir); err != nil {
+		return err
+	}
+	done := func() error { return nil }
+	if to == "" {
+		var err error
+		recv := &snap{path: dir, flat: s.flat}
+		if done, err = a.begin(storage, opReceive, recv); err != nil {
+			return err
+		}
+	}
+	start := time.Now()
+	if err := a.runPipeline(stages); err != nil {
+		var execErr *ExecError
+		if parent != nil && errors.As(err, &execErr) &&
+			strings.Contains(execErr.Stderr, "cannot find parent subvolume") {
+			err = fmt.Errorf("%w (%s): %w", ErrDestinationMissingParent,
+				path.Base(parent.path), err)
+		}
+		if to == "" {
+			if cerr := a.cleanupReceive(dir, s.flat); cerr != nil {
+				fmt.Fprintf(os.Stderr, "cannot delete partially "+
+					"received snapshot: %v\n", cerr)
+			} else {
+				done()
+			}
+		} else {
+			fmt.Fprintf(os.Stderr, "partially received snapshot "+
+				"may be left in %s:%s\n", to, dir)
+		}
+		return err
+	}
+	a.telemetry.transferred(count)
+	a.transfers.transferred(count, start)
+	if ps := a.current(); ps != nil {
+		ps.Transferred = append(ps.Transferred, transferSummary{
+			Snapshot: s.path,
+			Bytes:    count,
+			Seconds:  time.Since(start).Seconds(),
+		})
+	}
+	return done()
+}
+
+// countsTransfers tells whether anything needs to know how many bytes
+// transfers of snapshots take.
+func (a *app) countsTransfers() bool {
+	return a.summary != nil || a.trace != nil || a.telemetry != nil ||
+		a.transfers != nil
+}
+
+// cleanupReceive removes what's left of a failed receive of a snapshot into
+// dir, so that the next backup doesn't mistake it for a complete snapshot.
+func (a *app) cleanupReceive(dir string, flat bool) error {
+	if flat {
+		if _, err := os.Stat(dir); err != nil {
+			return nil
+		}
+		return a.btrfsCmd("subvolume", "delete", dir)
+	}
+	fis, _ := ioutil.ReadDir(dir)
+	for _, fi := range fis {
+		p := path.Join(dir, fi.Name())
+		if err := a.btrfsCmd("subvolume", "delete", p); err != nil {
+			return err
+		}
+	}
+	if !a.opts.dryRun {
+		os.Remove(dir)
+	}
+	return nil
+}
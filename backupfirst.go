@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// requireBackups returns the snapshots out of p which pruning may delete
+// since all profiles backing up p have copies of them, if p has
+// RequireBackupBeforePrune. Others are kept until backups catch up. Pruning
+// fails if the storage of a backup profile is missing, such as a disk which
+// isn't plugged in, since nobody can tell what it has. --force prunes
+// regardless.
+func (a *app) requireBackups(p *profileJSON, out []*snap) ([]*snap, error) {
+	if !p.RequireBackupBeforePrune || a.opts.force || len(out) == 0 {
+		return out, nil
+	}
+	a.loadIDs("", out)
+	missing := make(map[*snap]bool)
+	for _, d := range a.cfg.destinations(p) {
+		dir, err := storageDir(d)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(dir); err != nil {
+			return nil, fmt.Errorf("cannot tell whether backup profile "+
+				"%q has copies of snapshots to prune, use --force "+
+				"to prune anyway: %v: %w", d.name, err,
+				ErrBackupUnreachable)
+		}
+		copies, err := profileSnaps(d)
+		if err != nil {
+			return nil, err
+		}
+		if d.Rsync == nil {
+			a.loadIDs("", copies)
+		}
+		have := matchSnaps(out, copies, clockSkew(d))
+		for _, s := range out {
+			if have[s] == nil && !missing[s] {
+				missing[s] = true
+				fmt.Fprintf(os.Stderr, "warning: not pruning %s, "+
+					"backup profile %q has no copy of it yet\n",
+					s.path, d.name)
+			}
+		}
+	}
+	backedUp := out[:0:0]
+	for _, s := range out {
+		if !missing[s] {
+			backedUp = append(backedUp, s)
+		}
+	}
+	return backedUp, nil
+}
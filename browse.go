@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// view is a screen of snap browse: a list of rows, one of which is selected.
+type view interface {
+	title() string
+	rows() []string
+	// open acts on the row i, typically by pushing a view.
+	open(b *browser, i int) error
+}
+
+// browser is the state of snap browse. Views are stacked as the user drills
+// down, the top one is shown.
+type browser struct {
+	a        *app
+	p        *profileJSON
+	snaps    []*snap
+	listings map[*snap]*snapListing
+	views    []view
+	sel      []int
+	top      []int
+	msg      string
+	out      *bufio.Writer
+	state    *term.State
+}
+
+// browse lets the user scroll through snapshots of p, drill into directories,
+// compare versions of files and restore them.
+func (a *app) browse(p *profileJSON) error {
+	if !term.IsTerminal(int(os.Stdin.Fd())) ||
+		!term.IsTerminal(int(os.Stdout.Fd())) {
+		return fmt.Errorf("browse needs a terminal")
+	}
+	snaps, err := profileSnaps(p)
+	if err != nil {
+		return err
+	}
+	if len(snaps) == 0 {
+		return fmt.Errorf("no snapshots")
+	}
+	if err := loadNotes(snaps); err != nil {
+		return err
+	}
+	b := &browser{
+		a:        a,
+		p:        p,
+		snaps:    snaps,
+		listings: make(map[*snap]*snapListing),
+		out:      bufio.NewWriter(os.Stdout),
+	}
+	b.push(&snapsView{b: b})
+	defer func() {
+		for s, l := range b.listings {
+			a.saveListing(s, l)
+		}
+	}()
+	if err := b.enter(); err != nil {
+		return err
+	}
+	defer b.leave()
+	return b.loop()
+}
+
+// enter switches the terminal to the alternate screen in raw mode.
+func (b *browser) enter() error {
+	state, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return err
+	}
+	b.state = state
+	fmt.Fprint(os.Stdout, "\x1b[?1049h\x1b[?25l")
+	return nil
+}
+
+// leave restores the terminal as enter found it.
+func (b *browser) leave() {
+	fmt.Fprint(os.Stdout, "\x1b[?25h\x1b[?1049l")
+	term.Restore(int(os.Stdin.Fd()), b.state)
+}
+
+// run runs cmds, whose output is piped from each to the next one, with the
+// terminal restored for them.
+func (b *browser) run(cmds ...*exec.Cmd) error {
+	b.leave()
+	defer b.enter()
+	for i, cmd := range cmds {
+		cmd.Stderr = os.Stderr
+		if i == 0 {
+			cmd.Stdin = os.Stdin
+		}
+		if i == len(cmds)-1 {
+			cmd.Stdout = os.Stdout
+			continue
+		}
+		r, err := cmds[i].StdoutPipe()
+		if err != nil {
+			return err
+		}
+		cmds[i+1].Stdin = r
+	}
+	for _, cmd := range cmds {
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+	}
+	var err error
+	for _, cmd := range cmds {
+		if werr := cmd.Wait(); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+func (b *browser) push(v view) {
+	b.views = append(b.views, v)
+	b.sel = append(b.sel, 0)
+	b.top = append(b.top, 0)
+}
+
+func (b *browser) pop() {
+	if n := len(b.views); n > 1 {
+		b.views, b.sel, b.top = b.views[:n-1], b.sel[:n-1], b.top[:n-1]
+	}
+}
+
+// browseHelp is shown on the status line unless there is a message.
+const browseHelp = "↑↓ move  ⏎ open  ← back  d diff  D diff live  r restore  q quit"
+
+func (b *browser) loop() error {
+	buf := make([]byte, 16)
+	for {
+		if err := b.draw(); err != nil {
+			return err
+		}
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return err
+		}
+		b.msg = ""
+		n1 := len(b.views) - 1
+		v, sel := b.views[n1], &b.sel[n1]
+		rows := len(v.rows())
+		_, height := b.size()
+		switch string(buf[:n]) {
+		case "q", "\x03":
+			return nil
+		case "k", "\x1b[A":
+			*sel--
+		case "j", "\x1b[B":
+			*sel++
+		case "\x1b[5~":
+			*sel -= height - 2
+		case "\x1b[6~":
+			*sel += height - 2
+		case "g", "\x1b[H":
+			*sel = 0
+		case "G", "\x1b[F":
+			*sel = rows - 1
+		case "h", "\x1b", "\x1b[D", "\x7f":
+			b.pop()
+		case "l", "\r", "\x1b[C":
+			if *sel < rows {
+				err = v.open(b, *sel)
+			}
+		case "d", "D", "r":
+			vv, ok := v.(*versionsView)
+			if !ok || *sel >= rows {
+				break
+			}
+			switch buf[0] {
+			case 'd':
+				err = vv.diff(*sel)
+			case 'D':
+				err = vv.diffLive(*sel)
+			case 'r':
+				err = vv.restore(*sel)
+			}
+		}
+		if err != nil {
+			b.msg = err.Error()
+		}
+		if *sel >= rows {
+			*sel = rows - 1
+		}
+		if *sel < 0 {
+			*sel = 0
+		}
+	}
+}
+
+func (b *browser) size() (int, int) {
+	w, h, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || w <= 0 || h <= 0 {
+		return 80, 24
+	}
+	return w, h
+}
+
+// draw shows the top view, scrolled so that the selected row is visible,
+// with a title above and a status line below.
+func (b *browser) draw() error {
+	width, height := b.size()
+	n := len(b.views) - 1
+	v, sel, top := b.views[n], b.sel[n], &b.top[n]
+	rows := v.rows()
+	page := height - 2
+	if page < 1 {
+		page = 1
+	}
+	if sel < *top {
+		*top = sel
+	}
+	if sel >= *top+page {
+		*top = sel - page + 1
+	}
+	fmt.Fprint(b.out, "\x1b[H\x1b[2J")
+	fmt.Fprintf(b.out, "\x1b[1m%s\x1b[0m\r\n", clip(v.title(), width))
+	for i := *top; i < len(rows) && i < *top+page; i++ {
+		row := clip(rows[i], width)
+		if i == sel {
+			row = "\x1b[7m" + row + strings.Repeat(" ",
+				width-len([]rune(row))) + "\x1b[0m"
+		}
+		fmt.Fprintf(b.out, "%s\r\n", row)
+	}
+	status := browseHelp
+	if b.msg != "" {
+		status = b.msg
+	}
+	fmt.Fprintf(b.out, "\x1b[%dH%s", height, clip(status, width))
+	return b.out.Flush()
+}
+
+// clip cuts s to at most width runes.
+func clip(s string, width int) string {
+	if r := []rune(s); len(r) > width {
+		return string(r[:width])
+	}
+	return s
+}
+
+// confirm asks a yes/no question on the status line.
+func (b *browser) confirm(question string) (bool, error) {
+	b.msg = question + " [y/N]"
+	if err := b.draw(); err != nil {
+		return false, err
+	}
+	buf := make([]byte, 16)
+	n, err := os.Stdin.Read(buf)
+	if err != nil {
+		return false, err
+	}
+	b.msg = ""
+	return string(buf[:n]) == "y" || string(buf[:n]) == "Y", nil
+}
+
+// listing returns listings of snapshot s, which are saved when snap browse
+// quits.
+func (b *browser) listing(s *snap) *snapListing {
+	l, ok := b.listings[s]
+	if !ok {
+		l = b.a.snapListing(s)
+		b.listings[s] = l
+	}
+	return l
+}
+
+// globEscape escapes name so that it only matches itself in patterns.
+func globEscape(name string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`,
+		`[`, `\[`).Replace(name)
+}
+
+// snapsView lists snapshots of the profile.
+type snapsView struct {
+	b *browser
+}
+
+func (v *snapsView) title() string {
+	return fmt.Sprintf("%s: %d snapshots", v.b.a.opts.profileName,
+		len(v.b.snaps))
+}
+
+func (v *snapsView) rows() []string {
+	now := time.Now()
+	rows := make([]string, len(v.b.snaps))
+	for i, s := range v.b.snaps {
+		rows[i] = fmt.Sprintf("%-14s %-20s %-9s %s",
+			filepath.Base(s.path), v.b.a.formatTime(s.created, now),
+			s.reason, s.description)
+	}
+	return rows
+}
+
+func (v *snapsView) open(b *browser, i int) error {
+	return b.openDir(b.snaps[i], ".")
+}
+
+// dirView lists a directory of a snapshot.
+type dirView struct {
+	snap *snap
+	dir  string
+	ents []dirEntry
+}
+
+func (b *browser) openDir(s *snap, dir string) error {
+	ents, err := b.listing(s).readDir(dir)
+	if err != nil {
+		return err
+	}
+	b.push(&dirView{snap: s, dir: dir, ents: ents})
+	return nil
+}
+
+func (v *dirView) title() string {
+	return fmt.Sprintf("%s: %s", filepath.Base(v.snap.path),
+		filepath.Join("/", v.dir))
+}
+
+func (v *dirView) rows() []string {
+	rows := make([]string, len(v.ents))
+	for i, e := range v.ents {
+		name := e.Name
+		if e.Mode.IsDir() {
+			name += "/"
+		} else if e.Mode&os.ModeSymlink != 0 {
+			name += "@"
+		}
+		rows[i] = fmt.Sprintf("%10s  %-16s  %s",
+			formatBytes(uint64(e.Size)), e.ModTime.Format("2006-01-02 15:04"),
+			name)
+	}
+	return rows
+}
+
+func (v *dirView) open(b *browser, i int) error {
+	e := v.ents[i]
+	rel := filepath.Join(v.dir, e.Name)
+	if e.Mode.IsDir() {
+		return b.openDir(v.snap, rel)
+	}
+	return b.openVersions(rel)
+}
+
+// versionsView lists distinct versions of a file across snapshots.
+type versionsView struct {
+	b    *browser
+	rel  string
+	vers []*fileVersion
+}
+
+func (b *browser) openVersions(rel string) error {
+	perSnap := make([]map[string]dirEntry, len(b.snaps))
+	for i, s := range b.snaps {
+		files, err := b.listing(s).files(globEscape(rel), false)
+		if err != nil {
+			return err
+		}
+		perSnap[i] = files
+	}
+	manifests, err := readManifests(b.snaps)
+	if err != nil {
+		return err
+	}
+	vers, err := versions(b.snaps, perSnap, manifests, rel)
+	if err != nil {
+		return err
+	}
+	b.push(&versionsView{b: b, rel: rel, vers: vers})
+	return nil
+}
+
+func (v *versionsView) title() string {
+	return fmt.Sprintf("%s: %d versions", filepath.Join("/", v.rel),
+		len(v.vers))
+}
+
+func (v *versionsView) rows() []string {
+	now := time.Now()
+	rows := make([]string, len(v.vers))
+	for i, fv := range v.vers {
+		size, mod := "deleted", ""
+		if fv.path != "" {
+			size = formatBytes(uint64(fv.fi.Size))
+			mod = fv.fi.ModTime.Format("2006-01-02 15:04")
+		}
+		rows[i] = fmt.Sprintf("%-14s %-20s %10s  %s",
+			filepath.Base(fv.snap.path),
+			v.b.a.formatTime(fv.snap.created, now), size, mod)
+	}
+	return rows
+}
+
+// open shows the version in a pager.
+func (v *versionsView) open(b *browser, i int) error {
+	fv := v.vers[i]
+	if fv.path == "" {
+		return fmt.Errorf("deleted in %s", filepath.Base(fv.snap.path))
+	}
+	return b.run(pager(fv.path))
+}
+
+// diff compares the version i with the one before it.
+func (v *versionsView) diff(i int) error {
+	old := os.DevNull
+	if i > 0 && v.vers[i-1].path != "" {
+		old = v.vers[i-1].path
+	}
+	cur := v.vers[i].path
+	if cur == "" {
+		cur = os.DevNull
+	}
+	return v.b.showDiff(old, cur)
+}
+
+// diffLive compares the version i with the file on the live filesystem.
+func (v *versionsView) diffLive(i int) error {
+	if v.b.p.Subvolume == nil {
+		return fmt.Errorf("profile doesn't take snapshots")
+	}
+	old := v.vers[i].path
+	if old == "" {
+		old = os.DevNull
+	}
+	live := filepath.Join(*v.b.p.Subvolume, v.rel)
+	if _, err := os.Lstat(live); err != nil {
+		live = os.DevNull
+	}
+	return v.b.showDiff(old, live)
+}
+
+func (b *browser) showDiff(old, cur string) error {
+	err := b.run(exec.Command("diff", "-u", "--", old, cur), pager())
+	// Diff exits with 1 when the files differ.
+	if e, ok := err.(*exec.ExitError); ok && e.ExitCode() == 1 {
+		return nil
+	}
+	return err
+}
+
+// restore restores the version i into Subvolume.
+func (v *versionsView) restore(i int) error {
+	fv := v.vers[i]
+	if fv.path == "" {
+		return fmt.Errorf("deleted in %s", filepath.Base(fv.snap.path))
+	}
+	ts := filepath.Base(fv.snap.path)
+	ok, err := v.b.confirm(fmt.Sprintf("restore %s from %s?", v.rel, ts))
+	if err != nil || !ok {
+		return err
+	}
+	var dst string
+	// Restoring prints, don't let it garble the screen.
+	err = v.b.quietly(func() error {
+		var err error
+		dst, err = v.b.a.restoreFile(v.b.p, ts, v.rel)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	v.b.msg = "restored " + dst
+	return nil
+}
+
+// quietly runs fn with its output to stdout discarded.
+func (b *browser) quietly(fn func() error) error {
+	stdout := os.Stdout
+	devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer devnull.Close()
+	os.Stdout = devnull
+	defer func() { os.Stdout = stdout }()
+	return fn()
+}
+
+// pager returns the command which pages args, or its input if there are
+// none, using $PAGER if set.
+func pager(args ...string) *exec.Cmd {
+	argv := strings.Fields(os.Getenv("PAGER"))
+	if len(argv) == 0 {
+		argv = []string{"less"}
+	}
+	return exec.Command(argv[0], append(argv[1:], args...)...)
+}
@@ -0,0 +1,36 @@
+package main
+
+import "time"
+
+// calendarMonths returns how many calendar months the interval d, a whole
+// number of months or years, stands for, or 0 if it's neither.
+func calendarMonths(d time.Duration) int {
+	switch {
+	case d >= year && d%year == 0:
+		return int(d/year) * 12
+	case d >= month && d%month == 0:
+		return int(d / month)
+	}
+	return 0
+}
+
+// addMonths adds n calendar months to t. Unlike time.AddDate, it doesn't
+// overflow into the month after: a month after January 31 is the last day
+// of February.
+func addMonths(t time.Time, n int) time.Time {
+	u := t.AddDate(0, n, 0)
+	if u.Day() != t.Day() {
+		// Went past the end of the month, go back to its last day.
+		u = u.AddDate(0, 0, -u.Day())
+	}
+	return u
+}
+
+// tooClose tells whether the snapshot created at t is too close to the one
+// created at prev for b to keep both.
+func (b *bucket) tooClose(prev, t time.Time) bool {
+	if b.months > 0 {
+		return t.Before(addMonths(prev, b.months))
+	}
+	return t.Sub(prev) < b.interval
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+)
+
+// lastRun records when snapshots of a profile were last created or backed
+// up, so that --catch-up can tell what was missed while the machine was off.
+// Failed and Error tell when and why it last failed, if it hasn't succeeded
+// since, for --status --all.
+type lastRun struct {
+	Succeeded time.Time
+	Failed    time.Time `json:",omitempty"`
+	Error     string    `json:",omitempty"`
+}
+
+func lastRunKey(p *profileJSON) string {
+	return "lastrun/" + url.PathEscape(p.name)
+}
+
+// recordRun records that snapshots of p were created or backed up just now.
+func (a *app) recordRun(p *profileJSON) {
+	if a.opts.dryRun {
+		return
+	}
+	err := a.db.put(lastRunKey(p), &lastRun{Succeeded: time.Now()})
+	if err != nil && a.opts.verbose {
+		fmt.Fprintf(os.Stderr, "cannot record run of profile %q: %v\n",
+			p.name, err)
+	}
+}
+
+// recordFailure records that creating or backing up snapshots of p failed
+// just now with failure.
+func (a *app) recordFailure(p *profileJSON, failure error) {
+	if a.opts.dryRun {
+		return
+	}
+	var last lastRun
+	_, err := a.db.get(lastRunKey(p), &last)
+	if err == nil {
+		last.Failed, last.Error = time.Now(), failure.Error()
+		err = a.db.put(lastRunKey(p), &last)
+	}
+	if err != nil && a.opts.verbose {
+		fmt.Fprintf(os.Stderr, "cannot record run of profile %q: %v\n",
+			p.name, err)
+	}
+}
+
+// catchUp creates or backs up snapshots of p, and prunes them, if that's
+// overdue, as it is after a laptop was off while the timer which runs snap
+// was due. It's due once the shortest bucket interval passed since it last
+// succeeded, or since the newest snapshot was taken if snap doesn't know.
+func (a *app) catchUp(p *profileJSON) error {
+	interval := minInterval(p)
+	if interval == 0 {
+		return nil
+	}
+	var last lastRun
+	if _, err := a.db.get(lastRunKey(p), &last); err != nil {
+		return err
+	}
+	if last.Succeeded.IsZero() {
+		snaps, err := profileSnaps(p)
+		if err != nil {
+			return err
+		}
+		for _, s := range snaps {
+			if s.created.After(last.Succeeded) {
+				last.Succeeded = s.created
+			}
+		}
+	}
+	if time.Since(last.Succeeded) < interval {
+		return nil
+	}
+	if a.opts.dryRun || a.opts.verbose {
+		fmt.Fprintf(os.Stderr, "profile %q last ran %s ago, catching up\n",
+			p.name, time.Since(last.Succeeded).Round(time.Second))
+	}
+	sa := *a
+	sa.opts.catchUp = false
+	sa.opts.create, sa.opts.backup = !p.isBackup(), p.isBackup()
+	sa.opts.prune = true
+	return sa.runProfile(p)
+}
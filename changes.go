@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// genAtCreation returns the generation in which the snapshot s was taken.
+func (a *app) genAtCreation(s *snap) (uint64, error) {
+	out, err := a.btrfsQuery("subvolume", "show", s.subvolPath())
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		f := strings.SplitN(line, ":", 2)
+		if len(f) == 2 && strings.TrimSpace(f[0]) == "Gen at creation" {
+			return strconv.ParseUint(strings.TrimSpace(f[1]), 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("%s: no generation in btrfs subvolume show "+
+		"output", s.subvolPath())
+}
+
+// snapGeneration returns the generation of the subvolume which s was taken
+// of as it was when s was taken. It's recorded in notes of snapshots taken
+// while SkipIdle is set, otherwise the generation in which s was taken is
+// just as good, since taking a snapshot changes the subvolume too.
+func (a *app) snapGeneration(s *snap) (uint64, error) {
+	if s.generation != 0 {
+		return s.generation, nil
+	}
+	return a.genAtCreation(s)
+}
+
+// changedFiles returns files of the subvolume subvol whose data changed after
+// generation gen, relative to subvol. Unlike comparing files with those in a
+// snapshot, find-new only looks at the extents which changed, but it doesn't
+// report deleted files nor changes of metadata only.
+func (a *app) changedFiles(subvol string, gen uint64) ([]string, error) {
+	out, err := a.btrfsQuery("subvolume", "find-new", subvol,
+		strconv.FormatUint(gen, 10))
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var files []string
+	for _, line := range strings.Split(string(out), "\n") {
+		// inode N file offset N len N disk start N offset N gen N
+		// flags FLAGS path
+		f := strings.SplitN(line, " ", 17)
+		if len(f) != 17 || f[0] != "inode" || seen[f[16]] {
+			continue
+		}
+		seen[f[16]] = true
+		files = append(files, f[16])
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// changedSince lists files of Subvolume of p which changed since the
+// snapshot taken at timestamp.
+func (a *app) changedSince(p *profileJSON, timestamp string) error {
+	if p.Subvolume == nil {
+		return fmt.Errorf("changes can only be listed in profiles with " +
+			"Subvolume")
+	}
+	snaps, err := profileSnaps(p)
+	if err != nil {
+		return err
+	}
+	var s *snap
+	for _, t := range snaps {
+		if filepath.Base(t.path) == timestamp {
+			s = t
+		}
+	}
+	if s == nil {
+		return fmt.Errorf("no snapshot %s", timestamp)
+	}
+	if err := loadNotes([]*snap{s}); err != nil {
+		return err
+	}
+	gen, err := a.snapGeneration(s)
+	if err != nil {
+		return err
+	}
+	files, err := a.changedFiles(*p.Subvolume, gen)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		fmt.Println(f)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/dcepelik/snap/humanize"
+)
+
+const (
+	sendStreamMagic = "btrfs-stream\x00"
+
+	sendCmdEnd          = 21
+	sendCmdUpdateExtent = 22
+
+	sendAttrSize = 4
+)
+
+// sumUpdateExtents reads a send stream produced by btrfs send --no-data and
+// returns the total size of file ranges which were updated.
+func sumUpdateExtents(r io.Reader) (total uint64, err error) {
+	br := bufio.NewReader(r)
+	hdr := make([]byte, len(sendStreamMagic)+4)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return 0, fmt.Errorf("cannot read stream header: %w", err)
+	}
+	if string(hdr[:len(sendStreamMagic)]) != sendStreamMagic {
+		return 0, fmt.Errorf("not a send stream")
+	}
+	cmdHdr := make([]byte, 10)
+	for {
+		if _, err := io.ReadFull(br, cmdHdr); err == io.EOF {
+			return total, nil
+		} else if err != nil {
+			return 0, err
+		}
+		size := binary.LittleEndian.Uint32(cmdHdr[0:4])
+		cmd := binary.LittleEndian.Uint16(cmdHdr[4:6])
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return 0, err
+		}
+		if cmd == sendCmdEnd {
+			_, err := io.Copy(ioutil.Discard, br)
+			return total, err
+		}
+		if cmd != sendCmdUpdateExtent {
+			continue
+		}
+		for len(payload) >= 4 {
+			typ := binary.LittleEndian.Uint16(payload[0:2])
+			l := int(binary.LittleEndian.Uint16(payload[2:4]))
+			payload = payload[4:]
+			if l > len(payload) {
+				return 0, fmt.Errorf("truncated attribute")
+			}
+			if typ == sendAttrSize && l == 8 {
+				total += binary.LittleEndian.Uint64(payload[:8])
+			}
+			payload = payload[l:]
+		}
+	}
+}
+
+// sendChanges returns how much file data changed between the parent and snap
+// subvolumes, without actually transferring any data.
+func (a *app) sendChanges(parent, snap string) (uint64, error) {
+	args := []string{"send", "--no-data", "-q", "-p", parent, snap}
+	if a.opts.verbose {
+		a.printCmd(args)
+	}
+	pr, pw := io.Pipe()
+	var changed uint64
+	errc := make(chan error, 1)
+	go func() {
+		var err error
+		changed, err = sumUpdateExtents(pr)
+		pr.CloseWithError(err)
+		errc <- err
+	}()
+	err := a.btrfsRun(pw, args...)
+	pw.Close()
+	if perr := <-errc; err == nil {
+		err = perr
+	}
+	return changed, err
+}
+
+// churn reports how much data changed between each pair of consecutive
+// snapshots, which helps to pick sensible bucket intervals.
+func (a *app) churn(p *profileJSON) error {
+	snaps, err := profileSnaps(p)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	t := newTable("#", "CREATED", "INTERVAL", "CHANGED", "RATE", "PATH")
+	t.alignRight(0, 1, 2, 3, 4)
+	for i := 1; i < len(snaps); i++ {
+		prev, s := snaps[i-1], snaps[i]
+		changed, err := a.sendChanges(prev.subvolPath(), s.subvolPath())
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.path, err)
+		}
+		gap := s.created.Sub(prev.created)
+		perHour := "-"
+		if gap > 0 {
+			rate := float64(changed) / gap.Hours()
+			perHour = formatBytes(uint64(rate)) + "/h"
+		}
+		t.add(plainCell("%d", i+1),
+			plainCell("%s", a.formatTime(s.created, now)),
+			plainCell("%s", humanize.Duration(gap, 2)),
+			plainCell("%s", formatBytes(changed)),
+			plainCell("%s", perHour),
+			plainCell("%s", s.path))
+	}
+	return a.printTable(t)
+}
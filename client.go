@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pborman/getopt/v2"
+)
+
+// apiRequest performs a request against the API of snap serve running at
+// --connect and decodes the JSON response into v, unless v is nil.
+func (a *app) apiRequest(method string, v interface{}, elems ...string) error {
+	for i, e := range elems {
+		elems[i] = url.PathEscape(e)
+	}
+	u := strings.TrimRight(a.opts.connect, "/") + "/v1/" +
+		strings.Join(elems, "/")
+	if a.opts.dryRun && method == http.MethodPost {
+		u += "?dry-run=1"
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return err
+	}
+	if token := os.Getenv("SNAP_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// remoteOptions are the options which runRemote honours, all others are
+// rejected with --connect rather than ignored.
+var remoteOptions = map[string]bool{"backup": true, "connect": true,
+	"create": true, "date-format": true, "dry-run": true, "list": true,
+	"maintain": true, "plain": true, "prune": true}
+
+// runRemote is like run, but performs the operations through snap serve.
+func (a *app) runRemote() error {
+	given := make(map[string]bool)
+	getopt.Visit(func(o getopt.Option) {
+		given[o.LongName()] = true
+	})
+	// Subcommands set their options without getopt seeing them.
+	for name, set := range a.commands() {
+		if *set {
+			given[name] = true
+		}
+	}
+	for name, arg := range a.argCommands() {
+		if *arg != "" {
+			given[name] = true
+		}
+	}
+	var unsupported []string
+	for name := range given {
+		if !remoteOptions[name] {
+			unsupported = append(unsupported, "--"+name)
+		}
+	}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		return fmt.Errorf("%s cannot be used with --connect, only "+
+			"create, backup, prune, maintain and list can",
+			strings.Join(unsupported, ", "))
+	}
+	names := []string{a.opts.profileName}
+	if a.opts.profileName == "" {
+		names = nil
+		if err := a.apiRequest(http.MethodGet, &names, "profiles"); err != nil {
+			return fmt.Errorf("cannot list profiles: %w", err)
+		}
+	}
+	for _, name := range names {
+		for _, op := range []struct {
+			set  bool
+			name string
+		}{
+			{a.opts.create, "create"},
+			{a.opts.backup, "backup"},
+			{a.opts.prune, "prune"},
+			{a.opts.maintain, "maintain"},
+		} {
+			if !op.set {
+				continue
+			}
+			err := a.apiRequest(http.MethodPost, nil, "profiles", name, op.name)
+			if err != nil {
+				return fmt.Errorf("profile %q: cannot %s: %w",
+					name, op.name, err)
+			}
+		}
+		if a.opts.list {
+			if len(names) > 1 {
+				fmt.Printf("%s:\n", name)
+			}
+			if err := a.listRemote(name); err != nil {
+				return fmt.Errorf("profile %q: cannot list "+
+					"snapshots: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (a *app) listRemote(name string) error {
+	var snaps []snapJSON
+	err := a.apiRequest(http.MethodGet, &snaps, "profiles", name, "snapshots")
+	if err != nil {
+		return err
+	}
+	reasoned, described := false, false
+	for _, s := range snaps {
+		if s.Reason != "" {
+			reasoned = true
+		}
+		if s.Description != "" {
+			described = true
+		}
+	}
+	now := time.Now()
+	header := []string{"#", "CREATED", "REFERENCED", "EXCLUSIVE", "PATH"}
+	if reasoned {
+		header = append(header, "REASON")
+	}
+	if described {
+		header = append(header, "DESCRIPTION")
+	}
+	t := newTable(header...)
+	t.alignRight(0, 1, 2, 3)
+	for i, s := range snaps {
+		rfer, excl := cell{text: "-"}, cell{text: "-"}
+		if s.Referenced != nil && s.Exclusive != nil {
+			rfer.text = formatBytes(*s.Referenced)
+			excl.text = formatBytes(*s.Exclusive)
+		}
+		row := []cell{plainCell("%d", i+1),
+			plainCell("%s", a.formatTime(s.Created, now)),
+			rfer, excl, plainCell("%s", s.Path)}
+		if reasoned {
+			row = append(row, reasonCell(s.Reason, s.Transaction))
+		}
+		if described {
+			row = append(row, plainCell("%s", s.Description))
+		}
+		t.add(row...)
+	}
+	return a.printTable(t)
+}
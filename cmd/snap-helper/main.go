@@ -0,0 +1,258 @@
+// Command snap-helper runs the btrfs commands snap needs privileges for, so
+// that snap itself doesn't have to run as root. It's meant to be installed
+// setuid root and executable only by the group snap runs as:
+//
+//	install -o root -g snap -m 4750 snap-helper /usr/local/libexec/
+//
+// and configured as Helper in snap's configuration. Only the commands snap
+// runs are accepted. Those which modify anything must only touch storage
+// directories and subvolumes of profiles in the configuration, which is read
+// from /etc/snap/config.json and must only be writable by root. Paths are
+// passed on to btrfs as they were resolved when checked. btrfs send and
+// receive aren't accepted, since streams from and to the caller could read
+// any file in a snapshot or create setuid binaries; snap runs them only as
+// root.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	cfgPath  = "/etc/snap/config.json"
+	safePath = "/usr/sbin:/usr/bin:/sbin:/bin"
+)
+
+// config is the part of snap's configuration the helper needs.
+type config struct {
+	Profiles map[string]*struct {
+		Subvolume *string
+		Storage   *string
+	}
+}
+
+// roots holds what commands may touch: storage directories and their
+// contents, and subvolumes which snapshots are taken of.
+type roots struct {
+	storage    []string
+	subvolumes []string
+}
+
+func loadRoots() (*roots, error) {
+	f, err := os.Open(cfgPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var cfg config
+	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", cfgPath, err)
+	}
+	r := &roots{}
+	for _, p := range cfg.Profiles {
+		if p == nil {
+			continue
+		}
+		if p.Storage != nil {
+			if s, err := resolve(*p.Storage); err == nil {
+				r.storage = append(r.storage, s)
+			}
+		}
+		if p.Subvolume != nil {
+			if s, err := resolve(*p.Subvolume); err == nil {
+				r.subvolumes = append(r.subvolumes, s)
+			}
+		}
+	}
+	return r, nil
+}
+
+// resolve makes p absolute and free of symbolic links. The last element
+// needn't exist, since it may be about to be created.
+func resolve(p string) (string, error) {
+	if !filepath.IsAbs(p) {
+		return "", fmt.Errorf("%s: not an absolute path", p)
+	}
+	p = filepath.Clean(p)
+	if r, err := filepath.EvalSymlinks(p); err == nil {
+		return r, nil
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(p))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(p)), nil
+}
+
+// inStorage checks that p is inside one of the storage directories, and
+// returns it resolved.
+func (r *roots) inStorage(p string) (string, error) {
+	rp, err := resolve(p)
+	if err != nil {
+		return "", err
+	}
+	for _, s := range r.storage {
+		rel, err := filepath.Rel(s, rp)
+		if err == nil && rel != "." && rel != ".." &&
+			!strings.HasPrefix(rel, "../") {
+			return rp, nil
+		}
+	}
+	return "", fmt.Errorf("%s: not in storage of any profile", p)
+}
+
+// isStorage checks that p is one of the storage directories, or inside one,
+// and returns it resolved.
+func (r *roots) isStorage(p string) (string, error) {
+	rp, err := resolve(p)
+	if err != nil {
+		return "", err
+	}
+	for _, s := range r.storage {
+		if s == rp {
+			return rp, nil
+		}
+	}
+	return r.inStorage(p)
+}
+
+// isSubvolume checks that p is a subvolume snapshots are taken of, and
+// returns it resolved.
+func (r *roots) isSubvolume(p string) (string, error) {
+	rp, err := resolve(p)
+	if err != nil {
+		return "", err
+	}
+	for _, s := range r.subvolumes {
+		if s == rp {
+			return rp, nil
+		}
+	}
+	return "", fmt.Errorf("%s: not a subvolume of any profile", p)
+}
+
+// check validates the arguments of btrfs and returns them with paths
+// resolved, so that btrfs touches what was checked rather than what a
+// symbolic link swapped in meanwhile points to.
+func (r *roots) check(args []string) ([]string, error) {
+	is := func(prefix ...string) bool {
+		if len(args) < len(prefix) {
+			return false
+		}
+		for i, a := range prefix {
+			if args[i] != a {
+				return false
+			}
+		}
+		return true
+	}
+	args = append([]string(nil), args...)
+	// path replaces args[i] with it resolved by the given check.
+	path := func(i int, check func(string) (string, error)) error {
+		rp, err := check(args[i])
+		args[i] = rp
+		return err
+	}
+	last := len(args) - 1
+	var err error
+	switch {
+	case len(args) == 1 && is("--version"):
+	// Queries, which don't modify anything.
+	case len(args) == 3 && is("subvolume", "show"),
+		len(args) == 3 && is("subvolume", "sync"),
+		len(args) == 4 && is("qgroup", "show", "--raw"),
+		len(args) == 3 && is("inspect-internal", "rootid"),
+		len(args) == 3 && is("scrub", "status"),
+		len(args) == 4 && is("filesystem", "usage", "-b"):
+	case len(args) == 4 && is("subvolume", "snapshot"):
+		if err = path(2, r.isSubvolume); err == nil {
+			err = path(3, r.inStorage)
+		}
+	case len(args) == 5 && is("subvolume", "snapshot", "-r"):
+		if err = path(3, r.isSubvolume); err == nil {
+			err = path(4, r.inStorage)
+		}
+	case len(args) >= 3 && is("subvolume", "delete"):
+		i := 2
+		if args[i] == "--commit-after" || args[i] == "--commit-each" {
+			i++
+		}
+		if i > last {
+			return nil, notAllowed(args)
+		}
+		for ; i <= last && err == nil; i++ {
+			err = path(i, r.inStorage)
+		}
+	case len(args) == 3 && is("subvolume", "create"):
+		err = path(last, r.isStorage)
+	case len(args) == 5 && is("property", "set") &&
+		args[3] == "compression":
+		switch args[last] {
+		case "zlib", "lzo", "zstd", "none":
+			err = path(2, r.isStorage)
+		default:
+			return nil, notAllowed(args)
+		}
+	case len(args) == 4 && is("scrub", "start", "-B"):
+		err = path(last, r.inStorage)
+	case len(args) == 7 && is("property", "set", "-t", "subvol") &&
+		args[5] == "ro" && (args[last] == "true" || args[last] == "false"):
+		err = path(4, r.inStorage)
+	case len(args) == 4 && is("balance", "start") &&
+		strings.HasPrefix(args[2], "-dusage="):
+		if _, err := strconv.Atoi(args[2][len("-dusage="):]); err != nil {
+			return nil, fmt.Errorf("invalid balance filter %q", args[2])
+		}
+		err = path(last, r.inStorage)
+	default:
+		return nil, notAllowed(args)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+func notAllowed(args []string) error {
+	return fmt.Errorf("command not allowed: btrfs %s",
+		strings.Join(args, " "))
+}
+
+func run() error {
+	if len(os.Args) < 2 {
+		return fmt.Errorf("usage: snap-helper btrfs-arguments...")
+	}
+	r, err := loadRoots()
+	if err != nil {
+		return err
+	}
+	args, err := r.check(os.Args[1:])
+	if err != nil {
+		return err
+	}
+	// Become root for real, as btrfs may check the real user.
+	if err := syscall.Setuid(0); err != nil {
+		return err
+	}
+	os.Setenv("PATH", safePath)
+	btrfs, err := exec.LookPath("btrfs")
+	if err != nil {
+		return err
+	}
+	env := []string{"PATH=" + safePath}
+	return syscall.Exec(btrfs, append([]string{"btrfs"}, args...), env)
+}
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "snap-helper: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	storage := filepath.Join(dir, "storage")
+	subvol := filepath.Join(dir, "home")
+	for _, d := range []string{storage, subvol} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(storage, link); err != nil {
+		t.Fatal(err)
+	}
+	r := &roots{storage: []string{storage}, subvolumes: []string{subvol}}
+	snap := filepath.Join(storage, "1")
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"--version"}, []string{"--version"}},
+		{[]string{"subvolume", "snapshot", "-r", subvol, snap},
+			[]string{"subvolume", "snapshot", "-r", subvol, snap}},
+		{[]string{"subvolume", "delete", "--commit-each",
+			filepath.Join(link, "1")},
+			[]string{"subvolume", "delete", "--commit-each", snap}},
+		{[]string{"subvolume", "delete", filepath.Join(dir, "x")}, nil},
+		{[]string{"subvolume", "delete", "--commit-after"}, nil},
+		{[]string{"subvolume", "snapshot", "-r", storage, snap}, nil},
+		{[]string{"receive", storage}, nil},
+		{[]string{"receive", snap}, nil},
+		{[]string{"send", "-q", snap}, nil},
+		{[]string{"property", "set", storage, "compression", "zstd"},
+			[]string{"property", "set", storage, "compression", "zstd"}},
+		{[]string{"property", "set", storage, "compression", "x"}, nil},
+	}
+	for _, tt := range tests {
+		got, err := r.check(tt.args)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("check(%q) allowed", tt.args)
+			}
+		} else if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("check(%q) = %q, %v, want %q", tt.args, got,
+				err, tt.want)
+		}
+	}
+}
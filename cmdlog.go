@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLogMaxOutput = 64 << 10
+	defaultLogMaxSize   = 10 << 20
+)
+
+// commandLog is where commands run by snap are logged with their output, so
+// that failures can be looked into even though errors only carry the first
+// line of the standard error output. A nil commandLog logs nothing.
+type commandLog struct {
+	mu        sync.Mutex
+	file      string
+	maxOutput int64
+	maxSize   int64
+	failed    bool
+}
+
+func newCommandLog(cfg *logJSON) *commandLog {
+	l := &commandLog{
+		file:      *cfg.File,
+		maxOutput: defaultLogMaxOutput,
+		maxSize:   defaultLogMaxSize,
+	}
+	if cfg.MaxOutput != nil {
+		l.maxOutput, _ = parseSize(*cfg.MaxOutput)
+	}
+	if cfg.MaxSize != nil {
+		l.maxSize, _ = parseSize(*cfg.MaxSize)
+	}
+	return l
+}
+
+// cmdRun is a command run by snap, which is logged and traced once it
+// finishes. In-process stages of pipelines have no argv, just a name.
+type cmdRun struct {
+	host  string
+	argv  []string
+	line  string // argv as run on host
+	name  string
+	start time.Time
+}
+
+func (a *app) started(host string, argv []string) *cmdRun {
+	r := &cmdRun{host: host, argv: argv, start: time.Now()}
+	if argv != nil {
+		r.line = argvString(a.sshArgv(host, argv...))
+	}
+	return r
+}
+
+// capture returns a writer which keeps the standard output of a command for
+// the command log and counts it for the trace, and passes it on to w unless
+// it's nil. The returned buffer is nil if neither is enabled.
+func (a *app) capture(w io.Writer) (io.Writer, *cappedBuffer) {
+	if a.log == nil && a.trace == nil {
+		return w, nil
+	}
+	b := &cappedBuffer{}
+	if a.log != nil {
+		b.max = a.log.maxOutput
+	}
+	if w == nil {
+		return b, b
+	}
+	return io.MultiWriter(w, b), b
+}
+
+// finished logs and traces r, which finished with err.
+func (a *app) finished(r *cmdRun, err error, stdout *cappedBuffer, stderr []byte) {
+	a.log.record(r, err, stdout, stderr)
+	if a.trace != nil {
+		var n *int64
+		if stdout != nil {
+			total := int64(stdout.buf.Len()) + stdout.dropped
+			n = &total
+		}
+		a.trace.record(r, err, n)
+	}
+	a.telemetry.command(r, err)
+}
+
+// record logs that r finished with err. stdout is nil unless snap captured
+// the standard output.
+func (l *commandLog) record(r *cmdRun, err error, stdout *cappedBuffer, stderr []byte) {
+	if l == nil {
+		return
+	}
+	var b bytes.Buffer
+	status := "ok"
+	if err != nil {
+		status = err.Error()
+	}
+	fmt.Fprintf(&b, "%s %s: %s\n", time.Now().Format(time.RFC3339), r.line,
+		status)
+	errBuf := &cappedBuffer{max: l.maxOutput}
+	errBuf.Write(stderr)
+	errBuf.writeTo(&b, "stderr")
+	stdout.writeTo(&b, "stdout")
+	l.write(b.Bytes())
+}
+
+func (l *commandLog) write(entry []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.failed {
+		return
+	}
+	if fi, err := os.Stat(l.file); err == nil && fi.Size() >= l.maxSize {
+		os.Rename(l.file, l.file+".1")
+	}
+	f, err := os.OpenFile(l.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err == nil {
+		_, err = f.Write(entry)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: cannot write command log, "+
+			"not logging commands: %v\n", err)
+		l.failed = true
+	}
+}
+
+// cappedBuffer keeps the first max bytes written to it and counts the rest.
+type cappedBuffer struct {
+	buf     bytes.Buffer
+	max     int64
+	dropped int64
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := b.max - int64(b.buf.Len()); int64(n) > room {
+		b.dropped += int64(n) - room
+		p = p[:room]
+	}
+	b.buf.Write(p)
+	return n, nil
+}
+
+// writeTo writes the indented contents of b to w, if there are any, under
+// the given heading.
+func (b *cappedBuffer) writeTo(w io.Writer, heading string) {
+	if b == nil || b.buf.Len() == 0 && b.dropped == 0 {
+		return
+	}
+	fmt.Fprintf(w, "  %s:\n", heading)
+	for _, line := range strings.SplitAfter(b.buf.String(), "\n") {
+		if line != "" {
+			fmt.Fprintf(w, "\t%s", line)
+		}
+	}
+	if !strings.HasSuffix(b.buf.String(), "\n") {
+		fmt.Fprintln(w)
+	}
+	if b.dropped > 0 {
+		fmt.Fprintf(w, "  (%s more not logged)\n",
+			formatBytes(uint64(b.dropped)))
+	}
+}
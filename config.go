@@ -1,22 +1,46 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
+	"io/ioutil"
+	"math"
+	"net"
+	"path"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/dcepelik/snap/humanize"
 )
 
-const day = 24 * time.Hour
-const week = 7 * day
-const month = 30 * day
-const year = 365 * day
+const day = humanize.Day
+const week = humanize.Week
+const month = humanize.Month
+const year = humanize.Year
 
 type ProfileName = string
 
 type BucketInterval time.Duration
 
+// intervalUnits are the units of intervals in the configuration.
+var intervalUnits = map[byte]time.Duration{
+	's': time.Second,
+	'm': time.Minute,
+	'h': time.Hour,
+	'd': day,
+	'w': week,
+	'M': month,
+	'y': year,
+}
+
+// UnmarshalText parses intervals such as "90m", or compound ones such as
+// "1d12h", in intervalUnits. Anything else is parsed as a Go duration, such
+// as "1.5h".
 func (d *BucketInterval) UnmarshalText(text []byte) (err error) {
 	s := string(text)
 	defer func() {
@@ -27,89 +51,964 @@ func (d *BucketInterval) UnmarshalText(text []byte) (err error) {
 	if len(s) == 0 {
 		return fmt.Errorf("cannot be blank")
 	}
-	l := len(s) - 1
-	ns, unit := s[0:l], s[l]
-	n, err := strconv.Atoi(ns)
+	if v, ok, err := parseCompound(s); ok {
+		*d = v
+		return err
+	}
+	v, err := time.ParseDuration(s)
 	if err != nil {
-		return
-	}
-	nd := time.Duration(n)
-	switch unit {
-	case 's':
-		*d = BucketInterval(nd * time.Second)
-	case 'm':
-		*d = BucketInterval(nd * time.Minute)
-	case 'h':
-		*d = BucketInterval(nd * time.Hour)
-	case 'd':
-		*d = BucketInterval(nd * day)
-	case 'w':
-		*d = BucketInterval(nd * week)
-	case 'M':
-		*d = BucketInterval(nd * month)
-	case 'y':
-		*d = BucketInterval(nd * year)
-	default:
-		return fmt.Errorf("invalid unit: %q", unit)
-	}
-	return
+		return fmt.Errorf("neither numbers followed by units " +
+			"s, m, h, d, w, M or y nor a Go duration")
+	}
+	*d = BucketInterval(v)
+	return nil
+}
+
+// parseCompound parses s made of numbers each followed by one of
+// intervalUnits. If s isn't of that form, it returns false.
+func parseCompound(s string) (BucketInterval, bool, error) {
+	var total time.Duration
+	for len(s) > 0 {
+		i := 0
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		if i == 0 || i == len(s) {
+			return 0, false, nil
+		}
+		unit, ok := intervalUnits[s[i]]
+		if !ok {
+			return 0, false, nil
+		}
+		n, err := strconv.ParseInt(s[:i], 10, 64)
+		if err != nil || n > int64(math.MaxInt64/unit) ||
+			total > math.MaxInt64-time.Duration(n)*unit {
+			return 0, true, fmt.Errorf("too long")
+		}
+		total += time.Duration(n) * unit
+		s = s[i+1:]
+	}
+	return BucketInterval(total), true, nil
 }
 
 type configJSON struct {
-	Profiles map[ProfileName]*profileJSON
+	Version    *int
+	StateDir   *string
+	Helper     *string
+	Server     *serverJSON
+	SSH        *sshJSON
+	Log        *logJSON
+	Telemetry  *telemetryJSON
+	Events     *eventsJSON
+	PullConfig *pullConfigJSON
+	Serial     *int64
+	Expires    *time.Time
+	Groups     map[string][]ProfileName
+	Profiles   map[ProfileName]*profileJSON
+}
+
+// serverJSON configures snap serve. If Token is set, clients must present it
+// as a bearer token. Without one, snap serve only Listens on loopback
+// addresses and only lists profiles and snapshots. If DBus is set, snap
+// serve also provides its interface on the system bus. If TLSCert and TLSKey
+// are set, it serves HTTPS.
+type serverJSON struct {
+	Listen    *string
+	Token     *secret
+	DBus      bool
+	TLSCert   *string
+	TLSKey    *string
+	Dashboard *dashboardJSON
+	Webhooks  map[string]*webhookJSON
+}
+
+// dashboardJSON enables the web dashboard of snap serve, which is protected
+// by basic authentication as User with Password.
+type dashboardJSON struct {
+	User     *string
+	Password *secret
+}
+
+// webhookJSON lets other systems run Operation, create by default, on
+// Profile through snap serve. Callers present Token, either as a bearer token
+// or in the token query parameter, or sign request bodies with Secret the way
+// GitHub signs its webhooks.
+type webhookJSON struct {
+	Profile   *ProfileName
+	Operation *string
+	Token     *secret
+	Secret    *secret
+}
+
+func (c *serverJSON) validate(profiles map[ProfileName]*profileJSON) error {
+	if (c.TLSCert == nil) != (c.TLSKey == nil) {
+		return fmt.Errorf("TLSCert and TLSKey must be set together")
+	}
+	if c.Listen != nil && c.Token == nil && !loopback(*c.Listen) {
+		return fmt.Errorf("Token must be set to Listen on %s, which "+
+			"isn't a loopback address", *c.Listen)
+	}
+	if d := c.Dashboard; d != nil && (d.User == nil || d.Password == nil) {
+		return fmt.Errorf("Dashboard: User and Password must be set")
+	}
+	for name, h := range c.Webhooks {
+		if err := h.validate(profiles); err != nil {
+			return fmt.Errorf("Webhooks: %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (h *webhookJSON) validate(profiles map[ProfileName]*profileJSON) error {
+	if h == nil {
+		return fmt.Errorf("must be an object")
+	}
+	if h.Profile == nil {
+		return fmt.Errorf("Profile must be set")
+	}
+	if _, ok := profiles[*h.Profile]; !ok {
+		return fmt.Errorf("Profile: no profile named %q", *h.Profile)
+	}
+	if h.Operation != nil && !apiOperations[*h.Operation] {
+		return fmt.Errorf("Operation: must be create, backup, prune " +
+			"or maintain")
+	}
+	if (h.Token == nil) == (h.Secret == nil) {
+		return fmt.Errorf("exactly one of Token and Secret must be set")
+	}
+	return nil
+}
+
+// sshJSON configures how commands are run on remote hosts. If Native is set,
+// the built-in SSH client is used instead of spawning ssh for each command.
+// It authenticates using ssh-agent and IdentityFiles (by default the usual
+// keys in ~/.ssh), which may be protected by Passphrase, and verifies hosts
+// against KnownHosts (by default ~/.ssh/known_hosts and
+// /etc/ssh/ssh_known_hosts). Otherwise, Transport replaces the ssh command
+// for setups such as jump hosts or network namespaces: {host} in its
+// arguments is replaced by the host and {command} by the remote command, as
+// in ["ip", "netns", "exec", "vpn", "ssh", "{host}", "--", "{command}"].
+// Rsync copies still use ssh.
+type sshJSON struct {
+	Native        bool
+	IdentityFiles []string
+	Passphrase    *secret
+	KnownHosts    []string
+	Transport     []string
+}
+
+func (s *sshJSON) validate() error {
+	if len(s.Transport) == 0 {
+		return nil
+	}
+	if s.Native {
+		return fmt.Errorf("Transport can't be used with Native")
+	}
+	for _, arg := range s.Transport {
+		if strings.Contains(arg, "{command}") {
+			return nil
+		}
+	}
+	return fmt.Errorf("Transport: {command} is missing")
+}
+
+// logJSON makes snap log every command it runs to File, along with its
+// complete standard error output, and its standard output if snap reads it.
+// At most MaxOutput (64K by default) of each is kept. Once File grows beyond
+// MaxSize (10M by default), it's moved to File.1, replacing the older log.
+type logJSON struct {
+	File      *string
+	MaxOutput *string
+	MaxSize   *string
+}
+
+func (l *logJSON) validate() error {
+	if l.File == nil {
+		return fmt.Errorf("File is missing")
+	}
+	if !path.IsAbs(*l.File) {
+		return fmt.Errorf("File: must be an absolute path")
+	}
+	if l.MaxOutput != nil {
+		if _, err := parseSize(*l.MaxOutput); err != nil {
+			return fmt.Errorf("MaxOutput: %w", err)
+		}
+	}
+	if l.MaxSize != nil {
+		if _, err := parseSize(*l.MaxSize); err != nil {
+			return fmt.Errorf("MaxSize: %w", err)
+		}
+	}
+	return nil
 }
 
 func (c *configJSON) validate() error {
+	if c.Helper != nil && !path.IsAbs(*c.Helper) {
+		return fmt.Errorf("Helper: must be an absolute path")
+	}
+	if c.SSH != nil {
+		if err := c.SSH.validate(); err != nil {
+			return fmt.Errorf("SSH: %w", err)
+		}
+	}
+	if c.Log != nil {
+		if err := c.Log.validate(); err != nil {
+			return fmt.Errorf("Log: %w", err)
+		}
+	}
+	if c.Telemetry != nil {
+		if err := c.Telemetry.validate(); err != nil {
+			return fmt.Errorf("Telemetry: %w", err)
+		}
+	}
+	if c.Events != nil {
+		if err := c.Events.validate(); err != nil {
+			return fmt.Errorf("Events: %w", err)
+		}
+	}
+	if c.PullConfig != nil {
+		if err := c.PullConfig.validate(); err != nil {
+			return fmt.Errorf("PullConfig: %w", err)
+		}
+	}
+	if c.Serial != nil && *c.Serial < 1 {
+		return fmt.Errorf("Serial: must be a positive integer")
+	}
+	if c.Server != nil {
+		if err := c.Server.validate(c.Profiles); err != nil {
+			return fmt.Errorf("Server: %w", err)
+		}
+	}
 	for name, p := range c.Profiles {
+		if p == nil {
+			return fmt.Errorf("profile %q: must be an object", name)
+		}
+		p.name = name
 		if err := p.validate(); err != nil {
 			return fmt.Errorf("profile %q: %w", name, err)
 		}
+		if c.Helper != nil && p.Enter != nil {
+			return fmt.Errorf("profile %q: Enter can't be used "+
+				"with Helper", name)
+		}
+	}
+	for name, p := range c.Profiles {
+		if err := c.validateSource(p); err != nil {
+			return fmt.Errorf("profile %q: %w", name, err)
+		}
+		if p.RequireBackupBeforePrune && len(c.destinations(p)) == 0 {
+			return fmt.Errorf("profile %q: RequireBackupBeforePrune "+
+				"needs a profile with it as Source", name)
+		}
+	}
+	return c.validateGroups()
+}
+
+// validateSource checks that the chain of profiles whose snapshots p backs up
+// leads to a profile which takes them.
+func (c *configJSON) validateSource(p *profileJSON) error {
+	seen := map[ProfileName]bool{p.name: true}
+	for p.Source != nil {
+		src, ok := c.Profiles[*p.Source]
+		if !ok {
+			return fmt.Errorf("Source: no profile named %q", *p.Source)
+		}
+		if src.hasVolumes() {
+			return fmt.Errorf("Source: backing up snapshots of "+
+				"Containers or PVCs profile %q isn't supported",
+				src.name)
+		}
+		if seen[src.name] {
+			return fmt.Errorf("Source: profile %q backs up itself",
+				src.name)
+		}
+		seen[src.name] = true
+		p = src
 	}
 	return nil
 }
 
+// Snapshot layouts. In the nested one, snapshots are created as subvolumes
+// <storage>/<timestamp>/snapshot, in the flat one as <storage>/<timestamp>,
+// which is what other tools usually expect. Layouts can be mixed in one
+// storage directory.
+const (
+	layoutNested = "nested"
+	layoutFlat   = "flat"
+)
+
+// profileJSON describes a profile. Profiles of the source kind take snapshots
+// of Subvolume, profiles of the backup kind keep copies of snapshots taken by
+// the Source profile, or by a profile of another machine if they Pull them.
+// Profiles with Containers take snapshots of container volumes instead of
+// Subvolume, those with PVCs of volumes of Kubernetes persistent volume
+// claims. Either kind keeps its snapshots in Storage. Backups are received by
+// btrfs receive, or copied into plain directories by rsync if Rsync is set,
+// for storage which isn't on Btrfs. If Trash is set, pruned snapshots are only
+// deleted after they've been in the trash that long. Applications with data in
+// Subvolume are quiesced while snapshots are taken according to Quiesce. If
+// Manifests is set, files of new snapshots are summed in the background, see
+// manifestDir. SkipIdle skips scheduled snapshots while Subvolume doesn't
+// change, see idle. MinKeep is how many of the newest snapshots
+// --emergency-free never deletes. Storage is created as NewStorage says if
+// it's missing. Recursion tells what to do when Storage is inside Subvolume,
+// so that snapshots would contain older ones: warn about it (the default),
+// refuse to create snapshots, carve Storage out into its own subvolume while
+// it's empty, or filter it out of each snapshot. MaxAge is how old the newest
+// snapshot may get before snap serve reports the profile unhealthy, whereas
+// MaxSnapshots and MaxSnapshotAge limit how many snapshots are kept and for
+// how long, except those pending a backup, see enforceLimits. Backups
+// quarantine snapshots which fail to transfer QuarantineAfter times, see
+// transferFailures. Profiles with KeepUntilBackedUp don't prune snapshots
+// until all profiles with them as Source have copies, see backedUp, and those
+// with RequireBackupBeforePrune check that they do, see requireBackups.
+// Backups with RequireAC or AvoidMetered wait for AC power or an unmetered
+// connection, see mayBackUp. Env sets environment variables, such as
+// SSH_AUTH_SOCK, for commands run locally for the profile, including hooks and
+// ssh, but not the built-in SSH client. Hooks run once snapshots are created,
+// see hooksJSON. Watch configures --watch, see watchJSON. Exclude leaves files
+// out of --list-files and --find, see excludes. After and Requires order
+// profiles run as a group, see runGroup. Profiles from the configuration of
+// the user running snap are marked as user's, see addUserConfig.
 type profileJSON struct {
-	Subvolume *string
-	Storage   *string
-	Buckets   []*bucketJSON
+	name   ProfileName
+	pause  *containerPause
+	labels map[string]string
+	user   bool
+
+	Subvolume                *string
+	Containers               *containersJSON
+	PVCs                     *pvcsJSON
+	Source                   *ProfileName
+	Pull                     *pullJSON
+	Storage                  *string
+	NewStorage               *newStorageJSON
+	PerHost                  bool
+	Layout                   *string
+	ClockSkew                *string
+	Buffer                   *bufferJSON
+	Rsync                    *rsyncJSON
+	QuarantineAfter          *int
+	KeepUntilBackedUp        bool
+	RequireBackupBeforePrune bool
+	RequireAC                bool
+	AvoidMetered             bool
+	PreConnect               *preConnectJSON
+	Maintain                 *maintainJSON
+	Export                   *exportJSON
+	Manifests                bool
+	SkipIdle                 bool
+	Quiesce                  *quiesceJSON
+	Enter                    *enterJSON
+	Env                      map[string]*secret
+	Hooks                    *hooksJSON
+	Watch                    *watchJSON
+	Exclude                  []string
+	After                    []ProfileName
+	Requires                 []ProfileName
+	Trash                    *BucketInterval
+	MinKeep                  *int
+	MaxAge                   *BucketInterval
+	MaxSnapshots             *int
+	MaxSnapshotAge           *BucketInterval
+	Recursion                *string
+	Buckets                  []*bucketJSON
+}
+
+// isBackup tells whether p is a backup profile.
+func (p *profileJSON) isBackup() bool {
+	return p.Subvolume == nil && !p.hasVolumes()
+}
+
+// hasVolumes tells whether p takes snapshots of volumes it discovers,
+// see volumeProfiles.
+func (p *profileJSON) hasVolumes() bool {
+	return p.Containers != nil || p.PVCs != nil
 }
 
 func (p *profileJSON) validate() error {
-	if p.Subvolume == nil {
-		return fmt.Errorf("profile %q: Subvolume missing")
+	kinds := 0
+	for _, set := range []bool{p.Subvolume != nil, p.Containers != nil,
+		p.PVCs != nil} {
+		if set {
+			kinds++
+		}
+	}
+	switch {
+	case kinds > 1:
+		return fmt.Errorf("Subvolume, Containers and PVCs cannot be " +
+			"combined, snapshots are taken of one of them")
+	case !p.isBackup() && (p.Source != nil || p.Pull != nil):
+		return fmt.Errorf("Subvolume, Containers or PVCs cannot be " +
+			"combined with Source or Pull, snapshots are either " +
+			"taken or backed up")
+	case p.isBackup() && p.Source == nil && p.Pull == nil:
+		return fmt.Errorf("Subvolume, Containers or PVCs (to take " +
+			"snapshots) or Source or Pull (to back them up) missing")
+	case p.Source != nil && p.Pull != nil:
+		return fmt.Errorf("Source and Pull cannot be combined, " +
+			"snapshots are backed up from one place")
+	case p.Pull != nil && p.PerHost:
+		return fmt.Errorf("Pull cannot be combined with PerHost, " +
+			"which keeps snapshots under the name of this machine, " +
+			"give each pulled host its own Storage instead")
+	}
+	if p.Storage == nil {
+		return fmt.Errorf("Storage missing")
+	}
+	if err := validateEnv(p.Env); err != nil {
+		return err
+	}
+	if err := validateExcludes(p.Exclude); err != nil {
+		return fmt.Errorf("Exclude: %w", err)
 	}
+	if p.Hooks != nil {
+		if p.isBackup() {
+			return fmt.Errorf("Hooks only apply to profiles which " +
+				"take snapshots")
+		}
+		if err := p.Hooks.validate(); err != nil {
+			return fmt.Errorf("Hooks: %w", err)
+		}
+	}
+	if p.isBackup() {
+		if p.Layout != nil {
+			return fmt.Errorf("Layout only applies to profiles " +
+				"which take snapshots, backups keep the layout " +
+				"of their source")
+		}
+		if p.Quiesce != nil {
+			return fmt.Errorf("Quiesce only applies to profiles " +
+				"which take snapshots")
+		}
+		if p.Recursion != nil {
+			return fmt.Errorf("Recursion only applies to profiles " +
+				"which take snapshots")
+		}
+		if p.MaxSnapshots != nil || p.MaxSnapshotAge != nil {
+			return fmt.Errorf("MaxSnapshots and MaxSnapshotAge only " +
+				"apply to profiles which take snapshots")
+		}
+	} else {
+		if p.Buffer != nil {
+			return fmt.Errorf("Buffer only applies to backup profiles")
+		}
+		if p.ClockSkew != nil {
+			return fmt.Errorf("ClockSkew only applies to backup " +
+				"profiles")
+		}
+		if p.Rsync != nil {
+			return fmt.Errorf("Rsync only applies to backup profiles")
+		}
+		if p.QuarantineAfter != nil {
+			return fmt.Errorf("QuarantineAfter only applies to " +
+				"backup profiles")
+		}
+		if p.RequireAC || p.AvoidMetered {
+			return fmt.Errorf("RequireAC and AvoidMetered only " +
+				"apply to backup profiles")
+		}
+	}
+	if p.Pull != nil {
+		if err := p.Pull.validate(); err != nil {
+			return fmt.Errorf("Pull: %w", err)
+		}
+	}
+	if p.PVCs != nil {
+		if err := p.PVCs.validate(); err != nil {
+			return fmt.Errorf("PVCs: %w", err)
+		}
+	}
+	if p.Watch != nil {
+		if p.Subvolume == nil {
+			return fmt.Errorf("Watch only applies to profiles with " +
+				"Subvolume")
+		}
+		if err := p.Watch.validate(); err != nil {
+			return fmt.Errorf("Watch: %w", err)
+		}
+	}
+	if p.SkipIdle && p.Subvolume == nil {
+		return fmt.Errorf("SkipIdle only applies to profiles with " +
+			"Subvolume")
+	}
+	if p.Enter != nil && p.Subvolume == nil {
+		return fmt.Errorf("Enter only applies to profiles with Subvolume")
+	}
+	if p.Rsync != nil && p.Buffer != nil {
+		return fmt.Errorf("Buffer cannot be combined with Rsync, " +
+			"rsync doesn't send a stream")
+	}
+	if p.Rsync != nil && p.Trash != nil {
+		return fmt.Errorf("Trash cannot be combined with Rsync")
+	}
+	if p.Buffer != nil {
+		if err := p.Buffer.validate(); err != nil {
+			return fmt.Errorf("Buffer: %w", err)
+		}
+	}
+	if p.Layout != nil && *p.Layout != layoutNested &&
+		*p.Layout != layoutFlat {
+		return fmt.Errorf("Layout must be %q or %q", layoutNested,
+			layoutFlat)
+	}
+	if p.Recursion != nil && !validRecursion(*p.Recursion) {
+		return fmt.Errorf("Recursion must be one of %s, %s, %s or %s",
+			recursionWarn, recursionRefuse, recursionCarve,
+			recursionFilter)
+	}
+	if p.MinKeep != nil && *p.MinKeep < 0 {
+		return fmt.Errorf("MinKeep must not be negative")
+	}
+	if p.QuarantineAfter != nil && *p.QuarantineAfter < 0 {
+		return fmt.Errorf("QuarantineAfter must not be negative")
+	}
+	if p.MaxSnapshots != nil && *p.MaxSnapshots < 1 {
+		return fmt.Errorf("MaxSnapshots must be at least 1")
+	}
+	if p.MaxSnapshotAge != nil && *p.MaxSnapshotAge <= 0 {
+		return fmt.Errorf("MaxSnapshotAge must be positive")
+	}
+	if p.MaxAge != nil && *p.MaxAge <= 0 {
+		return fmt.Errorf("MaxAge must be positive")
+	}
+	if p.ClockSkew != nil {
+		if _, err := time.ParseDuration(*p.ClockSkew); err != nil {
+			return fmt.Errorf("ClockSkew: %w", err)
+		}
+	}
+	if p.NewStorage != nil {
+		if err := p.NewStorage.validate(); err != nil {
+			return fmt.Errorf("NewStorage: %w", err)
+		}
+	}
+	if p.Maintain != nil {
+		if err := p.Maintain.validate(); err != nil {
+			return fmt.Errorf("Maintain: %w", err)
+		}
+	}
+	if p.Quiesce != nil {
+		if err := p.Quiesce.validate(); err != nil {
+			return fmt.Errorf("Quiesce: %w", err)
+		}
+	}
+	if p.Export != nil {
+		if err := p.Export.validate(); err != nil {
+			return fmt.Errorf("Export: %w", err)
+		}
+	}
+	if p.PreConnect != nil {
+		if err := p.PreConnect.validate(p); err != nil {
+			return fmt.Errorf("PreConnect: %w", err)
+		}
+	}
+	// Snapshots move from bucket to bucket of the same Reason, each of
+	// which should keep them farther apart than the one before.
+	last := make(map[string]BucketInterval)
 	for i, b := range p.Buckets {
+		l := len(p.Buckets)
 		if err := b.validate(); err != nil {
-			l := len(p.Buckets)
 			return fmt.Errorf("bucket #%d/%d: %w", i+1, l, err)
 		}
+		var r string
+		if b.Reason != nil {
+			r = *b.Reason
+		}
+		if prev, ok := last[r]; ok && *b.Interval < prev {
+			return fmt.Errorf("bucket #%d/%d: Interval %s is shorter "+
+				"than %s of the bucket before it", i+1, l,
+				formatInterval(time.Duration(*b.Interval)),
+				formatInterval(time.Duration(prev)))
+		}
+		last[r] = *b.Interval
+	}
+	return nil
+}
+
+// pullJSON describes where a backup profile pulls snapshots from when they
+// are not stored on the local machine.
+type pullJSON struct {
+	Host    *string
+	Storage *string
+}
+
+func (p *pullJSON) validate() error {
+	if p.Host == nil {
+		return fmt.Errorf("Host missing")
+	}
+	if p.Storage == nil {
+		return fmt.Errorf("Storage missing")
+	}
+	return nil
+}
+
+// rsyncJSON configures copying of snapshots by rsync. Args are passed to
+// rsync in addition to those snap uses, which preserve hard links and owners
+// but not ACLs or extended attributes, say.
+type rsyncJSON struct {
+	Args []string
+}
+
+// bufferJSON configures buffering of streams between btrfs send and receive,
+// which smooths out bursty IO over slow links. Either an external Command
+// such as mbuffer is run, or up to Size bytes are buffered in memory.
+type bufferJSON struct {
+	Command []string
+	Size    *string
+}
+
+func (b *bufferJSON) validate() error {
+	if (len(b.Command) > 0) == (b.Size != nil) {
+		return fmt.Errorf("exactly one of Command and Size must be given")
+	}
+	if b.Size != nil {
+		if _, err := parseSize(*b.Size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// preConnectJSON prepares storage which isn't always available before the
+// profile is worked with: a machine which sleeps between backups is woken
+// up, an encrypted disk is unlocked and mounted. Afterwards, whatever was
+// done is undone and the disk may be spun down.
+type preConnectJSON struct {
+	WakeOnLAN *wakeJSON
+	Unlock    *unlockJSON
+	Mount     *string
+	SpinDown  *string
+}
+
+func (c *preConnectJSON) validate(p *profileJSON) error {
+	if c.WakeOnLAN != nil {
+		if err := c.WakeOnLAN.validate(); err != nil {
+			return fmt.Errorf("WakeOnLAN: %w", err)
+		}
+		if c.WakeOnLAN.Wait == nil && p.Pull == nil {
+			return fmt.Errorf("WakeOnLAN: Wait missing")
+		}
+	}
+	if c.Unlock != nil {
+		if err := c.Unlock.validate(); err != nil {
+			return fmt.Errorf("Unlock: %w", err)
+		}
+	}
+	return nil
+}
+
+// wakeJSON wakes up a machine by sending a magic packet for MAC to the
+// Broadcast address and waits until Wait accepts TCP connections, by
+// default the SSH port of the host snapshots are pulled from.
+type wakeJSON struct {
+	MAC       *string
+	Broadcast *string
+	Wait      *string
+	Timeout   *string
+}
+
+func (w *wakeJSON) validate() error {
+	if w.MAC == nil {
+		return fmt.Errorf("MAC missing")
+	}
+	if _, err := net.ParseMAC(*w.MAC); err != nil {
+		return err
+	}
+	if w.Timeout != nil {
+		if _, err := time.ParseDuration(*w.Timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unlockJSON opens LUKS Device as /dev/mapper/Name using KeyFile.
+type unlockJSON struct {
+	Device  *string
+	Name    *string
+	KeyFile *string
+}
+
+func (u *unlockJSON) validate() error {
+	if u.Device == nil {
+		return fmt.Errorf("Device missing")
+	}
+	if u.Name == nil {
+		return fmt.Errorf("Name missing")
+	}
+	if u.KeyFile == nil {
+		return fmt.Errorf("KeyFile missing")
+	}
+	return nil
+}
+
+// newStorageJSON tells how to create the storage directory of a profile
+// when it doesn't exist: with permissions Mode (octal, such as "0750"),
+// owned by Owner and Group, and as a subvolume rather than a directory if
+// Subvolume is set. Data received into it is compressed by Compression (such
+// as "zstd"), or not copied on write if NoCOW is set.
+type newStorageJSON struct {
+	Mode        *string
+	Owner       *string
+	Group       *string
+	Subvolume   bool
+	Compression *string
+	NoCOW       bool
+}
+
+func (c *newStorageJSON) validate() error {
+	if c.Mode != nil {
+		if _, err := strconv.ParseUint(*c.Mode, 8, 32); err != nil {
+			return fmt.Errorf("Mode must be an octal number")
+		}
+	}
+	if c.Compression != nil {
+		switch *c.Compression {
+		case "zlib", "lzo", "zstd", "none":
+		default:
+			return fmt.Errorf("Compression must be zlib, lzo, zstd " +
+				"or none")
+		}
+		if c.NoCOW {
+			return fmt.Errorf("Compression and NoCOW cannot be " +
+				"combined, data which isn't copied on write " +
+				"isn't compressed")
+		}
+	}
+	return nil
+}
+
+// maintainJSON configures maintenance of the filesystem which holds the
+// profile's storage: it's scrubbed every ScrubInterval and data chunks less
+// than BalanceUsage percent full are balanced when allocation gets skewed.
+type maintainJSON struct {
+	ScrubInterval *BucketInterval
+	BalanceUsage  *int
+}
+
+func (m *maintainJSON) validate() error {
+	if m.BalanceUsage != nil && (*m.BalanceUsage < 0 || *m.BalanceUsage > 100) {
+		return fmt.Errorf("BalanceUsage must be between 0 and 100")
+	}
+	return nil
+}
+
+// exportJSON configures repositories of restic and borg which snapshots are
+// exported into by --export-to, as another, off-site tier of backups.
+type exportJSON struct {
+	Restic *repoJSON
+	Borg   *repoJSON
+}
+
+func (e *exportJSON) validate() error {
+	if e.Restic != nil {
+		if err := e.Restic.validate(); err != nil {
+			return fmt.Errorf("Restic: %w", err)
+		}
+	}
+	if e.Borg != nil {
+		if err := e.Borg.validate(); err != nil {
+			return fmt.Errorf("Borg: %w", err)
+		}
 	}
 	return nil
 }
 
+// repoJSON describes a repository. Args are passed to the command which
+// creates backups, Env is added to its environment, which is where restic
+// and borg take passwords from, such as RESTIC_PASSWORD.
+type repoJSON struct {
+	Repository *string
+	Args       []string
+	Env        map[string]*secret
+}
+
+func (r *repoJSON) validate() error {
+	if r.Repository == nil {
+		return fmt.Errorf("Repository missing")
+	}
+	for k, v := range r.Env {
+		if v == nil {
+			return fmt.Errorf("Env: %s must be set", k)
+		}
+	}
+	return nil
+}
+
+// containersJSON selects container volumes to take snapshots of: all local
+// volumes on Btrfs subvolumes known to the Docker or Podman API listening on
+// Socket, or just those listed in Volumes. If Pause is set, running containers
+// which use a volume are paused while its snapshot is taken.
+type containersJSON struct {
+	Socket  *string
+	Volumes []string
+	Pause   bool
+}
+
+// pvcsJSON selects volumes of Kubernetes persistent volume claims on this
+// node: directories matching Glob which are Btrfs subvolumes. Pattern is a
+// regular expression matched against their names, whose named groups
+// namespace and pvc, and optionally pv, tell which claim each belongs to.
+// By default, it matches directories of local-path-provisioner, named
+// pvc-UID_NAMESPACE_NAME.
+type pvcsJSON struct {
+	Glob    *string
+	Pattern *string
+}
+
+func (c *pvcsJSON) validate() error {
+	if c.Glob == nil {
+		return fmt.Errorf("Glob missing")
+	}
+	if _, err := path.Match(*c.Glob, ""); err != nil {
+		return fmt.Errorf("Glob: %w", err)
+	}
+	if c.Pattern != nil {
+		if _, err := pvcPattern(c); err != nil {
+			return fmt.Errorf("Pattern: %w", err)
+		}
+	}
+	return nil
+}
+
+// enterJSON makes btrfs run in the mount Namespace of a process, given by
+// its PID or a path such as /proc/PID/ns/mnt, and in Root, for subvolumes
+// only visible there, such as those of containers or rescue environments.
+// Storage must be reachable at the same path from there and from where snap
+// runs, since snap works with it itself.
+type enterJSON struct {
+	Namespace *string
+	Root      *string
+}
+
+// quiesceJSON configures how applications are quiesced while a snapshot is
+// taken: PostgreSQL is put into backup mode, MySQL tables are flushed and
+// locked, Docker containers are paused.
+type quiesceJSON struct {
+	PostgreSQL *clientJSON
+	MySQL      *clientJSON
+	Docker     *dockerJSON
+}
+
+func (q *quiesceJSON) validate() error {
+	if q.Docker != nil && len(q.Docker.Containers) == 0 {
+		return fmt.Errorf("Docker: Containers missing")
+	}
+	return nil
+}
+
+// clientJSON describes how to run the client of an application, such as
+// ["sudo", "-u", "postgres", "psql"]. By default, it's run as is.
+type clientJSON struct {
+	Command []string
+}
+
+func (c *clientJSON) command(def string) []string {
+	if len(c.Command) == 0 {
+		return []string{def}
+	}
+	return append([]string(nil), c.Command...)
+}
+
+// dockerJSON lists Containers to pause. Command may be set to podman, say.
+type dockerJSON struct {
+	clientJSON
+	Containers []string
+}
+
+// bucketJSON describes a bucket of the retention policy. If Reason is set,
+// the bucket only keeps snapshots taken for that reason, and such snapshots
+// are only kept by buckets with the same Reason. If Calendar is set, an
+// Interval of months or years is counted in calendar months from the date of
+// the snapshot kept before, rather than as 30 or 365 days, which drift apart
+// from the calendar over the years.
 type bucketJSON struct {
 	Interval *BucketInterval
 	Size     *int
+	Reason   *string
+	Calendar bool
 }
 
 func (b *bucketJSON) validate() error {
 	if b.Interval == nil {
 		return fmt.Errorf("Interval is missing")
 	}
+	if *b.Interval <= 0 {
+		return fmt.Errorf("Interval must be positive")
+	}
 	if b.Size == nil {
 		return fmt.Errorf("Size is missing")
 	}
+	if *b.Size <= 0 {
+		return fmt.Errorf("Size must be positive")
+	}
+	if b.Calendar && calendarMonths(time.Duration(*b.Interval)) == 0 {
+		return fmt.Errorf("Calendar only applies to Interval of " +
+			"whole months or years")
+	}
+	if b.Reason != nil && !validReason(*b.Reason) {
+		return fmt.Errorf("Reason must be one of %s", reasonList())
+	}
 	return nil
 }
 
 func loadConfig(filename string) (*configJSON, error) {
-	f, err := os.Open(filename)
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(data)
+}
+
+// configVersion is the version of the configuration format which snap
+// understands. Configurations without Version are of version 1.
+const configVersion = 1
+
+// configMigrations turn configurations of older versions into the current
+// one, in the form JSON decodes into: configMigrations[i] turns version i+1
+// into version i+2.
+var configMigrations []func(map[string]interface{}) error
+
+// migrateConfig returns the configuration data in the current format,
+// migrating it if it's older. Newer configurations can't be understood.
+func migrateConfig(data []byte) ([]byte, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	version := 1
+	if v, ok := raw["Version"]; ok {
+		f, ok := v.(float64)
+		if !ok || f != float64(int(f)) || f < 1 {
+			return nil, fmt.Errorf("Version must be a positive integer")
+		}
+		version = int(f)
+	}
+	if version > configVersion {
+		return nil, fmt.Errorf("Version %d is newer than %d, which "+
+			"this snap understands, upgrade snap", version,
+			configVersion)
+	}
+	if version == configVersion {
+		return data, nil
+	}
+	for ; version < configVersion; version++ {
+		if err := configMigrations[version-1](raw); err != nil {
+			return nil, fmt.Errorf("cannot migrate from version "+
+				"%d: %w", version, err)
+		}
+	}
+	raw["Version"] = configVersion
+	return json.Marshal(raw)
+}
+
+func parseConfig(data []byte) (*configJSON, error) {
+	data, err := migrateConfig(data)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
 	var cfg configJSON
-	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
+	if err := decodeStrict(data, &cfg); err != nil {
 		return nil, err
 	}
 	if err := cfg.validate(); err != nil {
@@ -117,3 +1016,80 @@ func loadConfig(filename string) (*configJSON, error) {
 	}
 	return &cfg, nil
 }
+
+// decodeStrict decodes configuration data into v. Unlike json.Unmarshal, it
+// rejects unknown keys, which are most likely misspelled, since a misspelled
+// Buckets would leave a profile without any and pruning would delete all its
+// snapshots. Errors tell where in data they are.
+func decodeStrict(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil {
+		return nil
+	}
+	offset := -1
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	const unknown = "json: unknown field "
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = int(syntaxErr.Offset)
+	case errors.As(err, &typeErr):
+		offset = int(typeErr.Offset)
+	case strings.HasPrefix(err.Error(), unknown):
+		// The decoder doesn't say where the key is, the first key of
+		// that name is the best guess.
+		name := strings.TrimPrefix(err.Error(), unknown)
+		re := regexp.MustCompile(regexp.QuoteMeta(name) + `\s*:`)
+		if loc := re.FindIndex(data); loc != nil {
+			offset = loc[0]
+		}
+		err = fmt.Errorf("unknown key %s", name)
+	}
+	if offset < 0 {
+		return err
+	}
+	line := 1 + bytes.Count(data[:offset], []byte("\n"))
+	col := offset - bytes.LastIndexByte(data[:offset], '\n')
+	return fmt.Errorf("line %d, column %d: %w", line, col, err)
+}
+
+// warnings returns problems with the configuration which don't make it
+// invalid, but are most likely mistakes. Unused profiles aren't among them:
+// profiles are run by timers and users outside of the configuration, so it
+// can't tell which are.
+func (c *configJSON) warnings() []string {
+	var names []string
+	for n := range c.Profiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var warnings []string
+	for _, n := range names {
+		p := c.Profiles[n]
+		if p.KeepUntilBackedUp && len(c.destinations(p)) == 0 {
+			warnings = append(warnings, fmt.Sprintf("profile %q "+
+				"keeps snapshots until they're backed up, but no "+
+				"profile backs them up", n))
+		}
+		if len(p.Buckets) == 0 {
+			warnings = append(warnings, fmt.Sprintf("profile %q has "+
+				"no Buckets, pruning it deletes all its "+
+				"snapshots", n))
+			continue
+		}
+		if p.Watch == nil {
+			continue
+		}
+		_, every := watchTimes(p)
+		if first := minInterval(p); every < first {
+			warnings = append(warnings, fmt.Sprintf("profile %q "+
+				"takes snapshots as often as every %s when "+
+				"watched, but keeps one per %s at most, "+
+				"others are pruned right away", n,
+				formatInterval(every), formatInterval(first)))
+		}
+	}
+	return warnings
+}
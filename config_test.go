@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketIntervalUnmarshalText(t *testing.T) {
+	tests := []struct {
+		s    string
+		want time.Duration
+		ok   bool
+	}{
+		{"90m", 90 * time.Minute, true},
+		{"1d12h", day + 12*time.Hour, true},
+		{"2w3d", 2*week + 3*day, true},
+		{"1y1M", year + month, true},
+		{"0s", 0, true},
+		{"1.5h", 90 * time.Minute, true},
+		{"1h30m15s", time.Hour + 30*time.Minute + 15*time.Second, true},
+		{"250ms", 250 * time.Millisecond, true},
+		{"9223372036s", 9223372036 * time.Second, true},
+		{"", 0, false},
+		{"d", 0, false},
+		{"12", 0, false},
+		{"1x", 0, false},
+		{"1d2", 0, false},
+		{"9223372037s", 0, false},
+		{"99999999999999999999s", 0, false},
+		{"300y", 0, false},
+		{"200y200y", 0, false},
+	}
+	for _, tt := range tests {
+		var d BucketInterval
+		err := d.UnmarshalText([]byte(tt.s))
+		if (err == nil) != tt.ok {
+			t.Errorf("UnmarshalText(%q) error %v, want ok %v", tt.s,
+				err, tt.ok)
+		} else if tt.ok && time.Duration(d) != tt.want {
+			t.Errorf("UnmarshalText(%q) = %v, want %v", tt.s,
+				time.Duration(d), tt.want)
+		}
+	}
+}
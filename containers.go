@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+const defaultContainerSocket = "/var/run/docker.sock"
+
+// volume is a container volume on a Btrfs subvolume, used by running
+// containers with the given IDs, or a volume of a Kubernetes claim, see
+// pvcVolumes.
+type volume struct {
+	Name       string
+	Mountpoint string
+	containers []string
+	labels     map[string]string
+}
+
+// containerAPI talks to the Docker API, or the compatible one of Podman,
+// listening on socket.
+type containerAPI struct {
+	socket string
+	client *http.Client
+}
+
+func newContainerAPI(c *containersJSON) *containerAPI {
+	socket := defaultContainerSocket
+	if c.Socket != nil {
+		socket = *c.Socket
+	}
+	return &containerAPI{
+		socket: socket,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// request performs a request against the API and decodes the JSON response
+// into v, unless v is nil.
+func (c *containerAPI) request(method, path string, v interface{}) error {
+	req, err := http.NewRequest(method, "http://localhost"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: %w", c.socket, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status,
+			strings.TrimSpace(string(msg)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// volumes discovers local volumes selected by c which are Btrfs subvolumes,
+// along with the running containers which use them.
+func (a *app) volumes(c *containersJSON) ([]*volume, error) {
+	api := newContainerAPI(c)
+	var vl struct {
+		Volumes []struct {
+			volume
+			Driver string
+		}
+	}
+	if err := api.request(http.MethodGet, "/volumes", &vl); err != nil {
+		return nil, fmt.Errorf("cannot list volumes: %w", err)
+	}
+	wanted := make(map[string]bool)
+	for _, name := range c.Volumes {
+		wanted[name] = true
+	}
+	byName := make(map[string]*volume)
+	var vols []*volume
+	for _, v := range vl.Volumes {
+		if v.Driver != "local" || (len(wanted) > 0 && !wanted[v.Name]) {
+			continue
+		}
+		if _, err := a.btrfsQuery("subvolume", "show", v.Mountpoint); err != nil {
+			if wanted[v.Name] {
+				fmt.Fprintf(os.Stderr, "warning: volume %s is "+
+					"not a Btrfs subvolume, skipping it\n",
+					v.Name)
+			}
+			continue
+		}
+		vol := v.volume
+		byName[v.Name] = &vol
+		vols = append(vols, &vol)
+	}
+	for name := range wanted {
+		if byName[name] == nil {
+			fmt.Fprintf(os.Stderr, "warning: no volume %s\n", name)
+		}
+	}
+	var cl []struct {
+		ID     string `json:"Id"`
+		State  string
+		Mounts []struct {
+			Type string
+			Name string
+		}
+	}
+	if err := api.request(http.MethodGet, "/containers/json", &cl); err != nil {
+		return nil, fmt.Errorf("cannot list containers: %w", err)
+	}
+	for _, ct := range cl {
+		if ct.State != "running" {
+			// Paused already, or about to stop.
+			continue
+		}
+		for _, m := range ct.Mounts {
+			if v := byName[m.Name]; m.Type == "volume" && v != nil {
+				v.containers = append(v.containers, ct.ID)
+			}
+		}
+	}
+	sort.Slice(vols, func(i, j int) bool {
+		return vols[i].Name < vols[j].Name
+	})
+	return vols, nil
+}
+
+// volumeProfiles expands the Containers or PVCs profile p into a profile for
+// each of its volumes, which keeps snapshots of the volume in a subdirectory
+// of Storage named after it. Other profiles are returned as they are.
+func (a *app) volumeProfiles(p *profileJSON) ([]*profileJSON, error) {
+	if !p.hasVolumes() {
+		return []*profileJSON{p}, nil
+	}
+	var vols []*volume
+	var err error
+	if p.Containers != nil {
+		vols, err = a.volumes(p.Containers)
+	} else {
+		vols, err = a.pvcVolumes(p.PVCs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	profiles := make([]*profileJSON, len(vols))
+	for i, v := range vols {
+		vp := *p
+		vp.name = p.name + "/" + v.Name
+		vp.Subvolume = &vols[i].Mountpoint
+		storage := path.Join(*p.Storage, v.Name)
+		vp.Storage = &storage
+		vp.Containers, vp.PVCs = nil, nil
+		vp.labels = v.labels
+		if p.Containers != nil && p.Containers.Pause {
+			vp.pause = &containerPause{
+				api:        newContainerAPI(p.Containers),
+				containers: v.containers,
+			}
+		}
+		profiles[i] = &vp
+	}
+	return profiles, nil
+}
+
+// containerPause lists containers to pause while a snapshot is taken.
+type containerPause struct {
+	api        *containerAPI
+	containers []string
+}
+
+// pauseContainers pauses containers of pause. The returned function resumes
+// those which were paused.
+func (a *app) pauseContainers(pause *containerPause) (func() error, error) {
+	var paused []string
+	resume := func() error {
+		var err error
+		for _, id := range paused {
+			if e := a.containerOp(pause.api, id, "unpause"); e != nil {
+				err = e
+			}
+		}
+		return err
+	}
+	for _, id := range pause.containers {
+		if err := a.containerOp(pause.api, id, "pause"); err != nil {
+			return resume, err
+		}
+		paused = append(paused, id)
+	}
+	return resume, nil
+}
+
+func (a *app) containerOp(api *containerAPI, id, op string) error {
+	if a.opts.dryRun || a.opts.verbose {
+		fmt.Fprintf(os.Stderr, "%s container %.12s\n", op, id)
+	}
+	if a.opts.dryRun {
+		return nil
+	}
+	p := "/containers/" + url.PathEscape(id) + "/" + op
+	return api.request(http.MethodPost, p, nil)
+}
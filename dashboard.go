@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dashboardPrefix is where pages of the web dashboard other than the
+// overview at / live:
+//
+//	GET  /ui/profiles/NAME                 snapshots of a profile
+//	POST /ui/profiles/NAME/{create,prune}  run an operation
+const dashboardPrefix = "/ui/"
+
+//go:embed web/dashboard.html
+var dashboardHTML string
+
+var dashboardTemplates = template.Must(template.New("").Parse(dashboardHTML))
+
+// dashboard holds the credentials which the web dashboard requires.
+type dashboard struct {
+	user     string
+	password string
+}
+
+// dashProfile summarizes a profile in the dashboard. Age is one of "ok",
+// "late" or "overdue", telling how worrying the age of the newest snapshot
+// is.
+type dashProfile struct {
+	Name      ProfileName
+	Kind      string
+	Storage   string
+	Snapshots int
+	Newest    string
+	Oldest    string
+	Age       string
+	Exclusive string
+	Available string
+	Pending   string
+	Error     string
+}
+
+// dashSnap describes a snapshot in the dashboard. X is its position on the
+// timeline and Height the height of its bar in the usage graph, both in
+// percent.
+type dashSnap struct {
+	Timestamp   string
+	Created     string
+	Ago         string
+	Reason      string
+	Description string
+	Exclusive   string
+	X           float64
+	Height      float64
+}
+
+func (s *server) serveDashboard(w http.ResponseWriter, r *http.Request) {
+	user, password, ok := r.BasicAuth()
+	if !ok || subtle.ConstantTimeCompare([]byte(user),
+		[]byte(s.dashboard.user)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(password),
+			[]byte(s.dashboard.password)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="snap"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path == "/" && r.Method == http.MethodGet {
+		s.overview(w)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, dashboardPrefix), "/")
+	if len(parts) < 2 || parts[0] != "profiles" {
+		http.NotFound(w, r)
+		return
+	}
+	name := parts[1]
+	p, ok := s.app.cfg.Profiles[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		s.profilePage(w, r, name, p)
+	case len(parts) == 3 && r.Method == http.MethodPost &&
+		(parts[2] == "create" || parts[2] == "prune"):
+		s.dashboardOperation(w, r, name, p, parts[2])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func renderDashboard(w http.ResponseWriter, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplates.ExecuteTemplate(w, name, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *server) overview(w http.ResponseWriter) {
+	names := make([]string, 0, len(s.app.cfg.Profiles))
+	for n := range s.app.cfg.Profiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	profiles := make([]*dashProfile, len(names))
+	for i, n := range names {
+		profiles[i], _ = s.summarize(n, s.app.cfg.Profiles[n])
+	}
+	renderDashboard(w, "overview", profiles)
+}
+
+// summarize describes p for the dashboard and returns its snapshots, oldest
+// first. Errors are reported in the description.
+func (s *server) summarize(name ProfileName, p *profileJSON) (*dashProfile, []*snap) {
+	a := s.app
+	dp := &dashProfile{Name: name}
+	switch {
+	case p.Containers != nil:
+		dp.Kind = "containers"
+	case p.PVCs != nil:
+		dp.Kind = "claims in " + *p.PVCs.Glob
+	case p.Source != nil:
+		dp.Kind = "backup of " + *p.Source
+	case p.Pull != nil:
+		dp.Kind = "pull from " + *p.Pull.Host
+	default:
+		dp.Kind = *p.Subvolume
+	}
+	if p.hasVolumes() {
+		return dp, nil
+	}
+	dir, err := storageDir(p)
+	if err != nil {
+		dp.Error = err.Error()
+		return dp, nil
+	}
+	dp.Storage = dir
+	if _, avail, err := a.statFS("", dir); err == nil {
+		dp.Available = formatBytes(avail)
+	}
+	snaps, err := profileSnaps(p)
+	if err != nil {
+		dp.Error = err.Error()
+		return dp, nil
+	}
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].created.Before(snaps[j].created)
+	})
+	dp.Snapshots = len(snaps)
+	if p.Source != nil {
+		if pending, err := s.pending(p, snaps); err != nil {
+			dp.Error = err.Error()
+		} else {
+			dp.Pending = fmt.Sprint(pending)
+		}
+	}
+	if len(snaps) == 0 {
+		return dp, snaps
+	}
+	now := time.Now()
+	newest, oldest := snaps[len(snaps)-1], snaps[0]
+	dp.Newest = a.formatTime(newest.created, now)
+	dp.Oldest = a.formatTime(oldest.created, now)
+	dp.Age = map[color]string{
+		colorNone:   "",
+		colorGreen:  "ok",
+		colorYellow: "late",
+		colorRed:    "overdue",
+	}[ageColor(now.Sub(newest.created), minInterval(p))]
+	a.loadUsage(p, snaps)
+	var excl uint64
+	known := false
+	for _, sn := range snaps {
+		if sn.usage != nil {
+			excl += sn.usage.exclusive
+			known = true
+		}
+	}
+	if known {
+		dp.Exclusive = formatBytes(excl)
+	}
+	return dp, snaps
+}
+
+// pending returns how many snapshots of the source of the backup profile p
+// haven't been backed up into snaps yet.
+func (s *server) pending(p *profileJSON, snaps []*snap) (int, error) {
+	a := s.app
+	host, dir, err := a.sourceDir(p)
+	if err != nil {
+		return 0, err
+	}
+	src, err := a.sourceSnaps(p, host, dir)
+	if err != nil {
+		return 0, err
+	}
+	a.loadIDs(host, src)
+	if p.Rsync == nil {
+		a.loadIDs("", snaps)
+	}
+	return len(src) - len(matchSnaps(src, snaps, clockSkew(p))), nil
+}
+
+func (s *server) profilePage(w http.ResponseWriter, r *http.Request, name ProfileName, p *profileJSON) {
+	dp, snaps := s.summarize(name, p)
+	if err := loadNotes(snaps); err != nil && dp.Error == "" {
+		dp.Error = err.Error()
+	}
+	now := time.Now()
+	var first time.Time
+	var maxExcl uint64
+	for _, sn := range snaps {
+		if first.IsZero() || sn.created.Before(first) {
+			first = sn.created
+		}
+		if sn.usage != nil && sn.usage.exclusive > maxExcl {
+			maxExcl = sn.usage.exclusive
+		}
+	}
+	span := now.Sub(first)
+	rows := make([]dashSnap, len(snaps))
+	for i, sn := range snaps {
+		rows[i] = dashSnap{
+			Timestamp:   filepath.Base(sn.path),
+			Created:     s.app.formatDate(sn.created),
+			Ago:         s.app.formatTime(sn.created, now),
+			Reason:      sn.reason,
+			Description: sn.description,
+			X:           100,
+		}
+		if span > 0 {
+			rows[i].X = 100 * float64(sn.created.Sub(first)) /
+				float64(span)
+		}
+		if sn.usage != nil {
+			rows[i].Exclusive = formatBytes(sn.usage.exclusive)
+			if maxExcl > 0 {
+				rows[i].Height = 100 * float64(sn.usage.exclusive) /
+					float64(maxExcl)
+			}
+		}
+	}
+	renderDashboard(w, "profile", struct {
+		Profile   *dashProfile
+		Snaps     []dashSnap
+		Usage     bool
+		CanCreate bool
+		Message   string
+	}{
+		Profile:   dp,
+		Snaps:     rows,
+		Usage:     maxExcl > 0,
+		CanCreate: p.Subvolume != nil,
+		Message:   r.URL.Query().Get("msg"),
+	})
+}
+
+// dashboardOperation runs op on the profile called name and goes back to its
+// page, telling how it went.
+func (s *server) dashboardOperation(w http.ResponseWriter, r *http.Request, name ProfileName, p *profileJSON, op string) {
+	// Browsers send credentials along with forms posted from anywhere,
+	// only accept those from the dashboard itself.
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	msg := op + " done"
+	err := s.run(name, p, op, func(a *app) func(*profileJSON) error {
+		if op == "create" {
+			a.opts.reason = reasonManual
+		}
+		return a.operation(op)
+	})
+	if err != nil {
+		msg = fmt.Sprintf("cannot %s: %v", op, err)
+	}
+	http.Redirect(w, r, dashboardPrefix+"profiles/"+
+		url.PathEscape(name)+"?msg="+url.QueryEscape(msg),
+		http.StatusSeeOther)
+}
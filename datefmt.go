@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultDateLayout = "2006-01-02 15:04:05"
+
+// localeLayouts maps locales (as found in LC_TIME and friends, without the
+// encoding) to their conventional date layouts. Locales not listed fall back
+// to their language, and then to defaultDateLayout.
+var localeLayouts = map[string]string{
+	"C":     defaultDateLayout,
+	"POSIX": defaultDateLayout,
+	"cs":    "2. 1. 2006 15:04:05",
+	"da":    "02.01.2006 15.04.05",
+	"de":    "02.01.2006 15:04:05",
+	"en":    "01/02/2006 03:04:05 PM",
+	"en_AU": "02/01/2006 03:04:05 PM",
+	"en_GB": "02/01/2006 15:04:05",
+	"en_IE": "02/01/2006 15:04:05",
+	"es":    "02/01/2006 15:04:05",
+	"fi":    "2.1.2006 15.04.05",
+	"fr":    "02/01/2006 15:04:05",
+	"it":    "02/01/2006 15:04:05",
+	"ja":    "2006/01/02 15:04:05",
+	"nl":    "02-01-2006 15:04:05",
+	"pl":    "02.01.2006 15:04:05",
+	"pt":    "02/01/2006 15:04:05",
+	"ru":    "02.01.2006 15:04:05",
+	"sk":    "2. 1. 2006 15:04:05",
+	"sv":    "2006-01-02 15:04:05",
+	"zh":    "2006/01/02 15:04:05",
+}
+
+// localeLayout returns the date layout for the locale configured in the
+// environment, following the precedence of LC_ALL, LC_TIME and LANG.
+func localeLayout() string {
+	var locale string
+	for _, v := range []string{"LC_ALL", "LC_TIME", "LANG"} {
+		if locale = os.Getenv(v); locale != "" {
+			break
+		}
+	}
+	if i := strings.IndexAny(locale, ".@"); i >= 0 {
+		locale = locale[:i]
+	}
+	if l, ok := localeLayouts[locale]; ok {
+		return l
+	}
+	if i := strings.IndexByte(locale, '_'); i >= 0 {
+		if l, ok := localeLayouts[locale[:i]]; ok {
+			return l
+		}
+	}
+	return defaultDateLayout
+}
+
+// strftime formats t according to the strftime(3)-style format. Fields of t
+// are written directly, so text around conversions is copied as is.
+func strftime(format string, t time.Time) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			b.WriteByte(format[i])
+			continue
+		}
+		i++
+		if i == len(format) {
+			return "", fmt.Errorf("format ends with a lone %%")
+		}
+		switch format[i] {
+		case 'a':
+			b.WriteString(t.Weekday().String()[:3])
+		case 'A':
+			b.WriteString(t.Weekday().String())
+		case 'b':
+			b.WriteString(t.Month().String()[:3])
+		case 'B':
+			b.WriteString(t.Month().String())
+		case 'd':
+			fmt.Fprintf(&b, "%02d", t.Day())
+		case 'e':
+			fmt.Fprintf(&b, "%2d", t.Day())
+		case 'F':
+			fmt.Fprintf(&b, "%04d-%02d-%02d", t.Year(), t.Month(), t.Day())
+		case 'H':
+			fmt.Fprintf(&b, "%02d", t.Hour())
+		case 'I':
+			h := t.Hour() % 12
+			if h == 0 {
+				h = 12
+			}
+			fmt.Fprintf(&b, "%02d", h)
+		case 'j':
+			fmt.Fprintf(&b, "%03d", t.YearDay())
+		case 'm':
+			fmt.Fprintf(&b, "%02d", t.Month())
+		case 'M':
+			fmt.Fprintf(&b, "%02d", t.Minute())
+		case 'p':
+			if t.Hour() < 12 {
+				b.WriteString("AM")
+			} else {
+				b.WriteString("PM")
+			}
+		case 'S':
+			fmt.Fprintf(&b, "%02d", t.Second())
+		case 'T':
+			fmt.Fprintf(&b, "%02d:%02d:%02d", t.Hour(), t.Minute(),
+				t.Second())
+		case 'y':
+			fmt.Fprintf(&b, "%02d", t.Year()%100)
+		case 'Y':
+			fmt.Fprintf(&b, "%d", t.Year())
+		case 'z':
+			_, off := t.Zone()
+			sign := '+'
+			if off < 0 {
+				sign, off = '-', -off
+			}
+			fmt.Fprintf(&b, "%c%02d%02d", sign, off/3600, off%3600/60)
+		case 'Z':
+			name, _ := t.Zone()
+			b.WriteString(name)
+		case '%':
+			b.WriteByte('%')
+		default:
+			return "", fmt.Errorf("unsupported conversion %%%c", format[i])
+		}
+	}
+	return b.String(), nil
+}
+
+// dateFormatter returns the function which formats dates as --date-format
+// asks for: "iso" (the default), "locale", or a strftime-style format.
+func dateFormatter(format string) (func(time.Time) string, error) {
+	layout := defaultDateLayout
+	switch format {
+	case "", "iso":
+	case "locale":
+		layout = localeLayout()
+	default:
+		if !strings.Contains(format, "%") {
+			return nil, fmt.Errorf("invalid date format %q", format)
+		}
+		// Conversions don't depend on the time, check them once.
+		if _, err := strftime(format, time.Time{}); err != nil {
+			return nil, err
+		}
+		return func(t time.Time) string {
+			s, _ := strftime(format, t)
+			return s
+		}, nil
+	}
+	return func(t time.Time) string {
+		return t.Format(layout)
+	}, nil
+}
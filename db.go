@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const defaultStateDir = "/var/lib/snap"
+
+// metaDB is a simple key-value store for metadata which snap keeps across
+// runs. Values are stored as JSON files in a directory tree, so keys may
+// contain slashes.
+type metaDB struct {
+	dir string
+}
+
+func (db *metaDB) path(key string) string {
+	return filepath.Join(db.dir, filepath.FromSlash(key)+".json")
+}
+
+// get loads the value stored under key into v and tells whether there was
+// any.
+func (db *metaDB) get(key string, v interface{}) (bool, error) {
+	data, err := ioutil.ReadFile(db.path(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+// put stores v under key. The file is replaced atomically, so readers never
+// see a partially written value.
+func (db *metaDB) put(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	p := db.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), defaultDirMode); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+func (db *metaDB) remove(key string) error {
+	if err := os.Remove(db.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// snapKey returns a key unique to snapshot s, prefixed with kind.
+func snapKey(kind string, s *snap) string {
+	storage := url.PathEscape(filepath.Dir(s.path))
+	return kind + "/" + storage + "/" + filepath.Base(s.path)
+}
+
+// getSnap is like get, but for a key which snapKey made for s. Keys used to
+// end with the Unix time of snapshots rather than their names. Values still
+// stored under such a key are read from there and moved to key.
+func (db *metaDB) getSnap(key string, s *snap, v interface{}) (bool, error) {
+	ok, err := db.get(key, v)
+	// Only snapshots without a number after the second have old keys.
+	if ok || err != nil || s.created.Nanosecond() != 0 {
+		return ok, err
+	}
+	old := key[:strings.LastIndexByte(key, '/')+1] +
+		strconv.FormatInt(s.created.Unix(), 10)
+	if old == key {
+		return false, nil
+	}
+	if ok, err = db.get(old, v); !ok || err != nil {
+		return ok, err
+	}
+	// The value is read either way, it's moved again next time if this
+	// fails.
+	os.Rename(db.path(old), db.path(key))
+	return true, nil
+}
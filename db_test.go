@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGetSnapOldKey(t *testing.T) {
+	db := &metaDB{dir: t.TempDir()}
+	s := &snap{path: "/s/0001577836800", created: time.Unix(1577836800, 0)}
+	key := snapKey("uuid", s)
+	old := "uuid/%2Fs/1577836800"
+	if err := db.put(old, &snapIDs{UUID: "u"}); err != nil {
+		t.Fatal(err)
+	}
+	var ids snapIDs
+	ok, err := db.getSnap(key, s, &ids)
+	if err != nil || !ok || ids.UUID != "u" {
+		t.Fatalf("getSnap = %v, %v, %+v, want the value under %s", ok,
+			err, ids, old)
+	}
+	if _, err := os.Stat(db.path(old)); !os.IsNotExist(err) {
+		t.Errorf("value left under %s", old)
+	}
+	if ok, _ := db.get(key, &ids); !ok {
+		t.Errorf("value not moved to %s", key)
+	}
+}
+
+func TestGetSnapNumbered(t *testing.T) {
+	db := &metaDB{dir: t.TempDir()}
+	if err := db.put("uuid/%2Fs/1577836800", &snapIDs{UUID: "u"}); err != nil {
+		t.Fatal(err)
+	}
+	// The old key belongs to the first snapshot of the second.
+	s := &snap{path: "/s/1577836800.1", created: time.Unix(1577836800, 1)}
+	var ids snapIDs
+	if ok, err := db.getSnap(snapKey("uuid", s), s, &ids); ok || err != nil {
+		t.Errorf("getSnap = %v, %v, want nothing", ok, err)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+)
+
+// The D-Bus interface of snap serve, for desktop environments and applets.
+// The system bus has to let snap own the name, see dbus/.
+const (
+	dbusName      = "io.github.dcepelik.Snap"
+	dbusPath      = "/io/github/dcepelik/Snap"
+	dbusInterface = "io.github.dcepelik.Snap"
+)
+
+// States of operations announced by the Status signal.
+const (
+	statusStarted  = "started"
+	statusFinished = "finished"
+	statusFailed   = "failed"
+)
+
+const dbusIntrospection = `<node>
+	<interface name="` + dbusInterface + `">
+		<method name="ListSnapshots">
+			<arg name="profile" direction="in" type="s"/>
+			<arg name="snapshots" direction="out" type="a(sxss)"/>
+		</method>
+		<method name="CreateSnapshot">
+			<arg name="profile" direction="in" type="s"/>
+			<arg name="description" direction="in" type="s"/>
+		</method>
+		<method name="RestoreFile">
+			<arg name="profile" direction="in" type="s"/>
+			<arg name="timestamp" direction="in" type="s"/>
+			<arg name="file" direction="in" type="s"/>
+			<arg name="restored" direction="out" type="s"/>
+		</method>
+		<signal name="Status">
+			<arg name="profile" type="s"/>
+			<arg name="operation" type="s"/>
+			<arg name="state" type="s"/>
+			<arg name="error" type="s"/>
+		</signal>
+	</interface>` + introspect.IntrospectDataString + `</node>`
+
+// dbusSnap describes a snapshot in ListSnapshots: its timestamp, when it was
+// created (in seconds since the epoch), its description and reason.
+type dbusSnap struct {
+	Timestamp   string
+	Created     int64
+	Description string
+	Reason      string
+}
+
+// dbusObject implements the D-Bus interface. Anyone whom the bus lets in may
+// list snapshots; only root and owners of Subvolume may create snapshots and
+// files are only restored to those who own them, once polkit authorizes it,
+// see polkit/.
+type dbusObject struct {
+	srv *server
+}
+
+// exportDBus connects to the system bus and provides the interface there.
+func (s *server) exportDBus() error {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return fmt.Errorf("cannot connect to D-Bus: %w", err)
+	}
+	obj := &dbusObject{srv: s}
+	err = conn.Export(obj, dbusPath, dbusInterface)
+	if err == nil {
+		err = conn.Export(introspect.Introspectable(dbusIntrospection),
+			dbusPath, "org.freedesktop.DBus.Introspectable")
+	}
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("cannot export D-Bus object: %w", err)
+	}
+	reply, err := conn.RequestName(dbusName, dbus.NameFlagDoNotQueue)
+	if err == nil && reply != dbus.RequestNameReplyPrimaryOwner {
+		err = fmt.Errorf("name is taken")
+	}
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("cannot own D-Bus name %s: %w", dbusName, err)
+	}
+	s.bus = conn
+	fmt.Fprintf(os.Stderr, "providing %s on the system bus\n", dbusName)
+	return nil
+}
+
+// status announces a change of state of op on the profile called name.
+func (s *server) status(name, op, state string, opErr error) {
+	if s.bus == nil {
+		return
+	}
+	msg := ""
+	if opErr != nil {
+		msg = opErr.Error()
+	}
+	err := s.bus.Emit(dbusPath, dbusInterface+".Status", name, op, state, msg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot emit D-Bus signal: %v\n", err)
+	}
+}
+
+// polkitRestoreFile is the polkit action which authorizes RestoreFile.
+const polkitRestoreFile = "io.github.dcepelik.snap.restore-file"
+
+// authorize asks polkit whether sender may perform action, letting it
+// authenticate the user.
+func (o *dbusObject) authorize(sender dbus.Sender, action string) *dbus.Error {
+	subject := struct {
+		Kind    string
+		Details map[string]dbus.Variant
+	}{"system-bus-name", map[string]dbus.Variant{
+		"name": dbus.MakeVariant(string(sender)),
+	}}
+	var result struct {
+		Authorized bool
+		Challenge  bool
+		Details    map[string]string
+	}
+	const allowUserInteraction = 1
+	err := o.srv.bus.Object("org.freedesktop.PolicyKit1",
+		"/org/freedesktop/PolicyKit1/Authority").Call(
+		"org.freedesktop.PolicyKit1.Authority.CheckAuthorization", 0,
+		subject, action, map[string]string{},
+		uint32(allowUserInteraction), "").Store(&result)
+	if err != nil {
+		return dbus.MakeFailedError(fmt.Errorf("cannot check "+
+			"authorization: %w", err))
+	}
+	if !result.Authorized {
+		return dbus.MakeFailedError(fmt.Errorf("not authorized"))
+	}
+	return nil
+}
+
+// caller returns the profile called name and the user who sent the call, or
+// -1 if it was root.
+func (o *dbusObject) caller(sender dbus.Sender, name string) (*profileJSON, int, *dbus.Error) {
+	p, ok := o.srv.app.cfg.Profiles[name]
+	if !ok {
+		return nil, 0, dbus.MakeFailedError(
+			fmt.Errorf("%q: %w", name, ErrProfileNotFound))
+	}
+	var uid uint32
+	err := o.srv.bus.BusObject().Call("org.freedesktop.DBus.GetConnectionUnixUser",
+		0, string(sender)).Store(&uid)
+	if err != nil {
+		return nil, 0, dbus.MakeFailedError(err)
+	}
+	if uid == 0 {
+		return p, -1, nil
+	}
+	return p, int(uid), nil
+}
+
+func (o *dbusObject) ListSnapshots(sender dbus.Sender, name string) ([]dbusSnap, *dbus.Error) {
+	p, _, derr := o.caller(sender, name)
+	if derr != nil {
+		return nil, derr
+	}
+	profiles, err := o.srv.app.volumeProfiles(p)
+	if err != nil {
+		return nil, dbus.MakeFailedError(err)
+	}
+	var snaps []*snap
+	for _, vp := range profiles {
+		vsnaps, err := profileSnaps(vp)
+		if err != nil {
+			return nil, dbus.MakeFailedError(err)
+		}
+		snaps = append(snaps, vsnaps...)
+	}
+	if err := loadNotes(snaps); err != nil {
+		return nil, dbus.MakeFailedError(err)
+	}
+	resp := make([]dbusSnap, len(snaps))
+	for i, sn := range snaps {
+		resp[i] = dbusSnap{
+			Timestamp:   filepath.Base(sn.path),
+			Created:     sn.created.Unix(),
+			Description: sn.description,
+			Reason:      sn.reason,
+		}
+	}
+	return resp, nil
+}
+
+func (o *dbusObject) CreateSnapshot(sender dbus.Sender, name, description string) *dbus.Error {
+	p, uid, derr := o.caller(sender, name)
+	if derr != nil {
+		return derr
+	}
+	if p.Subvolume == nil {
+		return dbus.MakeFailedError(fmt.Errorf("profile %q doesn't take "+
+			"snapshots", name))
+	}
+	if uid >= 0 {
+		fi, err := os.Stat(*p.Subvolume)
+		if err != nil {
+			return dbus.MakeFailedError(err)
+		}
+		if int(fi.Sys().(*syscall.Stat_t).Uid) != uid {
+			return dbus.MakeFailedError(fmt.Errorf("%s isn't yours",
+				*p.Subvolume))
+		}
+	}
+	err := o.srv.run(name, p, "create", func(a *app) func(*profileJSON) error {
+		a.invoker = uid
+		a.opts.message = description
+		a.opts.reason = reasonManual
+		return a.create
+	})
+	if err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+func (o *dbusObject) RestoreFile(sender dbus.Sender, name, timestamp, file string) (string, *dbus.Error) {
+	p, uid, derr := o.caller(sender, name)
+	if derr != nil {
+		return "", derr
+	}
+	if uid >= 0 {
+		if derr := o.authorize(sender, polkitRestoreFile); derr != nil {
+			return "", derr
+		}
+	}
+	var restored string
+	err := o.srv.run(name, p, "restore-file", func(a *app) func(*profileJSON) error {
+		a.invoker = uid
+		return func(p *profileJSON) error {
+			var err error
+			restored, err = a.restoreFile(p, timestamp, file)
+			return err
+		}
+	})
+	if err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+	return restored, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// fiemap mirrors struct fiemap with room for a single extent, see
+// linux/fiemap.h.
+type fiemap struct {
+	start         uint64
+	length        uint64
+	flags         uint32
+	mappedExtents uint32
+	extentCount   uint32
+	reserved      uint32
+	extent        struct {
+		logical    uint64
+		physical   uint64
+		length     uint64
+		reserved64 [2]uint64
+		flags      uint32
+		reserved   [3]uint32
+	}
+}
+
+const (
+	fsIocFiemap            = 0xc020660b
+	fiemapFlagSync         = 0x1
+	fiemapExtentDataInline = 0x200
+)
+
+// firstExtent returns the physical address of the first extent of the file
+// at p. Files which share it share their data, as far as dedup is concerned.
+// Data of small files may be stored inline in metadata, which can't be
+// deduplicated, and the address of which is 0.
+func firstExtent(p string) (uint64, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	// Data yet to be written has no address.
+	fm := fiemap{length: ^uint64(0), flags: fiemapFlagSync, extentCount: 1}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocFiemap,
+		uintptr(unsafe.Pointer(&fm)))
+	if errno != 0 {
+		return 0, fmt.Errorf("%s: fiemap: %w", p, errno)
+	}
+	if fm.mappedExtents == 0 || fm.extent.flags&fiemapExtentDataInline != 0 {
+		return 0, nil
+	}
+	return fm.extent.physical, nil
+}
+
+// dupGroup is a set of files with the same contents, which are stored in
+// the given number of places.
+type dupGroup struct {
+	size   int64
+	paths  []string
+	copies int
+}
+
+func (g *dupGroup) wasted() int64 {
+	return g.size * int64(g.copies-1)
+}
+
+// dedupReport finds files in snapshots of p with the same contents, as told
+// by their manifests, which don't share their data. If dedup is set, such
+// files are deduplicated by duperemove.
+func (a *app) dedupReport(p *profileJSON, dedup bool) error {
+	snaps, err := profileSnaps(p)
+	if err != nil {
+		return err
+	}
+	bySum := make(map[string][]string)
+	sizes := make(map[string]int64)
+	without := 0
+	for _, s := range snaps {
+		m, err := readManifest(s)
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			without++
+			continue
+		}
+		for rel, e := range m {
+			if e.Symlink || e.Size == 0 {
+				continue
+			}
+			sum := string(e.Sum)
+			bySum[sum] = append(bySum[sum],
+				filepath.Join(s.subvolPath(), rel))
+			sizes[sum] = e.Size
+		}
+	}
+	if without > 0 {
+		fmt.Fprintf(os.Stderr, "warning: %d snapshots have no manifest "+
+			"and are left out, see --manifest\n", without)
+	}
+	var groups []*dupGroup
+	for sum, paths := range bySum {
+		if len(paths) < 2 {
+			continue
+		}
+		places := make(map[uint64]bool)
+		for _, p := range paths {
+			addr, err := firstExtent(p)
+			if err != nil {
+				return err
+			}
+			if addr != 0 {
+				places[addr] = true
+			}
+		}
+		if len(places) < 2 {
+			continue
+		}
+		sort.Strings(paths)
+		groups = append(groups, &dupGroup{
+			size:   sizes[sum],
+			paths:  paths,
+			copies: len(places),
+		})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].wasted() > groups[j].wasted()
+	})
+	t := newTable("WASTED", "COPIES", "SIZE", "FILE")
+	t.alignRight(0, 1, 2)
+	var total int64
+	for _, g := range groups {
+		total += g.wasted()
+		t.add(plainCell("%s", formatBytes(uint64(g.wasted()))),
+			plainCell("%d", g.copies),
+			plainCell("%s", formatBytes(uint64(g.size))),
+			plainCell("%s", g.paths[0]))
+	}
+	if err := a.printTable(t); err != nil {
+		return err
+	}
+	if !a.opts.plain {
+		fmt.Printf("%s in %d duplicated files could be reclaimed\n",
+			formatBytes(uint64(total)), len(groups))
+	}
+	if !dedup || len(groups) == 0 {
+		return nil
+	}
+	return a.duperemove(groups)
+}
+
+// duperemove deduplicates groups, which it's given in the format of fdupes.
+func (a *app) duperemove(groups []*dupGroup) error {
+	var list bytes.Buffer
+	for _, g := range groups {
+		list.WriteString(strings.Join(g.paths, "\n") + "\n\n")
+	}
+	argv := []string{"duperemove", "-d", "-q", "--fdupes"}
+	if a.opts.dryRun || a.opts.verbose {
+		fmt.Fprintf(os.Stderr, "%s < (%d groups of duplicates)\n",
+			argvString(argv), len(groups))
+	}
+	if a.opts.dryRun {
+		return nil
+	}
+	var stderr bytes.Buffer
+	run := a.started("", argv)
+	p, err := a.startOn("", argv, &list, nil, &stderr)
+	if err != nil {
+		return err
+	}
+	err = p.Wait()
+	a.finished(run, err, nil, stderr.Bytes())
+	if err != nil {
+		return cmdError(argv[0], err, &stderr)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// diffFile compares the versions of file in the snapshots taken at the
+// timestamps old and cur. Text files are compared by diff -u, others only by
+// size and hash. A file missing in one of the snapshots compares as empty.
+func (a *app) diffFile(p *profileJSON, file, old, cur string) error {
+	rel, err := a.relPattern(p, file)
+	if err != nil {
+		return err
+	}
+	snaps, err := profileSnaps(p)
+	if err != nil {
+		return err
+	}
+	var vs []*fileVersion
+	for _, ts := range []string{old, cur} {
+		var s *snap
+		for _, t := range snaps {
+			if filepath.Base(t.path) == ts {
+				s = t
+			}
+		}
+		if s == nil {
+			return fmt.Errorf("no snapshot %s", ts)
+		}
+		v := &fileVersion{snap: s, path: filepath.Join(s.subvolPath(), rel)}
+		fi, err := os.Lstat(v.path)
+		if os.IsNotExist(err) {
+			v.path = ""
+		} else if err != nil {
+			return err
+		} else if fi.IsDir() {
+			return fmt.Errorf("%s is a directory", v.path)
+		} else {
+			v.fi = dirEntry{
+				Name:    fi.Name(),
+				Mode:    fi.Mode(),
+				Size:    fi.Size(),
+				ModTime: fi.ModTime(),
+			}
+		}
+		vs = append(vs, v)
+	}
+	if vs[0].path == "" && vs[1].path == "" {
+		return fmt.Errorf("%s is in neither snapshot", rel)
+	}
+	text := true
+	for _, v := range vs {
+		ok, err := isText(v)
+		if err != nil {
+			return err
+		}
+		text = text && ok
+	}
+	if text {
+		return diffText(rel, vs[0], vs[1])
+	}
+	return a.diffBinary(vs[0], vs[1])
+}
+
+// isText tells whether the version v is a regular file which looks like text,
+// that is, has no NUL bytes at its start. Missing files are empty text.
+func isText(v *fileVersion) (bool, error) {
+	if v.path == "" {
+		return true, nil
+	}
+	if !v.fi.Mode.IsRegular() {
+		return false, nil
+	}
+	f, err := os.Open(v.path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	buf := make([]byte, 8000)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	return !bytes.Contains(buf[:n], []byte{0}), nil
+}
+
+// diffText prints the differences between versions x and y of the file rel
+// as a unified diff, labelled by the snapshots.
+func diffText(rel string, x, y *fileVersion) error {
+	argv := []string{"diff", "-u"}
+	for _, v := range []*fileVersion{x, y} {
+		argv = append(argv, "--label",
+			filepath.Join(filepath.Base(v.snap.path), rel))
+	}
+	argv = append(argv, "--", versionPath(x), versionPath(y))
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	// Diff exits with 1 when the files differ.
+	if e, ok := err.(*exec.ExitError); ok && e.ExitCode() == 1 {
+		return nil
+	}
+	return err
+}
+
+func versionPath(v *fileVersion) string {
+	if v.path == "" {
+		return os.DevNull
+	}
+	return v.path
+}
+
+// diffBinary prints sizes and hashes of versions x and y, and whether they
+// differ.
+func (a *app) diffBinary(x, y *fileVersion) error {
+	t := newTable("SNAPSHOT", "SIZE", "SHA256")
+	t.alignRight(1)
+	for _, v := range []*fileVersion{x, y} {
+		if v.path == "" {
+			t.add(plainCell("%s", v.snap.path),
+				cell{text: "missing", color: colorRed}, plainCell("-"))
+			continue
+		}
+		sum, err := v.sum()
+		if err != nil {
+			return err
+		}
+		t.add(plainCell("%s", v.snap.path),
+			plainCell("%s", formatBytes(uint64(v.fi.Size))),
+			plainCell("%s", hex.EncodeToString(sum)))
+	}
+	if err := a.printTable(t); err != nil {
+		return err
+	}
+	same := x.path != "" && y.path != ""
+	if same {
+		var err error
+		if same, err = sameContents(x, y); err != nil {
+			return err
+		}
+	}
+	if same {
+		fmt.Println("binary files are identical")
+	} else {
+		fmt.Println("binary files differ")
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// defaultMinKeep is how many of the newest snapshots --emergency-free keeps
+// unless MinKeep says otherwise.
+const defaultMinKeep = 1
+
+// emergencyFree deletes the oldest snapshots of p, regardless of the
+// retention policy, until there's at least want of space available in its
+// storage. Snapshots in the trash go first. Unowned snapshots in shared
+// storage are left alone, as pruning leaves them.
+func (a *app) emergencyFree(p *profileJSON, want string) error {
+	need, err := parseSize(want)
+	if err != nil {
+		return err
+	}
+	dir, err := storageDir(p)
+	if err != nil {
+		return err
+	}
+	_, avail, err := a.statFS("", dir)
+	if err != nil {
+		return err
+	}
+	start := avail
+	if avail >= uint64(need) {
+		fmt.Printf("%s available already\n", formatBytes(avail))
+		return nil
+	}
+	if p.Trash != nil {
+		if err := a.emptyTrash(dir, 0); err != nil {
+			return err
+		}
+		if avail, err = a.waitFreed(p, dir); err != nil {
+			return err
+		}
+	}
+	snaps, err := prunableSnaps(p)
+	if err != nil {
+		return err
+	}
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].created.Before(snaps[j].created)
+	})
+	minKeep := defaultMinKeep
+	if p.MinKeep != nil {
+		minKeep = *p.MinKeep
+	}
+	if len(snaps) > minKeep {
+		snaps = snaps[:len(snaps)-minKeep]
+	} else {
+		snaps = nil
+	}
+	if a.opts.dryRun {
+		// Nothing is freed, guess how much would be.
+		a.loadUsage(p, snaps)
+	}
+	deleted := 0
+	for _, s := range snaps {
+		if avail >= uint64(need) {
+			break
+		}
+		if err := a.removeOldest(p, dir, s); err != nil {
+			return err
+		}
+		deleted++
+		if a.opts.dryRun {
+			if s.usage != nil {
+				avail += s.usage.exclusive
+			}
+			continue
+		}
+		if avail, err = a.waitFreed(p, dir); err != nil {
+			return err
+		}
+	}
+	if avail < uint64(need) {
+		return fmt.Errorf("only %s available after deleting %d "+
+			"snapshots, keeping the newest %d", formatBytes(avail),
+			deleted, minKeep)
+	}
+	// Others may have taken space meanwhile.
+	var freed uint64
+	if avail > start {
+		freed = avail - start
+	}
+	fmt.Printf("deleted %d snapshots, %s available (%s freed)\n", deleted,
+		formatBytes(avail), formatBytes(freed))
+	return nil
+}
+
+// removeOldest deletes the snapshot s of p from storage in an emergency.
+func (a *app) removeOldest(p *profileJSON, storage string, s *snap) error {
+	done, err := a.begin(storage, opPrune, s)
+	if err != nil {
+		return err
+	}
+	if err := a.removeSnap(s); err != nil {
+		return err
+	}
+	if err := a.audit(storage, auditDelete, s, ""); err != nil {
+		return err
+	}
+	if err := done(); err != nil {
+		return err
+	}
+	a.emit(eventPruned, p, s, "", nil)
+	if ps := a.current(); ps != nil {
+		ps.Pruned = append(ps.Pruned, pruneSummary{Snapshot: s.path})
+	}
+	return nil
+}
+
+// waitFreed waits until deleted subvolumes in the storage dir of p are
+// cleaned up and returns the space available then.
+func (a *app) waitFreed(p *profileJSON, dir string) (uint64, error) {
+	if p.Rsync == nil {
+		if err := a.btrfsCmd("subvolume", "sync", dir); err != nil {
+			return 0, err
+		}
+	}
+	_, avail, err := a.statFS("", dir)
+	return avail, err
+}
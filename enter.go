@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strconv"
+)
+
+// enterArgv returns the command which runs btrfs for p in the mount namespace
+// and root directory set by its Enter settings, if any.
+func enterArgv(p *profileJSON) []string {
+	e := p.Enter
+	if e == nil {
+		return nil
+	}
+	var argv []string
+	if e.Namespace != nil {
+		if _, err := strconv.Atoi(*e.Namespace); err == nil {
+			argv = append(argv, "nsenter", "-t", *e.Namespace, "-m",
+				"--")
+		} else {
+			argv = append(argv, "nsenter", "--mount="+*e.Namespace,
+				"--")
+		}
+	}
+	if e.Root != nil {
+		argv = append(argv, "chroot", *e.Root)
+	}
+	return argv
+}
+
+// btrfsArgv returns argv which runs btrfs with args for the profile being
+// worked with.
+func (a *app) btrfsArgv(args []string) []string {
+	argv := append([]string(nil), a.enter...)
+	argv = append(argv, a.btrfs("", args[0]))
+	return append(argv, args...)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// profileEnv returns the environment of commands run for p: that of snap with
+// Env of p added, or nil if p has no Env, so that commands inherit it.
+func profileEnv(p *profileJSON) ([]string, error) {
+	if len(p.Env) == 0 {
+		return nil, nil
+	}
+	names := make([]string, 0, len(p.Env))
+	for k := range p.Env {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	env := os.Environ()
+	for _, k := range names {
+		v, err := p.Env[k].reveal()
+		if err != nil {
+			return nil, fmt.Errorf("Env: %s: %w", k, err)
+		}
+		env = append(env, k+"="+v)
+	}
+	return env, nil
+}
+
+func validateEnv(env map[string]*secret) error {
+	for k := range env {
+		if k == "" || strings.ContainsAny(k, "=\x00") {
+			return fmt.Errorf("Env: invalid variable name %q", k)
+		}
+	}
+	return nil
+}
+
+// environ returns the environment of commands run for the current profile.
+func (a *app) environ() []string {
+	if a.env != nil {
+		return a.env
+	}
+	return os.Environ()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Errors which callers can tell apart with errors.Is rather than by their
+// messages. They're wrapped along with details, such as the path concerned.
+var (
+	// ErrNotASubvolume is returned for paths which should be Btrfs
+	// subvolumes but aren't.
+	ErrNotASubvolume = errors.New("not a Btrfs subvolume")
+	// ErrDestinationMissingParent is returned when an incremental
+	// transfer fails since its parent is missing at the destination.
+	ErrDestinationMissingParent = errors.New("parent snapshot missing " +
+		"at the destination")
+	// ErrProfileNotFound is returned for names of profiles which aren't
+	// configured.
+	ErrProfileNotFound = errors.New("profile not found")
+	// ErrPrivileges is returned when snap lacks privileges for an
+	// operation, see checkPrivileges.
+	ErrPrivileges = errors.New("insufficient privileges")
+	// ErrBackupUnreachable is returned when pruning a profile with
+	// RequireBackupBeforePrune can't reach one of its backups.
+	ErrBackupUnreachable = errors.New("backup unreachable")
+)
+
+// ExecError is returned when a command, such as btrfs, exits with a non-zero
+// Code. Stderr holds its standard error output.
+type ExecError struct {
+	Name   string
+	Code   int
+	Stderr string
+}
+
+// Error includes the first line of the standard error output only.
+func (e *ExecError) Error() string {
+	stderr := "(stderr empty)"
+	if e.Stderr != "" {
+		stderr = strings.Split(e.Stderr, "\n")[0]
+	}
+	return fmt.Sprintf("%s: failed with exit code %d: %s", e.Name, e.Code,
+		stderr)
+}
+
+// exitCode returns the exit status of snap which failed with err, so that
+// scripts can tell failures apart too:
+//
+//	1  other errors
+//	3  profile not found
+//	4  not a Btrfs subvolume
+//	5  parent snapshot missing at the destination
+//	6  a command failed
+//	7  insufficient privileges
+//	8  backup unreachable
+func exitCode(err error) int {
+	var execErr *ExecError
+	switch {
+	case errors.Is(err, ErrProfileNotFound):
+		return 3
+	case errors.Is(err, ErrNotASubvolume):
+		return 4
+	case errors.Is(err, ErrDestinationMissingParent):
+		return 5
+	case errors.As(err, &execErr):
+		return 6
+	case errors.Is(err, ErrPrivileges):
+		return 7
+	case errors.Is(err, ErrBackupUnreachable):
+		return 8
+	}
+	return 1
+}
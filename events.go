@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// eventsJSON makes snap report what happens to snapshots as a stream of
+// events, one JSON object per line, so that dashboards and auditors can
+// follow it without polling storage. Events are appended to File, or sent
+// to the Unix stream Socket another program listens on, or both.
+type eventsJSON struct {
+	File   *string
+	Socket *string
+}
+
+func (e *eventsJSON) validate() error {
+	if e.File == nil && e.Socket == nil {
+		return fmt.Errorf("File or Socket must be set")
+	}
+	if e.File != nil && !path.IsAbs(*e.File) {
+		return fmt.Errorf("File: must be an absolute path")
+	}
+	if e.Socket != nil && !path.IsAbs(*e.Socket) {
+		return fmt.Errorf("Socket: must be an absolute path")
+	}
+	return nil
+}
+
+// Events reported, see eventsJSON.
+const (
+	eventCreated  = "created"
+	eventPruned   = "pruned"
+	eventTrashed  = "trashed"
+	eventBackedUp = "backed-up"
+	eventVerified = "verified"
+)
+
+// event tells that Event happened to Snapshot of Profile. Source is the
+// snapshot a backup was made of. Error says why verification failed.
+type event struct {
+	Time     time.Time
+	Host     string
+	Event    string
+	Profile  ProfileName
+	Snapshot string
+	Source   string `json:",omitempty"`
+	Error    string `json:",omitempty"`
+}
+
+// eventLog reports events. A nil eventLog reports nothing.
+type eventLog struct {
+	mu     sync.Mutex
+	cfg    *eventsJSON
+	host   string
+	failed bool
+}
+
+func newEventLog(cfg *eventsJSON) *eventLog {
+	host, _ := os.Hostname()
+	return &eventLog{cfg: cfg, host: host}
+}
+
+// emit reports that kind of event happened to the snapshot s of p. Events
+// aren't reported in dry runs.
+func (a *app) emit(kind string, p *profileJSON, s *snap, source string, err error) {
+	if a.events == nil || a.opts.dryRun {
+		return
+	}
+	e := &event{
+		Time:     time.Now(),
+		Host:     a.events.host,
+		Event:    kind,
+		Profile:  p.name,
+		Snapshot: s.path,
+		Source:   source,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	a.events.write(e)
+}
+
+func (l *eventLog) write(e *event) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.failed {
+		return
+	}
+	if l.cfg.File != nil {
+		err = appendFile(*l.cfg.File, data)
+	}
+	if err == nil && l.cfg.Socket != nil {
+		err = sendLine(*l.cfg.Socket, data)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: cannot report events, not "+
+			"reporting them: %v\n", err)
+		l.failed = true
+	}
+}
+
+func appendFile(file string, data []byte) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// sendLine sends data to whoever listens on socket. Nobody listening is not
+// an error, events are only for those who care.
+func sendLine(socket string, data []byte) error {
+	conn, err := net.DialTimeout("unix", socket, time.Second)
+	if err != nil {
+		if errors.Is(err, syscall.ENOENT) ||
+			errors.Is(err, syscall.ECONNREFUSED) {
+			return nil
+		}
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write(data)
+	return err
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// excludes are patterns of files which --list-files and --find leave out,
+// such as caches, so that they don't drown out the rest. Patterns without a
+// slash match names of files and directories anywhere, leaving out whole
+// subtrees. Others match paths relative to the root of snapshots.
+type excludes []string
+
+func validateExcludes(patterns []string) error {
+	for _, pat := range patterns {
+		if _, err := filepath.Match(pat, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pat, err)
+		}
+	}
+	return nil
+}
+
+// excludes returns the profile's Exclude patterns along with those given by
+// --exclude.
+func (a *app) excludes(p *profileJSON) (excludes, error) {
+	if err := validateExcludes(a.opts.exclude); err != nil {
+		return nil, err
+	}
+	x := append(excludes{}, p.Exclude...)
+	return append(x, a.opts.exclude...), nil
+}
+
+// match tells whether the file at path rel, or a directory it's in, is
+// excluded.
+func (x excludes) match(rel string) bool {
+	for _, pat := range x {
+		if strings.Contains(pat, "/") {
+			pat = strings.TrimPrefix(pat, "/")
+			for d := rel; d != "." && d != "/"; d = filepath.Dir(d) {
+				if ok, _ := filepath.Match(pat, d); ok {
+					return true
+				}
+			}
+			continue
+		}
+		for _, name := range strings.Split(rel, "/") {
+			if ok, _ := filepath.Match(pat, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"time"
+)
+
+// exportRecord records when a snapshot was exported.
+type exportRecord struct {
+	Exported time.Time
+}
+
+// export feeds the newest snapshot of p into the repository of tool, restic
+// or borg, unless it's been exported there already. Files are archived
+// relative to the snapshot, so that all exports have the same paths.
+func (a *app) export(p *profileJSON, tool string) error {
+	var repo *repoJSON
+	if e := p.Export; e != nil {
+		switch tool {
+		case "restic":
+			repo = e.Restic
+		case "borg":
+			repo = e.Borg
+		}
+	}
+	if repo == nil {
+		return fmt.Errorf("no %s repository configured, see Export", tool)
+	}
+	snaps, err := profileSnaps(p)
+	if err != nil {
+		return err
+	}
+	if len(snaps) == 0 {
+		return fmt.Errorf("no snapshots to export")
+	}
+	s := snaps[0]
+	for _, t := range snaps {
+		if t.created.After(s.created) {
+			s = t
+		}
+	}
+	key := snapKey("export-"+tool, s)
+	if ok, err := a.db.getSnap(key, s, &exportRecord{}); err != nil {
+		return err
+	} else if ok {
+		if a.opts.verbose {
+			fmt.Fprintf(os.Stderr, "%s was exported to %s already\n",
+				s.path, tool)
+		}
+		return nil
+	}
+	var argv []string
+	switch tool {
+	case "restic":
+		argv = []string{"restic", "-r", *repo.Repository, "backup",
+			"--time", s.created.Format("2006-01-02 15:04:05"),
+			"--tag", "snap", "--tag", p.name}
+		argv = append(argv, repo.Args...)
+		argv = append(argv, ".")
+	case "borg":
+		archive := fmt.Sprintf("%s::%s-%s", *repo.Repository, p.name,
+			path.Base(s.path))
+		argv = []string{"borg", "create", "--timestamp",
+			s.created.UTC().Format("2006-01-02T15:04:05")}
+		argv = append(argv, repo.Args...)
+		argv = append(argv, archive, ".")
+	}
+	dir := s.subvolPath()
+	if a.opts.dryRun || a.opts.verbose {
+		fmt.Fprintf(os.Stderr, "cd %s && %s\n", shellQuote(dir),
+			argvString(argv))
+	}
+	if a.opts.dryRun {
+		return nil
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Dir = dir
+	cmd.Env = a.environ()
+	for k, s := range repo.Env {
+		v, err := s.reveal()
+		if err != nil {
+			return fmt.Errorf("Env: %s: %w", k, err)
+		}
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	var stderrBuf bytes.Buffer
+	cmd.Stderr = &stderrBuf
+	run := a.started("", argv)
+	err = cmd.Run()
+	a.finished(run, err, nil, stderrBuf.Bytes())
+	if err != nil {
+		return cmdError(argv[0], err, &stderrBuf)
+	}
+	return a.db.put(key, &exportRecord{Exported: time.Now()})
+}
+
+// validExport tells whether tool is a valid --export-to value.
+func validExport(tool string) bool {
+	return tool == "" || tool == "restic" || tool == "borg"
+}
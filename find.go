@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseSize parses sizes such as "512", "10K" or "1.5G" (binary units).
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	if l := len(s); l > 0 {
+		if i := strings.IndexByte("KMGTPE", s[l-1]); i >= 0 {
+			mult = 1 << (10 * uint(i+1))
+			s = s[:l-1]
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(f * float64(mult)), nil
+}
+
+// parseDate parses a date given as YYYY-MM-DD in local time, or as a Unix
+// timestamp.
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if unix, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", s)
+}
+
+// findFilter restricts which files --find reports.
+type findFilter struct {
+	pattern        string
+	minSize        int64
+	maxSize        int64
+	modifiedAfter  time.Time
+	modifiedBefore time.Time
+}
+
+func (a *app) findFilter(pattern string) (*findFilter, error) {
+	f := &findFilter{pattern: pattern, maxSize: -1}
+	var err error
+	if a.opts.minSize != "" {
+		if f.minSize, err = parseSize(a.opts.minSize); err != nil {
+			return nil, err
+		}
+	}
+	if a.opts.maxSize != "" {
+		if f.maxSize, err = parseSize(a.opts.maxSize); err != nil {
+			return nil, err
+		}
+	}
+	if a.opts.modifiedAfter != "" {
+		if f.modifiedAfter, err = parseDate(a.opts.modifiedAfter); err != nil {
+			return nil, err
+		}
+	}
+	if a.opts.modifiedBefore != "" {
+		if f.modifiedBefore, err = parseDate(a.opts.modifiedBefore); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	return f, nil
+}
+
+// match tells whether the file at path rel matches the filter. Patterns
+// which contain a slash are matched against the whole path, others against
+// the file name only.
+func (f *findFilter) match(rel string, e dirEntry) bool {
+	name := filepath.Base(rel)
+	if strings.Contains(f.pattern, "/") {
+		name = rel
+	}
+	if ok, _ := filepath.Match(f.pattern, name); !ok {
+		return false
+	}
+	if e.Size < f.minSize || (f.maxSize >= 0 && e.Size > f.maxSize) {
+		return false
+	}
+	if !f.modifiedAfter.IsZero() && e.ModTime.Before(f.modifiedAfter) {
+		return false
+	}
+	if !f.modifiedBefore.IsZero() && !e.ModTime.Before(f.modifiedBefore) {
+		return false
+	}
+	return true
+}
+
+type findResult struct {
+	last       dirEntry
+	first      *snap
+	lastSeen   *snap
+	inNewest   bool
+	numVersion int
+}
+
+// find searches all snapshots for files matching pattern and reports in
+// which snapshots they existed.
+func (a *app) find(p *profileJSON, pattern string) error {
+	f, err := a.findFilter(pattern)
+	if err != nil {
+		return err
+	}
+	exclude, err := a.excludes(p)
+	if err != nil {
+		return err
+	}
+	snaps, err := profileSnaps(p)
+	if err != nil {
+		return err
+	}
+	perSnap, err := a.allSnapFiles(snaps, ".", true)
+	if err != nil {
+		return err
+	}
+	results := make(map[string]*findResult)
+	for i, files := range perSnap {
+		for rel, e := range files {
+			if !f.match(rel, e) || exclude.match(rel) {
+				continue
+			}
+			r, ok := results[rel]
+			if !ok {
+				r = &findResult{first: snaps[i]}
+				results[rel] = r
+			}
+			if r.numVersion == 0 || r.last.Size != e.Size ||
+				!r.last.ModTime.Equal(e.ModTime) {
+				r.numVersion++
+			}
+			r.last = e
+			r.lastSeen = snaps[i]
+			r.inNewest = i == len(snaps)-1
+		}
+	}
+	var names []string
+	for n := range results {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	now := time.Now()
+	t := newTable("FILE", "SIZE", "MODIFIED", "VERSIONS", "FIRST SEEN",
+		"LAST SEEN", "LAST SNAPSHOT")
+	t.alignRight(1, 3, 4, 5)
+	for _, n := range names {
+		r := results[n]
+		lastSeen := cell{text: a.formatTime(r.lastSeen.created, now)}
+		if r.inNewest {
+			lastSeen = cell{text: "present", color: colorGreen}
+		}
+		t.add(plainCell("%s", n),
+			plainCell("%s", formatBytes(uint64(r.last.Size))),
+			plainCell("%s", a.formatDate(r.last.ModTime)),
+			plainCell("%d", r.numVersion),
+			plainCell("%s", a.formatTime(r.first.created, now)),
+			lastSeen,
+			plainCell("%s", r.lastSeen.path))
+	}
+	return a.printTable(t)
+}
@@ -1,5 +1,12 @@
 module github.com/dcepelik/snap
 
-go 1.13
+go 1.24.0
 
-require github.com/pborman/getopt v0.0.0-20190409184431-ee0cd42419d3 // indirect
+require (
+	github.com/godbus/dbus/v5 v5.2.2
+	github.com/pborman/getopt v0.0.0-20190409184431-ee0cd42419d3
+	golang.org/x/crypto v0.48.0
+	golang.org/x/term v0.40.0
+)
+
+require golang.org/x/sys v0.41.0 // indirect
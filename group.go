@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+func (c *configJSON) validateGroups() error {
+	cmds := (&app{}).commands()
+	for name, g := range c.Groups {
+		if _, ok := c.Profiles[name]; ok {
+			return fmt.Errorf("Groups: %q: there's a profile of the "+
+				"same name", name)
+		}
+		if _, ok := cmds[name]; ok {
+			return fmt.Errorf("Groups: %q: there's a command of the "+
+				"same name", name)
+		}
+		if len(g) == 0 {
+			return fmt.Errorf("Groups: %q: no profiles", name)
+		}
+		for _, n := range g {
+			if _, ok := c.Profiles[n]; !ok {
+				return fmt.Errorf("Groups: %q: no profile named %q",
+					name, n)
+			}
+		}
+	}
+	for name, p := range c.Profiles {
+		for _, n := range p.predecessors() {
+			if _, ok := c.Profiles[n]; !ok {
+				return fmt.Errorf("profile %q: no profile named %q",
+					name, n)
+			}
+		}
+	}
+	// Ordering all profiles finds cycles.
+	all := make([]ProfileName, 0, len(c.Profiles))
+	for n := range c.Profiles {
+		all = append(all, n)
+	}
+	_, err := c.groupOrder(all)
+	return err
+}
+
+// predecessors returns the profiles p runs after if they run too.
+func (p *profileJSON) predecessors() []ProfileName {
+	preds := append(append([]ProfileName{}, p.After...), p.Requires...)
+	if p.Source != nil {
+		preds = append(preds, *p.Source)
+	}
+	return preds
+}
+
+// groupOrder returns the profiles called names, along with those they
+// require, in the order in which they run.
+func (c *configJSON) groupOrder(names []ProfileName) ([]ProfileName, error) {
+	run := make(map[ProfileName]bool)
+	var require func(n ProfileName)
+	require = func(n ProfileName) {
+		if run[n] {
+			return
+		}
+		run[n] = true
+		for _, r := range c.Profiles[n].Requires {
+			require(r)
+		}
+	}
+	for _, n := range names {
+		require(n)
+	}
+	sorted := make([]ProfileName, 0, len(run))
+	for n := range run {
+		sorted = append(sorted, n)
+	}
+	sort.Strings(sorted)
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[ProfileName]int)
+	var order []ProfileName
+	var visit func(n ProfileName, path []ProfileName) error
+	visit = func(n ProfileName, path []ProfileName) error {
+		switch state[n] {
+		case visiting:
+			return fmt.Errorf("profiles run after each other: %s",
+				strings.Join(append(path, n), " → "))
+		case visited:
+			return nil
+		}
+		state[n] = visiting
+		preds := c.Profiles[n].predecessors()
+		sort.Strings(preds)
+		for _, pred := range preds {
+			if !run[pred] {
+				continue
+			}
+			if err := visit(pred, append(path, n)); err != nil {
+				return err
+			}
+		}
+		state[n] = visited
+		order = append(order, n)
+		return nil
+	}
+	for _, n := range sorted {
+		if err := visit(n, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// runGroup runs the profiles of the group called name, as in "snap nightly".
+// Each runs the operations given, or if none are, takes a snapshot or backs
+// up snapshots, whichever it does, and prunes. Profiles run after those they
+// run After, including their Source, and after those they Require. Profiles
+// required by those of the group run too, even if they aren't in it, and if
+// one fails, those requiring it are skipped.
+func (a *app) runGroup(name string) error {
+	order, err := a.cfg.groupOrder(a.cfg.Groups[name])
+	if err != nil {
+		return err
+	}
+	explicit := false
+	for _, opt := range a.commands() {
+		explicit = explicit || *opt
+	}
+	create, backup, prune := a.opts.create, a.opts.backup, a.opts.prune
+	if !explicit || a.opts.runOnce {
+		create, backup, prune = true, true, true
+	}
+	failed := make(map[ProfileName]bool)
+	var failures, skipped []string
+	for _, n := range order {
+		p := a.cfg.Profiles[n]
+		var missing []string
+		for _, r := range p.Requires {
+			if failed[r] {
+				missing = append(missing, r)
+			}
+		}
+		if len(missing) > 0 {
+			fmt.Fprintf(os.Stderr, "skipping profile %q, it requires "+
+				"%s which failed\n", n, strings.Join(missing, ", "))
+			failed[n] = true
+			skipped = append(skipped, n)
+			continue
+		}
+		pa := *a
+		pa.opts.profileName = n
+		pa.opts.create = create && !p.isBackup()
+		pa.opts.backup = backup && p.isBackup()
+		pa.opts.prune = prune
+		if a.opts.list || a.opts.status {
+			fmt.Printf("%s:\n", n)
+		}
+		if err := pa.runProfile(p); err != nil {
+			fmt.Fprintf(os.Stderr, "profile %q: %v\n", n, err)
+			failed[n] = true
+			failures = append(failures, n)
+		}
+	}
+	if len(failures) > 0 {
+		err := fmt.Errorf("group %q: profiles failed: %s", name,
+			strings.Join(failures, ", "))
+		if len(skipped) > 0 {
+			err = fmt.Errorf("%w; skipped: %s", err,
+				strings.Join(skipped, ", "))
+		}
+		return err
+	}
+	return nil
+}
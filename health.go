@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// freeSpaceMargin is required on the destination on top of the estimated
+// size of a transfer, as btrfs needs room for metadata too.
+const freeSpaceMargin = 1 << 30
+
+// progsVersion is a btrfs-progs version, major and minor.
+type progsVersion [2]int
+
+func (v progsVersion) String() string {
+	return fmt.Sprintf("%d.%d", v[0], v[1])
+}
+
+func (v progsVersion) atLeast(major, minor int) bool {
+	return v[0] > major || v[0] == major && v[1] >= minor
+}
+
+// streamProto returns the newest send stream protocol version which
+// btrfs-progs of version v can receive.
+func (v progsVersion) streamProto() int {
+	if v.atLeast(6, 0) {
+		return 2
+	}
+	return 1
+}
+
+// btrfsVersion returns the version of btrfs-progs installed on host.
+func (a *app) btrfsVersion(host string) (progsVersion, error) {
+	var v progsVersion
+	var stdout bytes.Buffer
+	argv := []string{a.btrfs(host, "--version"), "--version"}
+	if err := a.runOn(host, &stdout, argv); err != nil {
+		return v, err
+	}
+	// btrfs-progs v6.6.3
+	f := strings.Fields(stdout.String())
+	if len(f) < 2 {
+		return v, fmt.Errorf("unexpected version output %q", stdout.String())
+	}
+	parts := strings.SplitN(strings.TrimPrefix(f[1], "v"), ".", 3)
+	for i := 0; i < 2 && i < len(parts); i++ {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return v, fmt.Errorf("invalid version %q", f[1])
+		}
+		v[i] = n
+	}
+	return v, nil
+}
+
+// statFS returns the type of the filesystem which holds dir on host and the
+// space available on it.
+func (a *app) statFS(host, dir string) (string, uint64, error) {
+	var stdout bytes.Buffer
+	argv := []string{"stat", "-f", "-c", "%T %a %S", dir}
+	if err := a.runOn(host, &stdout, argv); err != nil {
+		return "", 0, err
+	}
+	f := strings.Fields(stdout.String())
+	if len(f) != 3 {
+		return "", 0, fmt.Errorf("unexpected stat output %q",
+			stdout.String())
+	}
+	blocks, err1 := strconv.ParseUint(f[1], 10, 64)
+	bsize, err2 := strconv.ParseUint(f[2], 10, 64)
+	if err1 != nil || err2 != nil {
+		return "", 0, fmt.Errorf("unexpected stat output %q",
+			stdout.String())
+	}
+	return f[0], blocks * bsize, nil
+}
+
+// transferSize estimates how much space receiving snaps will take: all data
+// referenced by the first one if it's sent in full, and exclusive data of
+// the others. It returns false if qgroup usage of snaps isn't known.
+func transferSize(snaps []*snap, full bool) (uint64, bool) {
+	var size uint64
+	for i, s := range snaps {
+		if s.usage == nil {
+			return 0, false
+		}
+		if i == 0 && full {
+			size += s.usage.referenced
+		} else {
+			size += s.usage.exclusive
+		}
+	}
+	return size, true
+}
+
+// fullSize is like transferSize, but for snaps which are all sent in full.
+func fullSize(snaps []*snap) (uint64, bool) {
+	var size uint64
+	for _, s := range snaps {
+		if s.usage == nil {
+			return 0, false
+		}
+		size += s.usage.referenced
+	}
+	return size, true
+}
+
+// checkTransfer makes sure that snapshots of the given estimated size (or
+// unknown size, if known is false) can be sent from host from to storage on
+// host to, so that a transfer fails before it starts rather than halfway
+// through a long stream. It creates storage if it doesn't exist yet and
+// returns the send stream protocol version to request, or 0 to leave the
+// choice to btrfs send.
+func (a *app) checkTransfer(from, to, storage string, size uint64, known bool) (int, error) {
+	if err := a.mkdirAll(to, storage); err != nil {
+		return 0, err
+	}
+	where := storage
+	if to != "" {
+		where = to + ":" + storage
+	}
+	typ, avail, err := a.statFS(to, storage)
+	if err != nil {
+		return 0, fmt.Errorf("cannot check destination: %w", err)
+	}
+	if typ != "btrfs" {
+		return 0, fmt.Errorf("%s is on %s, not btrfs; "+
+			"snapshots can only be received into btrfs", where, typ)
+	}
+	if known && size+freeSpaceMargin > avail {
+		return 0, fmt.Errorf("%s has %s free, but about %s is needed "+
+			"(including %s reserve); free up space or prune first",
+			where, formatBytes(avail), formatBytes(size+freeSpaceMargin),
+			formatBytes(freeSpaceMargin))
+	} else if !known && a.opts.verbose {
+		fmt.Fprintf(os.Stderr, "size of transfer unknown, "+
+			"%s free in %s\n", formatBytes(avail), where)
+	}
+
+	sendVer, err := a.btrfsVersion(from)
+	if err != nil {
+		return 0, fmt.Errorf("cannot run btrfs on sending side: %w", err)
+	}
+	recvVer, err := a.btrfsVersion(to)
+	if err != nil {
+		return 0, fmt.Errorf("cannot run btrfs on receiving side: %w", err)
+	}
+	if a.opts.verbose {
+		fmt.Fprintf(os.Stderr, "btrfs-progs %s sending, %s receiving\n",
+			sendVer, recvVer)
+	}
+	// Older btrfs send only speaks protocol version 1, which every btrfs
+	// receive understands. Newer ones are told not to use anything the
+	// receiving side wouldn't understand.
+	if sendVer.streamProto() > recvVer.streamProto() {
+		return recvVer.streamProto(), nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/dcepelik/snap/humanize"
+)
+
+// Probes of snap serve, which need no token so that uptime checkers and
+// Kubernetes can use them:
+//
+//	GET /healthz  fails if a profile's newest snapshot is older than MaxAge
+//	GET /readyz   also fails if snapshots of any profile can't be listed
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+)
+
+// checkHealth responds with what's wrong with profiles, or just "ok".
+// Profiles without MaxAge are only checked if all is set.
+func (s *server) checkHealth(w http.ResponseWriter, all bool) {
+	names := make([]string, 0, len(s.app.cfg.Profiles))
+	for n := range s.app.cfg.Profiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var problems []string
+	now := time.Now()
+	for _, n := range names {
+		p := s.app.cfg.Profiles[n]
+		if p.MaxAge == nil && !all {
+			continue
+		}
+		for _, err := range s.app.staleness(p, now) {
+			problems = append(problems, err.Error())
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(problems) == 0 {
+		fmt.Fprintln(w, "ok")
+		return
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	for _, p := range problems {
+		fmt.Fprintln(w, p)
+	}
+}
+
+// staleness returns errors telling why snapshots of p, or of each of its
+// volumes, can't be listed or are older than MaxAge. Each starts with the
+// name of the profile or volume.
+func (a *app) staleness(p *profileJSON, now time.Time) []error {
+	profiles, err := a.volumeProfiles(p)
+	if err != nil {
+		return []error{fmt.Errorf("%s: %w", p.name, err)}
+	}
+	var errs []error
+	for _, vp := range profiles {
+		snaps, err := profileSnaps(vp)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", vp.name, err))
+			continue
+		}
+		if p.MaxAge == nil {
+			continue
+		}
+		var newest *snap
+		for _, s := range snaps {
+			if newest == nil || s.created.After(newest.created) {
+				newest = s
+			}
+		}
+		maxAge := time.Duration(*p.MaxAge)
+		switch {
+		case newest == nil:
+			errs = append(errs, fmt.Errorf("%s: no snapshots", vp.name))
+		case now.Sub(newest.created) > maxAge:
+			errs = append(errs, fmt.Errorf("%s: newest snapshot "+
+				"taken %s, MaxAge is %s", vp.name,
+				humanize.Ago(now.Sub(newest.created), 2),
+				formatInterval(maxAge)))
+		}
+	}
+	return errs
+}
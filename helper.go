@@ -0,0 +1,13 @@
+package main
+
+// btrfs returns the command which runs the btrfs command cmd on host.
+// Locally, that's the helper if one is configured, so that snap needn't run
+// as root; see cmd/snap-helper. The helper refuses send and receive, which
+// only snap running as root may run.
+func (a *app) btrfs(host, cmd string) string {
+	if host == "" && a.cfg.Helper != nil && cmd != "send" &&
+		cmd != "receive" {
+		return *a.cfg.Helper
+	}
+	return a.opts.btrfsBin
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// metaDir holds metadata directories of snapshots in a storage directory,
+// relative to it. Generators of hooks fill them with files such as lists of
+// installed packages, and backups copy them along with the snapshots.
+const metaDir = ".meta"
+
+// hooksJSON configures commands run once a profile has created a snapshot.
+// Generators map names of files to commands whose standard output is saved
+// as those files in the metadata directory of the snapshot, for example
+// "packages.txt": ["dpkg-query", "-l"]. PostCreate commands run after them.
+// Both get the following environment variables:
+//
+//	SNAP_PROFILE   name of the profile
+//	SNAP_SNAPSHOT  path of the snapshot
+//	SNAP_META      metadata directory of the snapshot, see metaDir
+//	SNAP_SCRATCH   scratch directory, removed once the hooks are done
+type hooksJSON struct {
+	Generators map[string][]string
+	PostCreate [][]string
+}
+
+func (h *hooksJSON) validate() error {
+	for name, argv := range h.Generators {
+		if name == "" || name != path.Base(name) || name[0] == '.' {
+			return fmt.Errorf("Generators: %q: must be a plain file "+
+				"name", name)
+		}
+		if len(argv) == 0 {
+			return fmt.Errorf("Generators: %q: command is empty", name)
+		}
+	}
+	for _, argv := range h.PostCreate {
+		if len(argv) == 0 {
+			return fmt.Errorf("PostCreate: command is empty")
+		}
+	}
+	return nil
+}
+
+func metaPath(s *snap) string {
+	return path.Join(path.Dir(s.path), metaDir, path.Base(s.path))
+}
+
+func removeMeta(s *snap) error {
+	return os.RemoveAll(metaPath(s))
+}
+
+// runHooks runs Hooks of p for the snapshot s it has just created.
+func (a *app) runHooks(p *profileJSON, s *snap) error {
+	h := p.Hooks
+	if h == nil {
+		return nil
+	}
+	names := make([]string, 0, len(h.Generators))
+	for name := range h.Generators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if a.opts.dryRun || a.opts.verbose {
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "%s > %s\n",
+				argvString(h.Generators[name]),
+				shellQuote(path.Join(metaPath(s), name)))
+		}
+		for _, argv := range h.PostCreate {
+			printArgv(argv)
+		}
+	}
+	if a.opts.dryRun {
+		return nil
+	}
+	meta := metaPath(s)
+	if err := os.MkdirAll(meta, defaultDirMode); err != nil {
+		return err
+	}
+	scratch, err := os.MkdirTemp("", "snap-hook-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(scratch)
+	env := a.environ()
+	env = append(env[:len(env):len(env)],
+		"SNAP_PROFILE="+p.name,
+		"SNAP_SNAPSHOT="+s.subvolPath(),
+		"SNAP_META="+meta,
+		"SNAP_SCRATCH="+scratch)
+	for _, name := range names {
+		err := a.generate(h.Generators[name], env, path.Join(meta, name))
+		if err != nil {
+			return fmt.Errorf("Generators: %s: %w", name, err)
+		}
+	}
+	for _, argv := range h.PostCreate {
+		if err := a.runHook(argv, env, nil); err != nil {
+			return fmt.Errorf("PostCreate: %w", err)
+		}
+	}
+	return nil
+}
+
+// generate saves the output of argv as the file dst.
+func (a *app) generate(argv, env []string, dst string) error {
+	f, err := os.CreateTemp(path.Dir(dst), ".tmp-")
+	if err != nil {
+		return err
+	}
+	err = a.runHook(argv, env, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), dst)
+}
+
+func (a *app) runHook(argv, env []string, stdout io.Writer) error {
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Env = env
+	var stdoutBuf *cappedBuffer
+	cmd.Stdout, stdoutBuf = a.capture(stdout)
+	var stderrBuf bytes.Buffer
+	cmd.Stderr = &stderrBuf
+	run := a.started("", argv)
+	err := cmd.Run()
+	a.finished(run, err, stdoutBuf, stderrBuf.Bytes())
+	if err != nil {
+		return cmdError(argv[0], err, &stderrBuf)
+	}
+	return nil
+}
+
+// copyMeta copies the metadata directory of the snapshot s on host, if it
+// has any, to that of its copy dst.
+func (a *app) copyMeta(host string, s, dst *snap) error {
+	if a.opts.dryRun {
+		return nil
+	}
+	var archive bytes.Buffer
+	argv := []string{"sh", "-c", `test ! -d "$1" || tar -cf - -C "$1" .`,
+		"sh", metaPath(s)}
+	if err := a.runOn(host, &archive, argv); err != nil {
+		return fmt.Errorf("cannot copy metadata of %s: %w", s.path, err)
+	}
+	if archive.Len() == 0 {
+		return nil
+	}
+	meta := metaPath(dst)
+	if err := os.MkdirAll(meta, defaultDirMode); err != nil {
+		return err
+	}
+	r := tar.NewReader(&archive)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("cannot copy metadata of %s: %w",
+				s.path, err)
+		}
+		name := path.Clean(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || strings.Contains(name, "/") {
+			// Generators only make plain files.
+			continue
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(filepath.Join(meta, name), data, 0600)
+		if err != nil {
+			return err
+		}
+	}
+}
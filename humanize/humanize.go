@@ -0,0 +1,62 @@
+// Package humanize formats durations in a compact form meant for humans,
+// such as "3d5h" or "2w ago".
+package humanize
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	Day   = 24 * time.Hour
+	Week  = 7 * Day
+	Month = 30 * Day
+	Year  = 365 * Day
+)
+
+// Duration formats d using at most maxPrec units, largest first. Units are
+// picked so that the leading number stays reasonably small, e.g. durations
+// between one and three months are given in weeks. The sign of d is ignored.
+func Duration(d time.Duration, maxPrec int) string {
+	if maxPrec <= 0 {
+		return ""
+	}
+	if d < 0 {
+		d = -d
+	}
+	ranges := []struct {
+		lt   time.Duration
+		div  time.Duration
+		unit string
+	}{
+		{time.Minute, time.Second, "s"},
+		{time.Hour, time.Minute, "m"},
+		{2 * Day, time.Hour, "h"},
+		{Month, Day, "d"},
+		{3 * Month, Week, "w"},
+		{2 * Year, Month, "M"},
+	}
+	div, unit := Year, "y"
+	for _, r := range ranges {
+		if d < r.lt {
+			div, unit = r.div, r.unit
+			break
+		}
+	}
+	v := d / div
+	r := d - v*div
+	tail := ""
+	if r >= time.Second {
+		tail = Duration(r, maxPrec-1)
+	}
+	return fmt.Sprintf("%d%s%s", v, unit, tail)
+}
+
+// Ago formats d as the age of something, e.g. "5m ago". Negative durations
+// are in the future, e.g. "in 5m".
+func Ago(d time.Duration, maxPrec int) string {
+	if d < 0 {
+		return "in " + Duration(d, maxPrec)
+	}
+	return Duration(d, maxPrec) + " ago"
+}
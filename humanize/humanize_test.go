@@ -0,0 +1,64 @@
+package humanize
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDuration(t *testing.T) {
+	tests := []struct {
+		d       time.Duration
+		maxPrec int
+		want    string
+	}{
+		{0, 2, "0s"},
+		{500 * time.Millisecond, 2, "0s"},
+		{59 * time.Second, 2, "59s"},
+		{time.Minute, 2, "1m"},
+		{time.Minute + 500*time.Millisecond, 2, "1m"},
+		{90 * time.Second, 1, "1m"},
+		{90 * time.Second, 2, "1m30s"},
+		{time.Hour - time.Second, 2, "59m59s"},
+		{time.Hour, 2, "1h"},
+		{time.Hour + time.Minute + time.Second, 2, "1h1m"},
+		{time.Hour + time.Minute + time.Second, 3, "1h1m1s"},
+		{2*Day - time.Hour, 2, "47h"},
+		{2 * Day, 2, "2d"},
+		{Month - Day, 2, "29d"},
+		{Month, 2, "4w2d"},
+		{3*Month - Day, 2, "12w5d"},
+		{3 * Month, 2, "3M"},
+		{2*Year - Day, 2, "24M9d"},
+		{2 * Year, 2, "2y"},
+		{2*Year + Month, 2, "2y4w"},
+		{-90 * time.Second, 2, "1m30s"},
+		{time.Hour, 0, ""},
+		{time.Hour, -1, ""},
+	}
+	for _, tt := range tests {
+		if got := Duration(tt.d, tt.maxPrec); got != tt.want {
+			t.Errorf("Duration(%v, %d) = %q, want %q", tt.d,
+				tt.maxPrec, got, tt.want)
+		}
+	}
+}
+
+func TestAgo(t *testing.T) {
+	tests := []struct {
+		d       time.Duration
+		maxPrec int
+		want    string
+	}{
+		{0, 2, "0s ago"},
+		{5 * time.Minute, 2, "5m ago"},
+		{-5 * time.Minute, 2, "in 5m"},
+		{-(Day + time.Hour), 1, "in 25h"},
+		{3*Week + 2*Day, 2, "23d ago"},
+	}
+	for _, tt := range tests {
+		if got := Ago(tt.d, tt.maxPrec); got != tt.want {
+			t.Errorf("Ago(%v, %d) = %q, want %q", tt.d, tt.maxPrec,
+				got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// generation returns the generation of the subvolume subvol, the ID of the
+// last transaction which changed it. Asked for files newer than any there
+// are, find-new only prints it as its transid marker.
+func (a *app) generation(subvol string) (uint64, error) {
+	out, err := a.btrfsQuery("subvolume", "find-new", subvol,
+		strconv.FormatUint(math.MaxUint64, 10))
+	if err != nil {
+		return 0, err
+	}
+	const marker = "transid marker was "
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, marker) {
+			gen := strings.TrimSpace(line[len(marker):])
+			return strconv.ParseUint(gen, 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("%s: no transid marker in output of find-new",
+		subvol)
+}
+
+// idle tells whether Subvolume of p hasn't changed since its newest snapshot
+// was taken, judging by generations, see snapGeneration.
+func (a *app) idle(p *profileJSON) (bool, error) {
+	snaps, err := profileSnaps(p)
+	if err != nil {
+		return false, err
+	}
+	var newest *snap
+	for _, s := range snaps {
+		if newest == nil || s.created.After(newest.created) {
+			newest = s
+		}
+	}
+	if newest == nil {
+		return false, nil
+	}
+	if err := loadNotes([]*snap{newest}); err != nil {
+		return false, err
+	}
+	last, err := a.snapGeneration(newest)
+	if err != nil {
+		return false, err
+	}
+	gen, err := a.generation(*p.Subvolume)
+	if err != nil {
+		return false, err
+	}
+	if gen == last && (a.opts.dryRun || a.opts.verbose) {
+		fmt.Fprintf(os.Stderr, "%s hasn't changed since %s was taken, "+
+			"not taking another snapshot\n", *p.Subvolume, newest)
+	}
+	return gen == last, nil
+}
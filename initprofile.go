@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// bucketTemplate is a bucket as written into the configuration.
+type bucketTemplate struct {
+	Interval string
+	Size     int
+}
+
+// defaultBuckets are the buckets of profiles made by --init-profile.
+var defaultBuckets = []bucketTemplate{
+	{"1h", 24}, {"1d", 7}, {"1w", 4}, {"1M", 12},
+}
+
+// profileTemplate is a profile as written into the configuration.
+type profileTemplate struct {
+	Buckets   []bucketTemplate
+	Storage   string
+	Subvolume string
+}
+
+// initProfile adds a profile taking snapshots of the subvolume given by
+// --subvolume into storage given by --storage to the configuration file.
+// The file is edited in place, so that the rest of it stays as it is.
+func (a *app) initProfile() error {
+	name := a.opts.profileName
+	if _, ok := a.cfg.Profiles[name]; ok {
+		return fmt.Errorf("profile %q exists already", name)
+	}
+	if a.opts.subvolume == "" || a.opts.storage == "" {
+		return fmt.Errorf("--subvolume and --storage are needed")
+	}
+	t := profileTemplate{
+		Buckets:   defaultBuckets,
+		Storage:   a.opts.storage,
+		Subvolume: a.opts.subvolume,
+	}
+	buf, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	// Validate the profile the way loadConfig would.
+	var p profileJSON
+	if err := json.Unmarshal(buf, &p); err != nil {
+		return err
+	}
+	p.name = name
+	if err := p.validate(); err != nil {
+		return fmt.Errorf("profile %q: %w", name, err)
+	}
+
+	cfgPath := a.opts.cfgPath
+	if os.Geteuid() != 0 {
+		// Users keep their profiles in their own configuration.
+		if cfgPath, err = userConfigPath(); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(cfgPath), 0700); err != nil {
+			return err
+		}
+	}
+	data, err := ioutil.ReadFile(cfgPath)
+	if os.IsNotExist(err) && cfgPath != a.opts.cfgPath {
+		data, err = []byte("{\n  \"Profiles\": {}\n}\n"), nil
+	}
+	if err != nil {
+		return err
+	}
+	out, err := insertProfile(data, name, t)
+	if err != nil {
+		return fmt.Errorf("%s: %w", cfgPath, err)
+	}
+	if _, err := parseConfig(out); err != nil {
+		return fmt.Errorf("%s would be invalid: %w", cfgPath, err)
+	}
+	if a.opts.dryRun {
+		_, err := os.Stdout.Write(out)
+		return err
+	}
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(cfgPath); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(cfgPath), ".config-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(out); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), cfgPath); err != nil {
+		return err
+	}
+	fmt.Printf("profile %q added to %s\n", name, cfgPath)
+	return nil
+}
+
+// insertProfile adds profile t named name to Profiles of the configuration
+// data, indented like the rest of it.
+func insertProfile(data []byte, name string, t profileTemplate) ([]byte, error) {
+	indent := indentUnit(data)
+	key, err := json.Marshal(name)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.MarshalIndent(t, indent+indent, indent)
+	if err != nil {
+		return nil, err
+	}
+	entry := "\n" + indent + indent + string(key) + ": " + string(body)
+
+	open, close, empty, err := profilesSpan(data)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if open < 0 {
+		// No Profiles yet, add them as the last key.
+		end := bytes.LastIndexByte(data, '}')
+		if end < 0 {
+			return nil, fmt.Errorf("not a JSON object")
+		}
+		last := len(bytes.TrimRight(data[:end], " \t\r\n"))
+		b.Write(data[:last])
+		if data[last-1] != '{' {
+			b.WriteString(",")
+		}
+		b.WriteString("\n" + indent + `"Profiles": {` + entry + "\n" +
+			indent + "}\n")
+		b.Write(data[end:])
+		return b.Bytes(), nil
+	}
+	if empty {
+		b.Write(data[:open+1])
+		b.WriteString(entry + "\n" + indent)
+		b.Write(data[close:])
+		return b.Bytes(), nil
+	}
+	last := len(bytes.TrimRight(data[:close], " \t\r\n"))
+	b.Write(data[:last])
+	b.WriteString("," + entry)
+	b.Write(data[last:])
+	return b.Bytes(), nil
+}
+
+// profilesSpan returns offsets of the braces of the Profiles object in the
+// configuration data, or -1 if there's none, and whether it's empty.
+func profilesSpan(data []byte) (open, close int, empty bool, err error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil {
+		return 0, 0, false, err
+	} else if tok != json.Delim('{') {
+		return 0, 0, false, fmt.Errorf("not a JSON object")
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return 0, 0, false, err
+		}
+		if tok != "Profiles" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return 0, 0, false, err
+			}
+			continue
+		}
+		if tok, err := dec.Token(); err != nil {
+			return 0, 0, false, err
+		} else if tok != json.Delim('{') {
+			return 0, 0, false, fmt.Errorf("Profiles is not an object")
+		}
+		open = int(dec.InputOffset()) - 1
+		empty = !dec.More()
+		for dec.More() {
+			var skip json.RawMessage
+			if _, err := dec.Token(); err != nil {
+				return 0, 0, false, err
+			}
+			if err := dec.Decode(&skip); err != nil {
+				return 0, 0, false, err
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return 0, 0, false, err
+		}
+		return open, int(dec.InputOffset()) - 1, empty, nil
+	}
+	return -1, -1, false, nil
+}
+
+// indentUnit guesses what the configuration data is indented by from its
+// first indented line.
+func indentUnit(data []byte) string {
+	for _, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed != "" && len(trimmed) < len(line) {
+			return line[:len(line)-len(trimmed)]
+		}
+	}
+	return "  "
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// journalDir is where intents of operations which modify a storage directory
+// are recorded, relative to the storage directory. Should snap be
+// interrupted, the next run finds out what was going on and puts the storage
+// into a consistent state.
+const journalDir = ".journal"
+
+// Operations recorded in the journal.
+const (
+	opCreate   = "create"
+	opMigrate  = "migrate"
+	opPrune    = "prune"
+	opReceive  = "receive"
+	opTrash    = "trash"
+	opUndelete = "undelete"
+)
+
+type journalEntry struct {
+	Op    string
+	Name  string
+	Flat  bool
+	Plain bool
+}
+
+func journal(storage string) *metaDB {
+	return &metaDB{dir: path.Join(storage, journalDir)}
+}
+
+// begin records the intent to perform op on the snapshot s in storage. The
+// returned function marks the operation as done.
+func (a *app) begin(storage, op string, s *snap) (func() error, error) {
+	if a.opts.dryRun {
+		return func() error { return nil }, nil
+	}
+	j := journal(storage)
+	name := path.Base(s.path)
+	key := op + "-" + name
+	e := &journalEntry{Op: op, Name: name, Flat: s.flat, Plain: s.plain}
+	err := j.put(key, e)
+	if err != nil {
+		return nil, fmt.Errorf("cannot write journal: %w", err)
+	}
+	return func() error { return j.remove(key) }, nil
+}
+
+// reconcile finishes or reverts operations on storage which were
+// interrupted.
+func (a *app) reconcile(storage string) error {
+	j := journal(storage)
+	fis, err := ioutil.ReadDir(j.dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		key := strings.TrimSuffix(fi.Name(), ".json")
+		if key == fi.Name() {
+			// Temporary file of an interrupted write.
+			os.Remove(path.Join(j.dir, fi.Name()))
+			continue
+		}
+		var e journalEntry
+		if _, err := j.get(key, &e); err != nil {
+			return fmt.Errorf("journal entry %s: %w", key, err)
+		}
+		s := &snap{path: path.Join(storage, e.Name), flat: e.Flat,
+			plain: e.Plain}
+		fmt.Fprintf(os.Stderr, "%s of %s was interrupted, ", e.Op, s.path)
+		switch e.Op {
+		case opCreate:
+			// Snapshots are created atomically, only the directory
+			// made for it may be left behind, or the snapshot
+			// being filtered, see filterSnapshot.
+			tmp := path.Join(storage, filterPrefix+e.Name)
+			if _, err := os.Stat(tmp); err == nil {
+				err := a.btrfsCmd("subvolume", "delete", tmp)
+				if err != nil {
+					return err
+				}
+			}
+			if _, err := os.Stat(s.subvolPath()); err == nil {
+				fmt.Fprintln(os.Stderr, "snapshot is complete")
+				// Filtered snapshots are made read-only last.
+				if err := a.setReadOnly(s.subvolPath(), true); err != nil {
+					return err
+				}
+			} else {
+				fmt.Fprintln(os.Stderr, "removing directory")
+				if !a.opts.dryRun {
+					os.Remove(s.path)
+				}
+			}
+		case opPrune:
+			fmt.Fprintln(os.Stderr, "finishing")
+			if err := a.removeSnap(s); err != nil {
+				return err
+			}
+			if err := a.audit(storage, auditDelete, s, ""); err != nil {
+				return err
+			}
+		case opReceive:
+			// Received UUID is only set once receive finishes.
+			ids, err := a.subvolIDs("", s.subvolPath())
+			if err == nil && ids.ReceivedUUID != "" {
+				fmt.Fprintln(os.Stderr, "snapshot is complete")
+			} else {
+				fmt.Fprintln(os.Stderr, "removing partial snapshot")
+				if err := a.cleanupReceive(s.path, s.flat); err != nil {
+					return err
+				}
+			}
+		case opMigrate:
+			// Flat tells the layout the snapshot was moving to.
+			fmt.Fprintln(os.Stderr, "finishing")
+			if err := a.finishMigration(storage, e.Name, e.Flat); err != nil {
+				return err
+			}
+		case opTrash, opUndelete:
+			// Either the snapshot was moved or it wasn't, which
+			// is consistent either way. The trash takes care of
+			// missing records, see trashedSnaps.
+			fmt.Fprintln(os.Stderr, "the snapshot may need "+
+				"to be moved again")
+			// A flat snapshot may have been left writable.
+			p := path.Join(storage, trashDir, e.Name)
+			if _, err := os.Stat(p); err != nil {
+				p = s.path
+			}
+			if s.flat {
+				if err := a.setReadOnly(p, true); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("journal entry %s: unknown operation %q",
+				key, e.Op)
+		}
+		if !a.opts.dryRun {
+			if err := j.remove(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
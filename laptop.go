@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const powerSupplyDir = "/sys/class/power_supply"
+
+// onBattery tells whether the machine runs on battery, that is, whether it
+// has mains power supplies and none of them is online. Machines without any,
+// such as most desktops, aren't on battery.
+func onBattery() (bool, error) {
+	dirs, err := filepath.Glob(filepath.Join(powerSupplyDir, "*"))
+	if err != nil {
+		return false, err
+	}
+	mains := false
+	for _, dir := range dirs {
+		typ, err := ioutil.ReadFile(filepath.Join(dir, "type"))
+		if err != nil || strings.TrimSpace(string(typ)) != "Mains" {
+			continue
+		}
+		mains = true
+		online, err := ioutil.ReadFile(filepath.Join(dir, "online"))
+		if err != nil {
+			return false, err
+		}
+		if strings.TrimSpace(string(online)) == "1" {
+			return false, nil
+		}
+	}
+	return mains, nil
+}
+
+// NMMetered values of the Metered property of NetworkManager.
+const (
+	nmMeteredYes      = 1
+	nmMeteredGuessYes = 3
+)
+
+// metered tells whether NetworkManager thinks the primary connection is
+// metered. Without NetworkManager, connections aren't metered.
+func metered() (bool, error) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	obj := conn.Object("org.freedesktop.NetworkManager",
+		"/org/freedesktop/NetworkManager")
+	v, err := obj.GetProperty("org.freedesktop.NetworkManager.Metered")
+	if err != nil {
+		if e, ok := err.(dbus.Error); ok &&
+			e.Name == "org.freedesktop.DBus.Error.ServiceUnknown" {
+			return false, nil
+		}
+		return false, err
+	}
+	m, ok := v.Value().(uint32)
+	if !ok {
+		return false, fmt.Errorf("unexpected type of Metered: %s",
+			v.Signature())
+	}
+	return m == nmMeteredYes || m == nmMeteredGuessYes, nil
+}
+
+// mayBackUp tells whether p may be backed up now given its RequireAC and
+// AvoidMetered, so that big sends don't drain the battery or the data plan
+// of a laptop. If it may not, it says why. --force backs up regardless.
+// Conditions which can't be checked are taken as met.
+func (a *app) mayBackUp(p *profileJSON) bool {
+	if a.opts.force {
+		return true
+	}
+	why := ""
+	if p.RequireAC {
+		battery, err := onBattery()
+		if err != nil && a.opts.verbose {
+			fmt.Fprintf(os.Stderr, "cannot tell whether on AC "+
+				"power: %v\n", err)
+		}
+		if battery {
+			why = "running on battery"
+		}
+	}
+	if why == "" && p.AvoidMetered {
+		m, err := metered()
+		if err != nil && a.opts.verbose {
+			fmt.Fprintf(os.Stderr, "cannot tell whether the "+
+				"connection is metered: %v\n", err)
+		}
+		if m {
+			why = "the connection is metered"
+		}
+	}
+	if why == "" {
+		return true
+	}
+	fmt.Fprintf(os.Stderr, "not backing up profile %q, %s, use --force to "+
+		"back up anyway\n", p.name, why)
+	return false
+}
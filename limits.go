@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// enforceLimits prunes the oldest snapshots of p beyond MaxSnapshots, and
+// those older than MaxSnapshotAge, right after a snapshot is created. Unlike
+// pruning by buckets, this needs no --prune, so that storage doesn't grow
+// without bounds where nobody scheduled one. The newest snapshot always stays.
+// Snapshots pending a backup with KeepUntilBackedUp are neither pruned nor
+// counted, so with backups behind, more than MaxSnapshots may be kept, some
+// older than MaxSnapshotAge.
+func (a *app) enforceLimits(p *profileJSON) error {
+	if p.MaxSnapshots == nil && p.MaxSnapshotAge == nil {
+		return nil
+	}
+	snaps, err := prunableSnaps(p)
+	if err != nil {
+		return err
+	}
+	snaps, pending, err := a.splitBackedUp(p, snaps)
+	if err != nil {
+		return err
+	}
+	a.keepPending(pending)
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].created.Before(snaps[j].created)
+	})
+	if len(snaps) == 0 {
+		return nil
+	}
+	var out []*snap
+	for i, s := range snaps[:len(snaps)-1] {
+		over := p.MaxSnapshots != nil && len(snaps)-i > *p.MaxSnapshots
+		old := p.MaxSnapshotAge != nil &&
+			time.Since(s.created) > time.Duration(*p.MaxSnapshotAge)
+		if !over && !old {
+			break
+		}
+		out = append(out, s)
+	}
+	if out, err = a.requireBackups(p, out); err != nil {
+		return err
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	if a.opts.dryRun || a.opts.verbose {
+		fmt.Fprintf(os.Stderr, "pruning %d snapshots over the limits "+
+			"of profile %q\n", len(out), p.name)
+	}
+	dir, err := storageDir(p)
+	if err != nil {
+		return err
+	}
+	return a.discard(p, dir, out)
+}
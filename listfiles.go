@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dirEntry is the part of os.FileInfo which list-files needs.
+type dirEntry struct {
+	Name    string
+	Mode    os.FileMode
+	Size    int64
+	ModTime time.Time
+}
+
+// snapListing holds directory listings of a snapshot, keyed by paths relative
+// to the snapshot's root. Snapshots are read-only, so listings never go stale
+// and can be cached in the metadata DB indefinitely.
+type snapListing struct {
+	root  string
+	Dirs  map[string][]dirEntry
+	dirty bool
+}
+
+func (l *snapListing) readDir(rel string) ([]dirEntry, error) {
+	if ents, ok := l.Dirs[rel]; ok {
+		return ents, nil
+	}
+	fis, err := ioutil.ReadDir(filepath.Join(l.root, rel))
+	if err != nil {
+		return nil, err
+	}
+	ents := make([]dirEntry, len(fis))
+	for i, fi := range fis {
+		ents[i] = dirEntry{
+			Name:    fi.Name(),
+			Mode:    fi.Mode(),
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		}
+	}
+	l.Dirs[rel] = ents
+	l.dirty = true
+	return ents, nil
+}
+
+// glob is like filepath.Glob, but works on the listings, so that it doesn't
+// touch the filesystem when they're cached.
+func (l *snapListing) glob(pattern string) (map[string]dirEntry, error) {
+	matches := map[string]dirEntry{".": {Name: ".", Mode: os.ModeDir}}
+	pattern = filepath.Clean(pattern)
+	if pattern == "." {
+		return matches, nil
+	}
+	for _, part := range strings.Split(pattern, "/") {
+		next := make(map[string]dirEntry)
+		for dir, e := range matches {
+			if !e.Mode.IsDir() {
+				continue
+			}
+			ents, err := l.readDir(dir)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range ents {
+				ok, err := filepath.Match(part, e.Name)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					next[filepath.Join(dir, e.Name)] = e
+				}
+			}
+		}
+		matches = next
+	}
+	return matches, nil
+}
+
+// walk calls fn for every non-directory in the subtree rooted at dir.
+func (l *snapListing) walk(dir string, fn func(string, dirEntry)) error {
+	ents, err := l.readDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range ents {
+		p := filepath.Join(dir, e.Name)
+		if !e.Mode.IsDir() {
+			fn(p, e)
+		} else if err := l.walk(p, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// files returns the files which match pattern. If pattern names a directory,
+// its entries are listed. If recursive is set, whole subtrees of all matching
+// directories are listed.
+func (l *snapListing) files(pattern string, recursive bool) (map[string]dirEntry, error) {
+	matches, err := l.glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]dirEntry)
+	add := func(p string, e dirEntry) {
+		files[p] = e
+	}
+	for m, e := range matches {
+		if !e.Mode.IsDir() {
+			add(m, e)
+			continue
+		}
+		if !recursive && strings.ContainsAny(pattern, "*?[") {
+			continue
+		}
+		if recursive {
+			if err := l.walk(m, add); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		ents, err := l.readDir(m)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range ents {
+			if !e.Mode.IsDir() {
+				add(filepath.Join(m, e.Name), e)
+			}
+		}
+	}
+	return files, nil
+}
+
+// snapListing returns listings of snapshot s cached in the metadata DB.
+func (a *app) snapListing(s *snap) *snapListing {
+	l := &snapListing{root: s.subvolPath()}
+	if _, err := a.db.getSnap(snapKey("listing", s), s, l); err != nil && a.opts.verbose {
+		fmt.Fprintf(os.Stderr, "ignoring listing cache of %s: %v\n", s, err)
+	}
+	if l.Dirs == nil {
+		l.Dirs = make(map[string][]dirEntry)
+	}
+	return l
+}
+
+// saveListing saves listings of snapshot s in the metadata DB if any were
+// newly read.
+func (a *app) saveListing(s *snap, l *snapListing) {
+	if !l.dirty {
+		return
+	}
+	if err := a.db.put(snapKey("listing", s), l); err != nil && a.opts.verbose {
+		fmt.Fprintf(os.Stderr, "cannot cache listing of %s: %v\n", s, err)
+	}
+	l.dirty = false
+}
+
+// snapFiles is like snapListing.files for snapshot s, but uses listings
+// cached in the metadata DB and saves any newly read ones there.
+func (a *app) snapFiles(s *snap, pattern string, recursive bool) (map[string]dirEntry, error) {
+	l := a.snapListing(s)
+	files, err := l.files(pattern, recursive)
+	if err != nil {
+		return nil, err
+	}
+	a.saveListing(s, l)
+	return files, nil
+}
+
+// allSnapFiles runs snapFiles for all snaps, with a bounded number of
+// snapshots walked concurrently.
+func (a *app) allSnapFiles(snaps []*snap, pattern string, recursive bool) ([]map[string]dirEntry, error) {
+	perSnap := make([]map[string]dirEntry, len(snaps))
+	errs := make([]error, len(snaps))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	workers := runtime.NumCPU()
+	if workers > maxListWorkers {
+		workers = maxListWorkers
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				perSnap[i], errs[i] = a.snapFiles(snaps[i], pattern, recursive)
+			}
+		}()
+	}
+	for i := range snaps {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", snaps[i], err)
+		}
+	}
+	return perSnap, nil
+}
+
+// maxListWorkers limits how many snapshots are walked at once, since walking
+// is mostly bound by IO anyway.
+const maxListWorkers = 8
+
+type fileVersion struct {
+	snap *snap
+	path string
+	fi   dirEntry
+	hash []byte
+}
+
+func (v *fileVersion) sum() ([]byte, error) {
+	if v.hash != nil {
+		return v.hash, nil
+	}
+	h := sha256.New()
+	if v.fi.Mode&os.ModeSymlink != 0 {
+		target, err := os.Readlink(v.path)
+		if err != nil {
+			return nil, err
+		}
+		io.WriteString(h, target)
+	} else if v.fi.Mode.IsRegular() {
+		f, err := os.Open(v.path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if _, err := io.Copy(h, f); err != nil {
+			return nil, err
+		}
+	}
+	v.hash = h.Sum(nil)
+	return v.hash, nil
+}
+
+// sameContents tells whether two versions of a file have the same contents.
+// Sizes are compared first so that files only need to be hashed when they
+// can't be told apart otherwise.
+func sameContents(a, b *fileVersion) (bool, error) {
+	if a.fi.Mode&os.ModeType != b.fi.Mode&os.ModeType {
+		return false, nil
+	}
+	if a.fi.Size != b.fi.Size {
+		return false, nil
+	}
+	ha, err := a.sum()
+	if err != nil {
+		return false, err
+	}
+	hb, err := b.sum()
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(ha, hb), nil
+}
+
+// relPattern makes pattern relative to the snapshotted subvolume, so that
+// users can pass paths as they see them on the live filesystem.
+func (a *app) relPattern(p *profileJSON, pattern string) (string, error) {
+	if !filepath.IsAbs(pattern) {
+		return pattern, nil
+	}
+	// Backups may be backed up too, follow them to the original.
+	for p.Source != nil {
+		src, err := a.sourceProfile(p)
+		if err != nil {
+			return "", err
+		}
+		p = src
+	}
+	if p.Subvolume == nil {
+		return "", fmt.Errorf("absolute paths cannot be used with "+
+			"profiles which pull snapshots, use %q relative to the "+
+			"subvolume instead", pattern)
+	}
+	rel, err := filepath.Rel(*p.Subvolume, pattern)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%s is not inside %s", pattern, *p.Subvolume)
+	}
+	return rel, nil
+}
+
+// readManifests reads manifests of snaps. Sums from manifests spare reading
+// files to compare them.
+func readManifests(snaps []*snap) ([]map[string]manifestEntry, error) {
+	manifests := make([]map[string]manifestEntry, len(snaps))
+	for i, s := range snaps {
+		var err error
+		if manifests[i], err = readManifest(s); err != nil {
+			return nil, err
+		}
+	}
+	return manifests, nil
+}
+
+// versions returns the distinct versions of the file n across snaps, given
+// the files of each snapshot and their manifests. A deletion of the file is
+// returned as a version with no path.
+func versions(snaps []*snap, perSnap []map[string]dirEntry, manifests []map[string]manifestEntry, n string) ([]*fileVersion, error) {
+	var vs []*fileVersion
+	var prev *fileVersion
+	for i, s := range snaps {
+		fi, ok := perSnap[i][n]
+		if !ok {
+			if prev != nil {
+				vs = append(vs, &fileVersion{snap: s})
+			}
+			prev = nil
+			continue
+		}
+		v := &fileVersion{
+			snap: s,
+			path: filepath.Join(s.subvolPath(), n),
+			fi:   fi,
+		}
+		if e, ok := manifests[i][n]; ok && e.Size == fi.Size &&
+			e.ModTime.Equal(fi.ModTime) {
+			v.hash = e.Sum
+		}
+		if prev != nil {
+			same, err := sameContents(prev, v)
+			if err != nil {
+				return nil, err
+			}
+			if same {
+				continue
+			}
+		}
+		prev = v
+		vs = append(vs, v)
+	}
+	return vs, nil
+}
+
+// listFiles lists all distinct versions of files matching pattern across
+// snapshots, along with the snapshots in which they first appeared and how
+// much they grew since the previous version.
+func (a *app) listFiles(p *profileJSON, pattern string) error {
+	pattern, err := a.relPattern(p, pattern)
+	if err != nil {
+		return err
+	}
+	exclude, err := a.excludes(p)
+	if err != nil {
+		return err
+	}
+	snaps, err := profileSnaps(p)
+	if err != nil {
+		return err
+	}
+	perSnap, err := a.allSnapFiles(snaps, pattern, a.opts.recursive)
+	if err != nil {
+		return err
+	}
+	manifests, err := readManifests(snaps)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for _, files := range perSnap {
+		for n := range files {
+			if !exclude.match(n) {
+				names[n] = true
+			}
+		}
+	}
+	var sorted []string
+	for n := range names {
+		sorted = append(sorted, n)
+	}
+	sort.Strings(sorted)
+
+	now := time.Now()
+	t := newTable("FILE", "CREATED", "SIZE", "DELTA", "MODIFIED", "SNAPSHOT")
+	t.alignRight(1, 2, 3)
+	var unique int64
+	var count int
+	for _, n := range sorted {
+		vs, err := versions(snaps, perSnap, manifests, n)
+		if err != nil {
+			return err
+		}
+		var prev int64
+		for _, v := range vs {
+			age := plainCell("%s", a.formatTime(v.snap.created, now))
+			if v.path == "" {
+				t.add(plainCell("%s", n), age,
+					cell{text: "deleted", color: colorRed},
+					plainCell("%s", formatDelta(-prev)),
+					plainCell("-"), plainCell("%s", v.snap.path))
+				prev = 0
+				continue
+			}
+			t.add(plainCell("%s", n), age,
+				plainCell("%s", formatBytes(uint64(v.fi.Size))),
+				plainCell("%s", formatDelta(v.fi.Size-prev)),
+				plainCell("%s", a.formatDate(v.fi.ModTime)),
+				plainCell("%s", v.snap.path))
+			prev = v.fi.Size
+			unique += v.fi.Size
+			count++
+		}
+	}
+	if err := a.printTable(t); err != nil {
+		return err
+	}
+	if !a.opts.plain {
+		fmt.Printf("%s unique in %d versions of %d files\n",
+			formatBytes(uint64(unique)), count, len(sorted))
+	}
+	return nil
+}
+
+// formatDelta formats the change in size of a file between its versions.
+func formatDelta(d int64) string {
+	if d < 0 {
+		return "-" + formatBytes(uint64(-d))
+	}
+	return "+" + formatBytes(uint64(d))
+}
@@ -3,57 +3,56 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/dcepelik/snap/humanize"
 	"github.com/pborman/getopt/v2"
+	"golang.org/x/crypto/ssh"
 )
 
-func agoR(d time.Duration, maxPrec int) (s string) {
-	if maxPrec <= 0 {
-		return ""
-	}
-	ranges := []struct {
-		lt   time.Duration
-		div  time.Duration
-		unit string
-	}{
-		{time.Minute, time.Second, "s"},
-		{time.Hour, time.Minute, "m"},
-		{2 * day, time.Hour, "h"},
-		{month, day, "d"},
-		{3 * month, week, "w"},
-		{2 * year, month, "y"},
-	}
-	div, unit := year, "y"
-	for _, r := range ranges {
-		if d < r.lt {
-			div, unit = r.div, r.unit
-			break
-		}
+// formatTime formats t according to the --timestamps option, either as
+// relative to now, as an absolute date, or both.
+func (a *app) formatTime(t, now time.Time) string {
+	switch a.opts.timestamps {
+	case "absolute":
+		return a.formatDate(t)
+	case "both":
+		return a.formatDate(t) + " (" + humanize.Ago(now.Sub(t), 2) + ")"
+	default:
+		return humanize.Ago(now.Sub(t), 2)
 	}
-	v := int64(d.Seconds() / div.Seconds())
-	r := time.Duration(d.Seconds()-float64(v)*div.Seconds()) * time.Second
-	tail := ""
-	if r > 1*time.Second {
-		tail = agoR(r, maxPrec-1)
+}
+
+// formatDate formats t as set by --date-format. Output meant for scripts
+// always uses ISO 8601, regardless of the user's preferences.
+func (a *app) formatDate(t time.Time) string {
+	if a.opts.plain {
+		return t.Format(time.RFC3339)
 	}
-	return fmt.Sprintf("%2d%s%s", v, unit, tail)
+	return a.dateFormat(t)
 }
 
-func ago(d time.Duration, maxPrec int) string {
-	s := agoR(d, maxPrec)
-	if d > 0*time.Second {
-		return s + " ago"
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
 	}
-	return "in " + s
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
 }
 
 const defaultDirMode = 0755
@@ -62,12 +61,34 @@ const defaultBtrfsBin = "btrfs"
 type snap struct {
 	path    string
 	created time.Time
+	usage   *qgroupUsage
+	ids     *snapIDs
+	flat    bool
+	plain   bool
+	unowned bool
+
+	description string
+	reason      string
+	transaction string
+	pre         string
+	labels      map[string]string
+	generation  uint64
 }
 
 func (s *snap) String() string {
 	return s.path
 }
 
+// subvolPath returns the path of the snapshot's subvolume. In the nested
+// layout, it's a subdirectory of the snapshot's directory, in the flat one,
+// it's the directory itself.
+func (s *snap) subvolPath() string {
+	if s.flat {
+		return s.path
+	}
+	return path.Join(s.path, "snapshot")
+}
+
 func findSnaps(dir string) ([]*snap, error) {
 	fis, err := ioutil.ReadDir(dir)
 	if err != nil && os.IsNotExist(err) {
@@ -77,22 +98,150 @@ func findSnaps(dir string) ([]*snap, error) {
 		// If the directory does not exist, there are no snapshots.
 		return nil, err
 	}
-	snaps := make([]*snap, 0, len(fis))
+	var names []string
 	for _, fi := range fis {
-		snapPath := path.Join(dir, fi.Name())
-		createdUnix, err := strconv.ParseInt(fi.Name(), 10, 64)
+		names = append(names, fi.Name())
+		sub := path.Join(fi.Name(), "snapshot")
+		if _, err := os.Stat(path.Join(dir, sub)); err == nil {
+			names = append(names, sub)
+		}
+	}
+	return parseSnaps(dir, names)
+}
+
+// parseSnaps turns names of entries of the storage directory dir and of its
+// subdirectories into snapshots. A snapshot whose directory contains an entry
+// named snapshot uses the nested layout, others use the flat one. Other
+// entries of subdirectories are ignored.
+func parseSnaps(dir string, names []string) ([]*snap, error) {
+	nested := make(map[string]bool)
+	for _, name := range names {
+		if path.Base(name) == "snapshot" {
+			nested[path.Dir(name)] = true
+		}
+	}
+	snaps := make([]*snap, 0, len(names))
+	for _, name := range names {
+		// Subdirectory entries and hidden files such as the journal
+		// aren't snapshots.
+		if strings.Contains(name, "/") || strings.HasPrefix(name, ".") {
+			continue
+		}
+		snapPath := path.Join(dir, name)
+		created, err := parseSnapName(name)
 		if err != nil {
 			return nil, err
 		}
-		created := time.Unix(createdUnix, 0)
-		snaps = append(snaps, &snap{snapPath, created})
+		snaps = append(snaps, &snap{
+			path:    snapPath,
+			created: created,
+			flat:    !nested[name],
+		})
 	}
 	return snaps, nil
 }
 
+// maxSnapsPerSecond limits how many snapshots can be created in one second.
+const maxSnapsPerSecond = 1000
+
+// snapName returns the name of the n-th snapshot created in the second of
+// t, counting from 0: the Unix timestamp, followed by .n for n > 0.
+func snapName(t time.Time, n int) string {
+	name := strconv.FormatInt(t.Unix(), 10)
+	if n > 0 {
+		name += "." + strconv.Itoa(n)
+	}
+	return name
+}
+
+// parseSnapName returns when the snapshot with the given name was created.
+// Snapshots created in the same second are told apart by adding their
+// number to the time as nanoseconds, which keeps them in order.
+func parseSnapName(name string) (time.Time, error) {
+	sec, n := name, 0
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		var err error
+		sec = name[:i]
+		n, err = strconv.Atoi(name[i+1:])
+		if err != nil || n <= 0 || n >= maxSnapsPerSecond {
+			return time.Time{}, fmt.Errorf("invalid snapshot "+
+				"name %q", name)
+		}
+	}
+	unix, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(unix, int64(n)), nil
+}
+
+// storageDir returns the directory which holds snapshots of p. Profiles with
+// PerHost set share their Storage among several machines, each of which keeps
+// its snapshots in a subdirectory named after its host name.
+func storageDir(p *profileJSON) (string, error) {
+	if !p.PerHost {
+		return *p.Storage, nil
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(*p.Storage, host), nil
+}
+
+// profileSnaps returns snapshots of p made by this machine.
+func profileSnaps(p *profileJSON) ([]*snap, error) {
+	snaps, _, err := sharedSnaps(p)
+	return snaps, err
+}
+
+// sharedSnaps is like profileSnaps, but also tells whether the storage
+// directory holds snapshots of others.
+func sharedSnaps(p *profileJSON) ([]*snap, bool, error) {
+	dir, err := storageDir(p)
+	if err != nil {
+		return nil, false, err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, false, err
+	}
+	snaps, shared, err := ownSnaps(dir, p.name, host)
+	if p.Rsync != nil {
+		// Copies made by rsync are plain directories.
+		for _, s := range snaps {
+			s.plain = true
+		}
+	}
+	return snaps, shared, err
+}
+
+// hostDirs returns the names of hosts which keep snapshots in the storage
+// directory of a PerHost profile.
+func hostDirs(storage string) ([]string, error) {
+	fis, err := ioutil.ReadDir(storage)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var hosts []string
+	for _, fi := range fis {
+		if fi.IsDir() {
+			hosts = append(hosts, fi.Name())
+		}
+	}
+	return hosts, nil
+}
+
 type bucket struct {
+	// index is the position of the bucket in Buckets of its profile.
+	index    int
 	interval time.Duration
-	snaps    []*snap
+	// months is the interval in calendar months, if the bucket is
+	// Calendar.
+	months int
+	snaps  []*snap
 }
 
 func newBucket(interval time.Duration, size int) *bucket {
@@ -116,11 +265,16 @@ func newCascade() cascade {
 	return make(cascade, 0)
 }
 
-func (c *cascade) addBucket(b *bucketJSON) {
-	*c = append(*c, &bucket{
+func (c *cascade) addBucket(b *bucketJSON, index int) {
+	nb := &bucket{
+		index:    index,
 		interval: time.Duration(*b.Interval),
 		snaps:    make([]*snap, 0, *b.Size),
-	})
+	}
+	if b.Calendar {
+		nb.months = calendarMonths(nb.interval)
+	}
+	*c = append(*c, nb)
 }
 
 // insert puts in snapshots into the top bucket. If that bucket is full, oldest
@@ -137,8 +291,8 @@ func (c cascade) insert(in []*snap) (out []*snap) {
 		var prevCreated time.Time
 		var insertAt int
 		for i, s := range in {
-			d := s.created.Sub(prevCreated)
-			if (i > 0 && d < b.interval) || cap(b.snaps) == 0 {
+			if (i > 0 && b.tooClose(prevCreated, s.created)) ||
+				cap(b.snaps) == 0 {
 				out = append(out, s)
 				continue
 			}
@@ -158,122 +312,763 @@ func (c cascade) insert(in []*snap) (out []*snap) {
 	return out
 }
 
+// warnEvictedNewest warns if the newest of snaps is among those out, which
+// Buckets evict, since snapshots are then taken more often than the first
+// bucket keeps them and are pruned as soon as they're taken.
+func warnEvictedNewest(p *profileJSON, snaps, out []*snap) {
+	if len(p.Buckets) == 0 || len(snaps) == 0 {
+		return
+	}
+	newest := snaps[0]
+	for _, s := range snaps {
+		if s.created.After(newest.created) {
+			newest = s
+		}
+	}
+	for _, s := range out {
+		if s == newest {
+			fmt.Fprintf(os.Stderr, "warning: the newest snapshot %s "+
+				"is pruned, snapshots of profile %q are taken "+
+				"more often than its Buckets keep them\n", s,
+				p.name)
+			return
+		}
+	}
+}
+
 func (a *app) prune(p *profileJSON) error {
-	snaps, err := findSnaps(*p.Storage)
+	snaps, err := prunableSnaps(p)
+	if err != nil {
+		return err
+	}
+	if err := loadNotes(snaps); err != nil {
+		return err
+	}
+	snaps, pending, err := a.splitBackedUp(p, snaps)
 	if err != nil {
 		return err
 	}
-	out := a.cascade.insert(snaps)
+	a.keepPending(pending)
+	_, out := retain(p.Buckets, snaps)
+	if out, err = a.requireBackups(p, out); err != nil {
+		return err
+	}
+	warnEvictedNewest(p, snaps, out)
+	dir, err := storageDir(p)
+	if err != nil {
+		return err
+	}
+	if err := a.discard(p, dir, out); err != nil {
+		return err
+	}
+	if p.Trash != nil {
+		if err := a.emptyTrash(dir, time.Duration(*p.Trash)); err != nil {
+			return err
+		}
+	}
+	if a.opts.waitCleaned && p.Rsync == nil {
+		// Deleted subvolumes only free space once they're cleaned
+		// up, which happens in the background.
+		if a.opts.verbose {
+			fmt.Fprintln(os.Stderr, "waiting for deleted subvolumes "+
+				"to be cleaned up")
+		}
+		return a.btrfsCmd("subvolume", "sync", dir)
+	}
+	return nil
+}
+
+// prunableSnaps returns snapshots of p which may be pruned, leaving out
+// those in shared storage which have no owner.
+func prunableSnaps(p *profileJSON) ([]*snap, error) {
+	snaps, shared, err := sharedSnaps(p)
+	if err != nil {
+		return nil, err
+	}
+	if shared {
+		// Nobody knows whose these are.
+		own := snaps[:0]
+		for _, s := range snaps {
+			if s.unowned {
+				fmt.Fprintf(os.Stderr, "%s has no owner in shared "+
+					"storage, not pruning it\n", s.path)
+				continue
+			}
+			own = append(own, s)
+		}
+		snaps = own
+	}
+	return snaps, nil
+}
+
+// discard deletes the snapshots out of p from storage dir, or moves them to
+// the trash if p has one.
+func (a *app) discard(p *profileJSON, dir string, out []*snap) error {
+	if a.opts.dryRun || a.opts.verbose || a.summary != nil {
+		a.loadUsage(p, out)
+	}
+	if a.opts.dryRun || a.opts.verbose {
+		reportFreed(out)
+	}
+	var gone []*snap
 	for _, s := range out {
-		snapPath := path.Join(s.path, "snapshot")
-		if _, err := os.Stat(snapPath); !os.IsNotExist(err) {
-			// We're creating read-only subvolumes, which makes it
-			// impossible for non-root-users to delete them. Since
-			// we don't require to be run as root, unset the
-			// read-only property.
-			if err := a.btrfsCmd(
-				"property",
-				"set",
-				"-t", "subvol",
-				snapPath,
-				"ro",
-				"false",
-			); err != nil {
+		if p.Trash != nil {
+			done, err := a.begin(dir, opTrash, s)
+			if err != nil {
+				return err
+			}
+			if err := a.trashSnap(dir, s); err != nil {
+				return err
+			}
+			if err := a.audit(dir, auditTrash, s, ""); err != nil {
+				return err
+			}
+			if err := done(); err != nil {
+				return err
+			}
+			a.emit(eventTrashed, p, s, "", nil)
+			if ps := a.current(); ps != nil {
+				// Space is only freed once the trash is emptied.
+				ps.Pruned = append(ps.Pruned,
+					pruneSummary{Snapshot: s.path})
+			}
+			continue
+		}
+		gone = append(gone, s)
+	}
+	for len(gone) > 0 {
+		batch := gone[:min(len(gone), deleteBatch)]
+		gone = gone[len(batch):]
+		dones := make([]func() error, len(batch))
+		for i, s := range batch {
+			var err error
+			if dones[i], err = a.begin(dir, opPrune, s); err != nil {
+				return err
+			}
+		}
+		if err := a.deleteSubvols(batch); err != nil {
+			return err
+		}
+		for i, s := range batch {
+			if err := a.forgetSnap(s); err != nil {
 				return err
 			}
-			// Delete the subvolume.
-			if err := a.btrfsCmd(
-				"subvolume",
-				"delete",
-				snapPath,
-			); err != nil {
+			if err := a.audit(dir, auditDelete, s, ""); err != nil {
 				return err
 			}
+			if err := dones[i](); err != nil {
+				return err
+			}
+			a.emit(eventPruned, p, s, "", nil)
+			if ps := a.current(); ps != nil {
+				pr := pruneSummary{Snapshot: s.path}
+				if s.usage != nil {
+					pr.Freed = &s.usage.exclusive
+				}
+				ps.Pruned = append(ps.Pruned, pr)
+			}
 		}
-		if !a.opts.dryRun {
-			if err := os.Remove(s.path); err != nil {
+	}
+	return nil
+}
+
+// deleteBatch is how many subvolumes are deleted by one run of btrfs.
+const deleteBatch = 100
+
+// removeSnap deletes the snapshot s and what snap knows about it. It may be
+// called again if it was interrupted.
+func (a *app) removeSnap(s *snap) error {
+	if err := a.deleteSubvols([]*snap{s}); err != nil {
+		return err
+	}
+	return a.forgetSnap(s)
+}
+
+// deleteSubvols deletes subvolumes of snaps, or copies if they're plain,
+// running btrfs once for all of them.
+func (a *app) deleteSubvols(snaps []*snap) error {
+	args := []string{"subvolume", "delete"}
+	if a.opts.commit != "" {
+		args = append(args, "--commit-"+a.opts.commit)
+	}
+	n := len(args)
+	for _, s := range snaps {
+		snapPath := s.subvolPath()
+		if s.plain {
+			if err := a.removePlain(s); err != nil {
 				return err
 			}
+			continue
+		}
+		if _, err := os.Stat(snapPath); os.IsNotExist(err) {
+			continue
+		}
+		// We're creating read-only subvolumes, which makes it
+		// impossible for non-root-users to delete them. Since
+		// we don't require to be run as root, unset the
+		// read-only property.
+		if err := a.setReadOnly(snapPath, false); err != nil {
+			return err
+		}
+		args = append(args, snapPath)
+	}
+	if len(args) == n {
+		return nil
+	}
+	return a.btrfsCmd(args...)
+}
+
+// forgetSnap removes the directory of the snapshot s, whose subvolume is gone
+// already, and what snap knows about it.
+func (a *app) forgetSnap(s *snap) error {
+	if !a.opts.dryRun {
+		if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := a.db.remove(snapKey("listing", s)); err != nil {
+			return err
+		}
+		if err := a.db.remove(snapKey("uuid", s)); err != nil {
+			return err
+		}
+		if err := a.db.remove(snapKey("backedup", s)); err != nil {
+			return err
+		}
+		if err := removeOwner(s); err != nil {
+			return err
+		}
+		if err := removeNote(s); err != nil {
+			return err
+		}
+		if err := removeManifest(s); err != nil {
+			return err
+		}
+		if err := removeMeta(s); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+// newSnap picks the name of a snapshot created in dir at t which doesn't
+// collide with an existing one. In the nested layout, the name is taken by
+// creating the snapshot's directory.
+func (a *app) newSnap(dir string, flat bool, t time.Time) (*snap, error) {
+	for n := 0; n < maxSnapsPerSecond; n++ {
+		name := snapName(t, n)
+		s := &snap{path: path.Join(dir, name), flat: flat}
+		s.created, _ = parseSnapName(name)
+		if flat || a.opts.dryRun {
+			if _, err := os.Lstat(s.path); os.IsNotExist(err) {
+				return s, nil
+			} else if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := os.MkdirAll(dir, defaultDirMode); err != nil {
+			return nil, err
+		}
+		err := os.Mkdir(s.path, defaultDirMode)
+		if err == nil {
+			return s, nil
+		} else if !os.IsExist(err) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%s: too many snapshots created at %s",
+		dir, snapName(t, 0))
+}
+
 func (a *app) create(p *profileJSON) error {
-	unixStr := strconv.FormatInt(time.Now().Unix(), 10)
-	snapPath := path.Join("", *p.Storage, unixStr)
+	if p.isBackup() {
+		return fmt.Errorf("%q is a backup profile, its snapshots are "+
+			"made by backing up those of its source", p.name)
+	}
+	dir, err := storageDir(p)
+	if err != nil {
+		return err
+	}
+	if p.user {
+		if err := checkOwned(*p.Subvolume); err != nil {
+			return err
+		}
+	}
+	filter, err := a.checkPlacement(p, dir)
+	if err != nil {
+		return err
+	}
+	if p.SkipIdle && a.opts.reason == reasonTimeline &&
+		a.opts.message == "" && !a.opts.preTransaction &&
+		!a.opts.postTransaction {
+		idle, err := a.idle(p)
+		if err != nil {
+			return fmt.Errorf("cannot tell whether %s changed: %w",
+				*p.Subvolume, err)
+		}
+		if idle {
+			return nil
+		}
+	}
+	flat := p.Layout != nil && *p.Layout == layoutFlat
+	s, err := a.newSnap(dir, flat, time.Now())
+	if err != nil {
+		return err
+	}
+	snapPath, subvolPath := s.path, s.subvolPath()
+	if flat {
+		snapPath = dir
+	}
+	done, err := a.begin(dir, opCreate, s)
+	if err != nil {
+		return err
+	}
 	if err := os.MkdirAll(snapPath, defaultDirMode); err != nil {
 		return err
 	}
-	subvolPath := path.Join(snapPath, "/snapshot")
-	return a.btrfsCmd(
-		"subvolume",
-		"snapshot",
-		"-r",
-		*p.Subvolume,
-		subvolPath,
-	)
+	resume, err := a.quiesce(p)
+	if err != nil {
+		resume()
+		return fmt.Errorf("cannot quiesce applications: %w", err)
+	}
+	if filter != "" {
+		err = a.filterSnapshot(dir, *p.Subvolume, subvolPath, filter)
+	} else {
+		err = a.btrfsCmd(
+			"subvolume",
+			"snapshot",
+			"-r",
+			*p.Subvolume,
+			subvolPath,
+		)
+	}
+	resume()
+	if err != nil {
+		return err
+	}
+	if p.SkipIdle {
+		// Taking the snapshot changes the subvolume too, so its
+		// generation is read only now.
+		if s.generation, err = a.generation(*p.Subvolume); err != nil {
+			return err
+		}
+	}
+	if err := a.setOwner(s, p.name); err != nil {
+		return err
+	}
+	s.description, s.reason = a.opts.message, a.opts.reason
+	s.labels = p.labels
+	if a.opts.preTransaction || a.opts.postTransaction {
+		s.reason = reasonHook
+		if err := a.linkTransaction(p, s); err != nil {
+			return err
+		}
+	}
+	if err := a.saveNote(s); err != nil {
+		return err
+	}
+	if ps := a.current(); ps != nil {
+		ps.Created = append(ps.Created, s.path)
+	}
+	if err := done(); err != nil {
+		return err
+	}
+	a.emit(eventCreated, p, s, "", nil)
+	return a.runHooks(p, s)
 }
 
 type app struct {
-	cfg     *configJSON
-	cascade cascade
-	opts    struct {
-		btrfsBin    string
-		cfgPath     string
-		create      bool
-		dryRun      bool
-		list        bool
-		profileName string
-		prune       bool
-		verbose     bool
+	cfg        *configJSON
+	db         *metaDB
+	ssh        *sshPool
+	log        *commandLog
+	trace      *tracer
+	telemetry  *telemetry
+	events     *eventLog
+	summary    *summary
+	transfers  *backupStats // of the backup in progress, see recordStats
+	enter      []string
+	env        []string // environment of commands, nil to inherit snap's
+	invoker    int      // user on whose behalf snap runs, or -1
+	dateFormat func(time.Time) string
+	locks      map[string]func() // storage kept locked, see runOnce
+	opts       struct {
+		advise            bool
+		all               bool
+		annotateRetention bool
+		archive           string
+		auditLog          bool
+		backup            bool
+		browse            bool
+		btrfsBin          string
+		budget            string
+		cfgPath           string
+		catchUp           bool
+		changedSince      string
+		churn             bool
+		commit            string
+		connect           string
+		create            bool
+		dateFormat        string
+		dedup             bool
+		dedupReport       bool
+		diffFile          string
+		diffTimes         []string
+		dryRun            bool
+		emergencyFree     string
+		exclude           []string
+		exportTo          string
+		failedOnly        bool
+		find              string
+		force             bool
+		initProfile       bool
+		format            string
+		full              bool
+		grep              string
+		list              bool
+		listen            string
+		listFiles         string
+		maintain          bool
+		manifest          bool
+		migrateLayout     bool
+		message           string
+		maxSize           string
+		output            string
+		minSize           string
+		modifiedAfter     string
+		modifiedBefore    string
+		plain             bool
+		postTransaction   bool
+		preTransaction    bool
+		pullConfig        string
+		profileName       string
+		prune             bool
+		reason            string
+		recursive         bool
+		repairChain       bool
+		restore           string
+		restoreFile       string
+		rpo               string
+		runOnce           bool
+		seedExport        string
+		seedImport        string
+		serve             bool
+		stats             bool
+		status            bool
+		storage           string
+		subvolume         string
+		summary           string
+		timestamps        string
+		trace             string
+		undelete          string
+		verify            string
+		verbose           bool
+		waitCleaned       bool
+		watch             bool
+	}
+}
+
+// minInterval returns the shortest bucket interval of p, which is how often
+// snapshots are expected to be taken.
+func minInterval(p *profileJSON) time.Duration {
+	var min time.Duration
+	for _, b := range p.Buckets {
+		if d := time.Duration(*b.Interval); min == 0 || d < min {
+			min = d
+		}
 	}
+	return min
 }
 
 func (a *app) list(p *profileJSON) error {
-	snaps, err := findSnaps(*p.Storage)
+	var grep *regexp.Regexp
+	if a.opts.grep != "" {
+		var err error
+		if grep, err = regexp.Compile("(?i)" + a.opts.grep); err != nil {
+			return fmt.Errorf("invalid --grep pattern: %w", err)
+		}
+	}
+	hosts := []string{""}
+	if p.PerHost {
+		var err error
+		if hosts, err = hostDirs(*p.Storage); err != nil {
+			return err
+		}
+	}
+	hostSnaps := make([][]*snap, len(hosts))
+	hostKept := make([]map[*snap]int, len(hosts))
+	reasoned, described, labeled := false, false, false
+	for i, host := range hosts {
+		var snaps []*snap
+		var shared bool
+		var err error
+		if p.PerHost {
+			dir := path.Join(*p.Storage, host)
+			snaps, shared, err = ownSnaps(dir, p.name, host)
+		} else {
+			snaps, shared, err = sharedSnaps(p)
+		}
+		if err != nil {
+			return err
+		}
+		if err := loadNotes(snaps); err != nil {
+			return err
+		}
+		for _, s := range snaps {
+			if s.reason != "" {
+				reasoned = true
+			}
+			if s.description != "" {
+				described = true
+			}
+			if len(s.labels) > 0 {
+				labeled = true
+			}
+		}
+		a.loadUsage(p, snaps)
+		hostSnaps[i] = snaps
+		if a.opts.annotateRetention {
+			hostKept[i], err = a.retention(p, snaps, shared)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	header := []string{"#", "CREATED", "REFERENCED", "EXCLUSIVE", "PATH"}
+	if reasoned {
+		header = append(header, "REASON")
+	}
+	if described {
+		header = append(header, "DESCRIPTION")
+	}
+	if labeled {
+		header = append(header, "LABELS")
+	}
+	if a.opts.annotateRetention {
+		header = append(header, "RETENTION")
+	}
+	if p.PerHost {
+		header = append([]string{"HOST"}, header...)
+	}
+	now := time.Now()
+	t := newTable(header...)
+	if p.PerHost {
+		t.alignRight(1, 2, 3, 4)
+	} else {
+		t.alignRight(0, 1, 2, 3)
+	}
+	for i, host := range hosts {
+		snaps, kept := hostSnaps[i], hostKept[i]
+		for i, s := range snaps {
+			if grep != nil && !grep.MatchString(s.description) {
+				continue
+			}
+			age := cell{text: a.formatTime(s.created, now)}
+			if i == len(snaps)-1 {
+				age.color = ageColor(now.Sub(s.created), minInterval(p))
+			}
+			rfer, excl := cell{text: "-"}, cell{text: "-"}
+			if s.usage != nil {
+				rfer.text = formatBytes(s.usage.referenced)
+				excl.text = formatBytes(s.usage.exclusive)
+			}
+			row := []cell{plainCell("%d", i+1), age, rfer, excl,
+				plainCell("%s", s.path)}
+			if reasoned {
+				row = append(row, reasonCell(s.reason, s.transaction))
+			}
+			if described {
+				row = append(row, plainCell("%s", s.description))
+			}
+			if labeled {
+				row = append(row, plainCell("%s", formatLabels(s.labels)))
+			}
+			if a.opts.annotateRetention {
+				row = append(row, retentionCell(p, s, kept))
+			}
+			if p.PerHost {
+				row = append([]cell{plainCell("%s", host)}, row...)
+			}
+			t.add(row...)
+		}
+	}
+	return a.printTable(t)
+}
+
+// formatLabels formats labels as comma-separated key=value pairs, sorted.
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (a *app) status(p *profileJSON) error {
+	snaps, err := profileSnaps(p)
+	if err != nil {
+		return err
+	}
+	t := newTable()
+	t.add(plainCell("profile:"), plainCell("%s", a.opts.profileName))
+	switch {
+	case p.Source != nil:
+		t.add(plainCell("source:"), plainCell("%s", *p.Source))
+	case p.Pull != nil:
+		t.add(plainCell("pull:"),
+			plainCell("%s:%s", *p.Pull.Host, *p.Pull.Storage))
+	default:
+		t.add(plainCell("subvolume:"), plainCell("%s", *p.Subvolume))
+	}
+	dir, err := storageDir(p)
 	if err != nil {
 		return err
 	}
+	t.add(plainCell("storage:"), plainCell("%s", dir))
+	if p.Maintain != nil {
+		t.add(plainCell("scrubbed:"), a.scrubCell(dir))
+	}
+	t.add(plainCell("snapshots:"), plainCell("%d", len(snaps)))
+	if len(snaps) == 0 {
+		return a.printTable(t)
+	}
 	now := time.Now()
-	for i, s := range snaps {
-		delta := now.Sub(s.created)
-		fmt.Printf("%8d\t%10s\t%s\n", i+1, ago(delta, 2), s.path)
+	newest, oldest := snaps[0], snaps[0]
+	for _, s := range snaps {
+		if s.created.After(newest.created) {
+			newest = s
+		}
+		if s.created.Before(oldest.created) {
+			oldest = s
+		}
 	}
-	return nil
+	t.add(plainCell("newest:"), cell{
+		text:  a.formatTime(newest.created, now),
+		color: ageColor(now.Sub(newest.created), minInterval(p)),
+	})
+	t.add(plainCell("oldest:"), plainCell("%s", a.formatTime(oldest.created, now)))
+	a.loadUsage(p, snaps)
+	var rfer, excl uint64
+	known := 0
+	for _, s := range snaps {
+		if s.usage != nil {
+			rfer += s.usage.referenced
+			excl += s.usage.exclusive
+			known++
+		}
+	}
+	if known > 0 {
+		t.add(plainCell("referenced:"), plainCell("%s", formatBytes(rfer)))
+		t.add(plainCell("exclusive:"), plainCell("%s", formatBytes(excl)))
+	}
+	return a.printTable(t)
+}
+
+func (a *app) printCmd(args []string) {
+	printArgv(a.btrfsArgv(args))
+}
+
+func printArgv(argv []string) {
+	fmt.Fprintln(os.Stderr, argvString(argv))
+}
+
+func argvString(argv []string) string {
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
 }
 
 func (a *app) btrfsCmd(args ...string) error {
 	if a.opts.dryRun || a.opts.verbose {
-		// TODO: Escape command-line arguments correctly not to
-		//       produce confusing diagnostics.
-		cmdline := []string{a.opts.btrfsBin}
-		cmdline = append(cmdline, args...)
-		fmt.Fprintln(os.Stderr, strings.Join(cmdline, " "))
+		a.printCmd(args)
 	}
 	if a.opts.dryRun {
 		return nil
 	}
+	return a.btrfsRun(nil, args...)
+}
+
+// btrfsQuery runs a btrfs command which doesn't modify anything and returns
+// its standard output. Unlike btrfsCmd, it runs in dry-run mode too.
+func (a *app) btrfsQuery(args ...string) ([]byte, error) {
+	if a.opts.verbose {
+		a.printCmd(args)
+	}
+	var stdout bytes.Buffer
+	err := a.btrfsRun(&stdout, args...)
+	return stdout.Bytes(), err
+}
+
+func (a *app) btrfsRun(stdout io.Writer, args ...string) error {
+	return a.runArgv(stdout, a.btrfsArgv(args))
+}
 
-	cmd := exec.Command(a.opts.btrfsBin, args...)
+func (a *app) runArgv(stdout io.Writer, argv []string) error {
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Env = a.env
+	var stdoutBuf *cappedBuffer
+	cmd.Stdout, stdoutBuf = a.capture(stdout)
 	var stderrBuf bytes.Buffer
 	cmd.Stderr = &stderrBuf
-	if err := cmd.Run(); err == nil {
-		return nil
-	} else if exitErr, ok := err.(*exec.ExitError); ok {
-		stderr := "(stderr empty)"
-		if stderrBuf.Len() > 0 {
-			stderr = strings.Split(stderrBuf.String(), "\n")[0]
-		}
-		return fmt.Errorf("%s: failed with exit code %d: %s",
-			a.opts.btrfsBin, exitErr.ExitCode(), stderr)
-	} else {
+	run := a.started("", argv)
+	err := cmd.Run()
+	a.finished(run, err, stdoutBuf, stderrBuf.Bytes())
+	if err != nil {
+		return cmdError(argv[0], err, &stderrBuf)
+	}
+	return nil
+}
+
+// cmdError turns the error of a failed command into an ExecError which holds
+// its standard error output.
+func cmdError(name string, err error, stderrBuf *bytes.Buffer) error {
+	var code int
+	switch exitErr := err.(type) {
+	case *exec.ExitError:
+		code = exitErr.ExitCode()
+	case *ssh.ExitError:
+		code = exitErr.ExitStatus()
+	case *ssh.ExitMissingError:
+		return fmt.Errorf("%s: connection lost", name)
+	default:
 		return err
 	}
+	return &ExecError{Name: name, Code: code, Stderr: stderrBuf.String()}
 }
 
 func (a *app) run() error {
+	if a.opts.status && a.opts.all {
+		if a.opts.profileName != "" {
+			return fmt.Errorf("--status --all reports on all " +
+				"profiles, don't name one")
+		}
+		return a.statusAll()
+	}
+	if a.opts.profileName == "" {
+		var names []string
+		for n := range a.cfg.Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			a.opts.profileName = n
+			if a.opts.list {
+				fmt.Printf("%s:\n", n)
+			}
+			if err := a.runProfile(a.cfg.Profiles[n]); err != nil {
+				return fmt.Errorf("profile %q: %w", n, err)
+			}
+		}
+		return nil
+	}
 	profileName := a.opts.profileName
+	if _, ok := a.cfg.Groups[profileName]; ok {
+		return a.runGroup(profileName)
+	}
 	profile, ok := a.cfg.Profiles[profileName]
 	if !ok {
 		var knownNames []string
@@ -288,18 +1083,120 @@ func (a *app) run() error {
 		fmt.Fprintf(os.Stderr, "profile %q unknown, "+
 			"known profiles are: %s (loaded from %s)\n",
 			profileName, knownStr, from)
-		os.Exit(1)
+		os.Exit(exitCode(ErrProfileNotFound))
+	}
+	if a.opts.runOnce {
+		return a.runOnce(profile)
+	}
+	if a.opts.watch {
+		return a.watch(profile)
+	}
+	return a.runProfile(profile)
+}
+
+func (a *app) runProfile(profile *profileJSON) error {
+	if profile.hasVolumes() {
+		return a.runVolumes(profile)
+	}
+	if a.opts.catchUp {
+		return a.catchUp(profile)
+	}
+	if err := a.checkPrivileges(profile); err != nil {
+		return err
+	}
+	if a.summary != nil {
+		defer a.summary.begin(a.opts.profileName)()
+	}
+	a.enter = enterArgv(profile)
+	var err error
+	if a.env, err = profileEnv(profile); err != nil {
+		return err
+	}
+	done, err := a.preConnect(profile)
+	defer done()
+	if err != nil {
+		return fmt.Errorf("cannot prepare storage: %w", err)
 	}
-	for _, b := range profile.Buckets {
-		a.cascade.addBucket(b)
+	if a.modifies() {
+		unlock, err := a.prepareStorage(profile)
+		if err != nil {
+			return err
+		}
+		defer unlock()
 	}
 	if a.opts.create {
-		if err := a.create(profile); err != nil {
+		err := a.instrument("create", profile, a.create)
+		if err != nil {
+			a.recordFailure(profile, err)
 			return fmt.Errorf("cannot create snapshot: %w", err)
 		}
+		if err := a.enforceLimits(profile); err != nil {
+			return fmt.Errorf("cannot enforce limits: %w", err)
+		}
+		a.recordRun(profile)
+	}
+	if a.opts.backup && a.mayBackUp(profile) {
+		a.transfers = &backupStats{Started: time.Now()}
+		err := a.instrument("backup", profile, a.backup)
+		st := a.transfers
+		a.transfers = nil
+		if err != nil {
+			a.recordFailure(profile, err)
+			return fmt.Errorf("cannot back up snapshots: %w", err)
+		}
+		a.recordStats(profile, st)
+		a.recordRun(profile)
+	}
+	if a.opts.repairChain {
+		if err := a.repairChain(profile); err != nil {
+			return fmt.Errorf("cannot repair chain: %w", err)
+		}
+	}
+	if profile.Manifests && (a.opts.create || a.opts.backup) {
+		if err := a.manifestsInBackground(profile); err != nil {
+			return err
+		}
+	}
+	if a.opts.restore != "" {
+		if err := a.restore(profile, a.opts.restore); err != nil {
+			return fmt.Errorf("cannot restore snapshot: %w", err)
+		}
+	}
+	if a.opts.changedSince != "" {
+		if err := a.changedSince(profile, a.opts.changedSince); err != nil {
+			return fmt.Errorf("cannot list changes: %w", err)
+		}
+	}
+	if a.opts.diffFile != "" {
+		old, cur := a.opts.diffTimes[0], a.opts.diffTimes[1]
+		if err := a.diffFile(profile, a.opts.diffFile, old, cur); err != nil {
+			return fmt.Errorf("cannot compare file: %w", err)
+		}
+	}
+	if a.opts.restoreFile != "" {
+		_, err := a.restoreFile(profile, a.opts.restoreFile, a.opts.output)
+		if err != nil {
+			return fmt.Errorf("cannot restore file: %w", err)
+		}
+	}
+	if a.opts.undelete != "" {
+		if err := a.undelete(profile, a.opts.undelete); err != nil {
+			return fmt.Errorf("cannot undelete snapshot: %w", err)
+		}
+	}
+	if a.opts.emergencyFree != "" {
+		if err := a.emergencyFree(profile, a.opts.emergencyFree); err != nil {
+			return fmt.Errorf("cannot free space: %w", err)
+		}
+	}
+	if a.opts.migrateLayout {
+		if err := a.migrateLayout(profile); err != nil {
+			return fmt.Errorf("cannot migrate layout: %w", err)
+		}
 	}
 	if a.opts.prune {
-		if err := a.prune(profile); err != nil {
+		err := a.instrument("prune", profile, a.prune)
+		if err != nil {
 			return fmt.Errorf("cannot prune snapshots: %w", err)
 		}
 	}
@@ -308,42 +1205,645 @@ func (a *app) run() error {
 			return fmt.Errorf("cannot list snapshots: %w", err)
 		}
 	}
+	if a.opts.browse {
+		if err := a.browse(profile); err != nil {
+			return fmt.Errorf("cannot browse snapshots: %w", err)
+		}
+	}
+	if a.opts.listFiles != "" {
+		if err := a.listFiles(profile, a.opts.listFiles); err != nil {
+			return fmt.Errorf("cannot list files: %w", err)
+		}
+	}
+	if a.opts.find != "" {
+		if err := a.find(profile, a.opts.find); err != nil {
+			return fmt.Errorf("cannot find files: %w", err)
+		}
+	}
+	if a.opts.status {
+		if err := a.status(profile); err != nil {
+			return fmt.Errorf("cannot show status: %w", err)
+		}
+	}
+	if a.opts.churn {
+		if err := a.churn(profile); err != nil {
+			return fmt.Errorf("cannot analyze churn: %w", err)
+		}
+	}
+	if a.opts.stats {
+		if err := a.stats(profile); err != nil {
+			return fmt.Errorf("cannot show statistics: %w", err)
+		}
+	}
+	if a.opts.advise {
+		err := a.advise(profile, a.opts.budget, a.opts.rpo)
+		if err != nil {
+			return fmt.Errorf("cannot advise buckets: %w", err)
+		}
+	}
+	if a.opts.maintain {
+		err := a.instrument("maintain", profile, a.maintain)
+		if err != nil {
+			return fmt.Errorf("cannot maintain storage: %w", err)
+		}
+	}
+	if a.opts.manifest {
+		if err := a.manifests(profile); err != nil {
+			return fmt.Errorf("cannot generate manifests: %w", err)
+		}
+	}
+	if a.opts.verify != "" {
+		if err := a.verify(profile, a.opts.verify); err != nil {
+			return fmt.Errorf("cannot verify snapshot: %w", err)
+		}
+	}
+	if a.opts.auditLog {
+		if err := a.showAuditLog(profile); err != nil {
+			return fmt.Errorf("cannot show audit log: %w", err)
+		}
+	}
+	if a.opts.dedupReport {
+		if err := a.dedupReport(profile, a.opts.dedup); err != nil {
+			return fmt.Errorf("cannot report duplicates: %w", err)
+		}
+	}
+	if a.opts.exportTo != "" {
+		if err := a.export(profile, a.opts.exportTo); err != nil {
+			return fmt.Errorf("cannot export snapshot: %w", err)
+		}
+	}
+	if a.opts.seedExport != "" {
+		if err := a.seedExport(profile, a.opts.seedExport); err != nil {
+			return fmt.Errorf("cannot export seed: %w", err)
+		}
+	}
+	if a.opts.seedImport != "" {
+		if err := a.seedImport(profile, a.opts.seedImport); err != nil {
+			return fmt.Errorf("cannot import seed: %w", err)
+		}
+	}
+	if a.opts.archive != "" {
+		err := a.archive(profile, a.opts.archive, a.opts.format,
+			a.opts.output)
+		if err != nil {
+			return fmt.Errorf("cannot archive snapshot: %w", err)
+		}
+	}
+	return nil
+}
+
+// runVolumes runs the requested operations for each volume of the
+// Containers or PVCs profile p.
+func (a *app) runVolumes(p *profileJSON) error {
+	profiles, err := a.volumeProfiles(p)
+	if err != nil {
+		return err
+	}
+	name := a.opts.profileName
+	defer func() { a.opts.profileName = name }()
+	for _, vp := range profiles {
+		a.opts.profileName = vp.name
+		if a.opts.list {
+			fmt.Printf("%s:\n", vp.name)
+		}
+		if err := a.runProfile(vp); err != nil {
+			return fmt.Errorf("volume %q: %w",
+				path.Base(*vp.Storage), err)
+		}
+	}
 	return nil
 }
 
+// modifies tells whether any of the requested operations modifies storage
+// of the profile.
+func (a *app) modifies() bool {
+	return a.opts.create || a.opts.backup || a.opts.prune ||
+		a.opts.restore != "" || a.opts.undelete != "" || a.opts.dedup ||
+		a.opts.migrateLayout || a.opts.emergencyFree != "" ||
+		a.opts.repairChain || a.opts.seedImport != "" ||
+		a.opts.runOnce
+}
+
+// prepareStorage locks storage of p for modification and recovers from
+// operations which were interrupted. The returned function releases the
+// lock.
+func (a *app) prepareStorage(p *profileJSON) (func(), error) {
+	unlock := func() {}
+	dir, err := storageDir(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.createStorage(p, dir); err != nil {
+		return nil, fmt.Errorf("cannot create storage: %w", err)
+	}
+	if p.user && !a.opts.dryRun {
+		if err := os.MkdirAll(dir, defaultDirMode); err != nil {
+			return nil, err
+		}
+		if err := checkOwned(dir); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := a.locks[dir]; !ok && !a.opts.dryRun {
+		if unlock, err = lockStorage(dir); err != nil {
+			return nil, err
+		}
+		if a.locks != nil {
+			a.locks[dir] = unlock
+			unlock = func() {}
+		}
+	}
+	if err := a.reconcile(dir); err != nil {
+		unlock()
+		return nil, fmt.Errorf("cannot recover from interrupted "+
+			"operation: %w", err)
+	}
+	return unlock, nil
+}
+
+// commands maps names of subcommands to the options they stand for, so that
+// "snap create home" is the same as "snap --create home".
+func (a *app) commands() map[string]*bool {
+	return map[string]*bool{
+		"advise":           &a.opts.advise,
+		"audit-log":        &a.opts.auditLog,
+		"backup":           &a.opts.backup,
+		"browse":           &a.opts.browse,
+		"catch-up":         &a.opts.catchUp,
+		"churn":            &a.opts.churn,
+		"create":           &a.opts.create,
+		"dedup-report":     &a.opts.dedupReport,
+		"init-profile":     &a.opts.initProfile,
+		"list":             &a.opts.list,
+		"maintain":         &a.opts.maintain,
+		"manifest":         &a.opts.manifest,
+		"migrate-layout":   &a.opts.migrateLayout,
+		"post-transaction": &a.opts.postTransaction,
+		"pre-transaction":  &a.opts.preTransaction,
+		"prune":            &a.opts.prune,
+		"repair-chain":     &a.opts.repairChain,
+		"run":              &a.opts.runOnce,
+		"serve":            &a.opts.serve,
+		"stats":            &a.opts.stats,
+		"status":           &a.opts.status,
+		"watch":            &a.opts.watch,
+	}
+}
+
+// argCommands is like commands, but for subcommands which take an argument
+// after the profile name, as in "snap restore home 1577836800".
+func (a *app) argCommands() map[string]*string {
+	return map[string]*string{
+		"archive":        &a.opts.archive,
+		"changed-since":  &a.opts.changedSince,
+		"diff-file":      &a.opts.diffFile,
+		"emergency-free": &a.opts.emergencyFree,
+		"find":           &a.opts.find,
+		"list-files":     &a.opts.listFiles,
+		"restore":        &a.opts.restore,
+		"restore-file":   &a.opts.restoreFile,
+		"seed-export":    &a.opts.seedExport,
+		"seed-import":    &a.opts.seedImport,
+		"undelete":       &a.opts.undelete,
+		"verify":         &a.opts.verify,
+	}
+}
+
+// needsProfile tells whether any of the requested operations only makes
+// sense for a single profile given explicitly.
+func (a *app) needsProfile() bool {
+	return a.opts.advise || a.opts.initProfile || a.opts.backup ||
+		a.opts.browse || a.opts.churn || a.opts.create || a.opts.prune ||
+		a.opts.restore != "" || a.opts.undelete != "" ||
+		a.opts.listFiles != "" || a.opts.find != "" ||
+		a.opts.exportTo != "" || a.opts.archive != "" ||
+		a.opts.verify != "" || a.opts.migrateLayout ||
+		a.opts.emergencyFree != "" || a.opts.restoreFile != "" ||
+		a.opts.repairChain || a.opts.seedExport != "" ||
+		a.opts.seedImport != "" || a.opts.runOnce ||
+		a.opts.diffFile != "" || a.opts.watch ||
+		a.opts.changedSince != "" || a.opts.stats
+}
+
+func usage() {
+	getopt.PrintUsage(os.Stderr)
+	fmt.Fprintln(os.Stderr, "\nCommands (alternative to the options above):")
+	fmt.Fprintln(os.Stderr, "  snap {advise|backup|browse|churn|create|"+
+		"migrate-layout|prune|repair-chain|run|stats|watch} profile-name")
+	fmt.Fprintln(os.Stderr, "  snap init-profile profile-name --subvolume path --storage path")
+	fmt.Fprintln(os.Stderr, "  snap {pre-transaction|post-transaction} profile-name")
+	fmt.Fprintln(os.Stderr, "  snap {audit-log|catch-up|dedup-report|list|"+
+		"maintain|manifest|status} [profile-name]")
+	fmt.Fprintln(os.Stderr, "  snap status --all [--failed-only]")
+	fmt.Fprintln(os.Stderr, "  snap {find|list-files} profile-name pattern")
+	fmt.Fprintln(os.Stderr, "  snap {changed-since|restore|undelete|verify} profile-name timestamp")
+	fmt.Fprintln(os.Stderr, "  snap {seed-export|seed-import} profile-name dir")
+	fmt.Fprintln(os.Stderr, "  snap archive profile-name timestamp output")
+	fmt.Fprintln(os.Stderr, "  snap restore-file profile-name timestamp file")
+	fmt.Fprintln(os.Stderr, "  snap diff-file profile-name file timestamp timestamp")
+	fmt.Fprintln(os.Stderr, "  snap emergency-free profile-name size")
+	fmt.Fprintln(os.Stderr, "  snap serve")
+	fmt.Fprintln(os.Stderr, "  snap [options] group-name")
+}
+
+// setUp prepares what the configuration asks for.
+func (a *app) setUp() {
+	a.db = &metaDB{dir: defaultStateDir}
+	if a.cfg.StateDir != nil {
+		a.db.dir = *a.cfg.StateDir
+	} else if os.Geteuid() != 0 {
+		if dir, err := userStateDir(); err == nil {
+			a.db.dir = dir
+		}
+	}
+	a.ssh, a.log, a.telemetry, a.events = nil, nil, nil, nil
+	if a.cfg.SSH != nil && a.cfg.SSH.Native {
+		a.ssh = newSSHPool(a.cfg.SSH)
+	}
+	if a.cfg.Log != nil {
+		a.log = newCommandLog(a.cfg.Log)
+	}
+	if a.cfg.Telemetry != nil {
+		a.telemetry = newTelemetry(a.cfg.Telemetry)
+	}
+	if a.cfg.Events != nil {
+		a.events = newEventLog(a.cfg.Events)
+	}
+}
+
 func main() {
-	a := &app{}
+	a := &app{invoker: pkexecUID()}
 	a.opts.cfgPath = "/etc/snap/config.json"
 	var err error
 	a.cfg, err = loadConfig(a.opts.cfgPath)
 	if err != nil {
-		panic(err)
+		fmt.Fprintf(os.Stderr, "%s: %v\n", a.opts.cfgPath, err)
+		os.Exit(1)
+	}
+	if filename, err := addUserConfig(a.cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", filename, err)
+		os.Exit(1)
 	}
-	a.cascade = newCascade()
+	for _, w := range a.cfg.warnings() {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+	}
+	a.setUp()
+	a.opts.btrfsBin = defaultBtrfsBin
+	a.opts.format = defaultArchiveFormat
+	a.opts.reason = reasonTimeline
+	a.opts.timestamps = "relative"
+	getopt.FlagLong(&a.opts.advise, "advise", 0,
+		"propose buckets according to churn, see --budget and --rpo")
+	getopt.FlagLong(&a.opts.all, "all", 0,
+		"with --status, report on all profiles in one table, those "+
+			"most at risk first")
+	getopt.FlagLong(&a.opts.annotateRetention, "annotate-retention", 0,
+		"with --list, mark snapshots which pruning would keep, with "+
+			"the bucket keeping them, or delete")
+	getopt.FlagLong(&a.opts.archive, "archive", 0,
+		"package snapshot into an archive written to the file given "+
+			"after profile-name", "timestamp")
+	getopt.FlagLong(&a.opts.auditLog, "audit-log", 0,
+		"show deletions and restores of snapshots")
+	getopt.FlagLong(&a.opts.backup, "backup", 'B',
+		"back up snapshots of the source profile")
+	getopt.FlagLong(&a.opts.browse, "browse", 0,
+		"browse snapshots and restore files interactively")
+	getopt.FlagLong(&a.opts.budget, "budget", 0,
+		"with --advise, space snapshots may take", "size")
+	getopt.FlagLong(&a.opts.catchUp, "catch-up", 0,
+		"create or back up snapshots, and prune them, where that "+
+			"was missed, such as while the machine was off")
+	getopt.FlagLong(&a.opts.changedSince, "changed-since", 0,
+		"list files of the subvolume whose data changed since "+
+			"snapshot", "timestamp")
+	getopt.FlagLong(&a.opts.churn, "churn", 0,
+		"show how much data changed between consecutive snapshots")
+	getopt.FlagLong(&a.opts.commit, "commit", 0,
+		"when deleting snapshots, wait for the transaction to commit "+
+			"after all of them or after each one", "after|each")
+	getopt.FlagLong(&a.opts.connect, "connect", 0,
+		"perform operations through snap serve running at url "+
+			"(token is read from $SNAP_TOKEN)", "url")
 	getopt.FlagLong(&a.opts.create, "create", 'c',
 		"create a snapshot")
+	getopt.FlagLong(&a.opts.dateFormat, "date-format", 0,
+		"format dates as iso, per locale, or strftime-style format",
+		"iso|locale|format")
+	getopt.FlagLong(&a.opts.dedup, "dedup", 0,
+		"with --dedup-report, deduplicate the files using duperemove")
+	getopt.FlagLong(&a.opts.dedupReport, "dedup-report", 0,
+		"report files in snapshots with the same contents which "+
+			"don't share data")
+	getopt.FlagLong(&a.opts.diffFile, "diff-file", 0,
+		"compare file between the snapshots taken at the two "+
+			"timestamps given after profile-name", "file")
 	getopt.FlagLong(&a.opts.dryRun, "dry-run", 0,
 		"print what would be done, but don't do anything")
+	getopt.FlagLong(&a.opts.emergencyFree, "emergency-free", 0,
+		"delete the oldest snapshots, regardless of the retention "+
+			"policy, until this much space is available", "size")
+	getopt.FlagLong(&a.opts.exclude, "exclude", 0,
+		"with --list-files or --find, leave out files matching "+
+			"pattern, in addition to the profile's Exclude", "pattern")
+	getopt.FlagLong(&a.opts.exportTo, "export-to", 0,
+		"export the newest snapshot into the profile's restic or borg "+
+			"repository, unless it's there already", "restic|borg")
+	getopt.FlagLong(&a.opts.failedOnly, "failed-only", 0,
+		"with --status --all, only report on profiles with problems")
+	getopt.FlagLong(&a.opts.find, "find", 'f',
+		"search all snapshots for files whose name matches pattern",
+		"pattern")
+	getopt.FlagLong(&a.opts.force, "force", 0,
+		"with --backup, back up even if RequireAC or AvoidMetered "+
+			"say not to, with --prune, prune even if "+
+			"RequireBackupBeforePrune says not to")
+	getopt.FlagLong(&a.opts.format, "format", 0,
+		"with --archive, format of the archive", "tar.zst|squashfs")
+	getopt.FlagLong(&a.opts.full, "full", 0,
+		"with --backup or --restore, send snapshots in full rather "+
+			"than relative to older ones")
+	getopt.FlagLong(&a.opts.grep, "grep", 0,
+		"with --list, only list snapshots whose description matches "+
+			"regexp", "regexp")
+	getopt.FlagLong(&a.opts.initProfile, "init-profile", 0,
+		"add a profile to the configuration file, see --subvolume "+
+			"and --storage")
+	getopt.FlagLong(&a.opts.listen, "listen", 0,
+		"address for snap serve to listen on", "addr")
 	getopt.FlagLong(&a.opts.list, "list", 'l',
 		"list all snapshots")
+	getopt.FlagLong(&a.opts.listFiles, "list-files", 'L',
+		"list versions of files matching pattern across snapshots",
+		"pattern")
+	getopt.FlagLong(&a.opts.maintain, "maintain", 0,
+		"scrub and balance storage according to its Maintain settings")
+	getopt.FlagLong(&a.opts.manifest, "manifest", 0,
+		"generate manifests of snapshots which don't have any")
+	getopt.FlagLong(&a.opts.maxSize, "max-size", 0,
+		"with --find, only report files of at most this size", "size")
+	getopt.FlagLong(&a.opts.message, "message", 'm',
+		"with --create, attach description to the snapshot",
+		"description")
+	getopt.FlagLong(&a.opts.migrateLayout, "migrate-layout", 0,
+		"move snapshots into the layout set by the profile's Layout")
+	getopt.FlagLong(&a.opts.minSize, "min-size", 0,
+		"with --find, only report files of at least this size", "size")
+	getopt.FlagLong(&a.opts.modifiedAfter, "modified-after", 0,
+		"with --find, only report files modified on or after date",
+		"date")
+	getopt.FlagLong(&a.opts.modifiedBefore, "modified-before", 0,
+		"with --find, only report files modified before date", "date")
+	getopt.FlagLong(&a.opts.plain, "plain", 0,
+		"print tab-separated output without headers and colors")
+	getopt.FlagLong(&a.opts.postTransaction, "post-transaction", 0,
+		"create a snapshot after a package manager transaction, "+
+			"paired with the one created before it")
+	getopt.FlagLong(&a.opts.preTransaction, "pre-transaction", 0,
+		"create a snapshot before a package manager transaction")
 	getopt.FlagLong(&a.opts.prune, "prune", 'X',
 		"remove snapshots according to retention policy")
+	getopt.FlagLong(&a.opts.pullConfig, "pull-config", 0,
+		"fetch the configuration from url, see PullConfig", "url")
+	getopt.FlagLong(&a.opts.reason, "reason", 0,
+		"with --create, why the snapshot is taken", reasonList())
+	getopt.FlagLong(&a.opts.recursive, "recursive", 'r',
+		"list files in subdirectories too")
+	getopt.FlagLong(&a.opts.repairChain, "repair-chain", 0,
+		"delete broken copies of snapshots and back them up again")
+	getopt.FlagLong(&a.opts.restore, "restore", 0,
+		"restore snapshot from backup into the source profile",
+		"timestamp")
+	getopt.FlagLong(&a.opts.restoreFile, "restore-file", 0,
+		"copy the file given after profile-name from snapshot back "+
+			"into the subvolume", "timestamp")
+	getopt.FlagLong(&a.opts.rpo, "rpo", 0,
+		"with --advise, longest acceptable time between snapshots "+
+			"(shortest bucket interval by default)", "interval")
+	getopt.FlagLong(&a.opts.runOnce, "run", 0,
+		"create a snapshot, back it up to all destinations, prune "+
+			"the profile and then them, all under one lock")
+	getopt.FlagLong(&a.opts.seedExport, "seed-export", 0,
+		"write send streams of all snapshots into dir, to carry them "+
+			"to the destination", "dir")
+	getopt.FlagLong(&a.opts.seedImport, "seed-import", 0,
+		"receive send streams written by --seed-export in dir into "+
+			"the backup profile's storage", "dir")
+	getopt.FlagLong(&a.opts.serve, "serve", 0,
+		"serve an HTTP API for managing snapshots")
+	getopt.FlagLong(&a.opts.stats, "stats", 0,
+		"show sizes and durations of the latest backups, highlighting "+
+			"those which grew or slowed down suddenly")
+	getopt.FlagLong(&a.opts.status, "status", 's',
+		"show a summary of the profile's snapshots")
+	getopt.FlagLong(&a.opts.storage, "storage", 0,
+		"with --init-profile, where to keep snapshots", "path")
+	getopt.FlagLong(&a.opts.subvolume, "subvolume", 0,
+		"with --init-profile, subvolume to take snapshots of", "path")
+	getopt.FlagLong(&a.opts.summary, "summary", 0,
+		"print a summary of what was done at the end", "text|json")
+	getopt.FlagLong(&a.opts.undelete, "undelete", 0,
+		"move snapshot back from the trash", "timestamp")
+	getopt.FlagLong(&a.opts.timestamps, "timestamps", 0,
+		"show times as relative, absolute (ISO 8601) or both",
+		"relative|absolute|both")
+	getopt.FlagLong(&a.opts.trace, "trace", 0,
+		"record commands run, their timing and exit codes into file as "+
+			"JSON lines", "file")
+	getopt.FlagLong(&a.opts.verify, "verify", 0,
+		"check files of snapshot against its manifest", "timestamp")
 	getopt.FlagLong(&a.opts.verbose, "verbose", 'v',
 		"explain what is being done")
-	a.opts.btrfsBin = *getopt.StringLong("btrfs-bin", 'b', defaultBtrfsBin,
+	getopt.FlagLong(&a.opts.watch, "watch", 0,
+		"take snapshots whenever the subvolume changes, see Watch")
+	getopt.FlagLong(&a.opts.waitCleaned, "wait-cleaned", 0,
+		"with --prune, wait until space of deleted snapshots is freed")
+	getopt.FlagLong(&a.opts.btrfsBin, "btrfs-bin", 'b',
 		"name of the btrfs binary (searched in $PATH)")
 	getopt.SetParameters("profile-name")
-	getopt.Parse()
+	getopt.SetUsage(usage)
+
+	args := os.Args
+	// Options may follow positional parameters, as in "snap create home -v".
+	var params []string
+	for {
+		getopt.CommandLine.Parse(args)
+		rest := getopt.Args()
+		if getopt.CommandLine.State() == getopt.DashDash {
+			params = append(params, rest...)
+			break
+		}
+		if len(rest) == 0 {
+			break
+		}
+		params = append(params, rest[0])
+		args = append([]string{args[0]}, rest[1:]...)
+	}
+	var argOpt *string
+	if len(params) > 0 {
+		if opt, ok := a.commands()[params[0]]; ok {
+			*opt = true
+			params = params[1:]
+		} else if opt, ok := a.argCommands()[params[0]]; ok {
+			argOpt = opt
+			params = params[1:]
+		}
+	}
 
-	if getopt.NArgs() != 1 {
-		fmt.Fprintln(os.Stderr, "profile-name argument missing")
-		getopt.Usage()
+	switch a.opts.timestamps {
+	case "relative", "absolute", "both":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid --timestamps value: %q\n",
+			a.opts.timestamps)
+		usage()
 		os.Exit(1)
 	}
-	a.opts.profileName = getopt.Arg(0)
 
-	if err := a.run(); err != nil {
-		fmt.Fprintf(os.Stderr, "TODO: %s\n", err.Error())
+	if a.opts.commit != "" && a.opts.commit != "after" &&
+		a.opts.commit != "each" {
+		fmt.Fprintf(os.Stderr, "invalid --commit value: %q\n",
+			a.opts.commit)
+		usage()
+		os.Exit(1)
+	}
+	if !validExport(a.opts.exportTo) {
+		fmt.Fprintf(os.Stderr, "invalid --export-to value: %q\n",
+			a.opts.exportTo)
+		usage()
 		os.Exit(1)
 	}
+
+	if !validArchiveFormat(a.opts.format) {
+		fmt.Fprintf(os.Stderr, "invalid --format value: %q\n",
+			a.opts.format)
+		usage()
+		os.Exit(1)
+	}
+
+	if !validSummary(a.opts.summary) {
+		fmt.Fprintf(os.Stderr, "invalid --summary value: %q\n",
+			a.opts.summary)
+		usage()
+		os.Exit(1)
+	}
+	if a.opts.summary != "" {
+		a.summary = newSummary()
+	}
+	if a.opts.trace != "" {
+		if a.trace, err = newTracer(a.opts.trace); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot trace commands: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if (a.opts.all && !a.opts.status) || (a.opts.failedOnly && !a.opts.all) {
+		fmt.Fprintln(os.Stderr, "--all only goes with --status, "+
+			"--failed-only with --status --all")
+		usage()
+		os.Exit(1)
+	}
+
+	if a.opts.preTransaction && a.opts.postTransaction {
+		fmt.Fprintln(os.Stderr, "--pre-transaction and "+
+			"--post-transaction are mutually exclusive")
+		usage()
+		os.Exit(1)
+	}
+	if a.opts.preTransaction || a.opts.postTransaction {
+		a.opts.create = true
+	}
+
+	if a.opts.reason != "" && !validReason(a.opts.reason) {
+		fmt.Fprintf(os.Stderr, "invalid --reason value: %q\n",
+			a.opts.reason)
+		usage()
+		os.Exit(1)
+	}
+
+	if a.dateFormat, err = dateFormatter(a.opts.dateFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		usage()
+		os.Exit(1)
+	}
+
+	if u := a.pullURL(); u != "" {
+		cfg, err := a.pullConfig(u)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if filename, err := addUserConfig(cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", filename, err)
+			os.Exit(1)
+		}
+		a.cfg = cfg
+		a.setUp()
+	}
+
+	nargs := 1
+	if argOpt != nil {
+		nargs = 2
+		if len(params) > 1 {
+			*argOpt = params[1]
+		}
+	}
+	if a.opts.archive != "" || argOpt == &a.opts.archive ||
+		a.opts.restoreFile != "" || argOpt == &a.opts.restoreFile {
+		// The archive is written to the file named last, which is
+		// also the one to restore.
+		nargs++
+		if len(params) == nargs {
+			a.opts.output = params[nargs-1]
+		}
+	}
+	if a.opts.diffFile != "" || argOpt == &a.opts.diffFile {
+		// The file is compared between the two snapshots named last.
+		nargs += 2
+		if len(params) == nargs {
+			a.opts.diffTimes = params[nargs-2:]
+		}
+	}
+	if len(params) == 0 && !a.needsProfile() {
+		nargs = 0
+	}
+	if len(params) != nargs {
+		if len(params) < nargs {
+			fmt.Fprintln(os.Stderr, "profile-name argument missing")
+		} else {
+			fmt.Fprintln(os.Stderr, "too many arguments")
+		}
+		usage()
+		os.Exit(1)
+	}
+	if nargs > 0 {
+		a.opts.profileName = params[0]
+	}
+
+	if err := a.checkPkexec(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	run := a.run
+	if a.opts.initProfile {
+		run = a.initProfile
+	} else if a.opts.serve {
+		run = a.serve
+	} else if a.opts.connect != "" {
+		run = a.runRemote
+	}
+	err = run()
+	if a.telemetry != nil {
+		if err := a.telemetry.flush(); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot export telemetry: %v\n", err)
+		}
+	}
+	if a.summary != nil {
+		if err := a.printSummary(); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot print summary: %v\n", err)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "snap: %v\n", err)
+		os.Exit(exitCode(err))
+	}
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestParseSnapName(t *testing.T) {
+	tests := []struct {
+		name string
+		want time.Time
+		ok   bool
+	}{
+		{"1577836800", time.Unix(1577836800, 0), true},
+		{"1577836800.1", time.Unix(1577836800, 1), true},
+		{"1577836800.999", time.Unix(1577836800, 999), true},
+		{"1577836800.0", time.Time{}, false},
+		{"1577836800.1000", time.Time{}, false},
+		{"1577836800.-1", time.Time{}, false},
+		{"1577836800.x", time.Time{}, false},
+		{"snapshot", time.Time{}, false},
+		{"", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseSnapName(tt.name)
+		if (err == nil) != tt.ok || !got.Equal(tt.want) {
+			t.Errorf("parseSnapName(%q) = %v, %v, want %v", tt.name,
+				got, err, tt.want)
+		}
+	}
+}
+
+func TestSnapNameRoundTrip(t *testing.T) {
+	at := time.Unix(1577836800, 0)
+	for _, n := range []int{0, 1, maxSnapsPerSecond - 1} {
+		got, err := parseSnapName(snapName(at, n))
+		if err != nil || !got.Equal(at.Add(time.Duration(n))) {
+			t.Errorf("snapshot %d: parsed %v, %v", n, got, err)
+		}
+	}
+}
+
+func TestNewSnap(t *testing.T) {
+	at := time.Unix(1577836800, 0)
+	for _, flat := range []bool{false, true} {
+		dir := t.TempDir()
+		a := &app{}
+		for n, want := range []string{"1577836800", "1577836800.1",
+			"1577836800.2"} {
+			s, err := a.newSnap(dir, flat, at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.path != path.Join(dir, want) || s.flat != flat ||
+				!s.created.Equal(at.Add(time.Duration(n))) {
+				t.Errorf("flat %v: got %s created %v, want %s",
+					flat, s.path, s.created, want)
+			}
+			// The flat layout leaves creating it to btrfs.
+			if flat {
+				if err := os.Mkdir(s.path, defaultDirMode); err != nil {
+					t.Fatal(err)
+				}
+			} else if _, err := os.Stat(s.path); err != nil {
+				t.Errorf("%s not created: %v", s.path, err)
+			}
+		}
+	}
+}
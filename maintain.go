@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultScrubInterval = month
+	defaultBalanceUsage  = 50
+)
+
+// scrubStatus is the outcome of the last scrub of a filesystem.
+type scrubStatus struct {
+	started time.Time
+	status  string
+	errors  string
+}
+
+// scrubStatus returns the status of the last scrub of the filesystem which
+// holds dir, or nil if it was never scrubbed.
+func (a *app) scrubStatus(dir string) (*scrubStatus, error) {
+	out, err := a.btrfsQuery("scrub", "status", dir)
+	if err != nil {
+		return nil, err
+	}
+	var st scrubStatus
+	for _, line := range strings.Split(string(out), "\n") {
+		f := strings.SplitN(line, ":", 2)
+		if len(f) != 2 {
+			continue
+		}
+		v := strings.TrimSpace(f[1])
+		switch strings.TrimSpace(f[0]) {
+		case "Scrub started":
+			st.started, err = time.ParseInLocation(time.ANSIC, v,
+				time.Local)
+			if err != nil {
+				return nil, fmt.Errorf("invalid scrub start %q", v)
+			}
+		case "Status":
+			st.status = v
+		case "Error summary":
+			st.errors = v
+		}
+	}
+	if st.started.IsZero() {
+		return nil, nil
+	}
+	return &st, nil
+}
+
+func (st *scrubStatus) ok() bool {
+	return st.errors == "" || st.errors == "no errors found"
+}
+
+// scrubCell describes the last scrub of the filesystem which holds dir for
+// status.
+func (a *app) scrubCell(dir string) cell {
+	st, err := a.scrubStatus(dir)
+	switch {
+	case err != nil:
+		return cell{text: "unknown", color: colorYellow}
+	case st == nil:
+		return cell{text: "never", color: colorYellow}
+	case !st.ok():
+		return cell{text: fmt.Sprintf("%s, %s",
+			a.formatTime(st.started, time.Now()), st.errors),
+			color: colorRed}
+	}
+	return plainCell("%s, %s", a.formatTime(st.started, time.Now()),
+		st.status)
+}
+
+// dataUsage returns how much space is allocated to data chunks of the
+// filesystem which holds dir, how much of it is used, and how much space is
+// left unallocated.
+func (a *app) dataUsage(dir string) (size, used, unalloc uint64, err error) {
+	out, err := a.btrfsQuery("filesystem", "usage", "-b", dir)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "Device unallocated:"):
+			f := strings.Fields(line)
+			unalloc, err = strconv.ParseUint(f[2], 10, 64)
+		case strings.HasPrefix(line, "Data,"):
+			// Data,single: Size:1073741824, Used:536870912 (50.00%)
+			_, err = fmt.Sscanf(line[strings.Index(line, "Size:"):],
+				"Size:%d, Used:%d", &size, &used)
+		}
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("unexpected line %q", line)
+		}
+	}
+	return size, used, unalloc, nil
+}
+
+// maintain scrubs the filesystem which holds storage of p if it's due, and
+// balances it if more space is wasted in partly used data chunks than is
+// left unallocated, as btrfs then runs out of space while it's still free.
+func (a *app) maintain(p *profileJSON) error {
+	if p.Maintain == nil {
+		if a.opts.verbose {
+			fmt.Fprintf(os.Stderr, "%s: no maintenance configured\n",
+				a.opts.profileName)
+		}
+		return nil
+	}
+	dir, err := storageDir(p)
+	if err != nil {
+		return err
+	}
+	interval := time.Duration(defaultScrubInterval)
+	if p.Maintain.ScrubInterval != nil {
+		interval = time.Duration(*p.Maintain.ScrubInterval)
+	}
+	st, err := a.scrubStatus(dir)
+	if err != nil {
+		return fmt.Errorf("cannot get scrub status: %w", err)
+	}
+	if st != nil && st.status == "running" {
+		fmt.Printf("%s: scrub already running\n", dir)
+	} else if st == nil || time.Since(st.started) >= interval {
+		// Scrubbing takes long, but it's better to know when it's done
+		// and whether it found any errors.
+		if err := a.btrfsCmd("scrub", "start", "-B", dir); err != nil {
+			return fmt.Errorf("scrub failed: %w", err)
+		}
+		if !a.opts.dryRun {
+			st, err = a.scrubStatus(dir)
+			if err != nil {
+				return fmt.Errorf("cannot get scrub status: %w", err)
+			}
+			if st != nil && !st.ok() {
+				return fmt.Errorf("scrub of %s found errors: %s",
+					dir, st.errors)
+			}
+			fmt.Printf("%s: scrubbed, no errors found\n", dir)
+		}
+	}
+
+	size, used, unalloc, err := a.dataUsage(dir)
+	if err != nil {
+		return fmt.Errorf("cannot get filesystem usage: %w", err)
+	}
+	if size-used <= unalloc {
+		return nil
+	}
+	usage := defaultBalanceUsage
+	if p.Maintain.BalanceUsage != nil {
+		usage = *p.Maintain.BalanceUsage
+	}
+	err = a.btrfsCmd("balance", "start",
+		"-dusage="+strconv.Itoa(usage), dir)
+	if err != nil {
+		return fmt.Errorf("balance failed: %w", err)
+	}
+	if !a.opts.dryRun {
+		fmt.Printf("%s: balanced data chunks less than %d%% full\n",
+			dir, usage)
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// manifestDir holds manifests of snapshots in a storage directory, relative
+// to it. A manifest lists the files of a snapshot along with their sizes,
+// modification times and SHA-256 sums, one per line:
+//
+//	<sum> <size> <mtime in ns> <f|l> <quoted path>
+//
+// Symbolic links are summed by their targets, like list-files does.
+const manifestDir = ".manifests"
+
+type manifestEntry struct {
+	Sum     []byte
+	Size    int64
+	ModTime time.Time
+	Symlink bool
+}
+
+func manifestPath(s *snap) string {
+	return path.Join(path.Dir(s.path), manifestDir, path.Base(s.path))
+}
+
+// fileSum computes the sum of the file at p the way manifests record it.
+func fileSum(p string, fi os.FileInfo) ([]byte, error) {
+	h := sha256.New()
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(p)
+		if err != nil {
+			return nil, err
+		}
+		io.WriteString(h, target)
+		return h.Sum(nil), nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// scanFiles calls fn for each regular file and symbolic link in the snapshot
+// s, with paths relative to its root.
+func scanFiles(s *snap, fn func(rel string, fi os.FileInfo) error) error {
+	root := s.subvolPath()
+	return filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() && fi.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		return fn(rel, fi)
+	})
+}
+
+// writeManifest sums the files of the snapshot s and saves its manifest.
+func writeManifest(s *snap) error {
+	p := manifestPath(s)
+	if err := os.MkdirAll(path.Dir(p), defaultDirMode); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(path.Dir(p), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	err = scanFiles(s, func(rel string, fi os.FileInfo) error {
+		sum, err := fileSum(filepath.Join(s.subvolPath(), rel), fi)
+		if err != nil {
+			return err
+		}
+		kind := "f"
+		if fi.Mode()&os.ModeSymlink != 0 {
+			kind = "l"
+		}
+		_, err = fmt.Fprintf(w, "%x %d %d %s %s\n", sum, fi.Size(),
+			fi.ModTime().UnixNano(), kind, strconv.Quote(rel))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+// readManifest loads the manifest of the snapshot s, keyed by paths relative
+// to its root. It returns nil if there's none.
+func readManifest(s *snap) (map[string]manifestEntry, error) {
+	f, err := os.Open(manifestPath(s))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := make(map[string]manifestEntry)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		f := strings.SplitN(sc.Text(), " ", 5)
+		if len(f) != 5 {
+			return nil, fmt.Errorf("%s:%d: malformed line",
+				manifestPath(s), n)
+		}
+		var e manifestEntry
+		var mtime int64
+		var rel string
+		e.Sum, err = hex.DecodeString(f[0])
+		if err == nil {
+			e.Size, err = strconv.ParseInt(f[1], 10, 64)
+		}
+		if err == nil {
+			mtime, err = strconv.ParseInt(f[2], 10, 64)
+		}
+		if err == nil {
+			rel, err = strconv.Unquote(f[4])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", manifestPath(s), n, err)
+		}
+		e.ModTime = time.Unix(0, mtime)
+		e.Symlink = f[3] == "l"
+		m[rel] = e
+	}
+	return m, sc.Err()
+}
+
+func removeManifest(s *snap) error {
+	err := os.Remove(manifestPath(s))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// manifests generates manifests of snapshots of p which don't have any yet.
+func (a *app) manifests(p *profileJSON) error {
+	snaps, err := profileSnaps(p)
+	if err != nil {
+		return err
+	}
+	for _, s := range snaps {
+		if _, err := os.Stat(manifestPath(s)); err == nil {
+			continue
+		}
+		if a.opts.dryRun || a.opts.verbose {
+			fmt.Fprintf(os.Stderr, "generate manifest of %s\n", s.path)
+		}
+		if a.opts.dryRun {
+			continue
+		}
+		if err := writeManifest(s); err != nil {
+			if _, serr := os.Stat(s.path); os.IsNotExist(serr) {
+				// Pruned in the meantime.
+				continue
+			}
+			return fmt.Errorf("%s: %w", s.path, err)
+		}
+		if _, err := os.Stat(s.path); os.IsNotExist(err) {
+			removeManifest(s)
+		}
+	}
+	return nil
+}
+
+// manifestsInBackground starts snap to generate manifests of p, which may
+// take a while, without waiting for it to finish.
+func (a *app) manifestsInBackground(p *profileJSON) error {
+	if a.opts.dryRun || a.opts.verbose {
+		fmt.Fprintf(os.Stderr, "generate manifests of %s in background\n",
+			p.name)
+	}
+	if a.opts.dryRun {
+		return nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(self, "--manifest", p.name)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("cannot generate manifests: %w", err)
+	}
+	return cmd.Process.Release()
+}
+
+// verify checks the files of the snapshot of p created at the given time
+// against its manifest.
+func (a *app) verify(p *profileJSON, timestamp string) error {
+	snaps, err := profileSnaps(p)
+	if err != nil {
+		return err
+	}
+	var s *snap
+	for _, t := range snaps {
+		if path.Base(t.path) == timestamp {
+			s = t
+		}
+	}
+	if s == nil {
+		return fmt.Errorf("no snapshot %s", timestamp)
+	}
+	m, err := readManifest(s)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return fmt.Errorf("%s has no manifest", s.path)
+	}
+	problems := make(map[string]string)
+	err = scanFiles(s, func(rel string, fi os.FileInfo) error {
+		e, ok := m[rel]
+		delete(m, rel)
+		switch {
+		case !ok:
+			problems[rel] = "not in manifest"
+			return nil
+		case e.Symlink != (fi.Mode()&os.ModeSymlink != 0):
+			problems[rel] = "type differs"
+			return nil
+		case e.Size != fi.Size():
+			problems[rel] = "size differs"
+			return nil
+		}
+		sum, err := fileSum(filepath.Join(s.subvolPath(), rel), fi)
+		if err != nil {
+			problems[rel] = err.Error()
+		} else if !bytes.Equal(sum, e.Sum) {
+			problems[rel] = "contents differ"
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for rel := range m {
+		problems[rel] = "missing"
+	}
+	if len(problems) == 0 {
+		if a.opts.verbose {
+			fmt.Fprintf(os.Stderr, "%s matches its manifest\n", s.path)
+		}
+		a.emit(eventVerified, p, s, "", nil)
+		return nil
+	}
+	var sorted []string
+	for rel := range problems {
+		sorted = append(sorted, rel)
+	}
+	sort.Strings(sorted)
+	t := newTable("FILE", "PROBLEM")
+	for _, rel := range sorted {
+		t.add(plainCell("%s", rel),
+			cell{text: problems[rel], color: colorRed})
+	}
+	if err := a.printTable(t); err != nil {
+		return err
+	}
+	err = fmt.Errorf("%d files of %s don't match its manifest",
+		len(problems), s.path)
+	a.emit(eventVerified, p, s, "", err)
+	return err
+}
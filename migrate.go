@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// migratePrefix starts the name under which a snapshot is kept in its
+// storage directory while it's being moved to another layout.
+const migratePrefix = ".migrate-"
+
+// migrateLayout moves snapshots of p into the layout set by its Layout.
+func (a *app) migrateLayout(p *profileJSON) error {
+	if p.isBackup() {
+		return fmt.Errorf("%q is a backup profile, its snapshots keep "+
+			"the layout of their source", p.name)
+	}
+	if p.Rsync != nil {
+		return fmt.Errorf("copies made by rsync have no layout")
+	}
+	flat := p.Layout != nil && *p.Layout == layoutFlat
+	dir, err := storageDir(p)
+	if err != nil {
+		return err
+	}
+	snaps, err := profileSnaps(p)
+	if err != nil {
+		return err
+	}
+	n := 0
+	for _, s := range snaps {
+		if s.flat == flat {
+			continue
+		}
+		if err := a.migrateSnap(dir, s, flat); err != nil {
+			return fmt.Errorf("%s: %w", s.path, err)
+		}
+		n++
+	}
+	if !a.opts.plain {
+		fmt.Printf("%d snapshots moved to the %s layout\n", n,
+			layoutName(flat))
+	}
+	return nil
+}
+
+func layoutName(flat bool) string {
+	if flat {
+		return layoutFlat
+	}
+	return layoutNested
+}
+
+// migrateSnap moves the snapshot s in storage into the flat layout or the
+// nested one. The subvolume is moved aside first, since a snapshot's
+// directory and subvolume have the same name in different layouts.
+func (a *app) migrateSnap(storage string, s *snap, flat bool) error {
+	name := path.Base(s.path)
+	tmp := path.Join(storage, migratePrefix+name)
+	if flat {
+		fis, err := ioutil.ReadDir(s.path)
+		if err != nil {
+			return err
+		}
+		if len(fis) != 1 {
+			return fmt.Errorf("snapshot directory holds more than " +
+				"the snapshot")
+		}
+	}
+	if a.opts.dryRun || a.opts.verbose {
+		printArgv([]string{"mv", s.subvolPath(), tmp})
+		printArgv([]string{"mv", tmp, migratedPath(storage, name, flat)})
+	}
+	if a.opts.dryRun {
+		return nil
+	}
+	done, err := a.begin(storage, opMigrate, &snap{path: s.path, flat: flat})
+	if err != nil {
+		return err
+	}
+	// Read-only subvolumes can't be moved to another directory.
+	if err := a.setReadOnly(s.subvolPath(), false); err != nil {
+		return err
+	}
+	if err := os.Rename(s.subvolPath(), tmp); err != nil {
+		return err
+	}
+	if err := a.finishMigration(storage, name, flat); err != nil {
+		return err
+	}
+	return done()
+}
+
+// migratedPath returns where the subvolume of the snapshot with the given
+// name is in storage in the flat layout or the nested one.
+func migratedPath(storage, name string, flat bool) string {
+	if flat {
+		return path.Join(storage, name)
+	}
+	return path.Join(storage, name, "snapshot")
+}
+
+// finishMigration finishes moving the snapshot with the given name in
+// storage into the flat layout or the nested one, wherever migrateSnap got.
+func (a *app) finishMigration(storage, name string, flat bool) error {
+	tmp := path.Join(storage, migratePrefix+name)
+	dst := migratedPath(storage, name, flat)
+	if _, err := os.Lstat(tmp); err == nil {
+		if flat {
+			// The directory of the nested layout, now empty.
+			err := os.Remove(dst)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		} else if err := os.MkdirAll(path.Dir(dst), defaultDirMode); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, dst); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	} else if _, err := os.Lstat(dst); err != nil {
+		// The subvolume wasn't moved aside yet.
+		dst = migratedPath(storage, name, !flat)
+	}
+	return a.setReadOnly(dst, true)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"path"
+)
+
+// notesDir holds descriptions of snapshots, the reasons they were taken for,
+// how they pair up around transactions, their labels and generations of
+// subvolumes they were taken of in a storage directory, relative to it.
+// They're kept aside because snapshots are read-only.
+const notesDir = ".notes"
+
+type note struct {
+	Description string            `json:",omitempty"`
+	Reason      string            `json:",omitempty"`
+	Transaction string            `json:",omitempty"`
+	Pre         string            `json:",omitempty"`
+	Labels      map[string]string `json:",omitempty"`
+	Generation  uint64            `json:",omitempty"`
+}
+
+func notes(storage string) *metaDB {
+	return &metaDB{dir: path.Join(storage, notesDir)}
+}
+
+// saveNote records the description of the snapshot s, the reason it was
+// taken for and its labels.
+func (a *app) saveNote(s *snap) error {
+	if a.opts.dryRun || (s.description == "" && s.reason == "" &&
+		len(s.labels) == 0 && s.generation == 0) {
+		return nil
+	}
+	n := &note{
+		Description: s.description,
+		Reason:      s.reason,
+		Transaction: s.transaction,
+		Pre:         s.pre,
+		Labels:      s.labels,
+		Generation:  s.generation,
+	}
+	if err := notes(path.Dir(s.path)).put(path.Base(s.path), n); err != nil {
+		return fmt.Errorf("cannot save note of %s: %w", s.path, err)
+	}
+	return nil
+}
+
+// loadNotes fills in what notes say about snaps.
+func loadNotes(snaps []*snap) error {
+	for _, s := range snaps {
+		var n note
+		_, err := notes(path.Dir(s.path)).get(path.Base(s.path), &n)
+		if err != nil {
+			return err
+		}
+		s.description = n.Description
+		s.reason = n.Reason
+		s.transaction = n.Transaction
+		s.pre = n.Pre
+		s.labels = n.Labels
+		s.generation = n.Generation
+	}
+	return nil
+}
+
+func removeNote(s *snap) error {
+	return notes(path.Dir(s.path)).remove(path.Base(s.path))
+}
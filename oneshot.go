@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// runOnce does everything there is to do for p, as "snap run home" does: it
+// takes a snapshot, backs it up to all backup profiles whose Source is p,
+// prunes p and then those. Storage of each stays locked from its first step
+// until the last one is done, so that no other snap gets in between. Backup
+// profiles back up and prune. If a backup fails, the other destinations are
+// still backed up, but the failed one isn't pruned.
+func (a *app) runOnce(p *profileJSON) error {
+	var dests []ProfileName
+	for n, q := range a.cfg.Profiles {
+		if q.Source != nil && *q.Source == p.name {
+			dests = append(dests, n)
+		}
+	}
+	sort.Strings(dests)
+	a.locks = make(map[string]func())
+	defer func() {
+		for _, unlock := range a.locks {
+			unlock()
+		}
+		a.locks = nil
+	}()
+	step := func(n ProfileName, create, backup, prune bool) error {
+		q := a.cfg.Profiles[n]
+		sa := *a
+		sa.opts.runOnce = false
+		sa.opts.profileName = n
+		sa.opts.create, sa.opts.backup, sa.opts.prune = create, backup, prune
+		return sa.runProfile(q)
+	}
+	if err := step(p.name, !p.isBackup(), p.isBackup(), false); err != nil {
+		return err
+	}
+	var failed []string
+	ok := []ProfileName{p.name}
+	for _, n := range dests {
+		if err := step(n, false, true, false); err != nil {
+			fmt.Fprintf(os.Stderr, "profile %q: %v\n", n, err)
+			failed = append(failed, n)
+			continue
+		}
+		ok = append(ok, n)
+	}
+	for _, n := range ok {
+		if err := step(n, false, false, true); err != nil {
+			return fmt.Errorf("profile %q: %w", n, err)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("backups failed: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
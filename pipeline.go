@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+)
+
+// stage is a part of a pipeline. It's either a command run on host (the
+// local machine if empty), or if argv is nil, an in-memory buffer of the
+// given size. If count is not nil, the buffer counts bytes passing through
+// it there.
+type stage struct {
+	host   string
+	argv   []string
+	buffer int64
+	count  *int64
+}
+
+func (a *app) stageString(s stage) string {
+	if s.argv == nil && s.buffer == 0 {
+		return ""
+	} else if s.argv == nil {
+		return fmt.Sprintf("[buffer %s]", formatBytes(uint64(s.buffer)))
+	}
+	return argvString(a.sshArgv(s.host, s.argv...))
+}
+
+func (a *app) pipelineString(stages []stage) string {
+	var strs []string
+	for _, s := range stages {
+		if str := a.stageString(s); str != "" {
+			strs = append(strs, str)
+		}
+	}
+	return strings.Join(strs, " | ")
+}
+
+// runPipeline runs stages with the standard output of each connected to the
+// standard input of the next one and waits for all of them to finish.
+func (a *app) runPipeline(stages []stage) error {
+	n := len(stages)
+	readers := make([]*os.File, n)
+	writers := make([]*os.File, n)
+	closeAll := func() {
+		for i := range stages {
+			if readers[i] != nil {
+				readers[i].Close()
+			}
+			if writers[i] != nil {
+				writers[i].Close()
+			}
+		}
+	}
+	for i := 0; i < n-1; i++ {
+		r, w, err := os.Pipe()
+		if err != nil {
+			closeAll()
+			return err
+		}
+		writers[i], readers[i+1] = w, r
+	}
+
+	procs := make([]process, n)
+	stderrs := make([]bytes.Buffer, n)
+	bufErrs := make([]chan error, n)
+	runs := make([]*cmdRun, n)
+	// Bytes passing through stages of snap itself are counted for the
+	// trace even if the caller doesn't care.
+	counts := make([]*int64, n)
+	for i, s := range stages {
+		runs[i] = a.started(s.host, s.argv)
+		if s.argv == nil {
+			bufErrs[i] = make(chan error, 1)
+			counts[i] = s.count
+			if counts[i] == nil && a.trace != nil {
+				counts[i] = new(int64)
+			}
+			go func(i int) {
+				var dst io.Writer = writers[i]
+				if counts[i] != nil {
+					dst = &countingWriter{w: dst, n: counts[i]}
+				}
+				err := bufferedCopy(dst, readers[i], stages[i].buffer)
+				writers[i].Close()
+				readers[i].Close()
+				bufErrs[i] <- err
+			}(i)
+			continue
+		}
+		// Leave nil interfaces rather than typed nil pointers to the
+		// ends of the pipeline, so that exec doesn't try to use them.
+		var stdin io.Reader
+		var stdout io.Writer
+		if readers[i] != nil {
+			stdin = readers[i]
+		}
+		if writers[i] != nil {
+			stdout = writers[i]
+		}
+		p, err := a.startOn(s.host, s.argv, stdin, stdout, &stderrs[i])
+		if err != nil {
+			closeAll()
+			for _, p := range procs[:i] {
+				if p != nil {
+					p.Wait()
+				}
+			}
+			return err
+		}
+		procs[i] = p
+		// A child has its own copies now. Ours must be closed, or the
+		// other end of the pipe would never see EOF. Sessions of the
+		// built-in SSH client use them until they finish.
+		if _, ok := p.(*exec.Cmd); ok {
+			closeStage(readers[i], writers[i])
+		}
+	}
+
+	errs := make([]error, n)
+	for i, p := range procs {
+		if p == nil {
+			err := <-bufErrs[i]
+			if err != nil {
+				errs[i] = fmt.Errorf("buffer: %w", err)
+			}
+			runs[i].name = a.stageString(stages[i])
+			if runs[i].name == "" {
+				runs[i].name = "[snap]"
+			}
+			if a.trace != nil {
+				a.trace.record(runs[i], err, counts[i])
+			}
+			a.telemetry.command(runs[i], err)
+			continue
+		}
+		err := p.Wait()
+		if _, ok := p.(*exec.Cmd); !ok {
+			closeStage(readers[i], writers[i])
+		}
+		a.finished(runs[i], err, nil, stderrs[i].Bytes())
+		if err != nil {
+			name := commandName(stages[i].host, stages[i].argv)
+			errs[i] = cmdError(name, err, &stderrs[i])
+		}
+	}
+	// A stage which fails usually causes its neighbours to fail too,
+	// typically those before it with a broken pipe. Report the error of
+	// the stage which didn't die of a signal.
+	var first error
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if first == nil {
+			first = err
+		}
+		if !signaled(procs[i]) {
+			return err
+		}
+	}
+	return first
+}
+
+func closeStage(r, w *os.File) {
+	if r != nil {
+		r.Close()
+	}
+	if w != nil {
+		w.Close()
+	}
+}
+
+// signaled tells whether p, which has finished, was killed by a signal.
+func signaled(p process) bool {
+	switch p := p.(type) {
+	case *exec.Cmd:
+		return p.ProcessState != nil && p.ProcessState.ExitCode() == -1
+	case *sshProcess:
+		return p.signal != ""
+	}
+	return false
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	// Progress may be watched while the stream passes.
+	atomic.AddInt64(w.n, int64(n))
+	return n, err
+}
+
+// bufferedCopy copies src to dst through an in-memory buffer of up to size
+// bytes, so that bursts on either side don't stall the other one.
+func bufferedCopy(dst io.Writer, src io.ReadCloser, size int64) error {
+	const chunkSize = 1 << 20
+	n := int(size / chunkSize)
+	if n < 1 {
+		n = 1
+	}
+	chunks := make(chan []byte, n)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(chunks)
+		for {
+			buf := make([]byte, chunkSize)
+			k, err := io.ReadFull(src, buf)
+			if k > 0 {
+				chunks <- buf[:k]
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				readErr <- nil
+				return
+			} else if err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+	var writeErr error
+	for c := range chunks {
+		if writeErr != nil {
+			continue
+		}
+		if _, writeErr = dst.Write(c); writeErr != nil {
+			// Make the reader give up, the data has nowhere to go.
+			src.Close()
+		}
+	}
+	if err := <-readErr; writeErr == nil {
+		return err
+	}
+	return writeErr
+}
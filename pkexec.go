@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// pkexecUID returns the user who ran snap through pkexec, or -1 if snap
+// wasn't run that way.
+func pkexecUID() int {
+	uid, err := strconv.Atoi(os.Getenv("PKEXEC_UID"))
+	if err != nil || os.Geteuid() != 0 {
+		return -1
+	}
+	return uid
+}
+
+// userName returns the name of the user uid, or "" if uid is -1.
+func userName(uid int) string {
+	if uid < 0 {
+		return ""
+	}
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		return u.Username
+	}
+	return strconv.Itoa(uid)
+}
+
+// checkPkexec makes sure that users who run snap through pkexec, as the
+// polkit policy in polkit/ allows, only take snapshots, look at them and
+// restore their own files.
+func (a *app) checkPkexec() error {
+	if pkexecUID() < 0 {
+		return nil
+	}
+	allowed := map[string]bool{
+		"create":       true,
+		"list":         true,
+		"list-files":   true,
+		"restore-file": true,
+		"status":       true,
+	}
+	for name, set := range a.commands() {
+		if *set && !allowed[name] {
+			return fmt.Errorf("%s isn't allowed through pkexec", name)
+		}
+	}
+	for name, arg := range a.argCommands() {
+		if *arg != "" && !allowed[name] {
+			return fmt.Errorf("%s isn't allowed through pkexec", name)
+		}
+	}
+	if a.opts.btrfsBin != defaultBtrfsBin || a.opts.connect != "" ||
+		a.opts.exportTo != "" || a.opts.emergencyFree != "" ||
+		a.opts.advise || a.opts.dedup {
+		return fmt.Errorf("options other than those of create, list, " +
+			"list-files, restore-file and status aren't allowed " +
+			"through pkexec")
+	}
+	return nil
+}
+
+// checkInvoker makes sure that the user on whose behalf snap runs owns the
+// file src which is to be restored and the directory it's restored into, and
+// that no directory on the way to dst from subvol is a symbolic link, which
+// could lead out of subvol.
+func (a *app) checkInvoker(subvol, src, dst string) error {
+	uid := a.invoker
+	if uid < 0 {
+		return nil
+	}
+	rel, err := filepath.Rel(subvol, filepath.Dir(dst))
+	if err != nil {
+		return err
+	}
+	dir := subvol
+	for _, e := range strings.Split(rel, "/") {
+		dir = filepath.Join(dir, e)
+		fi, err := os.Lstat(dir)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("%s isn't a directory", dir)
+		}
+	}
+	for _, p := range []string{src, dir} {
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		if int(fi.Sys().(*syscall.Stat_t).Uid) != uid {
+			return fmt.Errorf("%s isn't yours", p)
+		}
+	}
+	return nil
+}
+
+// invokerCredential returns the credential of the user on whose behalf snap
+// runs, so that commands run for them can't do more than they could, or nil
+// if snap runs on its own behalf.
+func (a *app) invokerCredential() (*syscall.Credential, error) {
+	if a.invoker < 0 {
+		return nil, nil
+	}
+	u, err := user.LookupId(strconv.Itoa(a.invoker))
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return nil, err
+	}
+	cred := &syscall.Credential{Uid: uint32(a.invoker), Gid: uint32(gid)}
+	gids, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range gids {
+		if id, err := strconv.Atoi(g); err == nil {
+			cred.Groups = append(cred.Groups, uint32(id))
+		}
+	}
+	return cred, nil
+}
+
+// restoreFile copies file, given as a path on the live filesystem or
+// relative to Subvolume, from the snapshot of p created at the given time
+// back into Subvolume. An existing file isn't replaced, the copy is put next
+// to it with the timestamp appended to its name. Returns where the file was
+// restored to.
+func (a *app) restoreFile(p *profileJSON, timestamp, file string) (string, error) {
+	if p.Subvolume == nil {
+		return "", fmt.Errorf("files can only be restored in profiles " +
+			"which take snapshots")
+	}
+	rel, err := a.relPattern(p, file)
+	if err != nil {
+		return "", err
+	}
+	rel = filepath.Clean(rel)
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") ||
+		filepath.IsAbs(rel) {
+		return "", fmt.Errorf("%s is not inside %s", file, *p.Subvolume)
+	}
+	snaps, err := profileSnaps(p)
+	if err != nil {
+		return "", err
+	}
+	var s *snap
+	for _, t := range snaps {
+		if filepath.Base(t.path) == timestamp {
+			s = t
+		}
+	}
+	if s == nil {
+		return "", fmt.Errorf("no snapshot %s", timestamp)
+	}
+	src := filepath.Join(s.subvolPath(), rel)
+	if _, err := os.Lstat(src); err != nil {
+		return "", err
+	}
+	dst := filepath.Join(*p.Subvolume, rel)
+	if _, err := os.Lstat(dst); err == nil {
+		dst += "." + timestamp
+		if _, err := os.Lstat(dst); err == nil {
+			return "", fmt.Errorf("%s already exists", dst)
+		}
+	}
+	if err := a.checkInvoker(*p.Subvolume, src, dst); err != nil {
+		return "", err
+	}
+	cred, err := a.invokerCredential()
+	if err != nil {
+		return "", err
+	}
+	// Copies share data with the snapshot where possible. They're made as
+	// the user they're restored for, so that they can't end up anywhere
+	// the user couldn't write to, even if the directories checked above
+	// are swapped meanwhile.
+	argv := []string{"cp", "-a", "--reflink=auto", "--", src, dst}
+	if a.opts.dryRun || a.opts.verbose {
+		printArgv(argv)
+	}
+	if a.opts.dryRun {
+		return dst, nil
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stderr = os.Stderr
+	if cred != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	}
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+	dir, err := storageDir(p)
+	if err != nil {
+		return "", err
+	}
+	if err := a.audit(dir, auditRestore, s, dst); err != nil {
+		return "", err
+	}
+	fmt.Printf("restored %s\n", dst)
+	return dst, nil
+}
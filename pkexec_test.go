@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckInvoker(t *testing.T) {
+	dir := t.TempDir()
+	subvol := filepath.Join(dir, "home")
+	snap := filepath.Join(dir, "snap")
+	for _, d := range []string{filepath.Join(subvol, "d"), snap,
+		filepath.Join(dir, "etc")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src := filepath.Join(snap, "f")
+	if err := os.WriteFile(src, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := os.Symlink(filepath.Join(dir, "etc"), filepath.Join(subvol, "l"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &app{invoker: os.Getuid()}
+	tests := []struct {
+		dst string
+		ok  bool
+	}{
+		{"d/f", true},
+		{"f", true},
+		{"l/f", false},
+		{"d/missing/f", false},
+	}
+	for _, tt := range tests {
+		err := a.checkInvoker(subvol, src, filepath.Join(subvol, tt.dst))
+		if (err == nil) != tt.ok {
+			t.Errorf("checkInvoker(%s) = %v, want ok %v", tt.dst, err,
+				tt.ok)
+		}
+	}
+	a.invoker = os.Getuid() + 1
+	if err := a.checkInvoker(subvol, src, filepath.Join(subvol, "f")); err == nil {
+		t.Errorf("checkInvoker allowed restoring files of someone else")
+	}
+}
+
+func TestRestoreFileOutside(t *testing.T) {
+	subvol := t.TempDir()
+	p := &profileJSON{Subvolume: &subvol}
+	a := &app{invoker: -1}
+	for _, file := range []string{"..", "../etc/passwd", "d/../../x", "."} {
+		if _, err := a.restoreFile(p, "1577836800", file); err == nil {
+			t.Errorf("restoreFile(%q) allowed", file)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// What to do when Storage is inside Subvolume, see profileJSON.
+const (
+	recursionWarn   = "warn"
+	recursionRefuse = "refuse"
+	recursionCarve  = "carve"
+	recursionFilter = "filter"
+)
+
+func validRecursion(r string) bool {
+	switch r {
+	case recursionWarn, recursionRefuse, recursionCarve, recursionFilter:
+		return true
+	}
+	return false
+}
+
+// filterPrefix starts the name under which a snapshot is kept in its storage
+// directory while storage is being filtered out of it.
+const filterPrefix = ".filter-"
+
+const (
+	btrfsSuperMagic = 0x9123683e
+	btrfsIocFsInfo  = 0x8400941f
+	// Inode number of the root directory of every subvolume.
+	btrfsFirstFreeObjectid = 256
+)
+
+// btrfsFSID returns the UUID of the Btrfs filesystem which holds p.
+func btrfsFSID(p string) ([16]byte, error) {
+	var fsid [16]byte
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(p, &st); err != nil {
+		return fsid, err
+	}
+	if st.Type != btrfsSuperMagic {
+		return fsid, fmt.Errorf("%s is not on Btrfs", p)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return fsid, err
+	}
+	defer f.Close()
+	// struct btrfs_ioctl_fs_info_args, fsid follows two 64-bit fields.
+	var args [1024]byte
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), btrfsIocFsInfo,
+		uintptr(unsafe.Pointer(&args)))
+	if errno != 0 {
+		return fsid, fmt.Errorf("%s: fs info: %w", p, errno)
+	}
+	copy(fsid[:], args[16:32])
+	return fsid, nil
+}
+
+// checkPlacement makes sure snapshots of p can be created in storage, which
+// btrfs would otherwise refuse with a cryptic error. If storage is inside
+// Subvolume, where snapshots would include it, it's dealt with according to
+// Recursion; the returned path of storage relative to Subvolume is not empty
+// if storage is to be filtered out of snapshots.
+func (a *app) checkPlacement(p *profileJSON, storage string) (string, error) {
+	if a.enter != nil {
+		// Subvolume is seen from elsewhere than storage.
+		return "", nil
+	}
+	if _, err := os.Stat(storage); os.IsNotExist(err) && a.opts.dryRun {
+		return "", nil
+	}
+	src, err := btrfsFSID(*p.Subvolume)
+	if err != nil {
+		return "", err
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(*p.Subvolume, &st); err != nil {
+		return "", err
+	}
+	if st.Ino != btrfsFirstFreeObjectid {
+		return "", fmt.Errorf("Subvolume %s: %w", *p.Subvolume,
+			ErrNotASubvolume)
+	}
+	dst, err := btrfsFSID(storage)
+	if err != nil {
+		return "", err
+	}
+	if src != dst {
+		return "", fmt.Errorf("Subvolume %s and Storage %s are on "+
+			"different Btrfs filesystems, snapshots can only be "+
+			"created within one", *p.Subvolume, storage)
+	}
+	sub, err := filepath.EvalSymlinks(*p.Subvolume)
+	if err != nil {
+		return "", err
+	}
+	dir, err := filepath.EvalSymlinks(storage)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(sub, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", nil
+	}
+	// Subvolumes nested in Subvolume are left out of its snapshots.
+	for d := dir; d != sub; d = filepath.Dir(d) {
+		var st syscall.Stat_t
+		if err := syscall.Stat(d, &st); err != nil {
+			return "", err
+		}
+		if st.Ino == btrfsFirstFreeObjectid {
+			return "", nil
+		}
+	}
+	recursion := recursionWarn
+	if p.Recursion != nil {
+		recursion = *p.Recursion
+	}
+	switch recursion {
+	case recursionRefuse:
+		return "", fmt.Errorf("Storage %s is inside Subvolume %s, so "+
+			"snapshots would include older ones", storage,
+			*p.Subvolume)
+	case recursionCarve:
+		return "", a.carveStorage(storage)
+	case recursionFilter:
+		return rel, nil
+	}
+	fmt.Fprintf(os.Stderr, "warning: Storage %s is inside Subvolume %s, "+
+		"so snapshots include it; see Recursion\n", storage,
+		*p.Subvolume)
+	return "", nil
+}
+
+// carveStorage turns the storage directory dir into a subvolume, so that
+// snapshots of the subvolume it's in leave it out. Only storage without
+// snapshots can be carved out, since read-only snapshots can't be moved.
+func (a *app) carveStorage(dir string) error {
+	snaps, err := findSnaps(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(snaps) > 0 {
+		return fmt.Errorf("cannot make %s a subvolume, it holds "+
+			"snapshots already", dir)
+	}
+	tmp := filepath.Join(filepath.Dir(dir), "."+filepath.Base(dir)+
+		".carve")
+	if a.opts.dryRun || a.opts.verbose {
+		printArgv([]string{"mv", dir, tmp})
+	}
+	if !a.opts.dryRun {
+		if err := os.Rename(dir, tmp); err != nil {
+			return err
+		}
+	}
+	if err := a.btrfsCmd("subvolume", "create", dir); err != nil {
+		return err
+	}
+	if a.opts.dryRun {
+		return nil
+	}
+	// Metadata such as the journal.
+	fis, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		err := os.Rename(filepath.Join(tmp, fi.Name()),
+			filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return os.Remove(tmp)
+}
+
+// filterSnapshot takes a snapshot of subvol into dst without the directory
+// rel inside it. The snapshot is made writable under a temporary name in
+// storage, so that it only appears as dst when it's complete.
+func (a *app) filterSnapshot(storage, subvol, dst, rel string) error {
+	name := filepath.Base(dst)
+	if name == "snapshot" {
+		name = filepath.Base(filepath.Dir(dst))
+	}
+	tmp := filepath.Join(storage, filterPrefix+name)
+	if err := a.btrfsCmd("subvolume", "snapshot", subvol, tmp); err != nil {
+		return err
+	}
+	if a.opts.dryRun || a.opts.verbose {
+		printArgv([]string{"rm", "-rf", filepath.Join(tmp, rel)})
+		printArgv([]string{"mv", tmp, dst})
+	}
+	if !a.opts.dryRun {
+		if err := os.RemoveAll(filepath.Join(tmp, rel)); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, dst); err != nil {
+			return err
+		}
+	}
+	return a.setReadOnly(dst, true)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const (
+	defaultWakeBroadcast = "255.255.255.255:9"
+	defaultWakeTimeout   = 5 * time.Minute
+)
+
+// preConnect prepares storage of p according to its PreConnect settings.
+// The returned function undoes what was done; it must be called even if
+// preConnect fails.
+func (a *app) preConnect(p *profileJSON) (func(), error) {
+	var undo []func() error
+	done := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			if err := undo[i](); err != nil {
+				fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+			}
+		}
+	}
+	c := p.PreConnect
+	if c == nil {
+		return done, nil
+	}
+	if c.WakeOnLAN != nil {
+		if err := a.wake(p, c.WakeOnLAN); err != nil {
+			return done, err
+		}
+	}
+	if c.SpinDown != nil {
+		dev := *c.SpinDown
+		undo = append(undo, func() error {
+			return a.localCmd("hdparm", "-y", dev)
+		})
+	}
+	if u := c.Unlock; u != nil {
+		// A device someone else unlocked is left alone.
+		if _, err := os.Stat("/dev/mapper/" + *u.Name); os.IsNotExist(err) {
+			err := a.localCmd("cryptsetup", "open", "--key-file",
+				*u.KeyFile, *u.Device, *u.Name)
+			if err != nil {
+				return done, err
+			}
+			undo = append(undo, func() error {
+				return a.localCmd("cryptsetup", "close", *u.Name)
+			})
+		}
+	}
+	if c.Mount != nil {
+		dir := *c.Mount
+		if exec.Command("mountpoint", "-q", dir).Run() != nil {
+			if err := a.localCmd("mount", dir); err != nil {
+				return done, err
+			}
+			undo = append(undo, func() error {
+				return a.localCmd("umount", dir)
+			})
+		}
+	}
+	return done, nil
+}
+
+// localCmd runs a command which changes the state of the system, unless in
+// dry-run mode.
+func (a *app) localCmd(argv ...string) error {
+	if a.opts.dryRun || a.opts.verbose {
+		printArgv(argv)
+	}
+	if a.opts.dryRun {
+		return nil
+	}
+	return a.runOn("", nil, argv)
+}
+
+// wake sends a Wake-on-LAN packet and waits until the host wakes up.
+func (a *app) wake(p *profileJSON, w *wakeJSON) error {
+	addr := ""
+	if w.Wait != nil {
+		addr = *w.Wait
+	} else {
+		var err error
+		if _, addr, err = splitHost(*p.Pull.Host); err != nil {
+			return err
+		}
+	}
+	// Don't bother if it's up already.
+	if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		conn.Close()
+		return nil
+	}
+	broadcast := defaultWakeBroadcast
+	if w.Broadcast != nil {
+		broadcast = *w.Broadcast
+	}
+	if a.opts.dryRun || a.opts.verbose {
+		fmt.Fprintf(os.Stderr, "wake %s via %s, wait for %s\n",
+			*w.MAC, broadcast, addr)
+	}
+	if a.opts.dryRun {
+		return nil
+	}
+	mac, _ := net.ParseMAC(*w.MAC)
+	packet := make([]byte, 6, 6+16*len(mac))
+	for i := range packet {
+		packet[i] = 0xff
+	}
+	for i := 0; i < 16; i++ {
+		packet = append(packet, mac...)
+	}
+	timeout := defaultWakeTimeout
+	if w.Timeout != nil {
+		timeout, _ = time.ParseDuration(*w.Timeout)
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		// Packets get lost, keep sending them until the host is up.
+		if err := sendUDP(broadcast, packet); err != nil {
+			return fmt.Errorf("cannot send wake-up packet: %w", err)
+		}
+		conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		time.Sleep(5 * time.Second)
+	}
+	return fmt.Errorf("%s not up %v after wake-up packet was sent",
+		addr, timeout)
+}
+
+func sendUDP(addr string, packet []byte) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(packet)
+	return err
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// capSysAdmin is the capability btrfs send and receive require, and which
+// lets subvolumes be deleted without user_subvol_rm_allowed.
+const capSysAdmin = 21
+
+// privileged tells whether snap may do anything btrfs allows, because it
+// runs as root or with CAP_SYS_ADMIN.
+func privileged() bool {
+	if os.Geteuid() == 0 {
+		return true
+	}
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		v := strings.TrimPrefix(sc.Text(), "CapEff:")
+		if v == sc.Text() {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(v), 16, 64)
+		return err == nil && caps&(1<<capSysAdmin) != 0
+	}
+	return false
+}
+
+// mountOptions returns options of the filesystem mounted at the mount point
+// closest above dir, both those of the mount and those of the superblock.
+func mountOptions(dir string) (map[string]bool, error) {
+	// Storage may not exist yet, look at where it will be created.
+	for {
+		if _, err := os.Stat(dir); err == nil || dir == "/" {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var best string
+	var opts map[string]bool
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// ID parent major:minor root mountpoint options [optional
+		// fields...] - fstype source superoptions
+		f := strings.Fields(sc.Text())
+		sep := -1
+		for i, v := range f {
+			if v == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(f) < 6 || sep < 0 || sep+3 >= len(f) {
+			continue
+		}
+		mnt := f[4]
+		if !inside(dir, mnt) || len(mnt) < len(best) {
+			continue
+		}
+		best = mnt
+		opts = make(map[string]bool)
+		for _, o := range strings.Split(f[5]+","+f[sep+3], ",") {
+			opts[o] = true
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		return nil, fmt.Errorf("%s: no mount found", dir)
+	}
+	return opts, nil
+}
+
+// inside tells whether p is dir or inside it.
+func inside(p, dir string) bool {
+	return dir == "/" || p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// checkPrivileges tells what users who run snap without root privileges need
+// for the requested operations on p before any is started, rather than
+// letting btrfs fail halfway through with EPERM. With a Helper, btrfs runs
+// with privileges of its own, except for send and receive.
+func (a *app) checkPrivileges(p *profileJSON) error {
+	if a.opts.dryRun || privileged() {
+		return nil
+	}
+	remedy := "run snap as root, e.g. with sudo, or set Helper, " +
+		"see cmd/snap-helper"
+	if a.cfg.Helper != nil {
+		remedy = "run snap as root, e.g. with sudo, Helper doesn't " +
+			"run them"
+	}
+	var op string
+	switch {
+	case a.opts.backup && p.Rsync == nil:
+		op = "backing up snapshots"
+	case a.opts.restore != "":
+		op = "restoring snapshots"
+	case a.opts.repairChain:
+		op = "repairing backups"
+	case a.opts.seedExport != "":
+		op = "exporting seeds"
+	case a.opts.seedImport != "":
+		op = "importing seeds"
+	}
+	if op != "" {
+		return fmt.Errorf("%s of profile %q requires root privileges "+
+			"for btrfs send and receive: %s: %w", op, p.name, remedy,
+			ErrPrivileges)
+	}
+	if a.cfg.Helper != nil {
+		return nil
+	}
+	if a.opts.create && p.Subvolume != nil {
+		var st syscall.Stat_t
+		err := syscall.Stat(*p.Subvolume, &st)
+		if err == nil && int(st.Uid) != os.Geteuid() {
+			return fmt.Errorf("creating snapshots of %s requires "+
+				"root privileges, since it isn't yours: %s: %w",
+				*p.Subvolume, remedy, ErrPrivileges)
+		}
+	}
+	deletes := a.opts.prune || a.opts.emergencyFree != "" ||
+		a.opts.create && (p.MaxSnapshots != nil || p.MaxSnapshotAge != nil)
+	if deletes && p.Rsync == nil {
+		dir, err := storageDir(p)
+		if err != nil {
+			return err
+		}
+		opts, err := mountOptions(dir)
+		if err != nil {
+			// Let btrfs tell.
+			return nil
+		}
+		if !opts["user_subvol_rm_allowed"] {
+			return fmt.Errorf("deleting snapshots of profile %q "+
+				"requires root privileges, or %s mounted with "+
+				"user_subvol_rm_allowed: %s: %w", p.name, dir,
+				remedy, ErrPrivileges)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// pullConfigJSON makes snap fetch its configuration from URL before running,
+// so that a fleet of machines can be configured from one place. Files in Git
+// repositories are fetched through the raw file URLs of their hosting. The
+// signature of the configuration must be at URL.sig, encoded in base64, and
+// must verify with the Ed25519 PublicKey, also base64. With OpenSSL:
+//
+//	openssl pkey -in key.pem -pubout -outform DER | tail -c 32 | base64
+//	openssl pkeyutl -sign -rawin -inkey key.pem -in config.json |
+//		base64 -w0 >config.json.sig
+//
+// So that an old configuration can't be passed off as the current one, the
+// pulled configuration must have a Serial, increased whenever it changes, and
+// a time it Expires at. Configurations with a Serial lower than that of the
+// last one pulled are refused, and so are expired ones. The last
+// configuration pulled is used if fetching fails, until it expires.
+// PullConfig in the pulled configuration is ignored.
+type pullConfigJSON struct {
+	URL       *string
+	PublicKey *string
+}
+
+func (p *pullConfigJSON) validate() error {
+	if p.URL != nil {
+		if err := validatePullURL(*p.URL); err != nil {
+			return fmt.Errorf("URL: %w", err)
+		}
+	}
+	if p.PublicKey == nil {
+		return fmt.Errorf("PublicKey is missing")
+	}
+	if _, err := p.publicKey(); err != nil {
+		return fmt.Errorf("PublicKey: %w", err)
+	}
+	return nil
+}
+
+func (p *pullConfigJSON) publicKey() (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(*p.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("must be an Ed25519 public key in base64")
+	}
+	return key, nil
+}
+
+func validatePullURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("must be an https URL")
+	}
+	return nil
+}
+
+// pulledConfigKey is where the last configuration pulled is kept.
+const pulledConfigKey = "pulled-config"
+
+// pulledConfig is the last configuration pulled from URL with its signature,
+// which is verified again when it's used.
+type pulledConfig struct {
+	URL       string
+	Serial    int64
+	Data      []byte
+	Signature []byte
+}
+
+// maxPulledConfig limits the size of configurations and signatures pulled.
+const maxPulledConfig = 1 << 20
+
+var pullClient = &http.Client{Timeout: 30 * time.Second}
+
+// pullURL returns where the configuration should be pulled from, if at all.
+func (a *app) pullURL() string {
+	if a.opts.pullConfig != "" {
+		return a.opts.pullConfig
+	}
+	if a.cfg.PullConfig != nil && a.cfg.PullConfig.URL != nil {
+		return *a.cfg.PullConfig.URL
+	}
+	return ""
+}
+
+// pullConfig fetches the configuration from u, verifies its signature and
+// returns it. If it can't be fetched, the one pulled last time is used.
+func (a *app) pullConfig(u string) (*configJSON, error) {
+	if err := validatePullURL(u); err != nil {
+		return nil, fmt.Errorf("%s: %w", u, err)
+	}
+	if a.cfg.PullConfig == nil {
+		return nil, fmt.Errorf("PullConfig: PublicKey must be configured " +
+			"to verify pulled configurations")
+	}
+	key, _ := a.cfg.PullConfig.publicKey()
+	data, err := fetch(u)
+	var sig []byte
+	if err == nil {
+		sig, err = fetch(u + ".sig")
+	}
+	var last pulledConfig
+	if _, dbErr := a.db.get(pulledConfigKey, &last); dbErr != nil {
+		return nil, fmt.Errorf("cannot tell which configuration was "+
+			"pulled last: %w", dbErr)
+	}
+	if err != nil {
+		if last.URL != u || last.Data == nil {
+			return nil, fmt.Errorf("cannot pull configuration: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "warning: cannot pull configuration, "+
+			"using the last one pulled: %v\n", err)
+		data, sig = last.Data, last.Signature
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil || !ed25519.Verify(key, data, raw) {
+		return nil, fmt.Errorf("%s: bad signature", u)
+	}
+	cfg, err := parseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", u, err)
+	}
+	switch {
+	case cfg.Serial == nil || cfg.Expires == nil:
+		return nil, fmt.Errorf("%s: Serial and Expires must be set "+
+			"in pulled configurations", u)
+	case *cfg.Serial < last.Serial ||
+		*cfg.Serial == last.Serial && !bytes.Equal(data, last.Data):
+		return nil, fmt.Errorf("%s: Serial %d isn't newer than %d of "+
+			"the configuration pulled last", u, *cfg.Serial,
+			last.Serial)
+	case time.Now().After(*cfg.Expires):
+		return nil, fmt.Errorf("%s: expired %s", u,
+			cfg.Expires.Format(time.RFC3339))
+	}
+	cfg.PullConfig = a.cfg.PullConfig
+	err = a.db.put(pulledConfigKey, &pulledConfig{
+		URL:       u,
+		Serial:    *cfg.Serial,
+		Data:      data,
+		Signature: sig,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: cannot keep pulled "+
+			"configuration: %v\n", err)
+	}
+	return cfg, nil
+}
+
+func fetch(u string) ([]byte, error) {
+	resp, err := pullClient.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxPulledConfig+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxPulledConfig {
+		return nil, fmt.Errorf("%s: too large", u)
+	}
+	return data, nil
+}
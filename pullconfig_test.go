@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// pullServer serves configurations signed with a new key to a.
+type pullServer struct {
+	*httptest.Server
+	priv ed25519.PrivateKey
+	data []byte
+}
+
+func newPullServer(t *testing.T, a *app) *pullServer {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &pullServer{priv: priv}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case s.data == nil:
+				http.Error(w, "down", http.StatusServiceUnavailable)
+			case r.URL.Path == "/config.json":
+				w.Write(s.data)
+			case r.URL.Path == "/config.json.sig":
+				sig := ed25519.Sign(s.priv, s.data)
+				w.Write([]byte(base64.StdEncoding.EncodeToString(sig)))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	t.Cleanup(s.Close)
+	old := pullClient
+	pullClient = s.Client()
+	t.Cleanup(func() { pullClient = old })
+	key := base64.StdEncoding.EncodeToString(pub)
+	a.cfg.PullConfig = &pullConfigJSON{PublicKey: &key}
+	return s
+}
+
+func (s *pullServer) serve(serial int, expires time.Time) {
+	s.data = []byte(fmt.Sprintf(`{"Serial": %d, "Expires": %q}`, serial,
+		expires.Format(time.RFC3339)))
+}
+
+func TestPullConfig(t *testing.T) {
+	a := &app{cfg: &configJSON{}, db: &metaDB{dir: t.TempDir()}}
+	s := newPullServer(t, a)
+	u := s.URL + "/config.json"
+	later := time.Now().Add(time.Hour)
+	pull := func(wantSerial int64) {
+		t.Helper()
+		cfg, err := a.pullConfig(u)
+		if err != nil {
+			t.Fatalf("pullConfig: %v", err)
+		}
+		if *cfg.Serial != wantSerial {
+			t.Errorf("pulled Serial %d, want %d", *cfg.Serial,
+				wantSerial)
+		}
+	}
+	refuse := func(what string) {
+		t.Helper()
+		if _, err := a.pullConfig(u); err == nil {
+			t.Errorf("pulled %s", what)
+		}
+	}
+
+	s.data = []byte(`{}`)
+	refuse("a configuration without Serial and Expires")
+	s.serve(2, later)
+	pull(2)
+	pull(2)
+	s.serve(3, later)
+	pull(3)
+	s.serve(2, later)
+	refuse("an older configuration")
+	s.serve(3, later.Add(time.Hour))
+	refuse("another configuration with the same Serial")
+	s.serve(4, time.Now().Add(-time.Minute))
+	refuse("an expired configuration")
+
+	s.data = nil
+	pull(3)
+	s.serve(3, time.Now().Add(-time.Minute))
+	data, sig := s.data, ed25519.Sign(s.priv, s.data)
+	s.data = nil
+	err := a.db.put(pulledConfigKey, &pulledConfig{
+		URL:       u,
+		Serial:    3,
+		Data:      data,
+		Signature: []byte(base64.StdEncoding.EncodeToString(sig)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refuse("an expired configuration pulled before")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// defaultPVCPattern matches directories of local-path-provisioner, named
+// after the volume and the namespace and name of its claim.
+const defaultPVCPattern = `^(?P<pv>pvc-[0-9a-f-]+)_(?P<namespace>[^_]+)_(?P<pvc>.+)$`
+
+// pvcPattern returns the pattern which tells which claims volumes selected by
+// c belong to.
+func pvcPattern(c *pvcsJSON) (*regexp.Regexp, error) {
+	s := defaultPVCPattern
+	if c.Pattern != nil {
+		s = *c.Pattern
+	}
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range []string{"namespace", "pvc"} {
+		if re.SubexpIndex(group) < 0 {
+			return nil, fmt.Errorf("group %s missing", group)
+		}
+	}
+	return re, nil
+}
+
+// pvcVolumes discovers volumes selected by c. They're labeled by the named
+// groups of the pattern, so that snapshots tell which claim they're of.
+// Volumes whose names the pattern doesn't match are taken without labels.
+func (a *app) pvcVolumes(c *pvcsJSON) ([]*volume, error) {
+	re, err := pvcPattern(c)
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := filepath.Glob(*c.Glob)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(dirs)
+	byName := make(map[string]string)
+	var vols []*volume
+	for _, dir := range dirs {
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			continue
+		}
+		if _, err := a.btrfsQuery("subvolume", "show", dir); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %s is not a Btrfs "+
+				"subvolume, skipping it\n", dir)
+			continue
+		}
+		v := &volume{Name: filepath.Base(dir), Mountpoint: dir}
+		// Snapshots of volumes are kept in directories named after them.
+		if other, ok := byName[v.Name]; ok {
+			return nil, fmt.Errorf("%s and %s have the same name",
+				other, dir)
+		}
+		byName[v.Name] = dir
+		if m := re.FindStringSubmatch(v.Name); m != nil {
+			v.labels = make(map[string]string)
+			for i, group := range re.SubexpNames() {
+				if group != "" && m[i] != "" {
+					v.labels[group] = m[i]
+				}
+			}
+		}
+		vols = append(vols, v)
+	}
+	return vols, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// qgroupUsage is the space accounted to a snapshot by its level-0 qgroup.
+type qgroupUsage struct {
+	referenced uint64
+	exclusive  uint64
+}
+
+// qgroupShow returns usage of all level-0 qgroups of the filesystem which
+// contains path, keyed by subvolume ID. It fails if quotas aren't enabled.
+func (a *app) qgroupShow(path string) (map[uint64]qgroupUsage, error) {
+	out, err := a.btrfsQuery("qgroup", "show", "--raw", path)
+	if err != nil {
+		return nil, err
+	}
+	usage := make(map[uint64]qgroupUsage)
+	for _, line := range strings.Split(string(out), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 3 || !strings.HasPrefix(f[0], "0/") {
+			continue
+		}
+		id, err := strconv.ParseUint(f[0][2:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid qgroup ID %q", f[0])
+		}
+		rfer, err := strconv.ParseUint(f[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("qgroup %s: invalid size %q", f[0], f[1])
+		}
+		excl, err := strconv.ParseUint(f[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("qgroup %s: invalid size %q", f[0], f[2])
+		}
+		usage[id] = qgroupUsage{referenced: rfer, exclusive: excl}
+	}
+	return usage, nil
+}
+
+func (a *app) subvolID(path string) (uint64, error) {
+	out, err := a.btrfsQuery("inspect-internal", "rootid", path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(out)), 10, 64)
+}
+
+// loadUsage fills in qgroup usage of snaps. If quotas aren't enabled on the
+// storage filesystem, the snapshots are left without usage information.
+func (a *app) loadUsage(p *profileJSON, snaps []*snap) {
+	if len(snaps) == 0 {
+		return
+	}
+	usage, err := a.qgroupShow(*p.Storage)
+	if err != nil {
+		if a.opts.verbose {
+			fmt.Fprintf(os.Stderr, "qgroup usage not available: %v\n", err)
+		}
+		return
+	}
+	for _, s := range snaps {
+		id, err := a.subvolID(s.subvolPath())
+		if err != nil {
+			continue
+		}
+		if u, ok := usage[id]; ok {
+			s.usage = &u
+		}
+	}
+}
+
+// reportFreed tells how much space pruning snaps will free. Exclusive sizes
+// don't include extents shared only among the pruned snapshots, so the space
+// actually freed may be larger.
+func reportFreed(snaps []*snap) {
+	var excl uint64
+	known := 0
+	for _, s := range snaps {
+		if s.usage != nil {
+			excl += s.usage.exclusive
+			known++
+		}
+	}
+	if known == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "pruning %d snapshot(s) frees at least %s",
+		len(snaps), formatBytes(excl))
+	if known < len(snaps) {
+		fmt.Fprintf(os.Stderr, " (%d without usage information)",
+			len(snaps)-known)
+	}
+	fmt.Fprintln(os.Stderr)
+}
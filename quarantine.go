@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+)
+
+// defaultQuarantineAfter is how many times a transfer of a snapshot may fail
+// before it's quarantined, unless QuarantineAfter says otherwise.
+const defaultQuarantineAfter = 3
+
+// transferFailures records failed transfers of a snapshot by a backup
+// profile. Once there are QuarantineAfter Attempts, the snapshot is
+// quarantined: backups skip it and carry on with newer snapshots rather than
+// failing on it over and over. Raising QuarantineAfter, or removing the
+// record from the state directory, makes backups try it again.
+type transferFailures struct {
+	Attempts int
+	Last     time.Time
+	Error    string
+}
+
+func quarantineKey(p *profileJSON, s *snap) string {
+	return snapKey("quarantine/"+url.PathEscape(p.name), s)
+}
+
+// quarantineAfter returns how many failed transfers quarantine a snapshot,
+// or 0 if none do.
+func quarantineAfter(p *profileJSON) int {
+	if p.QuarantineAfter != nil {
+		return *p.QuarantineAfter
+	}
+	return defaultQuarantineAfter
+}
+
+// quarantined tells whether backups of p skip the snapshot s.
+func (a *app) quarantined(p *profileJSON, s *snap) (bool, error) {
+	n := quarantineAfter(p)
+	if n == 0 {
+		return false, nil
+	}
+	var f transferFailures
+	if _, err := a.db.getSnap(quarantineKey(p, s), s, &f); err != nil {
+		return false, err
+	}
+	return f.Attempts >= n, nil
+}
+
+// transferFailed records that transferring s failed with err and tells
+// whether s is now quarantined.
+func (a *app) transferFailed(p *profileJSON, s *snap, err error) (bool, error) {
+	n := quarantineAfter(p)
+	if n == 0 || a.opts.dryRun {
+		return false, nil
+	}
+	key := quarantineKey(p, s)
+	var f transferFailures
+	if _, err := a.db.getSnap(key, s, &f); err != nil {
+		return false, err
+	}
+	f.Attempts++
+	f.Last = time.Now()
+	f.Error = err.Error()
+	if err := a.db.put(key, &f); err != nil {
+		return false, err
+	}
+	if f.Attempts < n {
+		return false, nil
+	}
+	fmt.Fprintf(os.Stderr, "warning: %s failed to transfer %d times, "+
+		"quarantined: %v\n", s.path, f.Attempts, err)
+	return true, nil
+}
+
+// transferred forgets failed transfers of s, which has been transferred.
+func (a *app) transferred(p *profileJSON, s *snap) error {
+	if a.opts.dryRun {
+		return nil
+	}
+	return a.db.remove(quarantineKey(p, s))
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// readyMarker is printed by database sessions once they're quiesced.
+const readyMarker = "snap-ready"
+
+// quiesce makes applications with data in the subvolume of p consistent on
+// disk according to its Quiesce settings, so that a snapshot can be taken.
+// The returned function resumes them; it must be called even if quiesce
+// fails.
+func (a *app) quiesce(p *profileJSON) (func(), error) {
+	var undo []func() error
+	resume := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			if err := undo[i](); err != nil {
+				fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+			}
+		}
+	}
+	if p.pause != nil {
+		unpause, err := a.pauseContainers(p.pause)
+		undo = append(undo, unpause)
+		if err != nil {
+			return resume, err
+		}
+	}
+	q := p.Quiesce
+	if q == nil {
+		return resume, nil
+	}
+	if c := q.PostgreSQL; c != nil {
+		// The backup only lasts as long as the session which started
+		// it. Snapshots are atomic, so the backup label returned at
+		// the end isn't needed to recover.
+		argv := append(c.command("psql"), "-X", "-q", "-A", "-t",
+			"-v", "ON_ERROR_STOP=1")
+		end, err := a.session(argv,
+			"SELECT pg_backup_start('snap', true);",
+			"SELECT pg_backup_stop();")
+		if err != nil {
+			return resume, err
+		}
+		undo = append(undo, end)
+	}
+	if c := q.MySQL; c != nil {
+		// The lock is held until the session ends.
+		argv := append(c.command("mysql"), "--batch",
+			"--skip-column-names")
+		end, err := a.session(argv, "FLUSH TABLES WITH READ LOCK;",
+			"UNLOCK TABLES;")
+		if err != nil {
+			return resume, err
+		}
+		undo = append(undo, end)
+	}
+	if d := q.Docker; d != nil {
+		cmd := d.command("docker")
+		pause := append(append(cmd, "pause"), d.Containers...)
+		if err := a.localCmd(pause...); err != nil {
+			return resume, err
+		}
+		unpause := append(append(cmd, "unpause"), d.Containers...)
+		undo = append(undo, func() error {
+			return a.localCmd(unpause...)
+		})
+	}
+	return resume, nil
+}
+
+// session starts a database client session with argv, runs the begin
+// statement and waits until it's done. The returned function runs the end
+// statement and ends the session.
+func (a *app) session(argv []string, begin, end string) (func() error, error) {
+	if a.opts.dryRun || a.opts.verbose {
+		fmt.Fprintf(os.Stderr, "%s <<< %s\n", argvString(argv),
+			shellQuote(begin))
+	}
+	if a.opts.dryRun {
+		return func() error {
+			fmt.Fprintf(os.Stderr, "%s <<< %s\n", argvString(argv),
+				shellQuote(end))
+			return nil
+		}, nil
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Env = a.env
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	var stderrBuf bytes.Buffer
+	cmd.Stderr = &stderrBuf
+	run := a.started("", argv)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	wait := func() error {
+		io.Copy(ioutil.Discard, stdout)
+		err := cmd.Wait()
+		a.finished(run, err, nil, stderrBuf.Bytes())
+		if err != nil {
+			return cmdError(argv[0], err, &stderrBuf)
+		}
+		return nil
+	}
+	fmt.Fprintf(stdin, "%s\nSELECT '%s';\n", begin, readyMarker)
+	r := bufio.NewReader(stdout)
+	for {
+		line, err := r.ReadString('\n')
+		if strings.TrimSpace(line) == readyMarker {
+			break
+		}
+		if err != nil {
+			stdin.Close()
+			if err := wait(); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("%s: exited before %q was done",
+				argv[0], begin)
+		}
+	}
+	return func() error {
+		fmt.Fprintln(stdin, end)
+		stdin.Close()
+		return wait()
+	}, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// Reasons snapshots are taken for. Snapshots taken before reasons were
+// recorded have none.
+const (
+	reasonTimeline = "timeline"
+	reasonManual   = "manual"
+	reasonHook     = "hook"
+	reasonRollback = "rollback"
+)
+
+var reasons = []string{reasonTimeline, reasonManual, reasonHook, reasonRollback}
+
+func validReason(r string) bool {
+	for _, known := range reasons {
+		if r == known {
+			return true
+		}
+	}
+	return false
+}
+
+// retain plans which of snaps buckets keep. Each snapshot goes into the
+// cascade of buckets which keeps snapshots taken for its reason, or into the
+// one of buckets with no Reason. Post-transaction snapshots aren't inserted,
+// they're kept as long as their pre-transaction snapshot. It returns the
+// snapshots kept and those evicted, oldest first. The cascades are built
+// anew for each call, so retain has no effects and may be called any number
+// of times, for any profiles. Notes of snaps must be loaded.
+func retain(buckets []*bucketJSON, snaps []*snap) (keep, out []*snap) {
+	_, out = plan(buckets, snaps)
+	evicted := make(map[*snap]bool)
+	for _, s := range out {
+		evicted[s] = true
+	}
+	for _, s := range snaps {
+		if !evicted[s] {
+			keep = append(keep, s)
+		}
+	}
+	byCreation := func(snaps []*snap) {
+		sort.Slice(snaps, func(i, j int) bool {
+			return snaps[i].created.Before(snaps[j].created)
+		})
+	}
+	byCreation(keep)
+	byCreation(out)
+	return keep, out
+}
+
+// keptBy returns which of buckets keeps each of snaps which retain keeps, by
+// its index. Post-transaction snapshots are kept by the bucket of their
+// pre-transaction snapshot.
+func keptBy(buckets []*bucketJSON, snaps []*snap) map[*snap]int {
+	cascades, _ := plan(buckets, snaps)
+	posts := pairs(snaps)
+	by := make(map[*snap]int)
+	for _, c := range cascades {
+		for _, b := range c {
+			for _, s := range b.snaps {
+				by[s] = b.index
+				if post := posts[s.path]; post != nil {
+					by[post] = b.index
+				}
+			}
+		}
+	}
+	return by
+}
+
+// plan inserts snaps into cascades of buckets, see retain, and returns them
+// along with the snapshots evicted.
+func plan(buckets []*bucketJSON, snaps []*snap) (cascades map[string]cascade, out []*snap) {
+	cascades = newCascades(buckets)
+	posts := pairs(snaps)
+	paired := make(map[*snap]bool)
+	for _, s := range posts {
+		paired[s] = true
+	}
+	byReason := make(map[string][]*snap)
+	for _, s := range snaps {
+		if paired[s] {
+			continue
+		}
+		r := s.reason
+		if _, ok := cascades[r]; !ok {
+			r = ""
+		}
+		byReason[r] = append(byReason[r], s)
+	}
+	for r, in := range byReason {
+		out = append(out, cascades[r].insert(in)...)
+	}
+	for _, s := range out {
+		if post := posts[s.path]; post != nil {
+			out = append(out, post)
+		}
+	}
+	return cascades, out
+}
+
+// newCascades sets up a cascade of buckets for each reason snapshots are
+// kept for, "" being the one of buckets without a Reason.
+func newCascades(buckets []*bucketJSON) map[string]cascade {
+	cascades := map[string]cascade{"": newCascade()}
+	for i, b := range buckets {
+		var r string
+		if b.Reason != nil {
+			r = *b.Reason
+		}
+		c := cascades[r]
+		c.addBucket(b, i)
+		cascades[r] = c
+	}
+	return cascades
+}
+
+// reasonCell shows reason r in listings along with which side of a
+// transaction the snapshot was taken on, if any. Snapshots taken before
+// reasons were recorded have none.
+func reasonCell(r, transaction string) cell {
+	switch {
+	case r == "":
+		return plainCell("-")
+	case transaction != "":
+		return plainCell("%s (%s)", r, transaction)
+	}
+	return plainCell("%s", r)
+}
+
+func reasonList() string {
+	return strings.Join(reasons, "|")
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var retainEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// testSnap returns a snapshot taken d after retainEpoch for reason.
+func testSnap(d time.Duration, reason string) *snap {
+	t := retainEpoch.Add(d)
+	return &snap{
+		path:    fmt.Sprintf("/s/%d", t.Unix()),
+		created: t,
+		reason:  reason,
+	}
+}
+
+func testBucket(interval time.Duration, size int, reason string) *bucketJSON {
+	i := BucketInterval(interval)
+	b := &bucketJSON{Interval: &i, Size: &size}
+	if reason != "" {
+		b.Reason = &reason
+	}
+	return b
+}
+
+func snapPaths(snaps []*snap) []string {
+	var paths []string
+	for _, s := range snaps {
+		paths = append(paths, s.path)
+	}
+	return paths
+}
+
+func TestRetain(t *testing.T) {
+	const h, d = time.Hour, 24 * time.Hour
+	pre := testSnap(0, reasonManual)
+	post := testSnap(time.Minute, reasonManual)
+	post.pre = "1577836800"
+	later := testSnap(2*h, reasonManual)
+	tests := []struct {
+		name    string
+		buckets []*bucketJSON
+		snaps   []*snap
+		keep    []int
+	}{{
+		name:  "no buckets",
+		snaps: []*snap{testSnap(0, ""), testSnap(h, "")},
+	}, {
+		name:    "no snapshots",
+		buckets: []*bucketJSON{testBucket(h, 2, "")},
+	}, {
+		name:    "newest fill the bucket",
+		buckets: []*bucketJSON{testBucket(h, 2, "")},
+		snaps: []*snap{testSnap(0, ""), testSnap(h, ""),
+			testSnap(2*h, ""), testSnap(3*h, "")},
+		keep: []int{2, 3},
+	}, {
+		name:    "too close to the previous one",
+		buckets: []*bucketJSON{testBucket(h, 5, "")},
+		snaps: []*snap{testSnap(0, ""), testSnap(10*time.Minute, ""),
+			testSnap(h, "")},
+		keep: []int{0, 2},
+	}, {
+		name: "evicted to the next bucket",
+		buckets: []*bucketJSON{testBucket(h, 2, ""),
+			testBucket(d, 2, "")},
+		snaps: []*snap{testSnap(-2*d, ""), testSnap(-d, ""),
+			testSnap(0, ""), testSnap(h, ""), testSnap(2*h, "")},
+		keep: []int{1, 2, 3, 4},
+	}, {
+		name:    "zero size bucket",
+		buckets: []*bucketJSON{testBucket(h, 0, "")},
+		snaps:   []*snap{testSnap(0, ""), testSnap(h, "")},
+	}, {
+		name:    "reason without buckets",
+		buckets: []*bucketJSON{testBucket(h, 2, reasonManual)},
+		snaps: []*snap{testSnap(0, reasonManual),
+			testSnap(h, reasonTimeline)},
+		keep: []int{0},
+	}, {
+		name:    "post-transaction snapshot follows its pre",
+		buckets: []*bucketJSON{testBucket(h, 1, reasonManual)},
+		snaps:   []*snap{pre, post, later},
+		keep:    []int{2},
+	}}
+	for _, tt := range tests {
+		var wantKeep, wantOut []*snap
+		kept := make(map[int]bool)
+		for _, i := range tt.keep {
+			kept[i] = true
+		}
+		for i, s := range tt.snaps {
+			if kept[i] {
+				wantKeep = append(wantKeep, s)
+			} else {
+				wantOut = append(wantOut, s)
+			}
+		}
+		keep, out := retain(tt.buckets, tt.snaps)
+		if !reflect.DeepEqual(snapPaths(keep), snapPaths(wantKeep)) {
+			t.Errorf("%s: kept %v, want %v", tt.name,
+				snapPaths(keep), snapPaths(wantKeep))
+		}
+		if !reflect.DeepEqual(snapPaths(out), snapPaths(wantOut)) {
+			t.Errorf("%s: evicted %v, want %v", tt.name,
+				snapPaths(out), snapPaths(wantOut))
+		}
+	}
+}
+
+// TestRetainRepeatable checks that retain has no effects, so that calling it
+// again gives the same result.
+func TestRetainRepeatable(t *testing.T) {
+	buckets := []*bucketJSON{testBucket(time.Hour, 1, "")}
+	snaps := []*snap{testSnap(0, ""), testSnap(time.Hour, "")}
+	keep1, out1 := retain(buckets, snaps)
+	keep2, out2 := retain(buckets, snaps)
+	if !reflect.DeepEqual(keep1, keep2) || !reflect.DeepEqual(out1, out2) {
+		t.Errorf("retain gave %v, %v and then %v, %v", keep1, out1,
+			keep2, out2)
+	}
+}
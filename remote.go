@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// shellQuote quotes s for a POSIX shell, unless it's safe as is.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyz"+
+		"ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:@%+,") == "" {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// sshArgv returns argv which runs argv on host, by ssh or by the configured
+// Transport. The remote command is run by a shell, hence the quoting. An
+// empty host means the local machine.
+func (a *app) sshArgv(host string, argv ...string) []string {
+	if host == "" {
+		return argv
+	}
+	if a.cfg.SSH != nil && len(a.cfg.SSH.Transport) > 0 {
+		r := strings.NewReplacer("{host}", host,
+			"{command}", argvString(argv))
+		t := make([]string, len(a.cfg.SSH.Transport))
+		for i, s := range a.cfg.SSH.Transport {
+			t[i] = r.Replace(s)
+		}
+		return t
+	}
+	return []string{"ssh", "-o", "BatchMode=yes", host, "--",
+		argvString(argv)}
+}
+
+// process is a running command started by startOn.
+type process interface {
+	Wait() error
+}
+
+// startOn starts argv on host, where an empty host means the local machine.
+// Remote commands are run by the built-in SSH client if it's enabled, or by
+// spawning ssh otherwise.
+func (a *app) startOn(host string, argv []string, stdin io.Reader, stdout, stderr io.Writer) (process, error) {
+	if host != "" && a.ssh != nil {
+		return a.ssh.start(host, argvString(argv), stdin, stdout, stderr)
+	}
+	argv = a.sshArgv(host, argv...)
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Env = a.env
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, stdout, stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// runOn runs argv on host like startOn does and waits for it to finish.
+func (a *app) runOn(host string, stdout io.Writer, argv []string) error {
+	var stderr bytes.Buffer
+	stdout, stdoutBuf := a.capture(stdout)
+	run := a.started(host, argv)
+	p, err := a.startOn(host, argv, nil, stdout, &stderr)
+	if err != nil {
+		return err
+	}
+	err = p.Wait()
+	a.finished(run, err, stdoutBuf, stderr.Bytes())
+	if err != nil {
+		return cmdError(commandName(host, argv), err, &stderr)
+	}
+	return nil
+}
+
+// commandName names argv run on host in diagnostics.
+func commandName(host string, argv []string) string {
+	if host == "" {
+		return argv[0]
+	}
+	return host + ": " + argv[0]
+}
+
+// hostSnaps is like findSnaps, but looks for snapshots on host.
+func (a *app) hostSnaps(host, dir string) ([]*snap, error) {
+	if host == "" {
+		return findSnaps(dir)
+	}
+	// List snapshot directories and what's in them, as findSnaps does.
+	argv := []string{"find", dir, "-mindepth", "1", "-maxdepth", "2",
+		"-printf", `%P\n`}
+	if a.opts.verbose {
+		printArgv(a.sshArgv(host, argv...))
+	}
+	var stdout bytes.Buffer
+	if err := a.runOn(host, &stdout, argv); err != nil {
+		return nil, err
+	}
+	names := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if names[0] == "" {
+		names = nil
+	}
+	return parseSnaps(dir, names)
+}
+
+// mkdirAll creates dir and its parents on host.
+func (a *app) mkdirAll(host, dir string) error {
+	if host == "" {
+		return os.MkdirAll(dir, defaultDirMode)
+	}
+	return a.runOn(host, nil, []string{"mkdir", "-p", dir})
+}
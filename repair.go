@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+// repairChain restores the chain of snapshots backed up by p. Copies which
+// weren't received completely, and snapshots named like those of the source
+// which aren't copies of them, are deleted. Then everything missing is backed
+// up again, each snapshot relative to the newest older one present on both
+// sides, or as a full stream if that turns out to be missing after all.
+func (a *app) repairChain(p *profileJSON) error {
+	if !p.isBackup() {
+		return fmt.Errorf("only backup profiles have chains of snapshots")
+	}
+	if p.Rsync != nil {
+		return fmt.Errorf("copies made by rsync aren't snapshots, " +
+			"back them up instead")
+	}
+	host, srcDir, err := a.sourceDir(p)
+	if err != nil {
+		return err
+	}
+	srcSnaps, err := a.sourceSnaps(p, host, srcDir)
+	if err != nil {
+		return err
+	}
+	dst, err := storageDir(p)
+	if err != nil {
+		return err
+	}
+	dstSnaps, err := profileSnaps(p)
+	if err != nil {
+		return err
+	}
+	a.loadIDs(host, srcSnaps)
+	a.loadIDs("", dstSnaps)
+	have := matchSnaps(srcSnaps, dstSnaps, clockSkew(p))
+	copies := make(map[*snap]bool)
+	for _, t := range have {
+		copies[t] = true
+	}
+	names := make(map[string]*snap)
+	for _, s := range srcSnaps {
+		names[path.Base(s.path)] = s
+	}
+	var broken []*snap
+	for _, t := range dstSnaps {
+		if t.ids != nil && t.ids.ReceivedUUID == "" {
+			fmt.Fprintf(os.Stderr, "%s wasn't received completely\n",
+				t.path)
+		} else if s := names[path.Base(t.path)]; s != nil && !copies[t] {
+			fmt.Fprintf(os.Stderr, "%s is not a copy of %s\n", t.path,
+				s.path)
+		} else {
+			continue
+		}
+		broken = append(broken, t)
+	}
+	for _, t := range broken {
+		if err := a.removeBroken(dst, t); err != nil {
+			return fmt.Errorf("cannot delete %s: %w", t.path, err)
+		}
+	}
+	if a.opts.dryRun && len(broken) > 0 {
+		// Backup would find the broken copies still there.
+		return nil
+	}
+	return a.backup(p)
+}
+
+// removeBroken deletes the broken copy s from storage.
+func (a *app) removeBroken(storage string, s *snap) error {
+	done, err := a.begin(storage, opPrune, s)
+	if err != nil {
+		return err
+	}
+	if err := a.removeSnap(s); err != nil {
+		return err
+	}
+	if err := a.audit(storage, auditDelete, s, ""); err != nil {
+		return err
+	}
+	return done()
+}
@@ -0,0 +1,54 @@
+package main
+
+import "time"
+
+// Values of retention for snapshots which no bucket keeps.
+const (
+	retainPruned  = -1
+	retainPending = -2
+)
+
+// retention tells which bucket of p keeps each of snaps, by its index, or
+// whether pruning would delete it or keep it until it's backed up. Snapshots
+// in shared storage which have no owner are never pruned and are left out.
+func (a *app) retention(p *profileJSON, snaps []*snap, shared bool) (map[*snap]int, error) {
+	var own []*snap
+	for _, s := range snaps {
+		if !shared || !s.unowned {
+			own = append(own, s)
+		}
+	}
+	own, pending, err := a.splitBackedUp(p, own)
+	if err != nil {
+		return nil, err
+	}
+	kept := keptBy(p.Buckets, own)
+	for _, s := range own {
+		if _, ok := kept[s]; !ok {
+			kept[s] = retainPruned
+		}
+	}
+	for _, s := range pending {
+		kept[s] = retainPending
+	}
+	return kept, nil
+}
+
+// retentionCell formats what pruning would do with s, as told by retention.
+func retentionCell(p *profileJSON, s *snap, kept map[*snap]int) cell {
+	i, ok := kept[s]
+	switch {
+	case !ok:
+		return plainCell("-")
+	case i == retainPruned:
+		return cell{text: "WOULD-PRUNE", color: colorRed}
+	case i == retainPending:
+		return plainCell("KEEP until backed up")
+	}
+	b := p.Buckets[i]
+	interval := formatInterval(time.Duration(*b.Interval))
+	if b.Reason != nil {
+		return plainCell("KEEP #%d %s %s", i+1, interval, *b.Reason)
+	}
+	return plainCell("KEEP #%d %s", i+1, interval)
+}
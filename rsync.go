@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// partialPrefix names directories snapshots are copied into by rsync. They're
+// hidden until the copy is complete, and an interrupted copy is resumed by the
+// next backup.
+const partialPrefix = ".partial-"
+
+// rsync copies the files of the snapshot s on host into a plain directory in
+// the storage directory dst. Files which didn't change since the copy at
+// linkDest, unless it's empty, are hard-linked to it rather than copied.
+func (a *app) rsync(host string, s *snap, linkDest, dst string, r *rsyncJSON) error {
+	name := path.Base(s.path)
+	partial := path.Join(dst, partialPrefix+name)
+	argv := []string{"rsync", "-aH", "--numeric-ids", "--delete"}
+	if linkDest != "" {
+		argv = append(argv, "--link-dest="+linkDest)
+	}
+	if a.summary != nil {
+		argv = append(argv, "--stats")
+	}
+	argv = append(argv, r.Args...)
+	src := s.subvolPath() + "/"
+	if host != "" {
+		user, addr, err := splitHost(host)
+		if err != nil {
+			return err
+		}
+		h, port, _ := net.SplitHostPort(addr)
+		if strings.Contains(h, ":") {
+			h = "[" + h + "]"
+		}
+		argv = append(argv, "-e", "ssh -o BatchMode=yes -p "+port)
+		src = user + "@" + h + ":" + src
+	}
+	argv = append(argv, src, partial+"/")
+	if a.opts.dryRun || a.opts.verbose {
+		printArgv(argv)
+	}
+	if a.opts.dryRun {
+		return nil
+	}
+	if err := os.MkdirAll(partial, defaultDirMode); err != nil {
+		return err
+	}
+	start := time.Now()
+	var stdout bytes.Buffer
+	if err := a.runOn("", &stdout, argv); err != nil {
+		return err
+	}
+	if err := os.Rename(partial, path.Join(dst, name)); err != nil {
+		return err
+	}
+	size := transferredSize(stdout.String())
+	a.transfers.transferred(size, start)
+	if ps := a.current(); ps != nil {
+		ps.Transferred = append(ps.Transferred, transferSummary{
+			Snapshot: s.path,
+			Bytes:    size,
+			Seconds:  time.Since(start).Seconds(),
+		})
+	}
+	return nil
+}
+
+// transferredSize finds the size of files rsync copied in its --stats
+// output. Files hard-linked to the previous copy don't count.
+func transferredSize(stats string) int64 {
+	const prefix = "Total transferred file size: "
+	for _, line := range strings.Split(stats, "\n") {
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		f := strings.Fields(strings.TrimPrefix(line, prefix))
+		if len(f) == 0 {
+			break
+		}
+		n, _ := strconv.ParseInt(strings.Replace(f[0], ",", "", -1), 10, 64)
+		return n
+	}
+	return 0
+}
+
+// removePlain deletes the plain directory which holds a copy of a snapshot
+// made by rsync.
+func (a *app) removePlain(s *snap) error {
+	if err := a.localCmd("rm", "-rf", s.path); err != nil {
+		return fmt.Errorf("cannot remove %s: %w", s.path, err)
+	}
+	return nil
+}
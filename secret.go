@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// secret is a configuration value, such as a password, which needn't be
+// written in the configuration itself. It's either a string, or an object
+// telling where to get it from:
+//
+//	{"Env": "NAME"}                      an environment variable
+//	{"File": "/run/credentials/..."}     a file, such as a systemd credential
+//	{"Command": ["pass", "show", "x"]}   output of a command, such as sops
+//	{"Age": "-----BEGIN AGE...", "Identity": "/root/.age/key.txt"}
+//	                                     text encrypted by age
+//
+// Trailing newlines are trimmed from files and outputs of commands.
+type secret struct {
+	value    *string
+	Env      *string
+	File     *string
+	Command  []string
+	Age      *string
+	Identity *string
+}
+
+func (s *secret) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var v string
+		if err := json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		s.value = &v
+		return nil
+	}
+	// Without UnmarshalJSON, so that this doesn't recurse.
+	type source secret
+	if err := json.Unmarshal(data, (*source)(s)); err != nil {
+		return err
+	}
+	n := 0
+	for _, set := range []bool{
+		s.Env != nil, s.File != nil, len(s.Command) > 0, s.Age != nil,
+	} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return fmt.Errorf("secret must be a string or have exactly " +
+			"one of Env, File, Command or Age")
+	}
+	if s.Age != nil && s.Identity == nil {
+		return fmt.Errorf("secret encrypted by age needs Identity")
+	}
+	return nil
+}
+
+// reveal returns the value of s, which is only looked up once.
+func (s *secret) reveal() (string, error) {
+	if s.value != nil {
+		return *s.value, nil
+	}
+	var v string
+	switch {
+	case s.Env != nil:
+		var ok bool
+		if v, ok = os.LookupEnv(*s.Env); !ok {
+			return "", fmt.Errorf("$%s is not set", *s.Env)
+		}
+	case s.File != nil:
+		data, err := ioutil.ReadFile(*s.File)
+		if err != nil {
+			return "", err
+		}
+		v = strings.TrimRight(string(data), "\r\n")
+	case len(s.Command) > 0:
+		out, err := secretOutput(s.Command, nil)
+		if err != nil {
+			return "", err
+		}
+		v = out
+	case s.Age != nil:
+		argv := []string{"age", "--decrypt", "--identity", *s.Identity}
+		out, err := secretOutput(argv, strings.NewReader(*s.Age))
+		if err != nil {
+			return "", err
+		}
+		v = out
+	}
+	s.value = &v
+	return v, nil
+}
+
+// secretOutput runs argv and returns its output without trailing newlines.
+func secretOutput(argv []string, stdin *strings.Reader) (string, error) {
+	cmd := exec.Command(argv[0], argv[1:]...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", cmdError(argv[0], err, &stderr)
+	}
+	return strings.TrimRight(stdout.String(), "\r\n"), nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// seedFile describes the send streams on a seed drive, which carries the
+// first backup of snapshots to a destination too far away, or behind too
+// slow a link, to send them over the network. --seed-export writes the
+// streams, --seed-import receives them into the storage of a backup profile,
+// which then goes on to back up newer snapshots incrementally.
+const seedFile = "seed.json"
+
+type seedJSON struct {
+	Profile   ProfileName
+	Snapshots []*seedSnapshot
+}
+
+// seedSnapshot is a snapshot whose send stream is in the file Name.btrfs,
+// relative to the snapshot Parent if it's not empty.
+type seedSnapshot struct {
+	Name   string
+	Parent string `json:",omitempty"`
+	Flat   bool   `json:",omitempty"`
+	Note   note
+}
+
+func seedStream(dir, name string) string {
+	return path.Join(dir, name+".btrfs")
+}
+
+// seedExport writes send streams of all snapshots of p into dir, the oldest
+// one in full and each of the others relative to the one before it.
+func (a *app) seedExport(p *profileJSON, dir string) error {
+	if p.Rsync != nil {
+		return fmt.Errorf("copies made by rsync aren't snapshots")
+	}
+	if _, err := os.Stat(path.Join(dir, seedFile)); err == nil {
+		return fmt.Errorf("%s already holds a seed", dir)
+	}
+	snaps, err := profileSnaps(p)
+	if err != nil {
+		return err
+	}
+	if len(snaps) == 0 {
+		return fmt.Errorf("no snapshots to export")
+	}
+	if err := loadNotes(snaps); err != nil {
+		return err
+	}
+	seed := &seedJSON{Profile: p.name}
+	var parent *snap
+	for _, s := range snaps {
+		ss := &seedSnapshot{
+			Name: path.Base(s.path),
+			Flat: s.flat,
+			Note: note{
+				Description: s.description,
+				Reason:      s.reason,
+				Transaction: s.transaction,
+				Pre:         s.pre,
+				Labels:      s.labels,
+			},
+		}
+		argv := []string{a.btrfs("", "send"), "send", "-q"}
+		if parent != nil {
+			ss.Parent = path.Base(parent.path)
+			argv = append(argv, "-p", parent.subvolPath())
+		}
+		argv = append(argv, s.subvolPath())
+		if err := a.exportStream(argv, seedStream(dir, ss.Name)); err != nil {
+			return fmt.Errorf("%s: %w", s.path, err)
+		}
+		seed.Snapshots = append(seed.Snapshots, ss)
+		parent = s
+	}
+	if a.opts.dryRun {
+		return nil
+	}
+	data, err := json.MarshalIndent(seed, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(dir, seedFile), data, 0644)
+}
+
+// exportStream writes the output of the btrfs send command argv to file.
+func (a *app) exportStream(argv []string, file string) error {
+	if a.opts.dryRun || a.opts.verbose {
+		fmt.Fprintf(os.Stderr, "%s > %s\n", argvString(argv),
+			shellQuote(file))
+	}
+	if a.opts.dryRun {
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(file), defaultDirMode); err != nil {
+		return err
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	err = a.runArgv(f, argv)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(file)
+	}
+	return err
+}
+
+// seedImport receives the send streams in dir into the storage of the backup
+// profile p, skipping snapshots which are there already.
+func (a *app) seedImport(p *profileJSON, dir string) error {
+	if !p.isBackup() {
+		return fmt.Errorf("seeds are imported by backup profiles")
+	}
+	if p.Rsync != nil {
+		return fmt.Errorf("copies made by rsync aren't snapshots, " +
+			"copy the files instead")
+	}
+	data, err := ioutil.ReadFile(path.Join(dir, seedFile))
+	if err != nil {
+		return err
+	}
+	var seed seedJSON
+	if err := json.Unmarshal(data, &seed); err != nil {
+		return fmt.Errorf("%s: %w", seedFile, err)
+	}
+	storage, err := storageDir(p)
+	if err != nil {
+		return err
+	}
+	snaps, err := findSnaps(storage)
+	if err != nil {
+		return err
+	}
+	present := make(map[string]bool)
+	for _, s := range snaps {
+		present[path.Base(s.path)] = true
+	}
+	if !a.opts.dryRun {
+		if err := os.MkdirAll(storage, defaultDirMode); err != nil {
+			return err
+		}
+	}
+	for _, ss := range seed.Snapshots {
+		if present[ss.Name] {
+			continue
+		}
+		if ss.Parent != "" && !present[ss.Parent] {
+			return fmt.Errorf("%s: parent %s missing in %s", ss.Name,
+				ss.Parent, storage)
+		}
+		recv := &snap{path: path.Join(storage, ss.Name), flat: ss.Flat}
+		if err := a.receiveStream(storage, recv, seedStream(dir, ss.Name)); err != nil {
+			return fmt.Errorf("%s: %w", ss.Name, err)
+		}
+		present[ss.Name] = true
+		if err := a.setOwner(recv, p.name); err != nil {
+			return err
+		}
+		recv.description, recv.reason = ss.Note.Description, ss.Note.Reason
+		recv.transaction, recv.pre = ss.Note.Transaction, ss.Note.Pre
+		recv.labels = ss.Note.Labels
+		if err := a.saveNote(recv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// receiveStream receives the send stream in file as the snapshot s in
+// storage.
+func (a *app) receiveStream(storage string, s *snap, file string) error {
+	recvDir := s.path
+	if s.flat {
+		recvDir = storage
+	}
+	done, err := a.begin(storage, opReceive, s)
+	if err != nil {
+		return err
+	}
+	if !a.opts.dryRun {
+		if err := os.MkdirAll(recvDir, defaultDirMode); err != nil {
+			return err
+		}
+	}
+	if err := a.btrfsCmd("receive", "-f", file, recvDir); err != nil {
+		if cerr := a.cleanupReceive(s.path, s.flat); cerr != nil {
+			fmt.Fprintf(os.Stderr, "cannot delete partially "+
+				"received snapshot: %v\n", cerr)
+		} else {
+			done()
+		}
+		return err
+	}
+	return done()
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const defaultListenAddr = "localhost:7557"
+
+// snapJSON describes a snapshot in API responses.
+type snapJSON struct {
+	Path        string
+	Created     time.Time
+	Reason      string            `json:",omitempty"`
+	Transaction string            `json:",omitempty"`
+	Description string            `json:",omitempty"`
+	Labels      map[string]string `json:",omitempty"`
+	Referenced  *uint64           `json:",omitempty"`
+	Exclusive   *uint64           `json:",omitempty"`
+}
+
+// server implements the HTTP API of snap serve:
+//
+//	GET  /v1/profiles                                  names of profiles
+//	GET  /v1/profiles/NAME/snapshots                   snapshots of a profile
+//	POST /v1/profiles/NAME/{create,backup,prune,maintain}[?dry-run=1]
+//	                                                   run an operation
+//	GET  /v1/profiles/NAME/snapshots/TS/send[?parent=TS]
+//	                                                   btrfs send stream
+//	GET  /v1/profiles/NAME/snapshots/TS/files/PATH     file or directory
+//	                                                   listing in a snapshot
+//	GET  /v1/profiles/NAME/versions?path=PATH          versions of a file
+//	POST /v1/hooks/NAME[?description=TEXT]             run a webhook
+//	GET  /healthz, /readyz                             probes, see healthz.go
+//
+// Without a Token, only profiles and snapshots are listed; operations and
+// contents of snapshots, by send, files and versions, need one. Operations
+// are serialized, since they may touch the same storage. See dbus.go for the D-Bus interface, dashboard.go for the web dashboard and
+// webhook.go for webhooks.
+type server struct {
+	app       *app
+	token     string
+	bus       *dbus.Conn
+	dashboard *dashboard
+	hooks     map[string]*webhook
+	mu        sync.Mutex
+}
+
+func (a *app) serve() error {
+	addr := defaultListenAddr
+	srv := &server{app: a}
+	if c := a.cfg.Server; c != nil {
+		if c.Listen != nil {
+			addr = *c.Listen
+		}
+		if c.Token != nil {
+			token, err := c.Token.reveal()
+			if err != nil {
+				return fmt.Errorf("Token: %w", err)
+			}
+			srv.token = token
+		}
+	}
+	if a.opts.listen != "" {
+		addr = a.opts.listen
+	}
+	if srv.token == "" && !loopback(addr) {
+		return fmt.Errorf("refusing to serve the API on %s without a "+
+			"Token, anyone who can connect could run operations", addr)
+	}
+	if c := a.cfg.Server; c != nil && c.DBus {
+		if err := srv.exportDBus(); err != nil {
+			return err
+		}
+		defer srv.bus.Close()
+	}
+	var tlsCert, tlsKey string
+	if c := a.cfg.Server; c != nil && c.Dashboard != nil {
+		password, err := c.Dashboard.Password.reveal()
+		if err != nil {
+			return fmt.Errorf("Dashboard: Password: %w", err)
+		}
+		srv.dashboard = &dashboard{
+			user:     *c.Dashboard.User,
+			password: password,
+		}
+	}
+	if c := a.cfg.Server; c != nil {
+		if err := srv.loadWebhooks(c.Webhooks); err != nil {
+			return err
+		}
+	}
+	if c := a.cfg.Server; c != nil && c.TLSCert != nil {
+		tlsCert, tlsKey = *c.TLSCert, *c.TLSKey
+	}
+	fmt.Fprintf(os.Stderr, "listening on %s\n", addr)
+	if tlsCert != "" {
+		return http.ListenAndServeTLS(addr, tlsCert, tlsKey, srv)
+	}
+	return http.ListenAndServe(addr, srv)
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.dashboard != nil && (r.URL.Path == "/" ||
+		strings.HasPrefix(r.URL.Path, dashboardPrefix)) {
+		s.serveDashboard(w, r)
+		return
+	}
+	if r.Method == http.MethodGet && (r.URL.Path == healthzPath ||
+		r.URL.Path == readyzPath) {
+		s.checkHealth(w, r.URL.Path == readyzPath)
+		return
+	}
+	// Webhooks have tokens of their own.
+	if strings.HasPrefix(r.URL.Path, webhookPrefix) {
+		s.serveWebhook(w, r)
+		return
+	}
+	if s.token != "" && !s.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "v1" || parts[1] != "profiles" {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 2 && r.Method == http.MethodGet {
+		s.profiles(w)
+		return
+	}
+	if len(parts) < 4 {
+		http.NotFound(w, r)
+		return
+	}
+	name := parts[2]
+	p, ok := s.app.cfg.Profiles[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("profile %q unknown", name),
+			http.StatusNotFound)
+		return
+	}
+	// Contents of snapshots may include files only root can read, and
+	// operations delete snapshots, neither of which any local user gets
+	// without the Token.
+	contents := len(parts) >= 6 && parts[3] == "snapshots" &&
+		(parts[5] == "send" || parts[5] == "files") ||
+		len(parts) == 4 && parts[3] == "versions"
+	if s.token == "" && (contents || r.Method != http.MethodGet) {
+		http.Error(w, "operations and contents of snapshots require "+
+			"a Token", http.StatusForbidden)
+		return
+	}
+	switch {
+	case len(parts) == 4 && parts[3] == "snapshots" && r.Method == http.MethodGet:
+		s.snapshots(w, p)
+	case len(parts) == 4 && r.Method == http.MethodPost:
+		s.operation(w, r, name, p, parts[3])
+	case len(parts) == 6 && parts[3] == "snapshots" && parts[5] == "send" &&
+		r.Method == http.MethodGet:
+		s.send(w, r, p, parts[4])
+	case len(parts) >= 6 && parts[3] == "snapshots" && parts[5] == "files" &&
+		r.Method == http.MethodGet:
+		s.file(w, r, p, parts[4], path.Join(parts[6:]...))
+	case len(parts) == 4 && parts[3] == "versions" && r.Method == http.MethodGet:
+		s.versions(w, p, r.URL.Query().Get("path"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// authorized tells whether r presents the Token as a bearer token.
+func (s *server) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	return subtle.ConstantTimeCompare([]byte(auth),
+		[]byte("Bearer "+s.token)) == 1
+}
+
+// loopback tells whether addr, as given to Listen, only accepts connections
+// from the local machine.
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot write response: %v\n", err)
+	}
+}
+
+func (s *server) profiles(w http.ResponseWriter) {
+	names := make([]string, 0, len(s.app.cfg.Profiles))
+	for n := range s.app.cfg.Profiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	writeJSON(w, names)
+}
+
+func (s *server) snapshots(w http.ResponseWriter, p *profileJSON) {
+	profiles, err := s.app.volumeProfiles(p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var snaps []*snap
+	for _, vp := range profiles {
+		vsnaps, err := profileSnaps(vp)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		snaps = append(snaps, vsnaps...)
+	}
+	if err := loadNotes(snaps); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.app.loadUsage(p, snaps)
+	resp := make([]snapJSON, len(snaps))
+	for i, sn := range snaps {
+		resp[i] = snapJSON{
+			Path:        sn.path,
+			Created:     sn.created,
+			Reason:      sn.reason,
+			Transaction: sn.transaction,
+			Description: sn.description,
+			Labels:      sn.labels,
+		}
+		if sn.usage != nil {
+			resp[i].Referenced = &sn.usage.referenced
+			resp[i].Exclusive = &sn.usage.exclusive
+		}
+	}
+	writeJSON(w, resp)
+}
+
+func (s *server) operation(w http.ResponseWriter, r *http.Request, name string, p *profileJSON, op string) {
+	if !apiOperations[op] {
+		http.NotFound(w, r)
+		return
+	}
+	err := s.run(name, p, op, func(a *app) func(*profileJSON) error {
+		if r.URL.Query().Get("dry-run") == "1" {
+			a.opts.dryRun = true
+		}
+		return a.operation(op)
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cannot %s: %v", op, err),
+			http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiOperations are those which can be run through the API.
+var apiOperations = map[string]bool{
+	"create":   true,
+	"backup":   true,
+	"prune":    true,
+	"maintain": true,
+}
+
+// operation returns what runs op, or nil if op can't be run through the API.
+func (a *app) operation(op string) func(*profileJSON) error {
+	switch op {
+	case "create":
+		return a.create
+	case "backup":
+		return a.backup
+	case "prune":
+		return a.prune
+	case "maintain":
+		return a.maintain
+	}
+	return nil
+}
+
+// run runs op on the profile called name. Setup prepares a copy of the app
+// for it and returns what runs op on each of the profile's volumes.
+func (s *server) run(name string, p *profileJSON, op string, setup func(*app) func(*profileJSON) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Work on a copy so that nothing leaks between requests.
+	a := *s.app
+	a.opts.profileName = name
+	a.enter = enterArgv(p)
+	run := setup(&a)
+	s.status(name, op, statusStarted, nil)
+	var err error
+	done := func() {}
+	if a.env, err = profileEnv(p); err == nil {
+		done, err = a.preConnect(p)
+	}
+	defer done()
+	var profiles []*profileJSON
+	if err == nil {
+		profiles, err = a.volumeProfiles(p)
+	}
+	for _, vp := range profiles {
+		if err != nil {
+			break
+		}
+		err = a.runOperation(op, vp, run)
+	}
+	if err != nil {
+		s.status(name, op, statusFailed, err)
+	} else {
+		s.status(name, op, statusFinished, nil)
+	}
+	if a.telemetry != nil {
+		if err := a.telemetry.flush(); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot export telemetry: %v\n", err)
+		}
+	}
+	return err
+}
+
+// runOperation runs the operation op of the given profile with storage
+// prepared for it.
+func (a *app) runOperation(op string, p *profileJSON, run func(*profileJSON) error) error {
+	if op != "maintain" && op != "restore-file" {
+		unlock, err := a.prepareStorage(p)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	return a.instrument(op, p, run)
+}
+
+func (s *server) send(w http.ResponseWriter, r *http.Request, p *profileJSON, ts string) {
+	snaps, err := profileSnaps(p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	parentTS := r.URL.Query().Get("parent")
+	target, parent := snapNamed(snaps, ts), snapNamed(snaps, parentTS)
+	if target == nil || (parentTS != "" && parent == nil) {
+		http.Error(w, "no such snapshot", http.StatusNotFound)
+		return
+	}
+	args := []string{"send", "-q"}
+	if parent != nil {
+		args = append(args, "-p", parent.subvolPath())
+	}
+	args = append(args, target.subvolPath())
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err := s.app.btrfsRun(w, args...); err != nil {
+		// The status was sent already, all we can do is to cut the
+		// stream short, which will make the receiving side fail.
+		fmt.Fprintf(os.Stderr, "send of %s failed: %v\n", target, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// snapNamed returns the snapshot among snaps with the given timestamp, or nil
+// if there's none.
+func snapNamed(snaps []*snap, ts string) *snap {
+	for _, sn := range snaps {
+		if path.Base(sn.path) == ts {
+			return sn
+		}
+	}
+	return nil
+}
+
+// file sends the file rel from the snapshot of p with the given timestamp,
+// or a listing if it's a directory. Symlinks are followed, but only within
+// the snapshot.
+func (s *server) file(w http.ResponseWriter, r *http.Request, p *profileJSON, ts, rel string) {
+	snaps, err := profileSnaps(p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sn := snapNamed(snaps, ts)
+	if sn == nil {
+		http.Error(w, "no such snapshot", http.StatusNotFound)
+		return
+	}
+	root, err := filepath.EvalSymlinks(sn.subvolPath())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	name, err := filepath.EvalSymlinks(filepath.Join(root, rel))
+	if err != nil {
+		http.Error(w, "no such file", http.StatusNotFound)
+		return
+	}
+	if name != root && !strings.HasPrefix(name, root+"/") {
+		http.Error(w, "link leads out of the snapshot", http.StatusForbidden)
+		return
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !fi.IsDir() {
+		// Handles ranges, so that large downloads can be resumed.
+		http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+		return
+	}
+	fis, err := f.Readdir(-1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	ents := make([]dirEntry, len(fis))
+	for i, fi := range fis {
+		ents[i] = dirEntry{
+			Name:    fi.Name(),
+			Mode:    fi.Mode(),
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		}
+	}
+	writeJSON(w, ents)
+}
+
+// versionJSON describes a version of a file in API responses. Versions
+// without Size and ModTime tell that the file was deleted.
+type versionJSON struct {
+	Snapshot string
+	Created  time.Time
+	Size     *int64     `json:",omitempty"`
+	ModTime  *time.Time `json:",omitempty"`
+}
+
+// versions lists the distinct versions of file across snapshots of p, like
+// list-files does.
+func (s *server) versions(w http.ResponseWriter, p *profileJSON, file string) {
+	if file == "" {
+		http.Error(w, "path missing", http.StatusBadRequest)
+		return
+	}
+	rel, err := s.app.relPattern(p, file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rel = filepath.Clean(rel)
+	snaps, err := profileSnaps(p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	perSnap, err := s.app.allSnapFiles(snaps, globEscape(rel), false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	manifests, err := readManifests(snaps)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	vs, err := versions(snaps, perSnap, manifests, rel)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := make([]versionJSON, len(vs))
+	for i, v := range vs {
+		resp[i] = versionJSON{
+			Snapshot: path.Base(v.snap.path),
+			Created:  v.snap.created,
+		}
+		if v.path != "" {
+			resp[i].Size = &v.fi.Size
+			resp[i].ModTime = &v.fi.ModTime
+		}
+	}
+	writeJSON(w, resp)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeAuthorization(t *testing.T) {
+	home := &profileJSON{}
+	a := &app{cfg: &configJSON{
+		Profiles: map[ProfileName]*profileJSON{"home": home},
+	}}
+	tests := []struct {
+		method, path string
+		token        string
+		want         int
+	}{
+		{http.MethodGet, "/v1/profiles", "", http.StatusOK},
+		{http.MethodPost, "/v1/profiles/home/create", "", http.StatusForbidden},
+		{http.MethodPost, "/v1/profiles/home/prune", "", http.StatusForbidden},
+		{http.MethodGet, "/v1/profiles/home/snapshots/1/send", "",
+			http.StatusForbidden},
+		{http.MethodGet, "/v1/profiles/home/snapshots/1/files/etc", "",
+			http.StatusForbidden},
+		{http.MethodGet, "/v1/profiles/home/versions", "",
+			http.StatusForbidden},
+		{http.MethodGet, "/v1/profiles", "t", http.StatusUnauthorized},
+		{http.MethodPost, "/v1/profiles/home/create", "t",
+			http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		s := &server{app: a, token: tt.token}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.want {
+			t.Errorf("%s %s with token %q: %d, want %d", tt.method,
+				tt.path, tt.token, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+)
+
+// A storage directory may be shared by several profiles, possibly of several
+// machines over NFS. Each snapshot is then owned by the profile and host which
+// created or received it, recorded in ownersDir, and only its owner sees
+// and prunes it. Snapshots without a record predate ownership and are seen
+// by everyone, but they're never pruned in a shared storage directory.
+const (
+	ownersDir = ".owners"
+	lockFile  = ".lock"
+)
+
+type owner struct {
+	Profile ProfileName
+	Host    string
+}
+
+func owners(storage string) *metaDB {
+	return &metaDB{dir: path.Join(storage, ownersDir)}
+}
+
+// setOwner records that the snapshot s is owned by profile of this machine.
+func (a *app) setOwner(s *snap, profile ProfileName) error {
+	if a.opts.dryRun {
+		return nil
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	o := &owner{Profile: profile, Host: host}
+	err = owners(path.Dir(s.path)).put(path.Base(s.path), o)
+	if err != nil {
+		return fmt.Errorf("cannot record owner of %s: %w", s.path, err)
+	}
+	return nil
+}
+
+func removeOwner(s *snap) error {
+	return owners(path.Dir(s.path)).remove(path.Base(s.path))
+}
+
+// ownSnaps returns snapshots in dir owned by profile of host. It also tells
+// whether there are any snapshots owned by someone else.
+func ownSnaps(dir string, profile ProfileName, host string) ([]*snap, bool, error) {
+	snaps, err := findSnaps(dir)
+	if err != nil {
+		return nil, false, err
+	}
+	db := owners(dir)
+	own := snaps[:0]
+	shared := false
+	for _, s := range snaps {
+		var o owner
+		ok, err := db.get(path.Base(s.path), &o)
+		if err != nil {
+			return nil, false, err
+		}
+		switch {
+		case !ok:
+			s.unowned = true
+			own = append(own, s)
+		case o.Profile == profile && o.Host == host:
+			own = append(own, s)
+		default:
+			shared = true
+		}
+	}
+	return own, shared, nil
+}
+
+// lockStorage takes an exclusive lock of the storage directory dir, which
+// all snap processes modifying it hold, waiting for it if necessary. The
+// returned function releases the lock.
+func lockStorage(dir string) (func(), error) {
+	if err := os.MkdirAll(dir, defaultDirMode); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path.Join(dir, lockFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fd := int(f.Fd())
+	err = syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		fmt.Fprintf(os.Stderr, "waiting for another snap using %s\n", dir)
+		err = syscall.Flock(fd, syscall.LOCK_EX)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot lock %s: %w", dir, err)
+	}
+	return func() { f.Close() }, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const sshDialTimeout = 30 * time.Second
+
+// sshPool is the built-in SSH client. It keeps a connection to each host
+// and runs all commands on that host over it, which saves a handshake per
+// command and transferred snapshot.
+type sshPool struct {
+	cfg     *sshJSON
+	mu      sync.Mutex
+	clients map[string]*ssh.Client
+}
+
+func newSSHPool(cfg *sshJSON) *sshPool {
+	return &sshPool{cfg: cfg, clients: make(map[string]*ssh.Client)}
+}
+
+// session opens a new session to host, connecting to it if there's no
+// connection yet or if the existing one went away.
+func (p *sshPool) session(host string) (*ssh.Session, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c, ok := p.clients[host]; ok {
+		if s, err := c.NewSession(); err == nil {
+			return s, nil
+		}
+		c.Close()
+		delete(p.clients, host)
+	}
+	c, err := p.dial(host)
+	if err != nil {
+		return nil, err
+	}
+	p.clients[host] = c
+	return c.NewSession()
+}
+
+func (p *sshPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for host, c := range p.clients {
+		c.Close()
+		delete(p.clients, host)
+	}
+}
+
+type sshProcess struct {
+	s      *ssh.Session
+	signal string
+}
+
+func (p *sshProcess) Wait() error {
+	defer p.s.Close()
+	err := p.s.Wait()
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		p.signal = exitErr.Signal()
+	}
+	return err
+}
+
+func (p *sshPool) start(host, cmd string, stdin io.Reader, stdout, stderr io.Writer) (process, error) {
+	s, err := p.session(host)
+	if err != nil {
+		return nil, err
+	}
+	s.Stdin, s.Stdout, s.Stderr = stdin, stdout, stderr
+	if err := s.Start(cmd); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return &sshProcess{s: s}, nil
+}
+
+// splitHost splits host given as [user@]host[:port] into the user name and
+// the address to connect to.
+func splitHost(host string) (string, string, error) {
+	var name string
+	if i := strings.LastIndexByte(host, '@'); i >= 0 {
+		name, host = host[:i], host[i+1:]
+	} else if u, err := user.Current(); err == nil {
+		name = u.Username
+	} else {
+		return "", "", fmt.Errorf("cannot determine user name: %w", err)
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), "22")
+	}
+	return name, host, nil
+}
+
+func homePath(elem ...string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(append([]string{home}, elem...)...)
+}
+
+// authMethods returns keys from ssh-agent, if there's one running, and keys
+// from identity files which aren't protected by a passphrase, or are protected
+// by the configured one.
+func (p *sshPool) authMethods() []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			methods = append(methods,
+				ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	files := p.cfg.IdentityFiles
+	if len(files) == 0 {
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			files = append(files, homePath(".ssh", name))
+		}
+	}
+	var signers []ssh.Signer
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) && p.cfg.Passphrase != nil {
+			pass, perr := p.cfg.Passphrase.reveal()
+			if perr != nil {
+				fmt.Fprintf(os.Stderr, "%s: cannot get passphrase: "+
+					"%v\n", f, perr)
+				continue
+			}
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(data,
+				[]byte(pass))
+		}
+		if err != nil {
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	return methods
+}
+
+func (p *sshPool) dial(host string) (*ssh.Client, error) {
+	name, addr, err := splitHost(host)
+	if err != nil {
+		return nil, err
+	}
+	files := p.cfg.KnownHosts
+	if len(files) == 0 {
+		for _, f := range []string{
+			homePath(".ssh", "known_hosts"),
+			"/etc/ssh/ssh_known_hosts",
+		} {
+			if _, err := os.Stat(f); err == nil {
+				files = append(files, f)
+			}
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s: no known_hosts file to verify "+
+			"the host key against", host)
+	}
+	hostKeys, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load known hosts: %w", err)
+	}
+	c, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            name,
+		Auth:            p.authMethods(),
+		HostKeyCallback: hostKeys,
+		Timeout:         sshDialTimeout,
+	})
+	var keyErr *knownhosts.KeyError
+	if errors.As(err, &keyErr) {
+		if len(keyErr.Want) == 0 {
+			return nil, fmt.Errorf("%s: host key unknown, connect "+
+				"with ssh once to add it to %s", host,
+				strings.Join(files, ", "))
+		}
+		return nil, fmt.Errorf("%s: host key does not match the one "+
+			"in %s:%d, the host may be impersonated", host,
+			keyErr.Want[0].Filename, keyErr.Want[0].Line)
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: %w", host, err)
+	}
+	return c, nil
+}
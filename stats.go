@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+)
+
+// backupStats are statistics of a backup which transferred Snapshots, kept
+// so that --stats can show how backups of a profile develop. Seconds only
+// count time spent transferring.
+type backupStats struct {
+	Started   time.Time
+	Snapshots int
+	Bytes     int64
+	Seconds   float64
+}
+
+// statsHistory holds the statistics of the latest backups of a profile,
+// oldest first.
+type statsHistory struct {
+	Backups []backupStats
+}
+
+// maxStats is how many backups of each profile statsHistory keeps.
+const maxStats = 200
+
+// statsBaseline is how many preceding backups each one is compared to, see
+// statsNote.
+const statsBaseline = 10
+
+// Backups which transfer this many times more per snapshot than they used to,
+// or this many times slower, are highlighted by --stats.
+const (
+	statsGrowth   = 3
+	statsSlowdown = 3
+)
+
+func statsKey(p *profileJSON) string {
+	return "stats/" + url.PathEscape(p.name)
+}
+
+// transferred adds a transfer of bytes which took since start to the
+// statistics of the backup in progress, if any.
+func (st *backupStats) transferred(bytes int64, start time.Time) {
+	if st == nil {
+		return
+	}
+	st.Snapshots++
+	st.Bytes += bytes
+	st.Seconds += time.Since(start).Seconds()
+}
+
+// recordStats adds the statistics of the backup of p which just succeeded to
+// its history, unless it transferred nothing.
+func (a *app) recordStats(p *profileJSON, st *backupStats) {
+	if a.opts.dryRun || st.Snapshots == 0 {
+		return
+	}
+	var h statsHistory
+	err := func() error {
+		if _, err := a.db.get(statsKey(p), &h); err != nil {
+			return err
+		}
+		h.Backups = append(h.Backups, *st)
+		if len(h.Backups) > maxStats {
+			h.Backups = h.Backups[len(h.Backups)-maxStats:]
+		}
+		return a.db.put(statsKey(p), &h)
+	}()
+	if err != nil && a.opts.verbose {
+		fmt.Fprintf(os.Stderr, "cannot record statistics of profile "+
+			"%q: %v\n", p.name, err)
+	}
+}
+
+// perSnapshot returns how many bytes st transferred per snapshot.
+func (st backupStats) perSnapshot() float64 {
+	return float64(st.Bytes) / float64(st.Snapshots)
+}
+
+// throughput returns how many bytes st transferred per second, or 0 if the
+// time wasn't measured.
+func (st backupStats) throughput() float64 {
+	if st.Seconds <= 0 {
+		return 0
+	}
+	return float64(st.Bytes) / st.Seconds
+}
+
+// median returns the median of xs, which it sorts.
+func median(xs []float64) float64 {
+	sort.Float64s(xs)
+	n := len(xs)
+	if n%2 == 1 {
+		return xs[n/2]
+	}
+	return (xs[n/2-1] + xs[n/2]) / 2
+}
+
+// statsNote compares st to the backups before it, by the medians of their
+// sizes per snapshot and throughputs, and tells if it grew or slowed down
+// suddenly, such as when a log file runs away or a disk or link fails.
+func statsNote(st backupStats, before []backupStats) cell {
+	if len(before) == 0 {
+		return plainCell("-")
+	}
+	if len(before) > statsBaseline {
+		before = before[len(before)-statsBaseline:]
+	}
+	var sizes, rates []float64
+	for _, b := range before {
+		sizes = append(sizes, b.perSnapshot())
+		if r := b.throughput(); r > 0 {
+			rates = append(rates, r)
+		}
+	}
+	if m := median(sizes); m > 0 && st.perSnapshot() >= statsGrowth*m {
+		return cell{text: fmt.Sprintf("grew %.1fx", st.perSnapshot()/m),
+			color: colorRed}
+	}
+	if len(rates) > 0 {
+		m, r := median(rates), st.throughput()
+		if r > 0 && r*statsSlowdown <= m {
+			return cell{text: fmt.Sprintf("slowed %.1fx", m/r),
+				color: colorRed}
+		}
+	}
+	return plainCell("-")
+}
+
+// stats shows the statistics of the latest backups of p, and highlights
+// those which transferred much more or much slower than the ones before.
+func (a *app) stats(p *profileJSON) error {
+	if !p.isBackup() {
+		return fmt.Errorf("only backup profiles have statistics")
+	}
+	var h statsHistory
+	if _, err := a.db.get(statsKey(p), &h); err != nil {
+		return err
+	}
+	now := time.Now()
+	t := newTable("STARTED", "SNAPSHOTS", "SIZE", "PER SNAPSHOT", "DURATION",
+		"THROUGHPUT", "TREND")
+	t.alignRight(0, 1, 2, 3, 4, 5)
+	var total backupStats
+	for i, st := range h.Backups {
+		rate := "-"
+		if r := st.throughput(); r > 0 {
+			rate = formatBytes(uint64(r)) + "/s"
+		}
+		t.add(plainCell("%s", a.formatTime(st.Started, now)),
+			plainCell("%d", st.Snapshots),
+			plainCell("%s", formatBytes(uint64(st.Bytes))),
+			plainCell("%s", formatBytes(uint64(st.perSnapshot()))),
+			plainCell("%s", formatSeconds(st.Seconds)),
+			plainCell("%s", rate),
+			statsNote(st, h.Backups[:i]))
+		total.Snapshots += st.Snapshots
+		total.Bytes += st.Bytes
+		total.Seconds += st.Seconds
+	}
+	if err := a.printTable(t); err != nil {
+		return err
+	}
+	if !a.opts.plain && len(h.Backups) > 0 {
+		fmt.Printf("%s in %d snapshots over %d backups, %s/s on average\n",
+			formatBytes(uint64(total.Bytes)), total.Snapshots,
+			len(h.Backups), formatBytes(uint64(total.throughput())))
+	}
+	return nil
+}
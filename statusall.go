@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dcepelik/snap/humanize"
+)
+
+// Weights of problems which --status --all finds with profiles. Profiles
+// with the greatest sum of weights are the most at risk and go first.
+const (
+	riskLate     = 1
+	riskLowSpace = 2
+	riskOverdue  = 3
+	riskStale    = 4
+	riskFailed   = 5
+	riskBroken   = 6
+)
+
+// lowSpace is the fraction of the storage filesystem which --status --all
+// reports as low on space when less is available.
+const lowSpace = 0.1
+
+// profileRisk is what --status --all reports about a profile.
+type profileRisk struct {
+	name      ProfileName
+	snapshots string
+	newest    cell
+	available string
+	problems  []string
+	risk      int
+}
+
+func (r *profileRisk) add(risk int, format string, args ...interface{}) {
+	r.problems = append(r.problems, fmt.Sprintf(format, args...))
+	r.risk += risk
+}
+
+// assessRisk finds what's wrong with p: a failed last run, stale snapshots,
+// or storage running out of space.
+func (a *app) assessRisk(p *profileJSON, now time.Time) *profileRisk {
+	r := &profileRisk{
+		name:      p.name,
+		snapshots: "-",
+		newest:    plainCell("-"),
+		available: "-",
+	}
+	var last lastRun
+	if _, err := a.db.get(lastRunKey(p), &last); err != nil {
+		r.add(riskBroken, "cannot tell how it last ran: %v", err)
+	} else if last.Failed.After(last.Succeeded) {
+		op := "create"
+		if p.isBackup() {
+			op = "backup"
+		}
+		r.add(riskFailed, "%s failed %s: %s", op,
+			humanize.Ago(now.Sub(last.Failed), 1), last.Error)
+	}
+	if p.hasVolumes() {
+		for _, err := range a.staleness(p, now) {
+			r.add(riskStale, "%v", err)
+		}
+		return r
+	}
+	dir, err := storageDir(p)
+	if err != nil {
+		r.add(riskBroken, "%v", err)
+		return r
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err == nil {
+		avail := st.Bavail * uint64(st.Bsize)
+		r.available = formatBytes(avail)
+		if total := st.Blocks * uint64(st.Bsize); total > 0 &&
+			float64(avail) < lowSpace*float64(total) {
+			r.add(riskLowSpace, "%s free in storage, %.0f%%",
+				formatBytes(avail), 100*float64(avail)/float64(total))
+		}
+	}
+	snaps, err := profileSnaps(p)
+	if err != nil {
+		r.add(riskBroken, "cannot list snapshots: %v", err)
+		return r
+	}
+	r.snapshots = fmt.Sprint(len(snaps))
+	var newest *snap
+	for _, s := range snaps {
+		if newest == nil || s.created.After(newest.created) {
+			newest = s
+		}
+	}
+	if newest == nil {
+		r.add(riskStale, "no snapshots")
+		return r
+	}
+	age := now.Sub(newest.created)
+	r.newest = cell{
+		text:  a.formatTime(newest.created, now),
+		color: ageColor(age, minInterval(p)),
+	}
+	switch {
+	case p.MaxAge != nil && age > time.Duration(*p.MaxAge):
+		r.add(riskStale, "newest snapshot older than MaxAge %s",
+			formatInterval(time.Duration(*p.MaxAge)))
+	case r.newest.color == colorRed:
+		r.add(riskOverdue, "newest snapshot overdue")
+	case r.newest.color == colorYellow:
+		r.add(riskLate, "newest snapshot late")
+	}
+	return r
+}
+
+// statusAll reports on all profiles in one table, those most at risk first,
+// so that many can be triaged at once. With --failed-only, profiles with no
+// problems are left out.
+func (a *app) statusAll() error {
+	now := time.Now()
+	var risks []*profileRisk
+	for _, p := range a.cfg.Profiles {
+		risks = append(risks, a.assessRisk(p, now))
+	}
+	sort.Slice(risks, func(i, j int) bool {
+		if risks[i].risk != risks[j].risk {
+			return risks[i].risk > risks[j].risk
+		}
+		return risks[i].name < risks[j].name
+	})
+	t := newTable("PROFILE", "SNAPSHOTS", "NEWEST", "AVAILABLE", "PROBLEMS")
+	t.alignRight(1, 2, 3)
+	atRisk := 0
+	for _, r := range risks {
+		if r.risk == 0 && a.opts.failedOnly {
+			continue
+		}
+		problems := cell{text: "-", color: colorGreen}
+		if r.risk > 0 {
+			atRisk++
+			problems = cell{text: strings.Join(r.problems, "; "),
+				color: colorYellow}
+			if r.risk >= riskOverdue {
+				problems.color = colorRed
+			}
+		}
+		t.add(plainCell("%s", r.name), plainCell("%s", r.snapshots),
+			r.newest, plainCell("%s", r.available), problems)
+	}
+	if err := a.printTable(t); err != nil {
+		return err
+	}
+	if !a.opts.plain {
+		fmt.Printf("%d of %d profiles at risk\n", atRisk, len(risks))
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// createStorage creates the storage directory dir of p as its NewStorage
+// settings say, unless it exists already.
+func (a *app) createStorage(p *profileJSON, dir string) error {
+	c := p.NewStorage
+	if c == nil {
+		return nil
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	uid, gid := -1, -1
+	if c.Owner != nil {
+		u, err := user.Lookup(*c.Owner)
+		if err != nil {
+			return err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if c.Group != nil {
+		g, err := user.LookupGroup(*c.Group)
+		if err != nil {
+			return err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	mode := os.FileMode(defaultDirMode)
+	if c.Mode != nil {
+		m, _ := strconv.ParseUint(*c.Mode, 8, 32)
+		mode = os.FileMode(m)
+	}
+	if a.opts.dryRun || a.opts.verbose {
+		fmt.Fprintf(os.Stderr, "creating storage %s\n", dir)
+	}
+	if a.opts.dryRun {
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(dir), defaultDirMode); err != nil {
+		return err
+	}
+	if c.Subvolume {
+		if err := a.btrfsCmd("subvolume", "create", dir); err != nil {
+			return err
+		}
+	} else if err := os.Mkdir(dir, mode); err != nil {
+		return err
+	}
+	// Mkdir is subject to umask, subvolume create ignores mode.
+	if err := os.Chmod(dir, mode); err != nil {
+		return err
+	}
+	if c.Compression != nil {
+		err := a.btrfsCmd("property", "set", dir, "compression",
+			*c.Compression)
+		if err != nil {
+			return err
+		}
+	}
+	if c.NoCOW {
+		if err := setNoCOW(dir); err != nil {
+			return fmt.Errorf("cannot disable copy on write: %w", err)
+		}
+	}
+	if uid != -1 || gid != -1 {
+		return os.Chown(dir, uid, gid)
+	}
+	return nil
+}
+
+const (
+	fsIocGetflags = 0x80086601
+	fsIocSetflags = 0x40086602
+	fsNocowFl     = 0x00800000
+)
+
+// setNoCOW sets the No_COW attribute of the directory dir, which files and
+// directories created in it inherit, as chattr +C does.
+func setNoCOW(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var flags int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocGetflags,
+		uintptr(unsafe.Pointer(&flags)))
+	if errno != 0 {
+		return errno
+	}
+	flags |= fsNocowFl
+	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocSetflags,
+		uintptr(unsafe.Pointer(&flags)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// summary records what was done to each profile, for --summary.
+type summary struct {
+	Profiles []*profileSummary
+	Seconds  float64
+	start    time.Time
+}
+
+type profileSummary struct {
+	Profile     ProfileName
+	Created     []string
+	Transferred []transferSummary
+	Quarantined []string
+	Pruned      []pruneSummary
+	Seconds     float64
+}
+
+type transferSummary struct {
+	Snapshot string
+	Bytes    int64
+	Seconds  float64
+}
+
+// pruneSummary tells how much space pruning the snapshot freed, if known.
+type pruneSummary struct {
+	Snapshot string
+	Freed    *uint64 `json:",omitempty"`
+}
+
+func newSummary() *summary {
+	return &summary{start: time.Now()}
+}
+
+// begin starts recording operations on profile. The returned function
+// finishes it.
+func (sum *summary) begin(profile ProfileName) func() {
+	ps := &profileSummary{
+		Profile:     profile,
+		Created:     []string{},
+		Transferred: []transferSummary{},
+		Pruned:      []pruneSummary{},
+	}
+	sum.Profiles = append(sum.Profiles, ps)
+	start := time.Now()
+	return func() {
+		ps.Seconds = time.Since(start).Seconds()
+	}
+}
+
+// current returns summary of the profile being worked on, or nil if no
+// summary is being recorded.
+func (a *app) current() *profileSummary {
+	if a.summary == nil || len(a.summary.Profiles) == 0 {
+		return nil
+	}
+	return a.summary.Profiles[len(a.summary.Profiles)-1]
+}
+
+func (a *app) printSummary() error {
+	sum := a.summary
+	sum.Seconds = time.Since(sum.start).Seconds()
+	if a.opts.summary == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(sum)
+	}
+	t := newTable("PROFILE", "OPERATION", "SNAPSHOT", "SIZE", "DURATION")
+	t.alignRight(3, 4)
+	for _, ps := range sum.Profiles {
+		for _, s := range ps.Created {
+			t.add(plainCell("%s", ps.Profile), plainCell("create"),
+				plainCell("%s", s), plainCell("-"), plainCell("-"))
+		}
+		for _, tr := range ps.Transferred {
+			t.add(plainCell("%s", ps.Profile), plainCell("transfer"),
+				plainCell("%s", tr.Snapshot),
+				plainCell("%s", formatBytes(uint64(tr.Bytes))),
+				plainCell("%s", formatSeconds(tr.Seconds)))
+		}
+		for _, pr := range ps.Pruned {
+			freed := "-"
+			if pr.Freed != nil {
+				freed = formatBytes(*pr.Freed)
+			}
+			t.add(plainCell("%s", ps.Profile), plainCell("prune"),
+				plainCell("%s", pr.Snapshot), plainCell("%s", freed),
+				plainCell("-"))
+		}
+		t.add(plainCell("%s", ps.Profile), plainCell("total"),
+			plainCell("%d created, %d transferred, %d pruned",
+				len(ps.Created), len(ps.Transferred), len(ps.Pruned)),
+			plainCell("-"), plainCell("%s", formatSeconds(ps.Seconds)))
+	}
+	if err := a.printTable(t); err != nil {
+		return err
+	}
+	if !a.opts.plain {
+		fmt.Printf("total runtime %s\n", formatSeconds(sum.Seconds))
+	}
+	return nil
+}
+
+func formatSeconds(s float64) string {
+	d := time.Duration(s * float64(time.Second))
+	return d.Round(time.Millisecond).String()
+}
+
+// validSummary tells whether format is a valid --summary value.
+func validSummary(format string) bool {
+	return format == "" || format == "text" || format == "json"
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+type color int
+
+const (
+	colorNone color = iota
+	colorRed
+	colorGreen
+	colorYellow
+)
+
+func (c color) wrap(s string) string {
+	codes := map[color]string{
+		colorRed:    "31",
+		colorGreen:  "32",
+		colorYellow: "33",
+	}
+	if c == colorNone {
+		return s
+	}
+	return "\x1b[" + codes[c] + "m" + s + "\x1b[0m"
+}
+
+// ageColor tells how worrying it is that the newest snapshot is of the given
+// age when snapshots are supposed to be taken every interval.
+func ageColor(age, interval time.Duration) color {
+	switch {
+	case interval <= 0:
+		return colorNone
+	case age <= interval:
+		return colorGreen
+	case age <= 2*interval:
+		return colorYellow
+	default:
+		return colorRed
+	}
+}
+
+type cell struct {
+	text  string
+	color color
+}
+
+func plainCell(format string, args ...interface{}) cell {
+	return cell{text: fmt.Sprintf(format, args...)}
+}
+
+// table renders rows of cells with columns sized to fit their contents.
+type table struct {
+	header []string
+	right  map[int]bool
+	rows   [][]cell
+}
+
+func newTable(header ...string) *table {
+	return &table{header: header, right: make(map[int]bool)}
+}
+
+// alignRight makes the given columns right-aligned, which suits numbers.
+func (t *table) alignRight(cols ...int) {
+	for _, c := range cols {
+		t.right[c] = true
+	}
+}
+
+func (t *table) add(cells ...cell) {
+	t.rows = append(t.rows, cells)
+}
+
+// write renders the table. In plain mode, which is meant for scripts, the
+// header is omitted and cells are separated by single tabs.
+func (t *table) write(w io.Writer, plain, colors bool) error {
+	if plain {
+		for _, row := range t.rows {
+			texts := make([]string, len(row))
+			for i, c := range row {
+				texts[i] = c.text
+			}
+			if _, err := fmt.Fprintln(w, strings.Join(texts, "\t")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var widths []int
+	measure := func(i int, s string) {
+		for len(widths) <= i {
+			widths = append(widths, 0)
+		}
+		if l := utf8.RuneCountInString(s); l > widths[i] {
+			widths[i] = l
+		}
+	}
+	for i, h := range t.header {
+		measure(i, h)
+	}
+	for _, row := range t.rows {
+		for i, c := range row {
+			measure(i, c.text)
+		}
+	}
+	line := func(cells []cell) error {
+		var b strings.Builder
+		for i, c := range cells {
+			pad := strings.Repeat(" ", widths[i]-utf8.RuneCountInString(c.text))
+			text := c.text
+			if colors {
+				text = c.color.wrap(text)
+			}
+			if i > 0 {
+				b.WriteString("  ")
+			}
+			if t.right[i] {
+				b.WriteString(pad + text)
+			} else if i < len(cells)-1 {
+				b.WriteString(text + pad)
+			} else {
+				b.WriteString(text)
+			}
+		}
+		_, err := fmt.Fprintln(w, strings.TrimRight(b.String(), " "))
+		return err
+	}
+	if len(t.header) > 0 {
+		hdr := make([]cell, len(t.header))
+		for i, h := range t.header {
+			hdr[i] = cell{text: h}
+		}
+		if err := line(hdr); err != nil {
+			return err
+		}
+	}
+	for _, row := range t.rows {
+		if err := line(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// useColors tells whether output should be colorized: only if stdout is a
+// terminal and the user didn't opt out by setting NO_COLOR to anything but
+// an empty string.
+func useColors() bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func (a *app) printTable(t *table) error {
+	return t.write(os.Stdout, a.opts.plain, !a.opts.plain && useColors())
+}
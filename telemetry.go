@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// telemetryJSON makes snap export traces and metrics of the create, backup,
+// prune and maintain operations to an OpenTelemetry collector listening for
+// OTLP over HTTP at Endpoint, such as http://localhost:4318. Headers, for
+// example for authentication, are sent with each export. ServiceName is the
+// service.name of the resource, snap by default.
+type telemetryJSON struct {
+	Endpoint    *string
+	Headers     map[string]*secret
+	ServiceName *string
+}
+
+func (t *telemetryJSON) validate() error {
+	if t.Endpoint == nil {
+		return fmt.Errorf("Endpoint is missing")
+	}
+	u, err := url.Parse(*t.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("Endpoint: must be an http or https URL")
+	}
+	return nil
+}
+
+// telemetryClient sends telemetry, which mustn't hold up snap for long.
+var telemetryClient = &http.Client{Timeout: 10 * time.Second}
+
+// durationBounds are the bucket boundaries, in seconds, of the histogram of
+// durations of operations.
+var durationBounds = []float64{1, 10, 60, 300, 1800, 3600, 4 * 3600}
+
+// telemetry collects spans and metrics of operations until they're exported
+// by flush. Each operation is the root span of its own trace, commands run
+// for it are its children.
+type telemetry struct {
+	cfg     *telemetryJSON
+	mu      sync.Mutex
+	since   time.Time
+	spans   []*otlpSpan
+	ops     []*opRecord
+	current *opRecord
+}
+
+// opRecord is an operation run on a profile, or being run.
+type opRecord struct {
+	span        *otlpSpan
+	profile     ProfileName
+	op          string
+	start       time.Time
+	failed      bool
+	seconds     float64
+	transferred int64
+}
+
+func newTelemetry(cfg *telemetryJSON) *telemetry {
+	return &telemetry{cfg: cfg, since: time.Now()}
+}
+
+// instrument runs the operation op of p, recording it for telemetry.
+func (a *app) instrument(op string, p *profileJSON, run func(*profileJSON) error) error {
+	if a.telemetry == nil {
+		return run(p)
+	}
+	a.telemetry.begin(op, p.name)
+	err := run(p)
+	a.telemetry.end(err)
+	return err
+}
+
+func (t *telemetry) begin(op string, profile ProfileName) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.current = &opRecord{
+		span: &otlpSpan{
+			TraceID:   randomID(16),
+			SpanID:    randomID(8),
+			Name:      op,
+			Kind:      otlpSpanKindInternal,
+			StartTime: unixNano(now),
+			Attributes: []otlpAttribute{
+				stringAttribute("snap.profile", profile),
+				stringAttribute("snap.operation", op),
+			},
+		},
+		profile: profile,
+		op:      op,
+		start:   now,
+	}
+}
+
+func (t *telemetry) end(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := t.current
+	t.current = nil
+	now := time.Now()
+	r.span.EndTime = unixNano(now)
+	r.seconds = now.Sub(r.start).Seconds()
+	r.span.Status = spanStatus(err)
+	r.failed = err != nil
+	if r.transferred > 0 {
+		r.span.Attributes = append(r.span.Attributes, otlpAttribute{
+			Key:   "snap.transferred_bytes",
+			Value: otlpValue{IntValue: fmt.Sprint(r.transferred)},
+		})
+	}
+	t.spans = append(t.spans, r.span)
+	t.ops = append(t.ops, r)
+}
+
+// transferred records that n bytes of snapshots were transferred by the
+// current operation.
+func (t *telemetry) transferred(n int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current != nil {
+		t.current.transferred += n
+	}
+}
+
+// command records r, which finished with err, as a child span of the
+// current operation.
+func (t *telemetry) command(r *cmdRun, err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current == nil {
+		return
+	}
+	name := r.name
+	if r.argv != nil {
+		name = commandName(r.host, r.argv)
+	}
+	span := &otlpSpan{
+		TraceID:      t.current.span.TraceID,
+		SpanID:       randomID(8),
+		ParentSpanID: t.current.span.SpanID,
+		Name:         name,
+		Kind:         otlpSpanKindInternal,
+		StartTime:    unixNano(r.start),
+		EndTime:      unixNano(time.Now()),
+		Status:       spanStatus(err),
+	}
+	if r.argv != nil {
+		span.Attributes = []otlpAttribute{
+			stringAttribute("process.command_line", r.line),
+		}
+	}
+	t.spans = append(t.spans, span)
+}
+
+// flush exports what was collected since the last flush.
+func (t *telemetry) flush() error {
+	t.mu.Lock()
+	spans, ops, since := t.spans, t.ops, t.since
+	t.spans, t.ops, t.since = nil, nil, time.Now()
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+	headers := make(map[string]string)
+	for k, s := range t.cfg.Headers {
+		v, err := s.reveal()
+		if err != nil {
+			return fmt.Errorf("Headers: %s: %w", k, err)
+		}
+		headers[k] = v
+	}
+	resource := t.resource()
+	scope := otlpScope{Name: "snap"}
+	err := t.post("/v1/traces", headers, map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": resource,
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": scope,
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	return t.post("/v1/metrics", headers, map[string]interface{}{
+		"resourceMetrics": []interface{}{map[string]interface{}{
+			"resource": resource,
+			"scopeMetrics": []interface{}{map[string]interface{}{
+				"scope":   scope,
+				"metrics": metrics(ops, since, time.Now()),
+			}},
+		}},
+	})
+}
+
+func (t *telemetry) resource() map[string]interface{} {
+	service := "snap"
+	if t.cfg.ServiceName != nil {
+		service = *t.cfg.ServiceName
+	}
+	attrs := []otlpAttribute{stringAttribute("service.name", service)}
+	if host, err := os.Hostname(); err == nil {
+		attrs = append(attrs, stringAttribute("host.name", host))
+	}
+	return map[string]interface{}{"attributes": attrs}
+}
+
+func (t *telemetry) post(path string, headers map[string]string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	u := strings.TrimSuffix(*t.cfg.Endpoint, "/") + path
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := telemetryClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s: %s", u, resp.Status,
+			strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// metrics aggregates ops per profile, operation and result into delta
+// metrics for the period from since until now:
+//
+//	snap.operations          number of operations
+//	snap.operation.duration  histogram of their durations
+//	snap.transferred         bytes of snapshots transferred
+func metrics(ops []*opRecord, since, now time.Time) []interface{} {
+	type key struct {
+		profile ProfileName
+		op      string
+		result  string
+	}
+	type agg struct {
+		count       int
+		seconds     float64
+		buckets     []int
+		transferred int64
+	}
+	aggs := make(map[key]*agg)
+	var keys []key
+	for _, r := range ops {
+		k := key{r.profile, r.op, "ok"}
+		if r.failed {
+			k.result = "error"
+		}
+		g, ok := aggs[k]
+		if !ok {
+			g = &agg{buckets: make([]int, len(durationBounds)+1)}
+			aggs[k] = g
+			keys = append(keys, k)
+		}
+		g.count++
+		g.seconds += r.seconds
+		g.buckets[sort.SearchFloat64s(durationBounds, r.seconds)]++
+		g.transferred += r.transferred
+	}
+	start, end := unixNano(since), unixNano(now)
+	var counts, durations, transferred []interface{}
+	for _, k := range keys {
+		g := aggs[k]
+		attrs := []otlpAttribute{
+			stringAttribute("snap.profile", k.profile),
+			stringAttribute("snap.operation", k.op),
+			stringAttribute("snap.result", k.result),
+		}
+		counts = append(counts, map[string]interface{}{
+			"attributes":        attrs,
+			"startTimeUnixNano": start,
+			"timeUnixNano":      end,
+			"asInt":             fmt.Sprint(g.count),
+		})
+		bucketCounts := make([]string, len(g.buckets))
+		for i, n := range g.buckets {
+			bucketCounts[i] = fmt.Sprint(n)
+		}
+		durations = append(durations, map[string]interface{}{
+			"attributes":        attrs,
+			"startTimeUnixNano": start,
+			"timeUnixNano":      end,
+			"count":             fmt.Sprint(g.count),
+			"sum":               g.seconds,
+			"bucketCounts":      bucketCounts,
+			"explicitBounds":    durationBounds,
+		})
+		if k.op == "backup" {
+			transferred = append(transferred, map[string]interface{}{
+				"attributes":        attrs,
+				"startTimeUnixNano": start,
+				"timeUnixNano":      end,
+				"asInt":             fmt.Sprint(g.transferred),
+			})
+		}
+	}
+	sum := func(name, unit string, points []interface{}) interface{} {
+		return map[string]interface{}{
+			"name": name,
+			"unit": unit,
+			"sum": map[string]interface{}{
+				"dataPoints":             points,
+				"aggregationTemporality": otlpTemporalityDelta,
+				"isMonotonic":            true,
+			},
+		}
+	}
+	ms := []interface{}{
+		sum("snap.operations", "{operation}", counts),
+		map[string]interface{}{
+			"name": "snap.operation.duration",
+			"unit": "s",
+			"histogram": map[string]interface{}{
+				"dataPoints":             durations,
+				"aggregationTemporality": otlpTemporalityDelta,
+			},
+		},
+	}
+	if len(transferred) > 0 {
+		ms = append(ms, sum("snap.transferred", "By", transferred))
+	}
+	return ms
+}
+
+// Parts of the OTLP JSON encoding, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding.
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusOK         = 1
+	otlpStatusError      = 2
+	otlpTemporalityDelta = 1
+)
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	StartTime    string          `json:"startTimeUnixNano"`
+	EndTime      string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue,omitempty"`
+	IntValue    string `json:"intValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: value}}
+}
+
+func spanStatus(err error) otlpStatus {
+	if err != nil {
+		return otlpStatus{Code: otlpStatusError, Message: err.Error()}
+	}
+	return otlpStatus{Code: otlpStatusOK}
+}
+
+// unixNano formats t the way OTLP JSON expects 64-bit integers.
+func unixNano(t time.Time) string {
+	return fmt.Sprint(t.UnixNano())
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
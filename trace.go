@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// traceEnv lists the environment variables recorded in traces. Commands run
+// by snap inherit its environment, of which these commonly affect them.
+var traceEnv = []string{"PATH", "HOME", "LANG", "LC_ALL", "TZ", "TMPDIR",
+	"SSH_AUTH_SOCK"}
+
+// tracer writes a span for every command run by snap to a file given by
+// --trace, one JSON object per line.
+type tracer struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+	env map[string]string
+}
+
+// traceSpan describes a command run by snap, or an in-process stage of a
+// pipeline (Name) such as a buffer. Bytes is how much it wrote to its
+// standard output, if that's known.
+type traceSpan struct {
+	Host     string            `json:",omitempty"`
+	Argv     []string          `json:",omitempty"`
+	Name     string            `json:",omitempty"`
+	Env      map[string]string `json:",omitempty"`
+	Start    time.Time
+	End      time.Time
+	Duration float64
+	ExitCode *int   `json:",omitempty"`
+	Error    string `json:",omitempty"`
+	Bytes    *int64 `json:",omitempty"`
+}
+
+func newTracer(filename string) (*tracer, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	env := make(map[string]string)
+	for _, k := range traceEnv {
+		if v, ok := os.LookupEnv(k); ok {
+			env[k] = v
+		}
+	}
+	return &tracer{f: f, enc: json.NewEncoder(f), env: env}, nil
+}
+
+// record writes a span for r, which finished with err after writing n bytes,
+// unless n is nil.
+func (t *tracer) record(r *cmdRun, err error, n *int64) {
+	end := time.Now()
+	span := &traceSpan{
+		Host:     r.host,
+		Argv:     r.argv,
+		Name:     r.name,
+		Start:    r.start,
+		End:      end,
+		Duration: end.Sub(r.start).Seconds(),
+		Bytes:    n,
+	}
+	if r.argv != nil {
+		span.Env = t.env
+		code := 0
+		var execErr *ExecError
+		if err == nil {
+			span.ExitCode = &code
+		} else if errors.As(cmdError("", err, &bytes.Buffer{}), &execErr) {
+			code = execErr.Code
+			span.ExitCode = &code
+		}
+	}
+	if err != nil {
+		span.Error = err.Error()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.enc.Encode(span)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+)
+
+// Snapshots taken by package manager hooks come in pairs around a
+// transaction: the post-transaction snapshot names the pre-transaction one it
+// belongs to, and the pair is pruned together.
+const (
+	transactionPre  = "pre"
+	transactionPost = "post"
+)
+
+// pendingTransaction is the pre-transaction snapshot of a profile which waits
+// for its post-transaction counterpart.
+type pendingTransaction struct {
+	Pre string
+}
+
+func transactionKey(p *profileJSON) string {
+	return "transaction/" + url.PathEscape(p.name)
+}
+
+// linkTransaction marks s as taken before or after a transaction, pairing a
+// post-transaction snapshot with the last pre-transaction one of p.
+func (a *app) linkTransaction(p *profileJSON, s *snap) error {
+	key := transactionKey(p)
+	if a.opts.preTransaction {
+		s.transaction = transactionPre
+		if a.opts.dryRun {
+			return nil
+		}
+		return a.db.put(key, &pendingTransaction{Pre: path.Base(s.path)})
+	}
+	s.transaction = transactionPost
+	var t pendingTransaction
+	ok, err := a.db.get(key, &t)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Fprintf(os.Stderr, "warning: no pre-transaction snapshot "+
+			"to pair %s with\n", s.path)
+		return nil
+	}
+	s.pre = t.Pre
+	if a.opts.dryRun {
+		return nil
+	}
+	return a.db.remove(key)
+}
+
+// pairs returns the post-transaction snapshots among snaps by the path of the
+// pre-transaction snapshot they belong to, if it's among snaps too.
+func pairs(snaps []*snap) map[string]*snap {
+	paths := make(map[string]bool)
+	for _, s := range snaps {
+		paths[s.path] = true
+	}
+	posts := make(map[string]*snap)
+	for _, s := range snaps {
+		if s.pre == "" {
+			continue
+		}
+		if pre := path.Join(path.Dir(s.path), s.pre); paths[pre] {
+			posts[pre] = s
+		}
+	}
+	return posts
+}
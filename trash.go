@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+// trashDir holds snapshots pruned from a storage directory by profiles with
+// Trash set, relative to the storage directory. They're only deleted once
+// they've been there for the Trash period, so that history wiped out by a
+// mistake in the retention policy can still be recovered.
+const trashDir = ".trash"
+
+// trashEntry records when a snapshot was moved to the trash.
+type trashEntry struct {
+	Trashed time.Time
+}
+
+func trashMeta(storage string) *metaDB {
+	return &metaDB{dir: path.Join(storage, trashDir, ".meta")}
+}
+
+// setReadOnly sets or unsets the read-only property of the subvolume at p.
+func (a *app) setReadOnly(p string, ro bool) error {
+	return a.btrfsCmd("property", "set", "-t", "subvol", p, "ro",
+		fmt.Sprint(ro))
+}
+
+// trashSnap moves the snapshot s into the trash of storage.
+func (a *app) trashSnap(storage string, s *snap) error {
+	name := path.Base(s.path)
+	dst := path.Join(storage, trashDir, name)
+	if a.opts.dryRun || a.opts.verbose {
+		printArgv([]string{"mv", s.path, dst})
+	}
+	if a.opts.dryRun {
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(dst), defaultDirMode); err != nil {
+		return err
+	}
+	// Read-only subvolumes can't be moved to another directory.
+	if s.flat {
+		if err := a.setReadOnly(s.path, false); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(s.path, dst); err != nil {
+		return err
+	}
+	if s.flat {
+		if err := a.setReadOnly(dst, true); err != nil {
+			return err
+		}
+	}
+	err := trashMeta(storage).put(name, &trashEntry{Trashed: time.Now()})
+	if err != nil {
+		return err
+	}
+	if err := a.db.remove(snapKey("listing", s)); err != nil {
+		return err
+	}
+	return a.db.remove(snapKey("uuid", s))
+}
+
+// trashedSnaps returns snapshots in the trash of storage and when they were
+// put there.
+func trashedSnaps(storage string) ([]*snap, map[*snap]time.Time, error) {
+	snaps, err := findSnaps(path.Join(storage, trashDir))
+	if err != nil {
+		return nil, nil, err
+	}
+	meta := trashMeta(storage)
+	trashed := make(map[*snap]time.Time)
+	for _, s := range snaps {
+		var e trashEntry
+		ok, err := meta.get(path.Base(s.path), &e)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			// Interrupted trashSnap, the grace period starts now.
+			e.Trashed = time.Now()
+			if err := meta.put(path.Base(s.path), &e); err != nil {
+				return nil, nil, err
+			}
+		}
+		trashed[s] = e.Trashed
+	}
+	return snaps, trashed, nil
+}
+
+// emptyTrash deletes snapshots which have been in the trash of storage for
+// longer than period.
+func (a *app) emptyTrash(storage string, period time.Duration) error {
+	snaps, trashed, err := trashedSnaps(storage)
+	if err != nil {
+		return err
+	}
+	var expired []*snap
+	for _, s := range snaps {
+		if time.Since(trashed[s]) >= period {
+			expired = append(expired, s)
+		}
+	}
+	for i := 0; i < len(expired); i += deleteBatch {
+		err := a.deleteSubvols(expired[i:min(len(expired), i+deleteBatch)])
+		if err != nil {
+			return err
+		}
+	}
+	for _, s := range expired {
+		if err := a.forgetSnap(s); err != nil {
+			return err
+		}
+		if err := a.audit(storage, auditDelete, s, ""); err != nil {
+			return err
+		}
+		if a.opts.dryRun {
+			continue
+		}
+		name := path.Base(s.path)
+		if err := trashMeta(storage).remove(name); err != nil {
+			return err
+		}
+		if err := owners(storage).remove(name); err != nil {
+			return err
+		}
+		if err := notes(storage).remove(name); err != nil {
+			return err
+		}
+		if err := removeManifest(&snap{path: path.Join(storage, name)}); err != nil {
+			return err
+		}
+		if err := removeMeta(&snap{path: path.Join(storage, name)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// undelete moves the snapshot created at the given time from the trash of p
+// back among its snapshots.
+func (a *app) undelete(p *profileJSON, timestamp string) error {
+	dir, err := storageDir(p)
+	if err != nil {
+		return err
+	}
+	snaps, _, err := trashedSnaps(dir)
+	if err != nil {
+		return err
+	}
+	var s *snap
+	for _, t := range snaps {
+		if path.Base(t.path) == timestamp {
+			s = t
+		}
+	}
+	if s == nil {
+		return fmt.Errorf("no snapshot %s in the trash", timestamp)
+	}
+	dst := path.Join(dir, timestamp)
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("%s already exists", dst)
+	}
+	if a.opts.dryRun || a.opts.verbose {
+		printArgv([]string{"mv", s.path, dst})
+	}
+	if !a.opts.dryRun {
+		done, err := a.begin(dir, opUndelete, s)
+		if err != nil {
+			return err
+		}
+		if s.flat {
+			if err := a.setReadOnly(s.path, false); err != nil {
+				return err
+			}
+		}
+		if err := os.Rename(s.path, dst); err != nil {
+			return err
+		}
+		if s.flat {
+			if err := a.setReadOnly(dst, true); err != nil {
+				return err
+			}
+		}
+		if err := trashMeta(dir).remove(timestamp); err != nil {
+			return err
+		}
+		if err := a.audit(dir, auditUndelete, s, ""); err != nil {
+			return err
+		}
+		if err := done(); err != nil {
+			return err
+		}
+	}
+
+	// The snapshot is subject to the retention policy again, which may
+	// well be what pruned it.
+	active, err := profileSnaps(p)
+	if err != nil {
+		return err
+	}
+	if a.opts.dryRun {
+		active = append(active, &snap{path: dst, created: s.created})
+	}
+	if err := loadNotes(active); err != nil {
+		return err
+	}
+	_, out := retain(p.Buckets, active)
+	for _, t := range out {
+		if t.path == dst {
+			fmt.Fprintf(os.Stderr, "warning: %s will be pruned again "+
+				"unless the retention policy is changed\n", dst)
+		}
+	}
+	return nil
+}
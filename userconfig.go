@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// userConfigPath returns where users other than root keep configuration of
+// their own profiles, which are added to those of the system configuration.
+func userConfigPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "snap", "config.json"), nil
+}
+
+// userStateDir returns where users other than root keep what snap knows
+// about their snapshots, unless StateDir is set.
+func userStateDir() (string, error) {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "snap"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "state", "snap"), nil
+}
+
+// addUserConfig adds profiles from the configuration file of the user
+// running snap, if there's one, to cfg. Only root can edit the rest of the
+// configuration.
+func addUserConfig(cfg *configJSON) (string, error) {
+	if os.Geteuid() == 0 {
+		return "", nil
+	}
+	filename, err := userConfigPath()
+	if err != nil {
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return filename, err
+	}
+	if data, err = migrateConfig(data); err != nil {
+		return filename, err
+	}
+	var user configJSON
+	if err := decodeStrict(data, &user); err != nil {
+		return filename, err
+	}
+	if user.StateDir != nil || user.Helper != nil || user.Server != nil ||
+		user.SSH != nil || user.Log != nil ||
+		user.Telemetry != nil || user.Events != nil ||
+		user.PullConfig != nil || user.Serial != nil ||
+		user.Expires != nil || user.Groups != nil {
+		return filename, fmt.Errorf("only Profiles can be configured " +
+			"per user")
+	}
+	if cfg.Profiles == nil {
+		cfg.Profiles = make(map[ProfileName]*profileJSON)
+	}
+	for name, p := range user.Profiles {
+		if _, ok := cfg.Profiles[name]; ok {
+			return filename, fmt.Errorf("profile %q: exists in the "+
+				"system configuration", name)
+		}
+		if p != nil {
+			p.user = true
+			if p.Enter != nil {
+				return filename, fmt.Errorf("profile %q: Enter "+
+					"needs root", name)
+			}
+		}
+		cfg.Profiles[name] = p
+	}
+	return filename, cfg.validate()
+}
+
+// checkOwned makes sure that path, which a profile of the user running snap
+// works with, is owned by them.
+func checkOwned(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if int(fi.Sys().(*syscall.Stat_t).Uid) != os.Getuid() {
+		return fmt.Errorf("%s isn't owned by you, profiles in your own "+
+			"configuration can only use what is", path)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// snapIDs identify a snapshot independently of where it's stored. UUID is
+// that of the subvolume, ReceivedUUID is the UUID of the subvolume it was
+// received from, if any.
+type snapIDs struct {
+	UUID         string
+	ReceivedUUID string
+}
+
+// same tells whether x and y are copies of the same snapshot.
+func (x *snapIDs) same(y *snapIDs) bool {
+	return x.UUID == y.ReceivedUUID ||
+		y.UUID == x.ReceivedUUID ||
+		x.ReceivedUUID != "" && x.ReceivedUUID == y.ReceivedUUID
+}
+
+func uuidKey(host string, s *snap) string {
+	if host == "" {
+		return snapKey("uuid", s)
+	}
+	return snapKey("uuid/"+url.PathEscape(host), s)
+}
+
+// subvolIDs reads UUIDs of the subvolume at path on host.
+func (a *app) subvolIDs(host, path string) (*snapIDs, error) {
+	var stdout bytes.Buffer
+	argv := []string{a.btrfs(host, "subvolume"), "subvolume", "show", path}
+	if a.opts.verbose {
+		printArgv(a.sshArgv(host, argv...))
+	}
+	if err := a.runOn(host, &stdout, argv); err != nil {
+		return nil, err
+	}
+	var ids snapIDs
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		f := strings.SplitN(line, ":", 2)
+		if len(f) != 2 {
+			continue
+		}
+		v := strings.TrimSpace(f[1])
+		if v == "-" {
+			v = ""
+		}
+		switch strings.TrimSpace(f[0]) {
+		case "UUID":
+			ids.UUID = v
+		case "Received UUID":
+			ids.ReceivedUUID = v
+		}
+	}
+	if ids.UUID == "" {
+		return nil, fmt.Errorf("%s: no UUID in btrfs subvolume show output",
+			path)
+	}
+	return &ids, nil
+}
+
+// loadIDs fills in UUIDs of snaps stored on host. Snapshots are read-only, so
+// their UUIDs are cached in the metadata DB. Snapshots whose UUIDs can't be
+// read, such as those on filesystems without UUID support, are left without.
+func (a *app) loadIDs(host string, snaps []*snap) {
+	for _, s := range snaps {
+		key := uuidKey(host, s)
+		var ids snapIDs
+		if ok, _ := a.db.getSnap(key, s, &ids); ok {
+			s.ids = &ids
+			continue
+		}
+		sids, err := a.subvolIDs(host, s.subvolPath())
+		if err != nil {
+			if a.opts.verbose {
+				fmt.Fprintf(os.Stderr, "UUID not available: %v\n", err)
+			}
+			continue
+		}
+		s.ids = sids
+		if err := a.db.put(key, sids); err != nil && a.opts.verbose {
+			fmt.Fprintf(os.Stderr, "cannot cache UUID: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// watchJSON configures --watch, which takes snapshots of Subvolume as it
+// changes rather than on a schedule, for data too precious to lose even an
+// hour of. A snapshot is taken once no changes were seen for Settle, but no
+// sooner than MinInterval after the previous one. Buckets keep their number
+// in check as they do for scheduled snapshots.
+type watchJSON struct {
+	Settle      *BucketInterval
+	MinInterval *BucketInterval
+}
+
+const (
+	defaultWatchSettle      = 10 * time.Second
+	defaultWatchMinInterval = time.Minute
+)
+
+func (w *watchJSON) validate() error {
+	if w.Settle != nil && *w.Settle <= 0 {
+		return fmt.Errorf("Settle must be positive")
+	}
+	if w.MinInterval != nil && *w.MinInterval < 0 {
+		return fmt.Errorf("MinInterval must not be negative")
+	}
+	return nil
+}
+
+// watchTimes returns how long changes of p settle and the shortest time
+// between snapshots.
+func watchTimes(p *profileJSON) (settle, minInterval time.Duration) {
+	settle, minInterval = defaultWatchSettle, defaultWatchMinInterval
+	if w := p.Watch; w != nil {
+		if w.Settle != nil {
+			settle = time.Duration(*w.Settle)
+		}
+		if w.MinInterval != nil {
+			minInterval = time.Duration(*w.MinInterval)
+		}
+	}
+	return settle, minInterval
+}
+
+// watchMask are the inotify events which count as changes.
+const watchMask = syscall.IN_MODIFY | syscall.IN_ATTRIB | syscall.IN_CREATE |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_ONLYDIR
+
+// watcher watches a directory tree with inotify, which has to be told about
+// every directory in it. Paths snap itself writes to, such as storage of the
+// profile, are left out if they're inside the tree, so that taking snapshots
+// doesn't look like a change, and so are nested subvolumes, which aren't part
+// of snapshots.
+type watcher struct {
+	fd   int
+	root string
+	skip map[string]bool
+	dirs map[int32]string
+}
+
+func newWatcher(root string, skip []string) (*watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("inotify: %w", err)
+	}
+	w := &watcher{
+		fd:   fd,
+		root: root,
+		skip: make(map[string]bool),
+		dirs: make(map[int32]string),
+	}
+	for _, p := range skip {
+		w.skip[filepath.Clean(p)] = true
+	}
+	if err := w.addTree(root); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return w, nil
+}
+
+// watchSkip returns the paths snap writes to while taking snapshots into
+// storage: storage itself, the state directory, and the files of Log,
+// Events and --trace.
+func (a *app) watchSkip(storage string) []string {
+	skip := []string{storage, a.db.dir}
+	if l := a.cfg.Log; l != nil {
+		skip = append(skip, *l.File, *l.File+".1")
+	}
+	if e := a.cfg.Events; e != nil && e.File != nil {
+		skip = append(skip, *e.File)
+	}
+	if a.opts.trace != "" {
+		skip = append(skip, a.opts.trace)
+	}
+	return skip
+}
+
+func (w *watcher) close() error {
+	return syscall.Close(w.fd)
+}
+
+// addTree watches dir and all directories below it.
+func (w *watcher) addTree(dir string) error {
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// Directories may vanish while they're walked.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		if w.skip[p] {
+			return filepath.SkipDir
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if p != w.root && ok && st.Ino == btrfsFirstFreeObjectid {
+			return filepath.SkipDir
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, p, watchMask)
+		if errors.Is(err, syscall.ENOSPC) {
+			return fmt.Errorf("%s: too many directories to watch, "+
+				"raise fs.inotify.max_user_watches", p)
+		}
+		if err != nil {
+			if errors.Is(err, syscall.ENOENT) {
+				return nil
+			}
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		w.dirs[int32(wd)] = p
+		return nil
+	})
+}
+
+// run reads events and signals changes on changed until reading fails.
+// Directories which are created or moved in get watched too.
+func (w *watcher) run(changed chan<- struct{}) error {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("inotify: %w", err)
+		}
+		change := false
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+			if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				change = true
+				continue
+			}
+			if ev.Mask&syscall.IN_IGNORED != 0 {
+				delete(w.dirs, ev.Wd)
+				continue
+			}
+			dir, ok := w.dirs[ev.Wd]
+			if !ok {
+				continue
+			}
+			if i := bytes.IndexByte(name, 0); i >= 0 {
+				name = name[:i]
+			}
+			p := filepath.Join(dir, string(name))
+			if w.skip[p] {
+				continue
+			}
+			change = true
+			if ev.Mask&syscall.IN_ISDIR != 0 &&
+				ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				if err := w.addTree(p); err != nil {
+					return err
+				}
+			}
+		}
+		if change {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// watch takes snapshots of p as its Subvolume changes, see watchJSON, until
+// watching fails. Snapshots which fail to be taken are reported, but don't
+// stop watching.
+func (a *app) watch(p *profileJSON) error {
+	if p.Subvolume == nil {
+		return fmt.Errorf("only profiles with Subvolume can be watched")
+	}
+	storage, err := storageDir(p)
+	if err != nil {
+		return err
+	}
+	settleTime, minInterval := watchTimes(p)
+	var last time.Time
+	snaps, err := profileSnaps(p)
+	if err != nil {
+		return err
+	}
+	for _, s := range snaps {
+		if s.created.After(last) {
+			last = s.created
+		}
+	}
+	w, err := newWatcher(filepath.Clean(*p.Subvolume), a.watchSkip(storage))
+	if err != nil {
+		return err
+	}
+	defer w.close()
+	if a.opts.verbose {
+		fmt.Fprintf(os.Stderr, "watching %d directories of %s\n",
+			len(w.dirs), *p.Subvolume)
+	}
+	changed := make(chan struct{}, 1)
+	failed := make(chan error, 1)
+	go func() {
+		failed <- w.run(changed)
+	}()
+	var settle <-chan time.Time
+	for {
+		select {
+		case err := <-failed:
+			return err
+		case <-changed:
+			settle = time.After(settleTime)
+		case <-settle:
+			if wait := minInterval - time.Since(last); wait > 0 {
+				settle = time.After(wait)
+				continue
+			}
+			settle = nil
+			last = time.Now()
+			if err := a.watchSnapshot(p); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+			}
+		}
+	}
+}
+
+// watchSnapshot takes a snapshot of p and prunes it, as if snap was run
+// with --create and --prune.
+func (a *app) watchSnapshot(p *profileJSON) error {
+	sa := *a
+	sa.opts.watch = false
+	sa.opts.create = true
+	sa.opts.prune = len(p.Buckets) > 0
+	return sa.runProfile(p)
+}
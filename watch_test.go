@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatcherSkip(t *testing.T) {
+	root := t.TempDir()
+	storage := filepath.Join(root, "snapshots")
+	state := filepath.Join(root, "var", "lib", "snap")
+	log := filepath.Join(root, "var", "log", "snap.log")
+	for _, d := range []string{storage, state, filepath.Dir(log)} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := &app{
+		cfg: &configJSON{Log: &logJSON{File: &log}},
+		db:  &metaDB{dir: state},
+	}
+	w, err := newWatcher(root, a.watchSkip(storage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Closing w doesn't interrupt run, which would then read events of
+	// watchers which get the same descriptor, so w is left open.
+	changed := make(chan struct{}, 1)
+	go w.run(changed)
+	write := func(p string) {
+		t.Helper()
+		if err := os.WriteFile(p, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(storage, "1"))
+	write(filepath.Join(state, "last-run"))
+	write(log)
+	if err := os.Rename(log, log+".1"); err != nil {
+		t.Fatal(err)
+	}
+	write(log)
+	select {
+	case <-changed:
+		t.Fatalf("writes of snap itself seen as a change")
+	case <-time.After(100 * time.Millisecond):
+	}
+	write(filepath.Join(root, "var", "data"))
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("change not seen")
+	}
+}
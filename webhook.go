@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// webhookPrefix is where webhooks are called, as in POST /v1/hooks/NAME.
+// Snapshots created by webhooks can be described by the description query
+// parameter.
+const webhookPrefix = "/v1/hooks/"
+
+// maxWebhookBody limits how much of request bodies is read to check their
+// signatures. Nothing else is done with them.
+const maxWebhookBody = 1 << 20
+
+// webhook is a webhook of snap serve with its secrets revealed.
+type webhook struct {
+	profile ProfileName
+	op      string
+	token   string
+	secret  string
+}
+
+func (s *server) loadWebhooks(hooks map[string]*webhookJSON) error {
+	s.hooks = make(map[string]*webhook)
+	for name, h := range hooks {
+		wh := &webhook{profile: *h.Profile, op: "create"}
+		if h.Operation != nil {
+			wh.op = *h.Operation
+		}
+		var err error
+		if h.Token != nil {
+			if wh.token, err = h.Token.reveal(); err != nil {
+				return fmt.Errorf("Webhooks: %q: Token: %w", name, err)
+			}
+		} else if wh.secret, err = h.Secret.reveal(); err != nil {
+			return fmt.Errorf("Webhooks: %q: Secret: %w", name, err)
+		}
+		s.hooks[name] = wh
+	}
+	return nil
+}
+
+func (s *server) serveWebhook(w http.ResponseWriter, r *http.Request) {
+	h, ok := s.hooks[strings.TrimPrefix(r.URL.Path, webhookPrefix)]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.authorized(r, body) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	p := s.app.cfg.Profiles[h.profile]
+	err = s.run(h.profile, p, h.op, func(a *app) func(*profileJSON) error {
+		if h.op == "create" {
+			a.opts.reason = reasonHook
+			a.opts.message = r.URL.Query().Get("description")
+		}
+		return a.operation(h.op)
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cannot %s: %v", h.op, err),
+			http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorized tells whether the request r with the given body presents the
+// token of h or is signed by its secret.
+func (h *webhook) authorized(r *http.Request, body []byte) bool {
+	if h.secret != "" {
+		mac := hmac.New(sha256.New, []byte(h.secret))
+		mac.Write(body)
+		want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		return hmac.Equal([]byte(r.Header.Get("X-Hub-Signature-256")),
+			[]byte(want))
+	}
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}